@@ -0,0 +1,58 @@
+package modl
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// QueryAnnotator returns key/value pairs which describe the code path
+// running query, such as the application, route or trace id.  When set on
+// a DbMap, they are appended to every statement as a comment in the
+// sqlcommenter format, so that load seen in tools like pg_stat_statements
+// can be attributed back to the code which caused it.  ctx is the context
+// passed to the call with WithContext, or context.Background().
+type QueryAnnotator func(ctx context.Context, query string) map[string]string
+
+// StaticAnnotator returns a QueryAnnotator which attaches the same tags to
+// every statement.
+func StaticAnnotator(tags map[string]string) QueryAnnotator {
+	return func(context.Context, string) map[string]string {
+		return tags
+	}
+}
+
+// SQLComment formats tags as an sqlcommenter comment, eg:
+//
+//	/*app='foo',route='%2Fusers'*/
+//
+// Keys are sorted and both keys and values are url encoded.  An empty
+// string is returned if there are no tags.
+func SQLComment(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.Replace(url.PathEscape(tags[k]), "'", `\'`, -1)
+		pairs = append(pairs, url.QueryEscape(k)+"='"+v+"'")
+	}
+	return "/*" + strings.Join(pairs, ",") + "*/"
+}
+
+// appendComment adds comment to the end of query, keeping it ahead of any
+// statement terminator.
+func appendComment(query, comment string) string {
+	trimmed := strings.TrimRight(query, " \t\n")
+	if strings.HasSuffix(trimmed, ";") {
+		return trimmed[:len(trimmed)-1] + " " + comment + ";"
+	}
+	return trimmed + " " + comment
+}
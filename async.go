@@ -0,0 +1,185 @@
+package modl
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ErrInserterClosed is returned by AsyncInserter.Add after Close.
+var ErrInserterClosed = errors.New("modl: AsyncInserter is closed")
+
+// An AsyncInserter buffers rows added from any number of goroutines and
+// inserts them in the background, in batches, whenever maxBatch rows are
+// buffered or flushEvery has passed.  It suits ingesting events, where
+// rows need not be written as soon as they are created.
+//
+// Rows are inserted with a WriteBatch which coalesces them, so tables
+// without auto-increment keys get multi-row inserts.  Rows must not be
+// modified after they are added.
+type AsyncInserter struct {
+	dbmap      *DbMap
+	table      *TableMap
+	flushEvery time.Duration
+	maxBatch   int
+
+	mu      sync.Mutex
+	buf     []interface{}
+	closed  bool
+	onError func(rows []interface{}, err error)
+
+	// flushing serializes flushes, so that rows are inserted in order
+	flushing sync.Mutex
+	full     chan struct{}
+	closing  chan struct{}
+	stopped  chan struct{}
+}
+
+// AsyncInserter starts an AsyncInserter for table which flushes every
+// flushEvery, or as soon as maxBatch rows are buffered.  If flushEvery is
+// 0, it only flushes full batches.  It must be stopped with Close.
+func (m *DbMap) AsyncInserter(table *TableMap, flushEvery time.Duration, maxBatch int) *AsyncInserter {
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+	a := &AsyncInserter{
+		dbmap:      m,
+		table:      table,
+		flushEvery: flushEvery,
+		maxBatch:   maxBatch,
+		full:       make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// OnError sets a function which is called with the rows of a background
+// flush which failed, and the error.  The rows have not been inserted;  fn
+// may Add them again.  Without it, the errors of background flushes are
+// only traced.
+func (a *AsyncInserter) OnError(fn func(rows []interface{}, err error)) *AsyncInserter {
+	a.mu.Lock()
+	a.onError = fn
+	a.mu.Unlock()
+	return a
+}
+
+// Add buffers each element of list, which must be pointers to rows of the
+// inserter's table, to be inserted.
+func (a *AsyncInserter) Add(list ...interface{}) error {
+	for _, ptr := range list {
+		v := reflect.ValueOf(ptr)
+		if v.Kind() != reflect.Ptr || v.Type().Elem() != a.table.gotype {
+			return fmt.Errorf("modl: AsyncInserter for %s got a %T", a.table.TableName, ptr)
+		}
+		if v.IsNil() {
+			return fmt.Errorf("modl: AsyncInserter for %s got a nil %T", a.table.TableName, ptr)
+		}
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return ErrInserterClosed
+	}
+	a.buf = append(a.buf, list...)
+	full := len(a.buf) >= a.maxBatch
+	a.mu.Unlock()
+
+	if full {
+		select {
+		case a.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Len returns the number of rows buffered.
+func (a *AsyncInserter) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.buf)
+}
+
+// Flush inserts the rows buffered so far and returns any error, rather
+// than passing it to the OnError function.
+func (a *AsyncInserter) Flush() error {
+	_, err := a.flush()
+	return err
+}
+
+// Close stops the inserter, inserts any rows still buffered and returns
+// the error of that final flush.
+func (a *AsyncInserter) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.mu.Unlock()
+
+	close(a.closing)
+	<-a.stopped
+	return a.Flush()
+}
+
+func (a *AsyncInserter) run() {
+	defer close(a.stopped)
+	var tick <-chan time.Time
+	if a.flushEvery > 0 {
+		ticker := time.NewTicker(a.flushEvery)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-a.full:
+		case <-a.closing:
+			return
+		}
+		rows, err := a.flush()
+		if err == nil {
+			continue
+		}
+		a.mu.Lock()
+		onError := a.onError
+		a.mu.Unlock()
+		if onError != nil {
+			onError(rows, err)
+		} else {
+			a.dbmap.traceError("async insert into "+a.table.TableName, nil, err)
+		}
+	}
+}
+
+// flush inserts the buffered rows, in batches of at most maxBatch, and
+// returns the rows which were not inserted if it fails.
+func (a *AsyncInserter) flush() ([]interface{}, error) {
+	a.flushing.Lock()
+	defer a.flushing.Unlock()
+
+	a.mu.Lock()
+	rows := a.buf
+	a.buf = nil
+	a.mu.Unlock()
+
+	for start := 0; start < len(rows); start += a.maxBatch {
+		end := start + a.maxBatch
+		if end > len(rows) {
+			end = len(rows)
+		}
+		b := a.dbmap.NewWriteBatch().SetCoalesce(true)
+		b.Insert(rows[start:end]...)
+		if err := b.Flush(); err != nil {
+			return rows[start:], err
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,597 @@
+package modl
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// BatchLockError is returned by Update and Delete with the Batch option
+// when some of the elements in their list were not written because their
+// version was out of date.  The other elements were written.
+type BatchLockError struct {
+	TableName string
+	// Errors has an entry for each element of the list, which is nil if
+	// the element was written and an OptimisticLockError if it was not.
+	Errors []error
+}
+
+// Error returns a description of the rows which were not written.
+func (e BatchLockError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errors {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d rows in table=%s not written: %v", failed, len(e.Errors), e.TableName, first)
+}
+
+// batchTable returns the table all of the pointers in list map to, or nil
+// if they do not all map to the same table.
+func batchTable(m *DbMap, list []interface{}, checkPk bool) (*TableMap, []reflect.Value, error) {
+	var table *TableMap
+	elems := make([]reflect.Value, len(list))
+	for i, ptr := range list {
+		t, elem, err := tableForPointer(m, ptr, checkPk)
+		if err != nil {
+			return nil, nil, err
+		}
+		if table != nil && t != table {
+			return nil, nil, nil
+		}
+		table, elems[i] = t, elem
+	}
+	return table, elems, nil
+}
+
+// batchSize returns how many rows can be written by one statement which
+// binds perRow parameters for each row, and reserved parameters besides.
+func (t *TableMap) batchSize(perRow, reserved int) int {
+	n := (t.dbmap.Dialect.MaxBindParams() - reserved) / perRow
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// writeRowCondition writes a condition matching the row with keys, and
+// version if the table has a version column, to s, appending its args.
+func (t *TableMap) writeRowCondition(s *bytes.Buffer, args []interface{}, bi bindInstance) []interface{} {
+	d := t.dbmap.Dialect
+	s.WriteString("(")
+	for i, k := range t.Keys {
+		if i > 0 {
+			s.WriteString(" and ")
+		}
+		s.WriteString(d.QuoteField(k.ColumnName))
+		s.WriteString("=")
+		s.WriteString(d.BindVar(len(args)))
+		args = append(args, bi.keys[i])
+	}
+	if t.version != nil {
+		s.WriteString(" and ")
+		s.WriteString(d.QuoteField(t.version.ColumnName))
+		s.WriteString("=")
+		s.WriteString(d.BindVar(len(args)))
+		args = append(args, bi.existingVersion)
+	}
+	s.WriteString(")")
+	return args
+}
+
+// writeRowsCondition writes a condition matching each of the rows in bis.
+func (t *TableMap) writeRowsCondition(s *bytes.Buffer, args []interface{}, bis []bindInstance) []interface{} {
+	d := t.dbmap.Dialect
+	if len(t.Keys) == 1 && t.version == nil {
+		s.WriteString(d.QuoteField(t.Keys[0].ColumnName))
+		s.WriteString(" in (")
+		for i, bi := range bis {
+			if i > 0 {
+				s.WriteString(", ")
+			}
+			s.WriteString(d.BindVar(len(args)))
+			args = append(args, bi.keys[0])
+		}
+		s.WriteString(")")
+		return args
+	}
+	for i, bi := range bis {
+		if i > 0 {
+			s.WriteString(" or ")
+		}
+		args = t.writeRowCondition(s, args, bi)
+	}
+	return args
+}
+
+// canBatchInsert returns true if rows can be inserted into the table with
+// multi-row inserts.  Tables with auto-increment keys cannot, because the
+// generated keys could not be read back.
+func (t *TableMap) canBatchInsert(opts *queryOptions) bool {
+	if opts.returningAll || t.returningAll {
+		return false
+	}
+	for _, col := range t.Columns {
+		if col.isAutoIncr {
+			return false
+		}
+	}
+	return true
+}
+
+// batchInsertQuery returns a single statement inserting each of the rows
+// in bis, which were bound by bindInsert with the same query.
+func (t *TableMap) batchInsertQuery(bis []bindInstance) (string, []interface{}) {
+	d := t.dbmap.Dialect
+	query := bis[0].query
+	s := bytes.Buffer{}
+	s.WriteString(query[:strings.Index(query, " values (")])
+	s.WriteString(" values ")
+
+	args := make([]interface{}, 0, len(bis)*len(bis[0].args))
+	for i, bi := range bis {
+		if i > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString("(")
+		for j, arg := range bi.args {
+			if j > 0 {
+				s.WriteString(",")
+			}
+			s.WriteString(bi.columns[j].bindExpr(d.BindVar(len(args))))
+			args = append(args, arg)
+		}
+		if len(t.discriminator) > 0 {
+			if len(bi.args) > 0 {
+				s.WriteString(",")
+			}
+			s.WriteString(quoteValues([]string{t.discriminatorValue}))
+		}
+		s.WriteString(")")
+	}
+	s.WriteString(t.dbmap.terminator())
+	return s.String(), args
+}
+
+// batchUpdateQuery returns a single statement updating each of the rows in
+// bis, which were bound by bindUpdate.  Each column is set with a case
+// expression choosing the row's value by its keys and version.
+func (t *TableMap) batchUpdateQuery(bis []bindInstance, scope []interface{}) (string, []interface{}) {
+	d := t.dbmap.Dialect
+	s := bytes.Buffer{}
+	s.WriteString(fmt.Sprintf("update %s set ", quoteTable(d, t.qualifiedName())))
+
+	var args []interface{}
+	x := 0
+	for _, col := range t.Columns {
+		if col.isPK || !col.isWritten() {
+			continue
+		}
+		if x > 0 {
+			s.WriteString(", ")
+		}
+		column := d.QuoteField(col.ColumnName)
+		s.WriteString(column)
+		s.WriteString("=case")
+		for _, bi := range bis {
+			s.WriteString(" when ")
+			args = t.writeRowCondition(&s, args, bi)
+			s.WriteString(" then ")
+			s.WriteString(col.bindExpr(d.BindVar(len(args))))
+			args = append(args, bi.args[x])
+		}
+		// the else branch also gives the case the column's type, which
+		// postgres needs to know the type of the bind parameters
+		s.WriteString(" else ")
+		s.WriteString(column)
+		s.WriteString(" end")
+		x++
+	}
+
+	s.WriteString(" where (")
+	args = t.writeRowsCondition(&s, args, bis)
+	s.WriteString(")")
+	t.writeScope(&s, len(args))
+	s.WriteString(t.dbmap.terminator())
+	return s.String(), append(args, scope...)
+}
+
+// batchDeleteQuery returns a single statement deleting each of the rows in
+// bis, which were bound by bindDelete.
+func (t *TableMap) batchDeleteQuery(bis []bindInstance, scope []interface{}) (string, []interface{}) {
+	s := bytes.Buffer{}
+	s.WriteString(fmt.Sprintf("delete from %s where (", quoteTable(t.dbmap.Dialect, t.qualifiedName())))
+	args := t.writeRowsCondition(&s, nil, bis)
+	s.WriteString(")")
+	t.writeScope(&s, len(args))
+	s.WriteString(t.dbmap.terminator())
+	return s.String(), append(args, scope...)
+}
+
+// currentVersions returns the version of each of the rows in bis which
+// still exist, by the fmt representation of their keys.
+func currentVersions(e SqlExecutor, t *TableMap, bis []bindInstance, scope []interface{}, opts *queryOptions) (map[string]int64, error) {
+	d := t.dbmap.Dialect
+	s := bytes.Buffer{}
+	s.WriteString("select ")
+	for _, k := range t.Keys {
+		s.WriteString(d.QuoteField(k.ColumnName))
+		s.WriteString(", ")
+	}
+	s.WriteString(d.QuoteField(t.version.ColumnName))
+	s.WriteString(fmt.Sprintf(" from %s where (", quoteTable(d, t.qualifiedName())))
+
+	var args []interface{}
+	for i, bi := range bis {
+		if i > 0 {
+			s.WriteString(" or ")
+		}
+		args = append(args, bi.keys...)
+		s.WriteString("(")
+		for j, k := range t.Keys {
+			if j > 0 {
+				s.WriteString(" and ")
+			}
+			s.WriteString(d.QuoteField(k.ColumnName))
+			s.WriteString("=")
+			s.WriteString(d.BindVar(len(args) - len(bi.keys) + j))
+		}
+		s.WriteString(")")
+	}
+	s.WriteString(")")
+	t.writeScope(&s, len(args))
+	args = append(args, scope...)
+
+	// versions are read from the primary, which was just written to
+	h, done := opts.handleFor(e, false)
+	defer done()
+	rows, err := h.Queryx(s.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := map[string]int64{}
+	for rows.Next() {
+		keys := make([]interface{}, len(t.Keys))
+		dest := make([]interface{}, len(t.Keys)+1)
+		for i := range keys {
+			dest[i] = &keys[i]
+		}
+		var version int64
+		dest[len(keys)] = &version
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		versions[batchKey(keys)] = version
+	}
+	return versions, rows.Err()
+}
+
+// batchKey returns a comparable representation of keys.  Values scanned
+// into interface{} may come back as []byte or a different integer type, so
+// keys are compared by their formatted values.
+func batchKey(keys []interface{}) string {
+	s := bytes.Buffer{}
+	for _, k := range keys {
+		if b, ok := k.([]byte); ok {
+			k = string(b)
+		}
+		fmt.Fprintf(&s, "%v\x00", k)
+	}
+	return s.String()
+}
+
+func insertBatch(e SqlExecutor, table *TableMap, list []interface{}, elems []reflect.Value, opts *queryOptions) error {
+	var err error
+	var bis []bindInstance
+	var kept []interface{}
+	var keptElems []reflect.Value
+	for i, ptr := range list {
+		if table.CanValidate {
+			err = table.runHook(validateInsert, opts.context(), e, ptr)
+			if err != nil {
+				return err
+			}
+		}
+		if table.CanPreInsert {
+			err = table.runHook(preInsert, opts.context(), e, ptr)
+			if skipped(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+		err = table.checkEnums(elems[i])
+		if err != nil {
+			return err
+		}
+		bis = append(bis, table.bindInsert(dbmapOf(e), elems[i], false))
+		kept, keptElems = append(kept, ptr), append(keptElems, elems[i])
+	}
+	list, elems = kept, keptElems
+
+	// rows with columns left out for their defaults have different
+	// queries;  each run of rows with the same query is inserted together
+	for start := 0; start < len(bis); {
+		size := table.batchSize(len(bis[start].args), 0)
+		end := start + 1
+		for end < len(bis) && end-start < size && bis[end].query == bis[start].query {
+			end++
+		}
+		query, args := table.batchInsertQuery(bis[start:end])
+		_, err = table.exec(e, query, args...)
+		if err != nil {
+			return err
+		}
+		start = end
+	}
+
+	if table.CanPostInsert {
+		for _, ptr := range list {
+			err = table.runHook(postInsert, opts.context(), e, ptr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, elem := range elems {
+		if err := table.recordHistory(e, OpInsert, elem); err != nil {
+			return err
+		}
+		table.changed(e, OpInsert, elem, nil)
+	}
+	return nil
+}
+
+func updateBatch(e SqlExecutor, table *TableMap, list []interface{}, elems []reflect.Value, opts *queryOptions) (int64, error) {
+	scope, err := table.scopeArgs(opts.context())
+	if err != nil {
+		return -1, err
+	}
+	var bis []bindInstance
+	var olds, kept []interface{}
+	var keptElems []reflect.Value
+	for i, ptr := range list {
+		old, err := table.oldSnapshot(e, ptr, elems[i], opts)
+		if err != nil {
+			return -1, err
+		}
+		if table.CanValidate {
+			err = table.runUpdateHook(validateUpdate, opts.context(), e, ptr, old)
+			if err != nil {
+				return -1, err
+			}
+		}
+		if table.CanPreUpdate {
+			err = table.runUpdateHook(preUpdate, opts.context(), e, ptr, old)
+			if skipped(err) {
+				continue
+			} else if err != nil {
+				return -1, err
+			}
+		}
+		err = table.checkEnums(elems[i])
+		if err != nil {
+			return -1, err
+		}
+		bis = append(bis, table.bindUpdate(dbmapOf(e), elems[i], false))
+		olds = append(olds, old)
+		kept, keptElems = append(kept, ptr), append(keptElems, elems[i])
+	}
+	if len(bis) == 0 {
+		return 0, nil
+	}
+	list, elems = kept, keptElems
+
+	perRow := len(bis[0].args) - len(bis[0].keys)
+	if table.version != nil {
+		perRow--
+	}
+	cond := len(table.Keys)
+	if table.version != nil {
+		cond++
+	}
+	size := table.batchSize(perRow*(cond+1)+cond, len(scope))
+
+	var count int64
+	written := make([]bool, len(list))
+	lockErr := BatchLockError{TableName: table.TableName, Errors: make([]error, len(list))}
+	for start := 0; start < len(bis); start += size {
+		end := start + size
+		if end > len(bis) {
+			end = len(bis)
+		}
+
+		// rows whose version is already out of date are left out of the
+		// statement, so that the rows it does not write can be told apart
+		// from rows which another writer has also updated once
+		var idx []int
+		var chunk []bindInstance
+		if table.version != nil {
+			versions, err := currentVersions(e, table, bis[start:end], scope, opts)
+			if err != nil {
+				return -1, err
+			}
+			for i := start; i < end; i++ {
+				v, exists := versions[batchKey(bis[i].keys)]
+				if !exists || v != bis[i].existingVersion {
+					lockErr.Errors[i] = OptimisticLockError{TableName: table.TableName, Keys: bis[i].keys, RowExists: exists, LocalVersion: bis[i].existingVersion}
+					continue
+				}
+				idx = append(idx, i)
+				chunk = append(chunk, bis[i])
+			}
+		} else {
+			for i := start; i < end; i++ {
+				idx = append(idx, i)
+			}
+			chunk = bis[start:end]
+		}
+		if len(chunk) == 0 {
+			continue
+		}
+
+		query, args := table.batchUpdateQuery(chunk, scope)
+		res, err := table.exec(e, query, append(args, opts.passOn()...)...)
+		if err != nil {
+			return -1, err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return -1, err
+		}
+		count += rows
+
+		// a row changed between the check and the update;  find which
+		var versions map[string]int64
+		if table.version != nil && rows < int64(len(chunk)) {
+			versions, err = currentVersions(e, table, chunk, scope, opts)
+			if err != nil {
+				return -1, err
+			}
+		}
+		for j, bi := range chunk {
+			i := idx[j]
+			if versions != nil {
+				v, exists := versions[batchKey(bi.keys)]
+				if !exists || v != bi.newVersion {
+					lockErr.Errors[i] = OptimisticLockError{TableName: table.TableName, Keys: bi.keys, RowExists: exists, LocalVersion: bi.existingVersion}
+					continue
+				}
+			}
+			written[i] = true
+			if bi.versField != "" {
+				elems[i].FieldByIndex(bi.versIndex).SetInt(bi.newVersion)
+			}
+		}
+	}
+
+	if table.CanPostUpdate {
+		for i, ptr := range list {
+			if !written[i] {
+				continue
+			}
+			err = table.runUpdateHook(postUpdate, opts.context(), e, ptr, olds[i])
+			if err != nil {
+				return -1, err
+			}
+		}
+	}
+	for i, ok := range written {
+		if ok {
+			if err := table.recordHistory(e, OpUpdate, elems[i]); err != nil {
+				return -1, err
+			}
+			table.changed(e, OpUpdate, elems[i], olds[i])
+		}
+	}
+	for _, ok := range written {
+		if !ok {
+			return count, lockErr
+		}
+	}
+	return count, nil
+}
+
+func deleteBatch(e SqlExecutor, table *TableMap, list []interface{}, elems []reflect.Value, opts *queryOptions) (int64, error) {
+	scope, err := table.scopeArgs(opts.context())
+	if err != nil {
+		return -1, err
+	}
+	var bis []bindInstance
+	var kept []interface{}
+	var keptElems []reflect.Value
+	for i, ptr := range list {
+		if table.CanPreDelete {
+			err = table.runHook(preDelete, opts.context(), e, ptr)
+			if skipped(err) {
+				continue
+			} else if err != nil {
+				return -1, err
+			}
+		}
+		bis = append(bis, table.bindDelete(dbmapOf(e), elems[i]))
+		kept, keptElems = append(kept, ptr), append(keptElems, elems[i])
+	}
+	if len(bis) == 0 {
+		return 0, nil
+	}
+	list, elems = kept, keptElems
+
+	perRow := len(table.Keys)
+	if table.version != nil {
+		perRow++
+	}
+	size := table.batchSize(perRow, len(scope))
+
+	var count int64
+	written := make([]bool, len(list))
+	lockErr := BatchLockError{TableName: table.TableName, Errors: make([]error, len(list))}
+	for start := 0; start < len(bis); start += size {
+		end := start + size
+		if end > len(bis) {
+			end = len(bis)
+		}
+		chunk := bis[start:end]
+		query, args := table.batchDeleteQuery(chunk, scope)
+		res, err := table.exec(e, query, append(args, opts.passOn()...)...)
+		if err != nil {
+			return -1, err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return -1, err
+		}
+		count += rows
+
+		// rows which still exist were not deleted because their version
+		// was out of date;  rows which are gone are treated as deleted
+		var versions map[string]int64
+		if table.version != nil && rows < int64(len(chunk)) {
+			versions, err = currentVersions(e, table, chunk, scope, opts)
+			if err != nil {
+				return -1, err
+			}
+		}
+		for i, bi := range chunk {
+			if _, exists := versions[batchKey(bi.keys)]; exists {
+				lockErr.Errors[start+i] = OptimisticLockError{TableName: table.TableName, Keys: bi.keys, RowExists: true, LocalVersion: bi.existingVersion}
+				continue
+			}
+			written[start+i] = true
+		}
+	}
+
+	if table.CanPostDelete {
+		for i, ptr := range list {
+			if !written[i] {
+				continue
+			}
+			err = table.runHook(postDelete, opts.context(), e, ptr)
+			if err != nil {
+				return -1, err
+			}
+		}
+	}
+	for i, ok := range written {
+		if ok {
+			if err := table.recordHistory(e, OpDelete, elems[i]); err != nil {
+				return count, err
+			}
+			table.changed(e, OpDelete, elems[i], nil)
+		}
+	}
+	for _, ok := range written {
+		if !ok {
+			return count, lockErr
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,209 @@
+package benchmarks
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/modl"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type Row struct {
+	ID      int64
+	Name    string
+	Email   string
+	Age     int
+	Active  bool
+	Score   float64
+	Created int64
+}
+
+// selectRows is the number of rows read by each Select.
+const selectRows = 100
+
+type database struct {
+	name    string
+	driver  string
+	dsn     string
+	dialect modl.Dialect
+}
+
+func databases() []database {
+	dbs := []database{{"sqlite", "sqlite3", ":memory:", modl.SqliteDialect{}}}
+	if dsn := os.Getenv("MODL_BENCH_POSTGRES_DSN"); dsn != "" {
+		dbs = append(dbs, database{"postgres", "postgres", dsn, modl.PostgresDialect{}})
+	}
+	if dsn := os.Getenv("MODL_BENCH_MYSQL_DSN"); dsn != "" {
+		dbs = append(dbs, database{"mysql", "mysql", dsn, modl.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}})
+	}
+	return dbs
+}
+
+// run runs fn as a sub-benchmark for each database, with a fresh
+// bench_rows table.
+func run(b *testing.B, fn func(b *testing.B, dbmap *modl.DbMap)) {
+	for _, d := range databases() {
+		b.Run(d.name, func(b *testing.B) {
+			db, err := sql.Open(d.driver, d.dsn)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			// each connection to :memory: is a different database
+			db.SetMaxOpenConns(1)
+
+			dbmap := modl.NewDbMap(db, d.dialect)
+			dbmap.AddTableWithName(Row{}, "bench_rows").SetKeys(true, "ID")
+			if _, err = dbmap.Exec("drop table if exists bench_rows"); err != nil {
+				b.Fatal(err)
+			}
+			if err = dbmap.CreateTables(); err != nil {
+				b.Fatal(err)
+			}
+			defer dbmap.DropTables()
+			fn(b, dbmap)
+		})
+	}
+}
+
+func newRow(i int) *Row {
+	return &Row{
+		Name:    fmt.Sprintf("row %d", i),
+		Email:   fmt.Sprintf("row%d@example.com", i),
+		Age:     i % 100,
+		Active:  i%2 == 0,
+		Score:   float64(i) / 3,
+		Created: int64(i),
+	}
+}
+
+func insertRows(b *testing.B, dbmap *modl.DbMap, n int) []*Row {
+	rows := make([]*Row, n)
+	list := make([]interface{}, n)
+	for i := range rows {
+		rows[i] = newRow(i)
+		list[i] = rows[i]
+	}
+	if err := dbmap.Insert(list...); err != nil {
+		b.Fatal(err)
+	}
+	return rows
+}
+
+func BenchmarkInsert(b *testing.B) {
+	run(b, func(b *testing.B, dbmap *modl.DbMap) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := dbmap.Insert(newRow(i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkInsertBatch(b *testing.B) {
+	run(b, func(b *testing.B, dbmap *modl.DbMap) {
+		// rows with auto-increment keys cannot be inserted together, so
+		// the keys are set here
+		dbmap.TableFor(Row{}).SetKeys(false, "ID")
+		b.ReportAllocs()
+		list := make([]interface{}, 0, selectRows+1)
+		id := int64(0)
+		for i := 0; i < b.N; i++ {
+			list = list[:0]
+			for j := 0; j < selectRows; j++ {
+				id++
+				r := newRow(j)
+				r.ID = id
+				list = append(list, r)
+			}
+			if err := dbmap.Insert(append(list, modl.Batch())...); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCopyInsert(b *testing.B) {
+	run(b, func(b *testing.B, dbmap *modl.DbMap) {
+		table := dbmap.TableFor(Row{})
+		rows := make([]Row, selectRows)
+		for i := range rows {
+			rows[i] = *newRow(i)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := dbmap.CopyInsert(table, rows); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	run(b, func(b *testing.B, dbmap *modl.DbMap) {
+		rows := insertRows(b, dbmap, selectRows)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var r Row
+			if err := dbmap.Get(&r, rows[i%len(rows)].ID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkUpdate(b *testing.B) {
+	run(b, func(b *testing.B, dbmap *modl.DbMap) {
+		rows := insertRows(b, dbmap, selectRows)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			r := rows[i%len(rows)]
+			r.Age++
+			if _, err := dbmap.Update(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSelect(b *testing.B) {
+	run(b, func(b *testing.B, dbmap *modl.DbMap) {
+		insertRows(b, dbmap, selectRows)
+		query := "select * from bench_rows"
+		b.Run("values", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var rows []Row
+				if err := dbmap.Select(&rows, query); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("pointers", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var rows []*Row
+				if err := dbmap.Select(&rows, query); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("reuse", func(b *testing.B) {
+			b.ReportAllocs()
+			var rows []*Row
+			for i := 0; i < b.N; i++ {
+				if err := dbmap.Select(&rows, query, modl.ReuseSlice()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+}
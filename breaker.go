@@ -0,0 +1,135 @@
+package modl
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of running a write while a
+// CircuitBreaker is open.
+var ErrCircuitOpen = errors.New("modl: circuit breaker open")
+
+// A CircuitBreaker fails writes fast while the database is unhealthy.  It
+// opens after threshold writes in a row have failed, and then returns
+// ErrCircuitOpen for writes instead of running them.  Once it has been
+// open for the reset duration, it lets a single write through:  if that
+// write succeeds the breaker closes, otherwise it stays open for another
+// reset duration.  Reads are never blocked.
+//
+// A breaker guards every write of a DbMap when used as middleware:
+//
+//	dbmap.Use(modl.NewCircuitBreaker(5, 10*time.Second).Middleware)
+//
+// or only the writes of Insert, Update and Delete to a table, with
+// TableMap.SetCircuitBreaker.  A CircuitBreaker is safe for concurrent
+// use, and may be shared between DbMaps and tables.
+type CircuitBreaker struct {
+	// IsFailure returns true if err shows the database is unhealthy.  By
+	// default, all errors count except sql.ErrNoRows and cancellation of
+	// the statement's context.  Set it before the breaker is used, eg. to
+	// ignore constraint violations.
+	IsFailure func(err error) bool
+
+	threshold int
+	reset     time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewCircuitBreaker returns a closed CircuitBreaker which opens after
+// threshold consecutive failures, for the reset duration.
+func NewCircuitBreaker(threshold int, reset time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{threshold: threshold, reset: reset}
+}
+
+// Middleware guards the Exec statements run through it.  See DbMap.Use.
+func (b *CircuitBreaker) Middleware(next ExecFunc) ExecFunc {
+	return func(ctx context.Context, stmt *Statement) error {
+		if !stmt.Exec {
+			return next(ctx, stmt)
+		}
+		if err := b.allow(); err != nil {
+			return err
+		}
+		err := next(ctx, stmt)
+		b.record(err)
+		return err
+	}
+}
+
+// Open returns true if the breaker is failing writes.
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold && (b.probing || time.Now().Before(b.openUntil))
+}
+
+// allow returns ErrCircuitOpen if a write should not be run.  Every write
+// which is allowed must be recorded.  A nil breaker allows everything.
+func (b *CircuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	// the reset duration has passed;  let this write test the database
+	b.probing = true
+	return nil
+}
+
+// record records the result of a write which was allowed.
+func (b *CircuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	failed := err != nil
+	if failed && b.IsFailure != nil {
+		failed = b.IsFailure(err)
+	} else if failed {
+		failed = err != sql.ErrNoRows && !errors.Is(err, context.Canceled)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.reset)
+	}
+}
+
+// SetCircuitBreaker guards the writes of Insert, Update and Delete to this
+// table with b, or removes its breaker if b is nil.  See CircuitBreaker.
+func (t *TableMap) SetCircuitBreaker(b *CircuitBreaker) *TableMap {
+	t.breaker = b
+	return t
+}
+
+// exec runs a write to t through its circuit breaker.
+func (t *TableMap) exec(e SqlExecutor, query string, args ...interface{}) (sql.Result, error) {
+	if err := t.breaker.allow(); err != nil {
+		return nil, err
+	}
+	res, err := e.Exec(query, args...)
+	t.breaker.record(err)
+	return res, err
+}
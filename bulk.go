@@ -0,0 +1,268 @@
+package modl
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// BulkLoader is implemented by Dialects which can load rows into a table
+// much faster than inserting them, eg. with postgres' COPY.  It is used by
+// DbMap.CopyInsert.
+type BulkLoader interface {
+	// BulkLoad loads the rows returned by next into columns of table,
+	// until next returns nil, and returns the number of rows loaded.
+	BulkLoad(tx *sqlx.Tx, table string, columns []string, next func() []interface{}) (int64, error)
+}
+
+// errNoBulkLoad is returned by a BulkLoad which cannot run because the
+// dialect has not been set up for it;  CopyInsert then inserts the rows.
+var errNoBulkLoad = errors.New("modl: bulk loading is not configured")
+
+// RegisterMySQLReader and DeregisterMySQLReader let MySQLDialect load rows
+// with LOAD DATA LOCAL INFILE.  modl does not import a MySQL driver, so to
+// use it, set them to the functions of the go-sql-driver/mysql package:
+//
+//	modl.RegisterMySQLReader = mysql.RegisterReaderHandler
+//	modl.DeregisterMySQLReader = mysql.DeregisterReaderHandler
+//
+// The server must also allow local_infile.
+var (
+	RegisterMySQLReader   func(name string, handler func() io.Reader)
+	DeregisterMySQLReader func(name string)
+)
+
+// CopyInsert loads rows, a slice of structs or of pointers to structs of
+// table's type, into table.  If the Dialect is a BulkLoader, the rows are
+// loaded with it in a single transaction;  hooks are not run and keys
+// generated by the database are not set on the rows.  Otherwise, or if the
+// table has columns with insert expressions, the rows are inserted with
+// Insert and the Batch option in a transaction.
+//
+// Returns the number of rows loaded.
+func (m *DbMap) CopyInsert(table *TableMap, rows interface{}) (int64, error) {
+	v := reflect.Indirect(reflect.ValueOf(rows))
+	if v.Kind() != reflect.Slice {
+		return -1, fmt.Errorf("modl: CopyInsert expected a slice, got %T", rows)
+	}
+	for i := 0; i < v.Len(); i++ {
+		elem := reflect.Indirect(v.Index(i))
+		if elem.Type() != table.gotype {
+			return -1, fmt.Errorf("modl: CopyInsert into %s got a %v", table.TableName, elem.Type())
+		}
+	}
+
+	tx, err := m.Begin()
+	if err != nil {
+		return -1, err
+	}
+	n, err := m.bulkLoad(tx, table, v)
+	if err == errNoBulkLoad {
+		n, err = m.copyByInsert(tx, v)
+	}
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	return n, tx.Commit()
+}
+
+// bulkLoad loads the rows in v into table with the Dialect's BulkLoader.
+func (m *DbMap) bulkLoad(tx *Transaction, table *TableMap, v reflect.Value) (int64, error) {
+	loader, ok := m.Dialect.(BulkLoader)
+	if !ok {
+		return 0, errNoBulkLoad
+	}
+	// bulk loads take raw values, so insert expressions cannot be applied
+	for _, col := range table.Columns {
+		if col.bindExpr("?") != "?" {
+			return 0, errNoBulkLoad
+		}
+	}
+
+	plan := table.insertPlan
+	if plan.query == "" {
+		plan = table.buildInsertPlan(nil, false)
+		table.insertPlan = plan
+	}
+	var columns []string
+	for _, col := range table.Columns {
+		if col.isWritten() && !col.isAutoIncr {
+			columns = append(columns, col.ColumnName)
+		}
+	}
+
+	if len(table.discriminator) > 0 {
+		columns = append(columns, table.discriminator)
+	}
+
+	i := 0
+	next := func() []interface{} {
+		if i >= v.Len() {
+			return nil
+		}
+		args, _ := unwrapSensitive(plan.createBindInstance(m, reflect.Indirect(v.Index(i))).args)
+		if len(table.discriminator) > 0 {
+			args = append(args, table.discriminatorValue)
+		}
+		i++
+		return args
+	}
+	m.trace(fmt.Sprintf("copy %s (%s) -- %d rows", table.TableName, strings.Join(columns, ", "), v.Len()))
+	return loader.BulkLoad(tx.Tx, table.qualifiedName(), columns, next)
+}
+
+// copyByInsert inserts the rows in v with a batched Insert.
+func (m *DbMap) copyByInsert(tx *Transaction, v reflect.Value) (int64, error) {
+	tx.stmts = newStmtCache(tx.Tx)
+	list := make([]interface{}, 0, v.Len()+1)
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		if elem.Kind() != reflect.Ptr {
+			elem = elem.Addr()
+		}
+		list = append(list, elem.Interface())
+	}
+	if err := tx.Insert(append(list, Batch())...); err != nil {
+		return -1, err
+	}
+	return int64(v.Len()), nil
+}
+
+// BulkLoad loads rows with COPY ... FROM STDIN, which lib/pq supports on
+// statements prepared in a transaction.
+func (d PostgresDialect) BulkLoad(tx *sqlx.Tx, table string, columns []string, next func() []interface{}) (int64, error) {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = d.QuoteField(c)
+	}
+	query := fmt.Sprintf("COPY %s (%s) FROM STDIN", quoteTable(d, table), strings.Join(quoted, ", "))
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return -1, err
+	}
+	defer stmt.Close()
+
+	for args := next(); args != nil; args = next() {
+		if _, err = stmt.Exec(args...); err != nil {
+			return -1, err
+		}
+	}
+	res, err := stmt.Exec()
+	if err != nil {
+		return -1, err
+	}
+	return res.RowsAffected()
+}
+
+var mysqlReaders int64
+
+// BulkLoad loads rows with LOAD DATA LOCAL INFILE, if RegisterMySQLReader
+// and DeregisterMySQLReader have been set.
+func (d MySQLDialect) BulkLoad(tx *sqlx.Tx, table string, columns []string, next func() []interface{}) (int64, error) {
+	if RegisterMySQLReader == nil || DeregisterMySQLReader == nil {
+		return 0, errNoBulkLoad
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		var buf bytes.Buffer
+		for args := next(); args != nil; args = next() {
+			buf.Reset()
+			for i, arg := range args {
+				if i > 0 {
+					buf.WriteByte('\t')
+				}
+				if err := writeMySQLField(&buf, arg); err != nil {
+					w.CloseWithError(err)
+					return
+				}
+			}
+			buf.WriteByte('\n')
+			if _, err := w.Write(buf.Bytes()); err != nil {
+				return
+			}
+		}
+		w.Close()
+	}()
+	defer r.Close()
+
+	name := fmt.Sprintf("modl-%d", atomic.AddInt64(&mysqlReaders, 1))
+	RegisterMySQLReader(name, func() io.Reader { return r })
+	defer DeregisterMySQLReader(name)
+
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = d.QuoteField(c)
+	}
+	query := fmt.Sprintf("LOAD DATA LOCAL INFILE 'Reader::%s' INTO TABLE %s (%s)", name, quoteTable(d, table), strings.Join(quoted, ", "))
+	res, err := tx.Exec(query)
+	if err != nil {
+		return -1, err
+	}
+	return res.RowsAffected()
+}
+
+// writeMySQLField writes v to buf in the default format of LOAD DATA, with
+// tab separated fields, backslash escapes and \N for NULL.
+func writeMySQLField(buf *bytes.Buffer, v interface{}) error {
+	if valuer, ok := v.(driver.Valuer); ok {
+		var err error
+		if v, err = valuer.Value(); err != nil {
+			return err
+		}
+	}
+	var s string
+	switch t := v.(type) {
+	case nil:
+		buf.WriteString(`\N`)
+		return nil
+	case []byte:
+		s = string(t)
+	case string:
+		s = t
+	case bool:
+		if t {
+			s = "1"
+		} else {
+			s = "0"
+		}
+	case time.Time:
+		s = t.Format("2006-01-02 15:04:05.999999")
+	default:
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				buf.WriteString(`\N`)
+				return nil
+			}
+			return writeMySQLField(buf, rv.Elem().Interface())
+		}
+		s = fmt.Sprint(v)
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case 0:
+			buf.WriteString(`\0`)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return nil
+}
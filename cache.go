@@ -0,0 +1,251 @@
+package modl
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cached makes Select or SelectOne serve the call from the DbMap's query
+// cache if the same query has been run with the same arguments into the
+// same type within ttl, rather than running it:
+//
+//	err := dbmap.Select(&countries, "select * from countries", modl.Cached(time.Minute))
+//
+// The cached rows are invalidated when rows of a table the query names are
+// written through the DbMap with Insert, Update, Delete or Exec.  Writes
+// made elsewhere should be followed by a call to InvalidateCache.  Rows
+// are copied into and out of the cache, but fields holding pointers, maps
+// or slices share what they point to with the cached rows.  PostGet hooks
+// are not run on rows served from the cache.  Cached has no effect in a
+// Transaction.
+func Cached(ttl time.Duration) QueryOption {
+	return func(o *queryOptions) {
+		o.cacheTTL = ttl
+	}
+}
+
+// InvalidateCache removes the results of cached queries which name any of
+// tables from the DbMap's query cache, or all results if no tables are
+// given.  See Cached.
+func (m *DbMap) InvalidateCache(tables ...string) {
+	m.cache.invalidate(tables)
+}
+
+// queryCache holds the results of queries run with Cached.
+type queryCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// gen is incremented by each invalidation, so that results read
+	// before a write are not stored after it
+	gen uint64
+}
+
+type cacheEntry struct {
+	value   reflect.Value
+	expires time.Time
+	tables  []string
+}
+
+// cacheKey identifies a cached query.
+type cacheKey struct {
+	key string
+	gen uint64
+	ttl time.Duration
+}
+
+// lookup copies the cached results of query into dest, appending them to
+// it like Select if it is a slice, and returns true if they are cached.
+// Otherwise, it returns the key to store the results under, which is empty
+// if the call should not be cached.
+func (m *DbMap) lookup(e SqlExecutor, dest interface{}, query string, args []interface{}, opts *queryOptions) (cacheKey, bool) {
+	if opts.cacheTTL <= 0 {
+		return cacheKey{}, false
+	}
+	if _, ok := e.(*Transaction); ok {
+		return cacheKey{}, false
+	}
+	key, err := queryKey(dest, query, args)
+	if err != nil {
+		return cacheKey{}, false
+	}
+
+	c := &m.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().Before(entry.expires) {
+		v := reflect.ValueOf(dest).Elem()
+		if v.Kind() == reflect.Slice && !opts.reuse {
+			v.Set(reflect.AppendSlice(v, copyValue(entry.value)))
+		} else {
+			v.Set(copyValue(entry.value))
+		}
+		return cacheKey{}, true
+	}
+	if ok {
+		delete(c.entries, key)
+	}
+	return cacheKey{key: key, gen: c.gen, ttl: opts.cacheTTL}, false
+}
+
+// store caches a copy of value, the results query has read, under k.
+func (m *DbMap) store(k cacheKey, value reflect.Value, query string) {
+	if len(k.key) == 0 {
+		return
+	}
+	tables := m.tablesIn(query)
+	c := &m.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != k.gen {
+		return
+	}
+	if c.entries == nil {
+		c.entries = map[string]cacheEntry{}
+	}
+	c.entries[k.key] = cacheEntry{
+		value:   copyValue(value),
+		expires: time.Now().Add(k.ttl),
+		tables:  tables,
+	}
+}
+
+// invalidate removes the entries which name any of tables, or all entries
+// if tables is empty.
+func (c *queryCache) invalidate(tables []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if len(tables) == 0 {
+		c.entries = nil
+		return
+	}
+	for key, entry := range c.entries {
+	match:
+		for _, name := range entry.tables {
+			for _, t := range tables {
+				if strings.EqualFold(name, t) {
+					delete(c.entries, key)
+					break match
+				}
+			}
+		}
+	}
+}
+
+// empty returns true if nothing is cached.
+func (c *queryCache) empty() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries) == 0
+}
+
+// written invalidates the cached results of queries naming tables, which
+// e has written to.  Results cached while a Transaction is open may still
+// hold the rows from before its writes, so they are invalidated again
+// when it commits.
+func (m *DbMap) written(e SqlExecutor, tables ...string) {
+	if tx, ok := e.(*Transaction); ok {
+		tx.written = append(tx.written, tables...)
+	}
+	if len(tables) > 0 && !m.cache.empty() {
+		m.cache.invalidate(tables)
+	}
+}
+
+// tablesIn returns the names of the DbMap's tables which appear in query.
+func (m *DbMap) tablesIn(query string) []string {
+	query = strings.ToLower(query)
+	var tables []string
+	for _, table := range distinctTables(m.Schema().Tables()) {
+		name := strings.ToLower(table.TableName)
+		for i := 0; ; {
+			j := strings.Index(query[i:], name)
+			if j < 0 {
+				break
+			}
+			start, end := i+j, i+j+len(name)
+			if (start == 0 || !isWordByte(query[start-1])) && (end == len(query) || !isWordByte(query[end])) {
+				tables = append(tables, table.TableName)
+				break
+			}
+			i = end
+		}
+	}
+	return tables
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9'
+}
+
+// queryKey returns the cache key of query with args read into dest.
+// Whitespace outside of quotes is normalized, so that queries differing
+// only by formatting share results.
+func queryKey(dest interface{}, query string, args []interface{}) (string, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%T\x00", dest)
+	var quote rune
+	space := false
+	for _, r := range strings.TrimSpace(query) {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	args, _ = unwrapSensitive(args)
+	for _, a := range args {
+		if v, ok := a.(driver.Valuer); ok {
+			var err error
+			if a, err = v.Value(); err != nil {
+				return "", err
+			}
+		}
+		if v := reflect.ValueOf(a); v.Kind() == reflect.Ptr && !v.IsNil() {
+			a = v.Elem().Interface()
+		}
+		fmt.Fprintf(&b, "\x00%T:%v", a, a)
+	}
+	return b.String(), nil
+}
+
+// copyValue returns a copy of v which does not share its slice, or the
+// structs its elements point to.
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return c
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(v.Elem())
+		return c
+	}
+	return v
+}
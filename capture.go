@@ -0,0 +1,318 @@
+package modl
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// A Change is a row of a changes table, recording a row written to one of
+// the tables set up with CaptureChanges.
+type Change struct {
+	ID    int64     `db:"id"`
+	Table string    `db:"table_name"`
+	Op    Operation `db:"op"`
+	// Keys and Data are JSON objects of the row's primary key columns and
+	// of all of its columns, keyed by column name:  the row as written,
+	// or for a delete, the row deleted.
+	Keys      string    `db:"row_keys"`
+	Data      string    `db:"row_data"`
+	ChangedAt time.Time `db:"changed_at"`
+}
+
+// Decode unmarshals the change's Data into v.
+func (c Change) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(c.Data), v)
+}
+
+// A ChangeCapturer is a Dialect which can write changes to a table with
+// triggers.  It is used by CaptureChanges.
+type ChangeCapturer interface {
+	// ChangeTriggers returns statements, without their terminators,
+	// replacing the triggers on table which insert a row into the changes
+	// table for each row inserted, updated or deleted.
+	ChangeTriggers(table *TableMap, changes string) []string
+	// DropChangeTriggers returns statements dropping the triggers created
+	// by ChangeTriggers.
+	DropChangeTriggers(table *TableMap, changes string) []string
+}
+
+// changeCheckpoint is a row of a changes table's checkpoints table, the
+// last change read by a ChangeReader.
+type changeCheckpoint struct {
+	Name     string `db:"name"`
+	ChangeID int64  `db:"change_id"`
+}
+
+// changeTables returns the changes table called changes and its
+// checkpoints table, which are not added to the DbMap.
+func (m *DbMap) changeTables(changes string) (*TableMap, *TableMap) {
+	t := m.newTableMap(reflect.TypeOf(Change{}), changes).SetKeys(true, "ID")
+	t.ColMap("Keys").SetSqlType("text")
+	t.ColMap("Data").SetSqlType("text")
+	t.ColMap("ChangedAt").SetDefault("current_timestamp")
+	cp := m.newTableMap(reflect.TypeOf(changeCheckpoint{}), changes+"_checkpoints").SetKeys(false, "Name")
+	return t, cp
+}
+
+// CaptureChanges installs triggers on each of tables which record the rows
+// inserted, updated and deleted, by modl or not, in the table named
+// changes, which is created along with a table of ChangeReader checkpoints
+// if they do not exist.  Unlike Subscribe, changes are recorded in the
+// transaction writing them, and can be read later by other processes with
+// a ChangeReader.  The Dialect must be a ChangeCapturer;  sqlite's needs
+// JSON support, which is built in since 3.38.
+//
+// Installing triggers again replaces them.  See StopCapturingChanges.
+func (m *DbMap) CaptureChanges(changes string, tables ...*TableMap) error {
+	cc, ok := m.Dialect.(ChangeCapturer)
+	if !ok {
+		return fmt.Errorf("modl: %T cannot capture changes", m.Dialect)
+	}
+	t, cp := m.changeTables(changes)
+	stmts := append(m.createTableSql(t, true, false), m.createTableSql(cp, true, false)...)
+	for _, table := range tables {
+		for _, stmt := range cc.ChangeTriggers(table, changes) {
+			stmts = append(stmts, stmt+m.terminator())
+		}
+	}
+	return m.execInTx(stmts)
+}
+
+// StopCapturingChanges drops the triggers installed by CaptureChanges on
+// each of tables.  The changes table is left as it is.
+func (m *DbMap) StopCapturingChanges(changes string, tables ...*TableMap) error {
+	cc, ok := m.Dialect.(ChangeCapturer)
+	if !ok {
+		return fmt.Errorf("modl: %T cannot capture changes", m.Dialect)
+	}
+	var stmts []string
+	for _, table := range tables {
+		for _, stmt := range cc.DropChangeTriggers(table, changes) {
+			stmts = append(stmts, stmt+m.terminator())
+		}
+	}
+	return m.execInTx(stmts)
+}
+
+// execInTx runs stmts in a transaction.
+func (m *DbMap) execInTx(stmts []string) error {
+	tx, err := m.Begin()
+	if err != nil {
+		return err
+	}
+	if err := execAll(tx, stmts); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// A ChangeReader reads a changes table written by the triggers installed
+// by CaptureChanges, keeping its place with a checkpoint which is stored
+// under its name.  Each name should be used by one reader at a time.
+//
+//	r := dbmap.ChangeReader("changes", "search-indexer")
+//	for {
+//		changes, err := r.Next(100)
+//		...
+//		for _, c := range changes {
+//			// process c
+//			if err := r.Ack(c); err != nil {
+//				...
+//			}
+//		}
+//	}
+type ChangeReader struct {
+	dbmap       *DbMap
+	changes     *TableMap
+	checkpoints *TableMap
+	name        string
+}
+
+// ChangeReader returns a ChangeReader named name for the changes table.
+func (m *DbMap) ChangeReader(changes, name string) *ChangeReader {
+	t, cp := m.changeTables(changes)
+	return &ChangeReader{dbmap: m, changes: t, checkpoints: cp, name: name}
+}
+
+// Next returns up to limit changes after the reader's checkpoint, oldest
+// first.  It does not move the checkpoint;  see Ack.
+func (r *ChangeReader) Next(limit int) ([]Change, error) {
+	after, err := r.Checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	d := r.dbmap.Dialect
+	query := fmt.Sprintf("select * from %s where %s > %s order by %s limit %d",
+		quoteTable(d, r.changes.qualifiedName()), d.QuoteField("id"), d.BindVar(0), d.QuoteField("id"), limit)
+	var changes []Change
+	if err := r.dbmap.Select(&changes, query, after); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Checkpoint returns the id of the last change acknowledged by the reader,
+// or 0 if it has acknowledged none.
+func (r *ChangeReader) Checkpoint() (int64, error) {
+	d := r.dbmap.Dialect
+	query := fmt.Sprintf("select %s from %s where %s = %s", d.QuoteField("change_id"),
+		quoteTable(d, r.checkpoints.qualifiedName()), d.QuoteField("name"), d.BindVar(0))
+	var id int64
+	err := r.dbmap.SelectOne(&id, query, r.name)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// Ack moves the reader's checkpoint to c, so that Next returns the changes
+// after it.
+func (r *ChangeReader) Ack(c Change) error {
+	return r.SetCheckpoint(c.ID)
+}
+
+// SetCheckpoint moves the reader's checkpoint to the change with the given
+// id, eg. 0 to read all changes again.
+func (r *ChangeReader) SetCheckpoint(id int64) error {
+	d := r.dbmap.Dialect
+	update := fmt.Sprintf("update %s set %s = %s where %s = %s", quoteTable(d, r.checkpoints.qualifiedName()),
+		d.QuoteField("change_id"), d.BindVar(0), d.QuoteField("name"), d.BindVar(1))
+	res, err := r.dbmap.Exec(update, id, r.name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	insert := fmt.Sprintf("insert into %s (%s, %s) values (%s, %s)", quoteTable(d, r.checkpoints.qualifiedName()),
+		d.QuoteField("name"), d.QuoteField("change_id"), d.BindVar(0), d.BindVar(1))
+	_, err = r.dbmap.Exec(insert, r.name, id)
+	return err
+}
+
+// changeTrigger returns the name of the trigger on table recording its
+// changes in changes, for op if it is not empty.
+func changeTrigger(table *TableMap, changes string, op Operation) string {
+	name := changes + "_" + unqualified(table.TableName)
+	if len(op) > 0 {
+		name += "_" + string(op)
+	}
+	return name
+}
+
+// jsonPairs returns the name and value of each of cols of row, eg. "new",
+// as the arguments of a function building a JSON object.
+func jsonPairs(d Dialect, cols []*ColumnMap, row string) string {
+	pairs := make([]string, 0, len(cols))
+	for _, col := range cols {
+		if !col.Transient {
+			pairs = append(pairs, quoteValues([]string{col.ColumnName})+", "+row+"."+d.QuoteField(col.ColumnName))
+		}
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// changeInsert returns a statement inserting the change of row, eg. "new",
+// of table into changes.  op and keys/data are SQL expressions.
+func changeInsert(d Dialect, table *TableMap, changes, op, keys, data string) string {
+	return fmt.Sprintf("insert into %s (%s, %s, %s, %s) values (%s, %s, %s, %s)",
+		d.QuoteField(changes), d.QuoteField("table_name"), d.QuoteField("op"), d.QuoteField("row_keys"), d.QuoteField("row_data"),
+		quoteValues([]string{table.TableName}), op, keys, data)
+}
+
+var captureOps = []Operation{OpInsert, OpUpdate, OpDelete}
+
+// captureRow returns the trigger row holding the change of op.
+func captureRow(op Operation) string {
+	if op == OpDelete {
+		return "old"
+	}
+	return "new"
+}
+
+// ChangeTriggers returns a trigger per operation, inserting the change
+// with json_object.
+func (d SqliteDialect) ChangeTriggers(table *TableMap, changes string) []string {
+	stmts := d.DropChangeTriggers(table, changes)
+	for _, op := range captureOps {
+		row := captureRow(op)
+		insert := changeInsert(d, table, changes, quoteValues([]string{string(op)}),
+			"json_object("+jsonPairs(d, table.Keys, row)+")", "json_object("+jsonPairs(d, table.Columns, row)+")")
+		stmts = append(stmts, fmt.Sprintf("create trigger %s after %s on %s for each row begin %s; end",
+			d.QuoteField(changeTrigger(table, changes, op)), op, quoteTable(d, table.TableName), insert))
+	}
+	return stmts
+}
+
+// DropChangeTriggers drops the trigger for each operation.
+func (d SqliteDialect) DropChangeTriggers(table *TableMap, changes string) []string {
+	var stmts []string
+	for _, op := range captureOps {
+		stmts = append(stmts, "drop trigger if exists "+d.QuoteField(changeTrigger(table, changes, op)))
+	}
+	return stmts
+}
+
+// ChangeTriggers returns a plpgsql function inserting the change, with
+// the row converted by row_to_json, and a trigger running it for each
+// operation.
+func (d PostgresDialect) ChangeTriggers(table *TableMap, changes string) []string {
+	name := d.QuoteField(changeTrigger(table, changes, ""))
+	insert := func(row string) string {
+		return changeInsert(d, table, changes, "lower(tg_op)",
+			"json_build_object("+jsonPairs(d, table.Keys, row)+")::text", "row_to_json("+row+")::text")
+	}
+	function := fmt.Sprintf(`create or replace function %s() returns trigger as $$
+begin
+	if tg_op = 'DELETE' then
+		%s;
+		return old;
+	end if;
+	%s;
+	return new;
+end
+$$ language plpgsql`, name, insert("old"), insert("new"))
+	return []string{
+		function,
+		fmt.Sprintf("drop trigger if exists %s on %s", name, quoteTable(d, table.qualifiedName())),
+		fmt.Sprintf("create trigger %s after insert or update or delete on %s for each row execute procedure %s()",
+			name, quoteTable(d, table.qualifiedName()), name),
+	}
+}
+
+// DropChangeTriggers drops the trigger and its function.
+func (d PostgresDialect) DropChangeTriggers(table *TableMap, changes string) []string {
+	name := d.QuoteField(changeTrigger(table, changes, ""))
+	return []string{
+		fmt.Sprintf("drop trigger if exists %s on %s", name, quoteTable(d, table.qualifiedName())),
+		fmt.Sprintf("drop function if exists %s()", name),
+	}
+}
+
+// ChangeTriggers returns a trigger per operation, inserting the change
+// with json_object.
+func (d MySQLDialect) ChangeTriggers(table *TableMap, changes string) []string {
+	stmts := d.DropChangeTriggers(table, changes)
+	for _, op := range captureOps {
+		row := captureRow(op)
+		insert := changeInsert(d, table, changes, quoteValues([]string{string(op)}),
+			"json_object("+jsonPairs(d, table.Keys, row)+")", "json_object("+jsonPairs(d, table.Columns, row)+")")
+		stmts = append(stmts, fmt.Sprintf("create trigger %s after %s on %s for each row %s",
+			d.QuoteField(changeTrigger(table, changes, op)), op, quoteTable(d, table.qualifiedName()), insert))
+	}
+	return stmts
+}
+
+// DropChangeTriggers drops the trigger for each operation.
+func (d MySQLDialect) DropChangeTriggers(table *TableMap, changes string) []string {
+	var stmts []string
+	for _, op := range captureOps {
+		stmts = append(stmts, "drop trigger if exists "+d.QuoteField(changeTrigger(table, changes, op)))
+	}
+	return stmts
+}
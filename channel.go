@@ -0,0 +1,101 @@
+package modl
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/jmoiron/sqlx/reflectx"
+)
+
+// ChannelSelecter is implemented by DbMap and Transaction, and by the
+// Queryer returned by FromContext, which can stream rows to a channel.
+// It is kept apart from Queryer so that other implementations of Queryer
+// need not provide it.
+type ChannelSelecter interface {
+	SelectToChannel(dest interface{}, query string, args ...interface{}) error
+}
+
+var (
+	_ ChannelSelecter = &DbMap{}
+	_ ChannelSelecter = &Transaction{}
+	_ ChannelSelecter = &contextQueryer{}
+)
+
+// SelectToChannel runs query and sends its rows to dest, a channel of
+// values Select could scan them into, like structs or pointers to structs,
+// as they are read, so that workers can process a large result
+// concurrently without holding it in memory.  Each
+// row is a new value, and sends block until the channel has room, so the
+// query is read no faster than the rows are received.  PostGet hooks are
+// run on rows of registered tables before they are sent.  dest is closed
+// when SelectToChannel returns:  after the last row, when the query fails,
+// or when the context passed WithContext is cancelled, in which case it
+// returns the context's error.  The connection is held until then, so
+// receivers which stop early should cancel the context.
+//
+//	rows := make(chan *Person, 100)
+//	go func() { errc <- dbmap.SelectToChannel(rows, "select * from person") }()
+//	for p := range rows {
+//		...
+//	}
+func (m *DbMap) SelectToChannel(dest interface{}, query string, args ...interface{}) error {
+	return selectToChannel(m, m, dest, query, args...)
+}
+
+func selectToChannel(m *DbMap, e SqlExecutor, dest interface{}, query string, args ...interface{}) error {
+	ch := reflect.ValueOf(dest)
+	if ch.Kind() != reflect.Chan || ch.Type().ChanDir()&reflect.SendDir == 0 {
+		return fmt.Errorf("modl: SelectToChannel needs a channel to send to, not a %T", dest)
+	}
+	defer ch.Close()
+
+	args, opts := splitOptions(args)
+	query, args, err := m.rewrite(query, args, opts)
+	if err != nil {
+		return err
+	}
+	h, done := opts.handleFor(e, true)
+	defer done()
+
+	rows, err := h.Queryx(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	elemType := ch.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	base := reflectx.Deref(elemType)
+	s, err := m.newScanner(rows.Rows, base)
+	if err != nil {
+		return err
+	}
+	defer s.release()
+
+	table := m.TableForType(base)
+	hooked := table != nil && ((table.CanPostGet && !opts.noHooks) || len(table.relations) > 0)
+	ctx := opts.context()
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	}
+	for rows.Next() {
+		row := reflect.New(base)
+		if err := s.scan(row.Elem()); err != nil {
+			return err
+		}
+		if hooked {
+			if err := table.loaded(e, row.Interface(), opts); err != nil {
+				return err
+			}
+		}
+		if !isPtr {
+			row = row.Elem()
+		}
+		cases[0].Send = row
+		if chosen, _, _ := reflect.Select(cases); chosen == 1 {
+			return ctx.Err()
+		}
+	}
+	return rows.Err()
+}
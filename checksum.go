@@ -0,0 +1,58 @@
+package modl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// placeholders for the checksum column's new value, and for its current
+// value in the where clause of an update
+const (
+	checksumFieldConst = "[modl_checksum_field]"
+	checksumMatchConst = "[modl_checksum_match]"
+)
+
+// SetChecksumCol sets the column holding a checksum of the row's other
+// columns, which Insert and Update compute and write, so that it can be
+// used like an HTTP ETag.  Update only writes a row whose stored checksum
+// is the one in its field, and returns an OptimisticLockError otherwise,
+// so that a row sent back with the checksum it was read with does not
+// overwrite changes made since.  The field must be a string.  Keys, the
+// version column and read-only columns are not part of the checksum.
+// Returns the column found, or panics if the struct does not contain a
+// field matching this name.
+//
+// Automatically calls ResetSql() to ensure SQL statements are regenerated.
+func (t *TableMap) SetChecksumCol(field string) *ColumnMap {
+	c := t.ColMap(field)
+	if c.gotype.Kind() != reflect.String {
+		panic(fmt.Sprintf("Checksum column %s of %s must be a string, not %s", c.ColumnName, t.TableName, c.gotype))
+	}
+	t.checksum = c
+	t.ResetSql()
+	return c
+}
+
+// computeChecksum returns the checksum of the columns of elem, written by
+// m.
+func (t *TableMap) computeChecksum(m *DbMap, elem reflect.Value) string {
+	h := sha256.New()
+	for _, col := range t.Columns {
+		if col.isPK || !col.isWritten() || col == t.version || col == t.checksum {
+			continue
+		}
+		field := elem.FieldByIndex(col.fieldIndex)
+		s, err := formatCSV(m, col, field, "\x00")
+		if err != nil {
+			s = fmt.Sprint(field.Interface())
+		}
+		io.WriteString(h, col.ColumnName)
+		h.Write([]byte{0})
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
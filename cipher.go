@@ -0,0 +1,199 @@
+package modl
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// A FieldCipher encrypts the values of columns set up with
+// ColumnMap.SetCipher before they are written, and decrypts them when they
+// are read back by Get, Reload, or a Select into the table's type.
+// additionalData is authenticated but not stored with the value, which
+// must only decrypt with the additionalData it was encrypted with;  it is
+// nil unless the column is set up with ColumnMap.SetBoundCipher.
+type FieldCipher interface {
+	Encrypt(plaintext, additionalData []byte) ([]byte, error)
+	Decrypt(ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// ErrUnknownKey is returned by AESCipher.Decrypt for values which were
+// encrypted with a key it does not have.
+var ErrUnknownKey = errors.New("modl: value encrypted with an unknown key")
+
+const keyIDSize = 4
+
+// keyIDLabel is the message whose HMAC, keyed with a key, is the key's id.
+const keyIDLabel = "modl AESCipher key id"
+
+// AESCipher is a FieldCipher using AES-GCM.  It encrypts with its first
+// key and decrypts with any of them, so keys can be rotated by adding a new
+// key in front of the old ones;  rows are re-encrypted with the new key as
+// they are saved.  Each value is stored with an id derived from its key
+// with an HMAC, which, unlike a hash of the key, cannot be checked against
+// guessed keys without also knowing how it was derived from them.
+type AESCipher struct {
+	aeads []cipher.AEAD
+	ids   [][]byte
+}
+
+// NewAESCipher returns an AESCipher with the given keys, which must be 16,
+// 24 or 32 bytes long, for AES-128, AES-192 or AES-256.
+func NewAESCipher(keys ...[]byte) (*AESCipher, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("modl: NewAESCipher needs at least one key")
+	}
+	c := &AESCipher{}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(keyIDLabel))
+		c.aeads = append(c.aeads, aead)
+		c.ids = append(c.ids, mac.Sum(nil)[:keyIDSize])
+	}
+	return c, nil
+}
+
+// Encrypt seals plaintext and additionalData with the first key, returning
+// the key's id, a random nonce and the sealed data.
+func (c *AESCipher) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	aead := c.aeads[0]
+	out := make([]byte, keyIDSize+aead.NonceSize(), keyIDSize+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	copy(out, c.ids[0])
+	nonce := out[keyIDSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, plaintext, additionalData), nil
+}
+
+// Decrypt opens ciphertext with the key it was encrypted with, failing if
+// it was not sealed with additionalData.
+func (c *AESCipher) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < keyIDSize {
+		return nil, errors.New("modl: ciphertext too short")
+	}
+	for i, id := range c.ids {
+		if !bytes.Equal(id, ciphertext[:keyIDSize]) {
+			continue
+		}
+		aead := c.aeads[i]
+		data := ciphertext[keyIDSize:]
+		if len(data) < aead.NonceSize() {
+			return nil, errors.New("modl: ciphertext too short")
+		}
+		return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+	}
+	return nil, ErrUnknownKey
+}
+
+// cipherValue is a bound value which is encrypted with additionalData
+// when the statement is run.  string values are stored base64 encoded, so
+// that they still fit text columns.
+type cipherValue struct {
+	cipher         FieldCipher
+	v              interface{}
+	additionalData []byte
+}
+
+// Value encrypts the value.  NULLs are not encrypted.
+func (c cipherValue) Value() (driver.Value, error) {
+	v := reflect.ValueOf(c.v)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	var plaintext []byte
+	isString := false
+	switch {
+	case !v.IsValid():
+		return nil, nil
+	case v.Kind() == reflect.String:
+		plaintext, isString = []byte(v.String()), true
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		if v.IsNil() {
+			return nil, nil
+		}
+		plaintext = v.Bytes()
+	default:
+		return nil, fmt.Errorf("modl: cannot encrypt a %T", c.v)
+	}
+	ciphertext, err := c.cipher.Encrypt(plaintext, c.additionalData)
+	if err != nil {
+		return nil, err
+	}
+	if isString {
+		return base64.StdEncoding.EncodeToString(ciphertext), nil
+	}
+	return ciphertext, nil
+}
+
+// String keeps encrypted values out of logs.
+func (c cipherValue) String() string {
+	return redacted
+}
+
+// decryptInto decrypts ciphertext, as stored by cipherValue with
+// additionalData, into field, which is a string, *string or []byte.
+func decryptInto(c FieldCipher, field reflect.Value, ciphertext, additionalData []byte) error {
+	if ciphertext == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	t := field.Type()
+	isString := t.Kind() == reflect.String || (t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.String)
+	if isString {
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(ciphertext)))
+		n, err := base64.StdEncoding.Decode(decoded, ciphertext)
+		if err != nil {
+			return err
+		}
+		ciphertext = decoded[:n]
+	}
+	plaintext, err := c.Decrypt(ciphertext, additionalData)
+	if err != nil {
+		return err
+	}
+	switch {
+	case t.Kind() == reflect.String:
+		field.SetString(string(plaintext))
+	case t.Kind() == reflect.Ptr:
+		p := reflect.New(t.Elem())
+		p.Elem().SetString(string(plaintext))
+		field.Set(p)
+	default:
+		field.SetBytes(plaintext)
+	}
+	return nil
+}
+
+// canEncrypt returns true if fields of type t can be encrypted.
+func canEncrypt(t reflect.Type) bool {
+	switch {
+	case t.Kind() == reflect.String:
+		return true
+	case t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.String:
+		return true
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+// Command modl-repo generates typed repositories for structs mapped with
+// modl.  For each type it writes an interface with GetByID, Insert,
+// Update, Delete and ListWhere methods, and an implementation running them
+// on a modl.Queryer, such as a DbMap or a Transaction.  The interfaces
+// can be mocked in tests of the code using them.
+//
+// It is meant to be run by go generate, from the package declaring the
+// types:
+//
+//	//go:generate modl-repo -type=User,Order=orders
+//
+// Each type may be followed by the name of its table, which defaults to
+// the type's name, as with DbMap.AddTable.  The key passed to GetByID is
+// the field named by -key, which defaults to ID.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+var (
+	typeNames = flag.String("type", "", "comma separated list of types, each optionally followed by =table")
+	keyField  = flag.String("key", "ID", "name of the primary key field passed to GetByID")
+	output    = flag.String("output", "modl_repo.go", "name of the file to write")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("modl-repo: ")
+	flag.Parse()
+	if len(*typeNames) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	specs, err := parseTypes(*typeNames, *keyField)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir := "."
+	if args := flag.Args(); len(args) > 0 {
+		dir = args[0]
+	}
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != *output
+	}, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(pkgs) != 1 {
+		log.Fatalf("expected one package in %s, found %d", dir, len(pkgs))
+	}
+	for name, pkg := range pkgs {
+		src, err := generate(name, pkg.Files, specs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(dir, *output), src, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// A typeSpec describes a repository to generate.
+type typeSpec struct {
+	Name    string
+	Table   string
+	Key     string
+	KeyType string
+}
+
+// parseTypes parses the -type flag.
+func parseTypes(list, key string) ([]typeSpec, error) {
+	var specs []typeSpec
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		name, table := t, t
+		if i := strings.IndexByte(t, '='); i >= 0 {
+			name, table = t[:i], t[i+1:]
+		}
+		if !token.IsIdentifier(name) || len(table) == 0 {
+			return nil, fmt.Errorf("invalid type %q", t)
+		}
+		specs = append(specs, typeSpec{Name: name, Table: table, Key: key})
+	}
+	return specs, nil
+}
+
+// generate returns the source of the repositories for specs, which are
+// structs declared in files of package pkg.
+func generate(pkg string, files map[string]*ast.File, specs []typeSpec) ([]byte, error) {
+	structs := map[string]*ast.StructType{}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ast.Inspect(files[name], func(n ast.Node) bool {
+			if ts, ok := n.(*ast.TypeSpec); ok {
+				if st, ok := ts.Type.(*ast.StructType); ok {
+					structs[ts.Name.Name] = st
+				}
+			}
+			return true
+		})
+	}
+
+	for i := range specs {
+		st, ok := structs[specs[i].Name]
+		if !ok {
+			return nil, fmt.Errorf("struct type %s not found", specs[i].Name)
+		}
+		specs[i].KeyType = keyType(st, specs[i].Key)
+		if len(specs[i].KeyType) == 0 {
+			return nil, fmt.Errorf("%s has no field %s", specs[i].Name, specs[i].Key)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := repoTemplate.Execute(&buf, struct {
+		Package string
+		Types   []typeSpec
+	}{pkg, specs})
+	if err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, errors.New("generated invalid code: " + err.Error())
+	}
+	return src, nil
+}
+
+// keyType returns the type of st's field named key, or "" if there is
+// none.
+func keyType(st *ast.StructType, key string) string {
+	for _, f := range st.Fields.List {
+		for _, n := range f.Names {
+			if n.Name == key {
+				return types.ExprString(f.Type)
+			}
+		}
+	}
+	return ""
+}
+
+func unexported(name string) string {
+	r := []rune(name)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
+
+var repoTemplate = template.Must(template.New("repo").Funcs(template.FuncMap{
+	"unexported": unexported,
+}).Parse(`// Code generated by modl-repo; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"github.com/jmoiron/modl"
+)
+{{range .Types}}{{$impl := printf "%sRepository" (unexported .Name)}}
+// {{.Name}}Repository reads and writes {{.Name}} rows.
+type {{.Name}}Repository interface {
+	// GetByID returns the {{.Name}} with the given {{.Key}}, or
+	// modl.ErrNotFound.
+	GetByID(id {{.KeyType}}) (*{{.Name}}, error)
+	Insert(rows ...*{{.Name}}) error
+	// Update returns the number of rows updated.
+	Update(rows ...*{{.Name}}) (int64, error)
+	// Delete returns the number of rows deleted.
+	Delete(rows ...*{{.Name}}) (int64, error)
+	// ListWhere returns the rows matching where, a SQL condition with
+	// args bound to its bindvars, or all rows if where is empty.
+	ListWhere(where string, args ...interface{}) ([]*{{.Name}}, error)
+}
+
+// New{{.Name}}Repository returns a {{.Name}}Repository using e, which is
+// usually a *modl.DbMap or *modl.Transaction on which {{.Name}} has been
+// added as table {{.Table}}.
+func New{{.Name}}Repository(e modl.Queryer) {{.Name}}Repository {
+	return &{{$impl}}{e}
+}
+
+type {{$impl}} struct {
+	e modl.Queryer
+}
+
+func (r *{{$impl}}) GetByID(id {{.KeyType}}) (*{{.Name}}, error) {
+	row := &{{.Name}}{}
+	if err := r.e.Get(row, id); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+func (r *{{$impl}}) Insert(rows ...*{{.Name}}) error {
+	list := make([]interface{}, len(rows))
+	for i, row := range rows {
+		list[i] = row
+	}
+	return r.e.Insert(list...)
+}
+
+func (r *{{$impl}}) Update(rows ...*{{.Name}}) (int64, error) {
+	list := make([]interface{}, len(rows))
+	for i, row := range rows {
+		list[i] = row
+	}
+	return r.e.Update(list...)
+}
+
+func (r *{{$impl}}) Delete(rows ...*{{.Name}}) (int64, error) {
+	list := make([]interface{}, len(rows))
+	for i, row := range rows {
+		list[i] = row
+	}
+	return r.e.Delete(list...)
+}
+
+func (r *{{$impl}}) ListWhere(where string, args ...interface{}) ([]*{{.Name}}, error) {
+	query := "select * from {{.Table}}"
+	if len(where) > 0 {
+		query += " where " + where
+	}
+	var rows []*{{.Name}}
+	if err := r.e.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+{{end}}`))
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+const source = `package store
+
+type User struct {
+	ID   int64
+	Name string
+}
+
+type Order struct {
+	Key    string
+	UserID int64
+}
+`
+
+func parse(t *testing.T) map[string]*ast.File {
+	f, err := parser.ParseFile(token.NewFileSet(), "store.go", source, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]*ast.File{"store.go": f}
+}
+
+func TestGenerate(t *testing.T) {
+	specs, err := parseTypes("User,Order=orders", "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs[1].Key = "Key"
+	src, err := generate("store", parse(t), specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parser.ParseFile(token.NewFileSet(), "modl_repo.go", src, 0); err != nil {
+		t.Fatalf("Generated code does not parse: %v\n%s", err, src)
+	}
+	for _, s := range []string{
+		"package store",
+		"type UserRepository interface",
+		"GetByID(id int64) (*User, error)",
+		`query := "select * from User"`,
+		"func NewOrderRepository(e modl.Queryer) OrderRepository",
+		"GetByID(id string) (*Order, error)",
+		`query := "select * from orders"`,
+	} {
+		if !strings.Contains(string(src), s) {
+			t.Errorf("Expected generated code to contain %q:\n%s", s, src)
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	if _, err := parseTypes("User=", "ID"); err == nil {
+		t.Error("Expected an error for a missing table name")
+	}
+	specs, _ := parseTypes("Missing", "ID")
+	if _, err := generate("store", parse(t), specs); err == nil {
+		t.Error("Expected an error for a missing type")
+	}
+	specs, _ = parseTypes("Order", "ID")
+	if _, err := generate("store", parse(t), specs); err == nil {
+		t.Error("Expected an error for a missing key field")
+	}
+}
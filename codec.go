@@ -0,0 +1,382 @@
+package modl
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a columnCodec converts the values of a column between its field and
+// what is stored in the database.
+type columnCodec interface {
+	// bind returns the value to bind for v, the value of the field.
+	bind(v interface{}) interface{}
+	// decode sets field from src, the value scanned from the column.
+	decode(field reflect.Value, src interface{}) error
+}
+
+// cipherCodec encrypts a column's values, bound to the column if it is
+// not nil.  See ColumnMap.SetCipher and SetBoundCipher.
+type cipherCodec struct {
+	cipher FieldCipher
+	column *ColumnMap
+}
+
+// additionalData returns the data the column's values are bound to.
+func (c cipherCodec) additionalData() []byte {
+	if c.column == nil {
+		return nil
+	}
+	return []byte(c.column.table.qualifiedName() + "." + c.column.ColumnName)
+}
+
+func (c cipherCodec) bind(v interface{}) interface{} {
+	return cipherValue{c.cipher, v, c.additionalData()}
+}
+
+func (c cipherCodec) decode(field reflect.Value, src interface{}) error {
+	var ciphertext []byte
+	switch s := src.(type) {
+	case nil:
+	case []byte:
+		ciphertext = s
+	case string:
+		ciphertext = []byte(s)
+	default:
+		return fmt.Errorf("cannot decrypt a %T", src)
+	}
+	if err := decryptInto(c.cipher, field, ciphertext, c.additionalData()); err != nil {
+		return fmt.Errorf("decrypting: %v", err)
+	}
+	return nil
+}
+
+var bytesType = reflect.TypeOf([]byte(nil))
+
+// bytesCodec converts the values of byte arrays, and of byte slice types
+// other than []byte, which drivers do not bind, and which database/sql
+// cannot scan into from drivers returning blobs as strings.  Types which
+// are Valuers or Scanners convert themselves.
+type bytesCodec struct{}
+
+func (bytesCodec) bind(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.IsNil() {
+			return nil
+		}
+		return rv.Bytes()
+	case reflect.Array:
+		b := make([]byte, rv.Len())
+		reflect.Copy(reflect.ValueOf(b), rv)
+		return b
+	}
+	return v
+}
+
+func (bytesCodec) decode(field reflect.Value, src interface{}) error {
+	var b []byte
+	switch s := src.(type) {
+	case nil:
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	case []byte:
+		b = s
+	case string:
+		b = []byte(s)
+	default:
+		return fmt.Errorf("cannot convert a %T to bytes", src)
+	}
+	if field.Kind() == reflect.Array {
+		if len(b) != field.Len() {
+			return fmt.Errorf("cannot store %d bytes in a %s", len(b), field.Type())
+		}
+		reflect.Copy(field, reflect.ValueOf(b))
+		return nil
+	}
+	field.SetBytes(b)
+	return nil
+}
+
+// isBytes returns true for byte slices and arrays.
+func isBytes(t reflect.Type) bool {
+	return (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && t.Elem().Kind() == reflect.Uint8
+}
+
+// boolCodec converts the values of bool and *bool columns, and of types
+// based on bool, which databases without a boolean type store as numbers,
+// eg. tinyint(1) in mysql or number(1) in oracle, and which drivers return
+// as integers, floats, text like "1", "t" or "yes", or a bit(1) byte.
+type boolCodec struct{}
+
+func (boolCodec) bind(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Bool {
+		return v
+	}
+	return rv.Bool()
+}
+
+// decode sets field from src.  NULL is nil for pointers, and an error
+// otherwise, as it is without the codec.
+func (boolCodec) decode(field reflect.Value, src interface{}) error {
+	var b bool
+	switch s := src.(type) {
+	case nil:
+		if field.Kind() != reflect.Ptr {
+			return fmt.Errorf("cannot convert NULL to a %s", field.Type())
+		}
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	case bool:
+		b = s
+	case int64:
+		b = s != 0
+	case float64:
+		b = s != 0
+	case []byte:
+		var err error
+		if b, err = parseBool(string(s)); err != nil {
+			return err
+		}
+	case string:
+		var err error
+		if b, err = parseBool(s); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot convert a %T to a bool", src)
+	}
+	if field.Kind() == reflect.Ptr {
+		field.Set(reflect.New(field.Type().Elem()))
+		field = field.Elem()
+	}
+	field.SetBool(b)
+	return nil
+}
+
+// parseBool parses the text of a boolean:  a number, which is true unless
+// it is 0, a bit(1) byte, or a word like "true", "t", "yes", "y" or "on".
+func parseBool(s string) (bool, error) {
+	if len(s) == 1 && s[0] <= 1 {
+		return s[0] == 1, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "t", "true", "y", "yes", "on":
+		return true, nil
+	case "f", "false", "n", "no", "off":
+		return false, nil
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return false, fmt.Errorf("cannot parse %q as a bool", s)
+	}
+	return f != 0, nil
+}
+
+// isBool returns true for bool and *bool, and types based on them.
+func isBool(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Bool
+}
+
+// timeLayouts are tried in turn to parse times stored as text without a
+// layout set on their column.  They include the formats the sqlite driver
+// writes.
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	timePtrType = reflect.TypeOf(&time.Time{})
+)
+
+// timeCodec converts the values of time.Time and *time.Time columns.  See
+// ColumnMap.SetTimeLayout.
+type timeCodec struct {
+	// layout, if set, is the layout times are stored as text in
+	layout string
+	// loc, if set, is the location times are converted to when they are
+	// written and read
+	loc *time.Location
+	// zeroNull writes zero times as NULL
+	zeroNull bool
+}
+
+func (c timeCodec) bind(v interface{}) interface{} {
+	var t time.Time
+	switch tv := v.(type) {
+	case time.Time:
+		t = tv
+	case *time.Time:
+		if tv == nil {
+			return nil
+		}
+		t = *tv
+	default:
+		return v
+	}
+	if c.zeroNull && t.IsZero() {
+		return nil
+	}
+	if c.loc != nil {
+		t = t.In(c.loc)
+	}
+	if len(c.layout) > 0 {
+		return t.Format(c.layout)
+	}
+	return t
+}
+
+func (c timeCodec) decode(field reflect.Value, src interface{}) error {
+	var t time.Time
+	switch s := src.(type) {
+	case nil:
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	case time.Time:
+		t = s
+	case []byte:
+		var err error
+		if t, err = c.parse(string(s)); err != nil {
+			return err
+		}
+	case string:
+		var err error
+		if t, err = c.parse(s); err != nil {
+			return err
+		}
+	case int64:
+		t = time.Unix(s, 0)
+	default:
+		return fmt.Errorf("cannot convert a %T to a time", src)
+	}
+	if c.loc != nil {
+		t = t.In(c.loc)
+	}
+	if field.Kind() == reflect.Ptr {
+		field.Set(reflect.ValueOf(&t))
+	} else {
+		field.Set(reflect.ValueOf(t))
+	}
+	return nil
+}
+
+// parse parses s with the codec's layout, or the first of timeLayouts
+// which matches.  Times without a zone are in the codec's location, or
+// UTC.
+func (c timeCodec) parse(s string) (time.Time, error) {
+	loc := c.loc
+	if loc == nil {
+		loc = time.UTC
+	}
+	if len(c.layout) > 0 {
+		return time.ParseInLocation(c.layout, s, loc)
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a time", s)
+}
+
+// getCodec returns the column's codec for statements run by m, or nil if
+// its values are stored as they are.  Time columns without a location of
+// their own use m's TimeLocation, which is not kept on the column, as its
+// table may be shared by DbMaps with different ones;  m may be nil for
+// none.  Decimals are converted to and from text, byte arrays and named
+// byte slices to and from []byte, and bools from whatever the driver
+// returns for them.
+func (c *ColumnMap) getCodec(m *DbMap) columnCodec {
+	if tc, ok := c.codec.(timeCodec); ok && tc.loc == nil && m != nil {
+		tc.loc = m.TimeLocation
+		return tc
+	}
+	if c.codec != nil {
+		return c.codec
+	}
+	if m != nil && m.TimeLocation != nil && isTime(c.gotype) {
+		return timeCodec{loc: m.TimeLocation}
+	}
+	if isDecimal(c.gotype) {
+		return decimalCodec{}
+	}
+	if c.gotype != bytesType && isBytes(c.gotype) && !reflect.PtrTo(c.gotype).Implements(valuerType) && !reflect.PtrTo(c.gotype).Implements(scannerType) {
+		return bytesCodec{}
+	}
+	if isBool(c.gotype) && !reflect.PtrTo(c.gotype).Implements(valuerType) && !reflect.PtrTo(c.gotype).Implements(scannerType) {
+		return boolCodec{}
+	}
+	return nil
+}
+
+// timeSettings returns the column's time codec, which it is given if it has
+// none.  It panics if the column is not a time.
+func (c *ColumnMap) timeSettings() timeCodec {
+	if !isTime(c.gotype) {
+		panic(fmt.Sprintf("Column %s of type %s is not a time.Time", c.ColumnName, c.gotype))
+	}
+	tc, _ := c.codec.(timeCodec)
+	return tc
+}
+
+// SetTimeLayout stores the column's times as text formatted with layout,
+// as in time.Format, and parses them with it when they are read.  This
+// suits databases like sqlite without a native time type, and existing
+// schemas storing times in a particular format.  The column's field must
+// be a time.Time or *time.Time.
+//
+// Without a layout, times which the driver returns as text are parsed
+// with the formats the sqlite driver writes, or as a date.
+func (c *ColumnMap) SetTimeLayout(layout string) *ColumnMap {
+	tc := c.timeSettings()
+	tc.layout = layout
+	c.codec = tc
+	return c
+}
+
+// SetTimeLocation converts the column's times to loc, eg. time.UTC, when
+// they are written and read, and parses times stored without a zone in
+// it.  It overrides the DbMap's TimeLocation.  The column's field must be
+// a time.Time or *time.Time.
+func (c *ColumnMap) SetTimeLocation(loc *time.Location) *ColumnMap {
+	tc := c.timeSettings()
+	tc.loc = loc
+	c.codec = tc
+	return c
+}
+
+// SetZeroTimeNull writes zero times to the column as NULL, and reads NULL
+// as the zero time, so that a time.Time field can map a nullable column
+// without a wrapper like sql.NullTime.  A *time.Time field pointing to a
+// zero time is written as NULL too.  The column's field must be a
+// time.Time or *time.Time.
+func (c *ColumnMap) SetZeroTimeNull(b bool) *ColumnMap {
+	tc := c.timeSettings()
+	tc.zeroNull = b
+	c.codec = tc
+	return c
+}
+
+func isTime(t reflect.Type) bool {
+	return t == timeType || t == timePtrType
+}
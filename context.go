@@ -0,0 +1,102 @@
+package modl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying e, which is a DbMap or a
+// Transaction.  Code given the context can then use FromContext to run its
+// statements the same way whether or not it is part of a transaction:
+//
+//	ctx = modl.NewContext(ctx, dbmap)
+//	...
+//	tx, err := dbmap.Begin()
+//	err = createAccount(modl.NewContext(ctx, tx), account)
+//	...
+//	func createAccount(ctx context.Context, a *Account) error {
+//		return modl.FromContext(ctx).Insert(a)
+//	}
+func NewContext(ctx context.Context, e SqlExecutor) context.Context {
+	return context.WithValue(ctx, contextKey{}, e)
+}
+
+// FromContext returns a Queryer running statements with the DbMap or
+// Transaction most recently stored in ctx by NewContext, and with ctx as
+// if passed WithContext.  It returns nil if ctx carries neither.
+func FromContext(ctx context.Context) Queryer {
+	e, ok := ctx.Value(contextKey{}).(SqlExecutor)
+	if !ok {
+		return nil
+	}
+	return &contextQueryer{e: e, ctx: WithContext(ctx)}
+}
+
+// contextQueryer passes its context to each call of its executor.
+type contextQueryer struct {
+	e   SqlExecutor
+	ctx QueryOption
+}
+
+func (c *contextQueryer) Get(dest interface{}, keys ...interface{}) error {
+	return c.e.Get(dest, append(keys, c.ctx)...)
+}
+
+func (c *contextQueryer) GetBy(dest interface{}, key interface{}, opts ...QueryOption) error {
+	return c.e.GetBy(dest, key, append(opts, c.ctx)...)
+}
+
+func (c *contextQueryer) Insert(list ...interface{}) error {
+	return c.e.Insert(append(list, c.ctx)...)
+}
+
+func (c *contextQueryer) InsertResult(list ...interface{}) ([]RowResult, error) {
+	return c.e.InsertResult(append(list, c.ctx)...)
+}
+
+func (c *contextQueryer) Update(list ...interface{}) (int64, error) {
+	return c.e.Update(append(list, c.ctx)...)
+}
+
+func (c *contextQueryer) Delete(list ...interface{}) (int64, error) {
+	return c.e.Delete(append(list, c.ctx)...)
+}
+
+func (c *contextQueryer) Save(list ...interface{}) error {
+	return c.e.Save(append(list, c.ctx)...)
+}
+
+func (c *contextQueryer) Reload(list ...interface{}) error {
+	return c.e.Reload(append(list, c.ctx)...)
+}
+
+func (c *contextQueryer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.e.Exec(query, append(args, c.ctx)...)
+}
+
+func (c *contextQueryer) Select(dest interface{}, query string, args ...interface{}) error {
+	return c.e.Select(dest, query, append(args, c.ctx)...)
+}
+
+func (c *contextQueryer) SelectOne(dest interface{}, query string, args ...interface{}) error {
+	return c.e.SelectOne(dest, query, append(args, c.ctx)...)
+}
+
+func (c *contextQueryer) SelectKeyset(dest interface{}, query string, cursor KeysetCursor, args ...interface{}) (KeysetCursor, error) {
+	return c.e.SelectKeyset(dest, query, cursor, append(args, c.ctx)...)
+}
+
+func (c *contextQueryer) SelectToChannel(dest interface{}, query string, args ...interface{}) error {
+	cs, ok := c.e.(ChannelSelecter)
+	if !ok {
+		return fmt.Errorf("modl: %T cannot select to a channel", c.e)
+	}
+	return cs.SelectToChannel(dest, query, append(args, c.ctx)...)
+}
+
+func (c *contextQueryer) Exists(i interface{}, keys ...interface{}) (bool, error) {
+	return c.e.Exists(i, append(keys, c.ctx)...)
+}
@@ -0,0 +1,323 @@
+package modl
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSVOptions control the format ExportCSV writes and ImportCSV reads.
+type CSVOptions struct {
+	// Comma is the field delimiter, ',' if it is 0.  Use '\t' for TSV.
+	Comma rune
+	// NoHeader leaves out the header row of column names.  ImportCSV then
+	// reads the columns in the order of Columns, or of InsertColumnList.
+	NoHeader bool
+	// Columns are the columns to export or import, by column or field
+	// name.  ExportCSV writes the columns Get selects if it is empty.
+	Columns []string
+	// Null is the text written for NULL values, and read as NULL or the
+	// zero value.  It is the empty string by default.
+	Null string
+}
+
+func (o CSVOptions) comma() rune {
+	if o.Comma == 0 {
+		return ','
+	}
+	return o.Comma
+}
+
+// ExportCSV writes the table's rows matching where, a condition with
+// bindvars for args, or all of its rows if where is empty, to w as CSV,
+// with a header row of column names.  The rows are read with e, a DbMap or
+// Transaction, and written as they are read.  args may include a
+// CSVOptions to change the format, and QueryOptions.  Values are read
+// through the table's mapping, so encrypted columns are written decrypted,
+// and are written in the text form of their driver values;  times use
+// RFC 3339.  Returns the number of rows written.
+func (t *TableMap) ExportCSV(e SqlExecutor, w io.Writer, where string, args ...interface{}) (int64, error) {
+	var opts CSVOptions
+	var queryArgs []interface{}
+	for _, arg := range args {
+		switch o := arg.(type) {
+		case CSVOptions:
+			opts = o
+		case *CSVOptions:
+			opts = *o
+		default:
+			queryArgs = append(queryArgs, arg)
+		}
+	}
+	columns, err := t.csvColumns(opts.Columns, false)
+	if err != nil {
+		return -1, err
+	}
+
+	m := dbmapOf(e)
+	query := "select " + t.SelectColumnList("") + " from " + quoteTable(m.Dialect, t.qualifiedName())
+	if len(where) > 0 {
+		query += " where " + where
+	}
+	queryArgs, qopts := splitOptions(queryArgs)
+	query, queryArgs, err = m.rewrite(query, queryArgs, qopts)
+	if err != nil {
+		return -1, err
+	}
+	h, done := qopts.handleFor(e, true)
+	defer done()
+
+	rows, err := h.Queryx(query, queryArgs...)
+	if err != nil {
+		return -1, err
+	}
+	defer rows.Close()
+	s, err := m.newScanner(rows.Rows, t.gotype)
+	if err != nil {
+		return -1, err
+	}
+	defer s.release()
+	hooked := (t.CanPostGet && !qopts.noHooks) || len(t.relations) > 0
+
+	cw := csv.NewWriter(w)
+	cw.Comma = opts.comma()
+	record := make([]string, len(columns))
+	if !opts.NoHeader {
+		for i, col := range columns {
+			record[i] = col.ColumnName
+		}
+		if err := cw.Write(record); err != nil {
+			return -1, err
+		}
+	}
+	var n int64
+	for rows.Next() {
+		row := reflect.New(t.gotype)
+		if err := s.scan(row.Elem()); err != nil {
+			return n, err
+		}
+		if hooked {
+			if err := t.loaded(e, row.Interface(), qopts); err != nil {
+				return n, err
+			}
+		}
+		for i, col := range columns {
+			text, err := formatCSV(m, col, row.Elem().FieldByIndex(col.fieldIndex), opts.Null)
+			if err != nil {
+				return n, fmt.Errorf("column %s: %v", col.ColumnName, err)
+			}
+			record[i] = text
+		}
+		if err := cw.Write(record); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	cw.Flush()
+	return n, cw.Error()
+}
+
+// ImportCSV reads rows of the table from r, which is in the format written
+// by ExportCSV, and inserts them with m's CopyInsert.  The header row names
+// the column of each field, by column or field name;  fields equal to
+// opts.Null are NULL, or the zero value for fields which cannot be nil.
+// Returns the number of rows inserted.
+func (t *TableMap) ImportCSV(m *DbMap, r io.Reader, opts CSVOptions) (int64, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = opts.comma()
+	cr.ReuseRecord = true
+
+	names := opts.Columns
+	if !opts.NoHeader {
+		header, err := cr.Read()
+		if err != nil {
+			return -1, err
+		}
+		if len(names) == 0 {
+			names = append([]string{}, header...)
+		}
+	}
+	columns, err := t.csvColumns(names, true)
+	if err != nil {
+		return -1, err
+	}
+
+	rows := reflect.New(reflect.SliceOf(t.gotype)).Elem()
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return -1, err
+		}
+		if len(record) != len(columns) {
+			return -1, fmt.Errorf("modl: CSV row %d has %d fields, expected %d", line, len(record), len(columns))
+		}
+		elem := reflect.New(t.gotype).Elem()
+		for i, col := range columns {
+			if err := parseCSV(m, col, elem.FieldByIndex(col.fieldIndex), record[i], opts.Null); err != nil {
+				return -1, fmt.Errorf("modl: CSV row %d, column %s: %v", line, col.ColumnName, err)
+			}
+		}
+		rows = reflect.Append(rows, elem)
+	}
+	if rows.Len() == 0 {
+		return 0, nil
+	}
+	return m.CopyInsert(t, rows.Interface())
+}
+
+// csvColumns returns the columns named in names, by column or field name,
+// or the columns Get selects, or Insert writes if insert is true, if names
+// is empty.
+func (t *TableMap) csvColumns(names []string, insert bool) ([]*ColumnMap, error) {
+	var columns []*ColumnMap
+	if len(names) == 0 {
+		for _, col := range t.Columns {
+			if insert && col.isWritten() && !col.isAutoIncr || !insert && col.isSelected() {
+				columns = append(columns, col)
+			}
+		}
+		return columns, nil
+	}
+	for _, name := range names {
+		var found *ColumnMap
+		for _, col := range t.Columns {
+			if !col.Transient && (strings.EqualFold(col.ColumnName, name) || col.fieldName == name) {
+				found = col
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("modl: table %s has no column %s", t.TableName, name)
+		}
+		columns = append(columns, found)
+	}
+	return columns, nil
+}
+
+// formatCSV returns the text of field, a field of col, for a CSV record
+// written for m.
+func formatCSV(m *DbMap, col *ColumnMap, field reflect.Value, null string) (string, error) {
+	v := bindValue(field)
+	if codec := col.getCodec(m); codec != nil {
+		if _, ok := codec.(cipherCodec); !ok {
+			v = codec.bind(v)
+		}
+	}
+	dv, err := driver.DefaultParameterConverter.ConvertValue(v)
+	if err != nil {
+		return "", err
+	}
+	if dv == nil {
+		return null, nil
+	}
+	return formatText(dv), nil
+}
+
+// formatText returns the text of dv, a driver value which is not nil.
+func formatText(dv driver.Value) string {
+	switch x := dv.(type) {
+	case []byte:
+		return string(x)
+	case string:
+		return x
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	return fmt.Sprint(dv)
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// parseCSV sets field, a field of col, to the value of s, a field of a CSV
+// record read for m.
+func parseCSV(m *DbMap, col *ColumnMap, field reflect.Value, s, null string) error {
+	if s == null {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	return parseColumn(m, col, field, s)
+}
+
+// parseColumn sets field, a field of col, to the value of the text s, read
+// for m.
+func parseColumn(m *DbMap, col *ColumnMap, field reflect.Value, s string) error {
+	if codec := col.getCodec(m); codec != nil {
+		if _, ok := codec.(cipherCodec); !ok {
+			return codec.decode(field, s)
+		}
+	}
+	return parseField(field, s)
+}
+
+// parseField sets field to the value of s.
+func parseField(field reflect.Value, s string) error {
+	t := field.Type()
+	if t.Kind() == reflect.Ptr {
+		p := reflect.New(t.Elem())
+		if err := parseField(p.Elem(), s); err != nil {
+			return err
+		}
+		field.Set(p)
+		return nil
+	}
+	switch pt := reflect.PtrTo(t); {
+	case pt.Implements(scannerType):
+		return field.Addr().Interface().(sql.Scanner).Scan(s)
+	case pt.Implements(textUnmarshalerType):
+		return field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("cannot read a %v from CSV", t)
+		}
+		field.SetBytes([]byte(s))
+	default:
+		return fmt.Errorf("cannot read a %v from CSV", t)
+	}
+	return nil
+}
@@ -17,6 +17,9 @@ import (
 	"log"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/reflectx"
@@ -43,20 +46,96 @@ type DbMap struct {
 	// Dialect implementation to use with this map
 	Dialect Dialect
 
-	tables    []*TableMap
-	logger    *log.Logger
-	logPrefix string
-	mapper    *reflectx.Mapper
+	// Replica, if set, receives the reads (Get, Select, SelectOne) made on
+	// this map outside of a transaction.  Pass Primary() to a call to send
+	// it to Dbx instead.
+	Replica *sqlx.DB
+
+	// Annotator, if set, tags each statement with a comment describing
+	// where it came from.  See QueryAnnotator.
+	Annotator QueryAnnotator
+
+	// SlowQueryThreshold, if non-zero, reports statements which run for
+	// longer than it to SlowQueryLogger.
+	SlowQueryThreshold time.Duration
+	SlowQueryLogger    func(SlowQuery)
+	// SlowQuerySampleRate is the fraction of slow statements which are
+	// reported, between 0 and 1.  The default of 0 reports all of them.
+	SlowQuerySampleRate float64
+	// SlowQueryRedactArgs replaces bound values in reported statements.
+	SlowQueryRedactArgs bool
+	// SlowQueryExplain adds the plans of slow statements which were run
+	// outside of a transaction to their SlowQuery, by explaining them
+	// after they have run.  It is meant for development, as it makes slow
+	// statements slower still.  See Explain.
+	SlowQueryExplain bool
+
+	// CollectStats records statistics about the statements run through
+	// the DbMap by their fingerprint, which are returned by Stats.
+	CollectStats bool
+
+	// TimeLocation, if set, is the location time.Time fields are converted
+	// to when they are written and read, eg. time.UTC, unless their column
+	// sets its own with SetTimeLocation.
+	TimeLocation *time.Location
+
+	// RawQueries sends queries written by hand as they are, rather than
+	// rebinding their "?" bindvars for the Dialect, so they must use its
+	// own.  Rebound postgres queries must write jsonb's "?" operators as
+	// "??";  use Raw to send a single query as it is.  See QueryRewriter.
+	RawQueries bool
+
+	// AutoRegister maps the types of structs passed to Insert, Update,
+	// Delete, Save, Reload, Get, GetBy and Exists with Register if they
+	// have not been added to the DbMap, rather than failing.
+	AutoRegister bool
+
+	// UnsupportedFieldLogger, if set, is called for each field which
+	// AddTable makes transient because it cannot be stored in a column,
+	// eg. a map, channel or struct without a driver.Valuer.  It is called
+	// while the table is being added, so it must not add tables itself.
+	// If it is not set, each such field is logged as a warning, with the
+	// DbMap's logger if tracing is on or else the log package's.  Tag a
+	// field db:"-" to leave it out on purpose.
+	UnsupportedFieldLogger func(UnsupportedFieldError)
+
+	// FailoverLogger, if set, is called each time the DbMap moves from one
+	// of its primaries to another.  See SetPrimaries.
+	FailoverLogger func(FailoverEvent)
+
+	// DeadlockLogger, if set, is called with each statement which fails
+	// because of a deadlock, as recognized by a DeadlockDialect.  Deadlocks
+	// are also logged once tracing is turned on.
+	DeadlockLogger func(Deadlock)
+
+	// DeadlockRetries is the number of times InTransaction runs a function
+	// again when its transaction fails because of a deadlock.
+	DeadlockRetries int
+
+	schema         *Schema
+	schemaOnce     sync.Once
+	middleware     []func(next ExecFunc) ExecFunc
+	tracer         atomic.Value // *tracer
+	mapper         *reflectx.Mapper
+	defaultTimeout time.Duration
+	scanCache      sync.Map // scanKey -> [][]int
+	events         eventBus
+	cache          queryCache
+	stats          statsRegistry
+	dryRun         dryRun
+	primaries      *primaries
+	watchdog       *watchdog
 }
 
 // NewDbMap returns a new DbMap using the db connection and dialect.
 func NewDbMap(db *sql.DB, dialect Dialect) *DbMap {
-	return &DbMap{
+	m := &DbMap{
 		Db:      db,
 		Dialect: dialect,
 		Dbx:     sqlx.NewDb(db, dialect.DriverName()),
 		mapper:  reflectx.NewMapperFunc("db", sqlx.NameMapper),
 	}
+	return m.SetSchema(NewSchema())
 }
 
 // TraceOn turns on SQL statement logging for this DbMap.  After this is
@@ -65,20 +144,40 @@ func NewDbMap(db *sql.DB, dialect Dialect) *DbMap {
 // strings, which can aid in filtering log lines.
 //
 // Use TraceOn if you want to spy on the SQL statements that modl
-// generates.
+// generates.  It is equivalent to TraceOnLevel with LogArgs.
 func (m *DbMap) TraceOn(prefix string, logger *log.Logger) {
-	m.logger = logger
-	if len(prefix) == 0 {
-		m.logPrefix = prefix
-	} else {
-		m.logPrefix = prefix + " "
+	m.TraceOnLevel(prefix, logger, LogArgs)
+}
+
+// TraceOnLevel turns on logging for this DbMap at the given level.  See
+// TraceOn.  It is safe to call while the DbMap is in use.
+func (m *DbMap) TraceOnLevel(prefix string, logger *log.Logger, level LogLevel) {
+	if len(prefix) > 0 {
+		prefix += " "
 	}
+	m.tracer.Store(&tracer{logger: logger, prefix: prefix, level: level})
 }
 
-// TraceOff turns off tracing. It is idempotent.
+// SetLogLevel changes the level of logging turned on with TraceOn.  It is
+// safe to call while the DbMap is in use.
+func (m *DbMap) SetLogLevel(level LogLevel) {
+	if t := m.getTracer(); t != nil {
+		m.tracer.Store(&tracer{logger: t.logger, prefix: t.prefix, level: level})
+	}
+}
+
+// TraceOff turns off tracing. It is idempotent, and safe to call while
+// the DbMap is in use.
 func (m *DbMap) TraceOff() {
-	m.logger = nil
-	m.logPrefix = ""
+	m.tracer.Store(&tracer{})
+}
+
+// SetDefaultTimeout sets a timeout which is applied to every statement run
+// through this DbMap, and its transactions, unless the call already has a
+// deadline, eg. from WithTimeout or WithContext.  Set it to 0, the
+// default, for no timeout.  It should be set before the DbMap is used.
+func (m *DbMap) SetDefaultTimeout(d time.Duration) {
+	m.defaultTimeout = d
 }
 
 // AddTable registers the given interface type with modl. The table name
@@ -98,54 +197,122 @@ func (m *DbMap) AddTable(i interface{}, name ...string) *TableMap {
 		Name = TableNameMapper(t.Name())
 	}
 
+	schema := m.Schema()
+	schema.mu.Lock()
+	defer schema.mu.Unlock()
+
 	// check if we have a table for this type already
 	// if so, update the name and return the existing pointer
-	for i := range m.tables {
-		table := m.tables[i]
+	for i := range schema.tables {
+		table := schema.tables[i]
 		if table.gotype == t {
 			table.TableName = Name
 			return table
 		}
 	}
 
+	tmap := m.newTableMap(t, Name)
+	schema.tables = append(schema.tables, tmap)
+
+	return tmap
+}
+
+// newTableMap maps the struct type t to the table name, without adding it
+// to the DbMap.
+func (m *DbMap) newTableMap(t reflect.Type, Name string) *TableMap {
 	tmap := &TableMap{gotype: t, TableName: Name, dbmap: m, mapper: m.mapper}
-	tmap.setupHooks(i)
-
-	n := t.NumField()
-	tmap.Columns = make([]*ColumnMap, 0, n)
-	for i := 0; i < n; i++ {
-		f := t.Field(i)
-		columnName := f.Tag.Get("db")
-		if columnName == "" {
-			columnName = sqlx.NameMapper(f.Name)
-		}
+	tmap.setupHooks(reflect.New(t).Interface())
 
-		cm := &ColumnMap{
-			ColumnName: columnName,
-			Transient:  columnName == "-",
-			fieldName:  f.Name,
-			gotype:     f.Type,
-			table:      tmap,
-		}
-		tmap.Columns = append(tmap.Columns, cm)
+	tmap.Columns = make([]*ColumnMap, 0, t.NumField())
+	tmap.addColumns(t, nil, "", "")
+	tmap.markUnsupported()
+	for _, cm := range tmap.Columns {
 		if cm.fieldName == "Version" {
-			tmap.version = tmap.Columns[len(tmap.Columns)-1]
+			tmap.version = cm
 		}
 	}
-	m.tables = append(m.tables, tmap)
+	return tmap
+}
+
+// Register is like AddTable, but takes a struct or a pointer to one, and
+// sets up the table's key:  a column named "id" becomes its primary key,
+// auto-incrementing if it is an integer.  Other keys can be set with
+// SetKeys.  If i's type is already mapped, the existing *TableMap is
+// returned, renamed if name is given.
+//
+//	dbmap.Register(&User{}, "users")
+func (m *DbMap) Register(i interface{}, name ...string) *TableMap {
+	t := reflect.TypeOf(i)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return m.register(t, name...)
+}
+
+func (m *DbMap) register(t reflect.Type, name ...string) *TableMap {
+	schema := m.Schema()
+	schema.mu.Lock()
+	defer schema.mu.Unlock()
 
+	for _, table := range schema.tables {
+		if table.gotype == t {
+			if len(name) > 0 {
+				table.TableName = name[0]
+			}
+			return table
+		}
+	}
+
+	Name := TableNameMapper(t.Name())
+	if len(name) > 0 {
+		Name = name[0]
+	}
+	// the table is set up before it is added, so that it is complete when
+	// it is found by a concurrent auto-registration
+	tmap := m.newTableMap(t, Name)
+	for _, col := range tmap.Columns {
+		if col.ColumnName == "id" {
+			switch col.gotype.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				tmap.SetKeys(true, col.fieldName)
+			default:
+				tmap.SetKeys(false, col.fieldName)
+			}
+			break
+		}
+	}
+	schema.tables = append(schema.tables, tmap)
 	return tmap
+}
 
+// autoTable returns the table for i, a struct or pointer to a struct.  If
+// there is none, it is registered with Register if AutoRegister is set.
+func (m *DbMap) autoTable(i interface{}) *TableMap {
+	if table := m.TableFor(i); table != nil || !m.AutoRegister {
+		return table
+	}
+	t := reflect.TypeOf(i)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return m.register(t)
 }
 
 // AddTableWithName adds a new mapping of the interface to a table name.
+// The name may be qualified by a schema, as "schema.table".
 func (m *DbMap) AddTableWithName(i interface{}, name string) *TableMap {
 	return m.AddTable(i, name)
 }
 
-// CreateTablesSql returns create table SQL as a map of table names to
-// their associated CREATE TABLE statements.
-func (m *DbMap) CreateTablesSql() (map[string]string, error) {
+// CreateTablesSql returns the create table statements which CreateTables
+// would run, in the order the tables were added, without executing them.
+// Their text depends only on the tables' mappings and that order, so it
+// can be kept under version control and diffed from release to release;
+// see SetColumnOrder to keep it from following the order of struct fields.
+func (m *DbMap) CreateTablesSql() ([]string, error) {
 	return m.createTables(false, false)
 }
 
@@ -172,90 +339,153 @@ func writeColumnSql(sql *bytes.Buffer, col *ColumnMap) {
 		sql.WriteString(col.createSql)
 		return
 	}
-	sqltype := col.sqltype
-	if len(sqltype) == 0 {
-		sqltype = col.table.dbmap.Dialect.ToSqlType(col)
+	sql.WriteString(fmt.Sprintf("%s %s", col.table.dbmap.Dialect.QuoteField(col.ColumnName), col.SqlType()))
+	if len(col.collation) > 0 {
+		sql.WriteString(" collate " + col.collation)
 	}
-	sql.WriteString(fmt.Sprintf("%s %s", col.table.dbmap.Dialect.QuoteField(col.ColumnName), sqltype))
-	if col.isPK {
+	if col.isPK || col.notNull {
 		sql.WriteString(" not null")
-		if len(col.table.Keys) == 1 {
-			sql.WriteString(" primary key")
-		}
+	}
+	if col.isPK && len(col.table.Keys) == 1 {
+		sql.WriteString(" primary key")
 	}
 	if col.Unique {
 		sql.WriteString(" unique")
 	}
+	if len(col.generatedExpr) > 0 {
+		if gd, ok := col.table.dbmap.Dialect.(GeneratedColumnDialect); ok {
+			sql.WriteString(gd.GeneratedColumnStr(col.generatedExpr, col.generatedStored))
+		} else {
+			sql.WriteString(generatedColumnStr(col.generatedExpr, col.generatedStored))
+		}
+	}
+	if len(col.defaultExpr) > 0 {
+		sql.WriteString(" default " + col.defaultExpr)
+	}
+	if len(col.checkExpr) > 0 {
+		sql.WriteString(" check (" + col.checkExpr + ")")
+	}
+	if len(col.enumValues) > 0 && !supportsEnum(col.table.dbmap.Dialect) {
+		sql.WriteString(fmt.Sprintf(" check (%s in (%s))",
+			col.table.dbmap.Dialect.QuoteField(col.ColumnName), quoteValues(col.enumValues)))
+	}
 	if col.isAutoIncr {
-		sql.WriteString(" " + col.table.dbmap.Dialect.AutoIncrStr())
+		autoIncr := col.table.dbmap.Dialect.AutoIncrStr()
+		if td, ok := col.table.dbmap.Dialect.(TableDialect); ok {
+			autoIncr = td.ColumnAutoIncrStr(col)
+		}
+		if len(autoIncr) > 0 {
+			sql.WriteString(" " + autoIncr)
+		}
+	}
+	if cd, ok := col.table.dbmap.Dialect.(CommentDialect); ok && len(col.comment) > 0 {
+		sql.WriteString(cd.ColumnCommentStr(col.comment))
 	}
 }
 
-func (m *DbMap) createTables(ifNotExists, exec bool) (map[string]string, error) {
-	var err error
-	ret := map[string]string{}
+func (m *DbMap) createTables(ifNotExists, exec bool) ([]string, error) {
+	var ret []string
+	tables := distinctTables(m.Schema().Tables())
+	for i := range tables {
+		stmts := m.createTableSql(tables[i], ifNotExists, !exec)
+		if h := tables[i].historyTable(); h != nil {
+			stmts = append(stmts, m.createTableSql(h, ifNotExists, !exec)...)
+		}
+		for _, stmt := range stmts {
+			if exec {
+				if _, err := m.Exec(stmt); err != nil {
+					return ret, err
+				}
+			} else {
+				ret = append(ret, stmt)
+			}
+		}
+	}
+	return ret, nil
+}
 
+// createTableSql returns the statements creating table:  the create table
+// statement, laid out on several lines if pretty is true, and the
+// statement creating its search index, if any.
+func (m *DbMap) createTableSql(table *TableMap, ifNotExists, pretty bool) []string {
 	sep := ", "
 	prefix := ""
-	if !exec {
+	if pretty {
 		sep = ",\n"
 		prefix = "    "
 	}
 
-	for i := range m.tables {
-		table := m.tables[i]
-
-		s := bytes.Buffer{}
-		s.WriteString("create table ")
-		if ifNotExists {
-			s.WriteString("if not exists ")
-		}
-		s.WriteString(m.Dialect.QuoteField(table.TableName))
-		s.WriteString(" (")
-		if !exec {
-			s.WriteString("\n")
-		}
-		x := 0
-		for _, col := range table.Columns {
-			if !col.Transient {
-				if x > 0 {
-					s.WriteString(sep)
-				}
-				s.WriteString(prefix)
-				writeColumnSql(&s, col)
-				x++
+	s := bytes.Buffer{}
+	s.WriteString("create table ")
+	if ifNotExists {
+		s.WriteString("if not exists ")
+	}
+	s.WriteString(quoteTable(m.Dialect, table.qualifiedName()))
+	s.WriteString(" (")
+	if pretty {
+		s.WriteString("\n")
+	}
+	x := 0
+	for _, col := range m.createColumns(table) {
+		if !col.Transient {
+			if x > 0 {
+				s.WriteString(sep)
 			}
+			s.WriteString(prefix)
+			writeColumnSql(&s, col)
+			x++
 		}
-		if len(table.Keys) > 1 {
-			s.WriteString(", primary key (")
-			for x := range table.Keys {
-				if x > 0 {
-					s.WriteString(", ")
-				}
-				s.WriteString(m.Dialect.QuoteField(table.Keys[x].ColumnName))
+	}
+	if len(table.Keys) > 1 {
+		s.WriteString(", primary key (")
+		for x := range table.Keys {
+			if x > 0 {
+				s.WriteString(", ")
 			}
-			s.WriteString(")")
+			s.WriteString(m.Dialect.QuoteField(table.Keys[x].ColumnName))
 		}
-		s.WriteString(fmt.Sprintf(")%s;", m.Dialect.CreateTableSuffix()))
-		if exec {
-			_, err = m.Exec(s.String())
-			if err != nil {
-				break
-			}
-		} else {
-			ret[table.TableName] = s.String()
+		s.WriteString(")")
+	}
+	suffix := m.Dialect.CreateTableSuffix()
+	if td, ok := m.Dialect.(TableDialect); ok {
+		suffix = td.TableSuffix(table)
+	}
+	s.WriteString(fmt.Sprintf(")%s%s", suffix, m.terminator()))
+	stmts := []string{s.String()}
+	if cd, ok := m.Dialect.(CommentDialect); ok {
+		for _, stmt := range cd.CommentStatements(table) {
+			stmts = append(stmts, stmt+m.terminator())
+		}
+	}
+	if searcher, ok := m.Dialect.(Searcher); ok && len(table.search) > 0 {
+		if index := searcher.SearchIndex(table, ifNotExists); len(index) > 0 {
+			stmts = append(stmts, index+m.terminator())
+		}
+	}
+	return stmts
+}
+
+// DropTablesSql returns the drop table statements which DropTables would
+// run, in the order the tables were added, without executing them.
+func (m *DbMap) DropTablesSql() []string {
+	tables := distinctTables(m.Schema().Tables())
+	ret := make([]string, 0, len(tables))
+	for i := range tables {
+		table := tables[i]
+		ret = append(ret, fmt.Sprintf("drop table %s%s", quoteTable(m.Dialect, table.qualifiedName()), m.terminator()))
+		if h := table.historyTable(); h != nil {
+			ret = append(ret, fmt.Sprintf("drop table %s%s", quoteTable(m.Dialect, h.qualifiedName()), m.terminator()))
 		}
 	}
-	return ret, err
+	return ret
 }
 
 // DropTables iterates through TableMaps registered to this DbMap and
 // executes "drop table" statements against the database for each.
 func (m *DbMap) DropTables() error {
 	var err error
-	for i := range m.tables {
-		table := m.tables[i]
-		_, e := m.Exec(fmt.Sprintf("drop table %s;", m.Dialect.QuoteField(table.TableName)))
+	for _, query := range m.DropTablesSql() {
+		_, e := m.Exec(query)
 		if e != nil {
 			err = e
 		}
@@ -269,10 +499,21 @@ func (m *DbMap) DropTables() error {
 //
 // Hook functions PreInsert() and/or PostInsert() will be executed
 // before/after the INSERT statement if the interface defines them.
+//
+// QueryOptions such as ExplicitKeys may be passed along with list.
 func (m *DbMap) Insert(list ...interface{}) error {
 	return insert(m, m, list...)
 }
 
+// InsertResult inserts each element in list like Insert, but returns a
+// RowResult for each of them, with the rows affected, the generated key or
+// the error.  Unlike Insert, it carries on after an element fails, and
+// returns the first error along with the results.  The Batch option is
+// ignored.
+func (m *DbMap) InsertResult(list ...interface{}) ([]RowResult, error) {
+	return insertResult(m, m, list...)
+}
+
 // Update runs a SQL UPDATE statement for each element in list.  List
 // items must be pointers.
 //
@@ -283,6 +524,8 @@ func (m *DbMap) Insert(list ...interface{}) error {
 //
 // Returns an error if SetKeys has not been called on the TableMap or if
 // any interface in the list has not been registered with AddTable.
+//
+// QueryOptions such as Batch may be passed along with list.
 func (m *DbMap) Update(list ...interface{}) (int64, error) {
 	return update(m, m, list...)
 }
@@ -297,10 +540,33 @@ func (m *DbMap) Update(list ...interface{}) (int64, error) {
 //
 // Returns an error if SetKeys has not been called on the TableMap or if
 // any interface in the list has not been registered with AddTable.
+//
+// QueryOptions such as Batch may be passed along with list.
 func (m *DbMap) Delete(list ...interface{}) (int64, error) {
 	return deletes(m, m, list...)
 }
 
+// Save persists each element in list, which must be pointers, using Insert
+// for new rows and Update for existing ones.
+//
+// A row is new if its version column is 0, or, for tables without a
+// version column, if all of its primary keys hold zero values.  When an
+// Update of a table without a version column finds no row, the row is
+// inserted with its keys instead.
+func (m *DbMap) Save(list ...interface{}) error {
+	return save(m, m, list...)
+}
+
+// Reload re-reads each element in list, which must be pointers, from the
+// database using its primary keys, eg. after a concurrent modification or
+// an OptimisticLockError.  Hook function PostGet() will be executed after
+// each row is loaded if the interface defines it.
+//
+// Returns ErrNotFound if a row no longer exists.
+func (m *DbMap) Reload(list ...interface{}) error {
+	return reload(m, m, list...)
+}
+
 // Get runs a SQL SELECT to fetch a single row from the table based on the
 // primary key(s)
 //
@@ -312,14 +578,38 @@ func (m *DbMap) Delete(list ...interface{}) (int64, error) {
 // Hook function PostGet() will be executed
 // after the SELECT statement if the interface defines it.
 //
-// Returns a pointer to a struct that matches or nil if no row is found.
+// Returns ErrNotFound, which wraps sql.ErrNoRows, if no row is found.
 //
 // Returns an error if SetKeys has not been called on the TableMap or
 // if any interface in the list has not been registered with AddTable.
+//
+// QueryOptions may be passed along with the keys to tune the call.
 func (m *DbMap) Get(dest interface{}, keys ...interface{}) error {
 	return get(m, m, dest, keys...)
 }
 
+// GetBy is like Get, but takes the primary keys as the fields of key, a
+// struct whose fields have the same names as the key fields of dest's
+// table, or map to the same columns.  This is clearer than passing
+// composite keys in the order they were given to SetKeys:
+//
+//	type UserKey struct {
+//		OrgID int64
+//		Email string
+//	}
+//	err := dbmap.GetBy(&user, UserKey{OrgID: 1, Email: "x@example.com"})
+func (m *DbMap) GetBy(dest interface{}, key interface{}, opts ...QueryOption) error {
+	return getBy(m, m, dest, key, opts...)
+}
+
+// Exists returns true if the table of i, a struct or pointer to a struct,
+// has a row with the given primary key(s).  Like Get, it applies the
+// table's default scope, and QueryOptions may be passed along with the
+// keys.
+func (m *DbMap) Exists(i interface{}, keys ...interface{}) (bool, error) {
+	return exists(m, m, i, keys...)
+}
+
 // Select runs an arbitrary SQL query, binding the columns in the result
 // to fields on the struct specified by dest.  args represent the bind
 // parameters for the SQL statement.
@@ -341,6 +631,17 @@ func (m *DbMap) Get(dest interface{}, keys ...interface{}) error {
 // and nil returned.
 //
 // dest does NOT need to be registered with AddTable().
+//
+// A slice in args is expanded into a list of bindvars, so that queries like
+// "select * from t where id in (?)" may be passed a slice of ids.  Such
+// queries must use "?" bindvars, and are rebound for the Dialect.  If a
+// slice in an "in" condition has more values than the Dialect's
+// MaxBindParams allows, the query is run once for each chunk of them
+// which fits, and their rows are returned together, unless the query
+// orders, limits, groups or aggregates its rows, or has an "or" or
+// negated condition.
+//
+// QueryOptions may be passed along with args to tune the call.
 func (m *DbMap) Select(dest interface{}, query string, args ...interface{}) error {
 	return hookedselect(m, m, dest, query, args...)
 }
@@ -352,25 +653,61 @@ func (m *DbMap) SelectOne(dest interface{}, query string, args ...interface{}) e
 }
 
 // Exec runs an arbitrary SQL statement.  args represent the bind parameters.
-// This is equivalent to running Exec() using database/sql.
+// This is equivalent to running Exec() using database/sql.  Slices in args
+// are expanded as they are by Select, and split the same way if they are
+// too long, in which case the result holds the number of rows affected by
+// all of the statements run;  they are not atomic, so run it in a
+// Transaction so that they are all or nothing.  QueryOptions may be passed
+// along with args to tune the call.
 func (m *DbMap) Exec(query string, args ...interface{}) (sql.Result, error) {
-	m.trace(query, args)
-	//stmt, err := m.Db.Prepare(query)
-	//if err != nil {
-	//	return nil, err
-	//}
-	//fmt.Println("Exec", query, args)
-	return m.Db.Exec(query, args...)
+	if chunks := m.splitIn(query, args, false); chunks != nil {
+		return execChunks(m, query, chunks)
+	}
+	args, opts := splitOptions(args)
+	query, args, err := m.rewrite(query, args, opts)
+	if err != nil {
+		return nil, err
+	}
+	h, done := opts.handleFor(m, false)
+	defer done()
+	res, err := h.Exec(query, args...)
+	if !m.cache.empty() {
+		m.written(m, m.tablesIn(query)...)
+	}
+	return res, err
 }
 
 // Begin starts a modl Transaction.
 func (m *DbMap) Begin() (*Transaction, error) {
 	m.trace("begin;")
-	tx, err := m.Dbx.Beginx()
+	var tx *sqlx.Tx
+	err := m.onPrimary(func(db *sqlx.DB) error {
+		return m.retry(func() (err error) {
+			tx, err = db.Beginx()
+			return err
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &Transaction{m, tx}, nil
+	return &Transaction{dbmap: m, Tx: tx}, nil
+}
+
+// retry runs fn, running it again for as long as the Dialect considers
+// the errors it returns transient.  See Retrier.
+func (m *DbMap) retry(fn func() error) error {
+	r, ok := m.Dialect.(Retrier)
+	if !ok {
+		return fn()
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		delay, again := r.RetryDelay(attempt, err)
+		if !again {
+			return err
+		}
+		time.Sleep(delay)
+	}
 }
 
 // FIXME: This is a poor interface.  Checking for nils is un-go-like, and this
@@ -405,7 +742,7 @@ start:
 
 // TableForType returns any matching tables for the type t or nil if not found.
 func (m *DbMap) TableForType(t reflect.Type) *TableMap {
-	for _, table := range m.tables {
+	for _, table := range m.Schema().Tables() {
 		if table.gotype == t {
 			return table
 		}
@@ -427,18 +764,19 @@ func (m *DbMap) TruncateTablesIdentityRestart() error {
 func (m *DbMap) truncateTables(restartIdentity bool) error {
 	var err error
 	var restartClause string
-	for i := range m.tables {
-		table := m.tables[i]
+	tables := distinctTables(m.Schema().Tables())
+	for i := range tables {
+		table := tables[i]
 		if restartIdentity {
-			restartClause = m.Dialect.RestartIdentityClause(table.TableName)
+			restartClause = m.Dialect.RestartIdentityClause(table.qualifiedName())
 		}
 
 		// if the restart clause exists and starts with ';', then assume it's an
 		// additional query to run after we truncate.  This is true with MySQL and
 		// SQLite, which do not have extra clauses for this during table truncation.
 		if len(restartClause) > 0 && restartClause[0] == ';' {
-			_, err = m.Exec(fmt.Sprintf("%s %s;", m.Dialect.TruncateClause(),
-				m.Dialect.QuoteField(table.TableName)))
+			_, err = m.Exec(fmt.Sprintf("%s %s%s", m.Dialect.TruncateClause(),
+				quoteTable(m.Dialect, table.qualifiedName()), m.terminator()))
 			if err != nil {
 				return err
 			}
@@ -447,7 +785,7 @@ func (m *DbMap) truncateTables(restartIdentity bool) error {
 				return err
 			}
 		} else {
-			_, err := m.Exec(fmt.Sprintf("%s %s %s;", m.Dialect.TruncateClause(), m.Dialect.QuoteField(table.TableName), restartClause))
+			_, err := m.Exec(fmt.Sprintf("%s %s %s%s", m.Dialect.TruncateClause(), quoteTable(m.Dialect, table.qualifiedName()), restartClause, m.terminator()))
 			if err != nil {
 				return err
 			}
@@ -457,11 +795,5 @@ func (m *DbMap) truncateTables(restartIdentity bool) error {
 }
 
 func (m *DbMap) handle() handle {
-	return &tracingHandle{h: m.Dbx, d: m}
-}
-
-func (m *DbMap) trace(query string, args ...interface{}) {
-	if m.logger != nil {
-		m.logger.Printf("%s%s %v", m.logPrefix, query, args)
-	}
+	return newHandle(m, m.primary())
 }
@@ -0,0 +1,261 @@
+package modl
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DeadlockDialect is implemented by dialects which can recognize the
+// errors of statements chosen as the victims of a deadlock, and find the
+// statements of the other transactions in it.  See DeadlockLogger and
+// InTransaction.
+type DeadlockDialect interface {
+	IsDeadlock(err error) bool
+	// DeadlockPeers returns the statements which the other transactions
+	// in the deadlock reported by err were running, as far as they can be
+	// found with db.
+	DeadlockPeers(ctx context.Context, db *sqlx.DB, err error) ([]string, error)
+}
+
+// A DeadlockStatement is a statement which took part in a deadlock, by
+// its Fingerprint and the names of the DbMap's tables it refers to.
+type DeadlockStatement struct {
+	Fingerprint string
+	Tables      []string
+}
+
+// A Deadlock reports a statement which failed because it was chosen as
+// the victim of a deadlock.  See DbMap.DeadlockLogger.
+type Deadlock struct {
+	Statement DeadlockStatement
+	// Peers are the statements of the other transactions in the deadlock,
+	// if the Dialect could find them.
+	Peers []DeadlockStatement
+	// InTx is true if the statement was run in a Transaction.
+	InTx bool
+	Err  error
+}
+
+// String returns the deadlock's statements and tables, as it is traced.
+func (d Deadlock) String() string {
+	var b strings.Builder
+	b.WriteString("deadlock: ")
+	b.WriteString(d.Statement.String())
+	for _, p := range d.Peers {
+		b.WriteString(" with ")
+		b.WriteString(p.String())
+	}
+	return b.String()
+}
+
+func (s DeadlockStatement) String() string {
+	return s.Fingerprint + " [" + strings.Join(s.Tables, ", ") + "]"
+}
+
+// deadlocked reports query, which failed with err, if err is a deadlock,
+// to the trace log and DeadlockLogger.
+func (m *DbMap) deadlocked(query string, inTx bool, err error) {
+	d, ok := m.Dialect.(DeadlockDialect)
+	if !ok || err == nil || !d.IsDeadlock(err) {
+		return
+	}
+	t := m.getTracer()
+	if t == nil && m.DeadlockLogger == nil {
+		return
+	}
+	dl := Deadlock{Statement: m.deadlockStatement(query), InTx: inTx, Err: err}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if peers, err := d.DeadlockPeers(ctx, m.primary(), err); err == nil {
+		for _, peer := range peers {
+			dl.Peers = append(dl.Peers, m.deadlockStatement(peer))
+		}
+	}
+	if t != nil {
+		t.logger.Printf("%s%s", t.prefix, dl)
+	}
+	if m.DeadlockLogger != nil {
+		m.DeadlockLogger(dl)
+	}
+}
+
+func (m *DbMap) deadlockStatement(query string) DeadlockStatement {
+	return DeadlockStatement{Fingerprint: Fingerprint(query), Tables: m.tablesIn(query)}
+}
+
+// isDeadlock returns true if the Dialect recognizes err as a deadlock.
+func (m *DbMap) isDeadlock(err error) bool {
+	d, ok := m.Dialect.(DeadlockDialect)
+	return ok && err != nil && d.IsDeadlock(err)
+}
+
+// InTransaction runs fn in a new transaction, which is committed if fn
+// returns nil, and rolled back otherwise.  If fn or the commit fail
+// because of a deadlock, as recognized by a DeadlockDialect, the
+// transaction is rolled back and fn is run again in a new one, up to
+// DeadlockRetries times, after a short random delay.  They are run again
+// as well after errors the Dialect's Retrier considers transient, like a
+// busy sqlite database, as often and as late as it says.  fn must not
+// have effects outside of the transaction which it cannot repeat.  If fn
+// panics, the transaction is rolled back before the panic continues.
+func (m *DbMap) InTransaction(fn func(tx *Transaction) error) error {
+	deadlocks, retries := 0, 0
+	for {
+		err := m.runTransaction(fn)
+		if err == nil {
+			return nil
+		}
+		if m.isDeadlock(err) && deadlocks < m.DeadlockRetries {
+			time.Sleep(time.Duration(rand.Int63n(int64(10*time.Millisecond) << uint(deadlocks))))
+			deadlocks++
+			continue
+		}
+		r, ok := m.Dialect.(Retrier)
+		if !ok {
+			return err
+		}
+		retries++
+		delay, again := r.RetryDelay(retries, err)
+		if !again {
+			return err
+		}
+		time.Sleep(delay)
+	}
+}
+
+// runTransaction runs fn in a new transaction, which is committed if fn
+// returns nil, and rolled back if it fails or panics.
+func (m *DbMap) runTransaction(fn func(tx *Transaction) error) (err error) {
+	tx, err := m.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsDeadlock recognizes deadlock_detected errors.
+func (d PostgresDialect) IsDeadlock(err error) bool {
+	var e interface{ SQLState() string }
+	return errors.As(err, &e) && e.SQLState() == "40P01"
+}
+
+// pgDeadlockProcess matches the processes in the detail of postgres'
+// deadlock errors, the first of which is the victim.
+var pgDeadlockProcess = regexp.MustCompile(`(?m)^Process (\d+) waits`)
+
+// DeadlockPeers returns the statements of the other processes in the
+// deadlock, from pg_stat_activity.  They are the statements those
+// processes are running or, if they have finished, last ran.
+func (d PostgresDialect) DeadlockPeers(ctx context.Context, db *sqlx.DB, err error) ([]string, error) {
+	var pids []string
+	for i, match := range pgDeadlockProcess.FindAllStringSubmatch(pgErrorDetail(err), -1) {
+		if i > 0 {
+			pids = append(pids, match[1])
+		}
+	}
+	if len(pids) == 0 {
+		return nil, nil
+	}
+	var peers []string
+	err = db.SelectContext(ctx, &peers, "select query from pg_stat_activity where pid in ("+strings.Join(pids, ", ")+")")
+	return peers, err
+}
+
+// pgErrorDetail returns the detail of err, a postgres error, so that modl
+// does not depend on a particular postgres driver:  lib/pq's errors return
+// their fields from Get, and pgx's hold it in a Detail field.
+func pgErrorDetail(err error) string {
+	var e interface{ SQLState() string }
+	if !errors.As(err, &e) {
+		return ""
+	}
+	if pq, ok := e.(interface{ Get(k byte) string }); ok {
+		return pq.Get('D')
+	}
+	v := reflect.Indirect(reflect.ValueOf(e))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	if f := v.FieldByName("Detail"); f.Kind() == reflect.String {
+		return f.String()
+	}
+	return ""
+}
+
+// IsDeadlock recognizes ER_LOCK_DEADLOCK errors by their text, so that
+// modl does not depend on a particular mysql driver.
+func (d MySQLDialect) IsDeadlock(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Error 1213")
+}
+
+// DeadlockPeers returns the statements of the transactions in the latest
+// deadlock detected by InnoDB which were not rolled back, from show engine
+// innodb status, which needs the PROCESS privilege.
+func (d MySQLDialect) DeadlockPeers(ctx context.Context, db *sqlx.DB, err error) ([]string, error) {
+	var status struct {
+		Type, Name, Status string
+	}
+	if err := db.QueryRowxContext(ctx, "show engine innodb status").Scan(&status.Type, &status.Name, &status.Status); err != nil {
+		return nil, err
+	}
+	return innodbDeadlockPeers(status.Status), nil
+}
+
+// innodbDeadlockPeers returns the statements of the transactions which
+// were not rolled back in the "latest detected deadlock" section of
+// InnoDB's status.  Each transaction's statement follows the line with its
+// thread id.
+func innodbDeadlockPeers(status string) []string {
+	i := strings.Index(status, "LATEST DETECTED DEADLOCK")
+	if i < 0 {
+		return nil
+	}
+	var queries, query []string
+	inQuery := false
+	victim := -1
+lines:
+	for _, line := range strings.Split(status[i:], "\n") {
+		switch {
+		case line == "TRANSACTIONS":
+			// the next section
+			break lines
+		case strings.HasPrefix(line, "MySQL thread id"):
+			inQuery, query = true, nil
+		case strings.HasPrefix(line, "*** WE ROLL BACK TRANSACTION ("):
+			n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, "*** WE ROLL BACK TRANSACTION ("), ")"))
+			victim = n - 1
+		case strings.HasPrefix(line, "***"):
+			if inQuery {
+				queries = append(queries, strings.Join(query, "\n"))
+			}
+			inQuery = false
+		case inQuery:
+			query = append(query, line)
+		}
+	}
+	var peers []string
+	for i, q := range queries {
+		if i != victim {
+			peers = append(peers, q)
+		}
+	}
+	return peers
+}
@@ -0,0 +1,110 @@
+package modl
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// A Decimal is an exact number, such as a shopspring/decimal Decimal or a
+// wrapper around math/big.Rat, mapped to a numeric column.  The field may
+// be of a type whose pointer is a Decimal, or a pointer to one for a
+// nullable column.
+//
+// Decimals are written as the text returned by String, which must be in
+// decimal notation, eg. big.Rat's FloatString rather than its String, and
+// read with UnmarshalText.  Drivers returning numerics as float64, like
+// sqlite's, have them formatted with the fewest digits which read back as
+// the same float64, so values within its precision are read exactly.
+// Float64 is not used, but tells Decimals apart from other types which
+// can be written as text, like time.Time.
+type Decimal interface {
+	String() string
+	UnmarshalText(text []byte) error
+	Float64() (f float64, exact bool)
+}
+
+var decimalType = reflect.TypeOf((*Decimal)(nil)).Elem()
+
+// isDecimal returns true if fields of type t hold a Decimal.
+func isDecimal(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return reflect.PtrTo(t).Implements(decimalType)
+}
+
+// decimalCodec converts the values of Decimal columns.
+type decimalCodec struct{}
+
+func (decimalCodec) bind(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil
+	}
+	p := reflect.New(rv.Type())
+	p.Elem().Set(rv)
+	return p.Interface().(Decimal).String()
+}
+
+func (decimalCodec) decode(field reflect.Value, src interface{}) error {
+	var text []byte
+	switch s := src.(type) {
+	case nil:
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	case []byte:
+		text = s
+	case string:
+		text = []byte(s)
+	case int64:
+		text = strconv.AppendInt(nil, s, 10)
+	case float64:
+		text = strconv.AppendFloat(nil, s, 'f', -1, 64)
+	default:
+		return fmt.Errorf("cannot convert a %T to a decimal", src)
+	}
+	t := field.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	p := reflect.New(t)
+	if err := p.Interface().(Decimal).UnmarshalText(text); err != nil {
+		return err
+	}
+	if field.Kind() == reflect.Ptr {
+		field.Set(p)
+	} else {
+		field.Set(p.Elem())
+	}
+	return nil
+}
+
+// SetPrecision sets the total number of digits, and the number of digits
+// after the decimal point, of the column, which CreateTables then creates
+// as numeric(precision,scale).  Columns holding a Decimal without a
+// precision are created as numeric, or in MySQL, whose numerics default to
+// integers, as decimal(65,30).
+func (c *ColumnMap) SetPrecision(precision, scale int) *ColumnMap {
+	c.Precision = precision
+	c.Scale = scale
+	return c
+}
+
+// numericType returns the type of a column with a precision, unsized for
+// a Decimal column without one, or "" for other columns.
+func numericType(col *ColumnMap, unsized string) string {
+	switch {
+	case col.Precision > 0:
+		return fmt.Sprintf("numeric(%d,%d)", col.Precision, col.Scale)
+	case isDecimal(col.gotype):
+		return unsized
+	}
+	return ""
+}
@@ -1,10 +1,12 @@
 package modl
 
 import (
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -58,6 +60,161 @@ type Dialect interface {
 
 	// DriverName returns the driver name for a dialect.
 	DriverName() string
+
+	// SupportsReturning reports whether insert, update and delete statements
+	// may end in a "returning" clause.
+	SupportsReturning() bool
+
+	// SupportsLastInsertId reports whether sql.Result.LastInsertId returns
+	// the value generated for an auto-increment column.
+	SupportsLastInsertId() bool
+
+	// SupportsSavepoints reports whether transactions may be nested using
+	// savepoints.
+	SupportsSavepoints() bool
+
+	// MaxBindParams returns the maximum number of bind parameters allowed in
+	// a single statement.
+	MaxBindParams() int
+}
+
+// TableDialect is implemented by dialects whose create table statements
+// depend on the table being created.  When a Dialect implements it,
+// CreateTables uses these methods in place of CreateTableSuffix and
+// AutoIncrStr.
+type TableDialect interface {
+	// TableSuffix returns the string to append to the create table
+	// statement for t.
+	TableSuffix(t *TableMap) string
+
+	// ColumnAutoIncrStr returns the string to append to the definition of
+	// the auto-increment column c.
+	ColumnAutoIncrStr(c *ColumnMap) string
+}
+
+// TableQuoter is implemented by dialects which quote table names
+// differently than their fields.  Otherwise a table name qualified by a
+// schema, as "schema.table", has each of its parts quoted with QuoteField.
+type TableQuoter interface {
+	// QuoteTable returns a quoted version of the table name.
+	QuoteTable(table string) string
+}
+
+// EnumDialect is implemented by dialects which have a native enum type.
+// Otherwise CreateTables restricts the values of columns with enum values
+// with a check constraint.
+type EnumDialect interface {
+	// SupportsEnum reports whether ToSqlType returns a native enum type
+	// for columns with enum values.
+	SupportsEnum() bool
+}
+
+// supportsEnum reports whether d has a native enum type.
+func supportsEnum(d Dialect) bool {
+	e, ok := d.(EnumDialect)
+	return ok && e.SupportsEnum()
+}
+
+// DefaultValuesDialect is implemented by dialects which do not support
+// "default values" for inserts which leave every column to its default.
+type DefaultValuesDialect interface {
+	// DefaultValues returns what follows the table name in an insert
+	// which writes no columns, eg. "() values ()".
+	DefaultValues() string
+}
+
+// defaultValues returns what follows the table name in an insert which
+// writes no columns with d.
+func defaultValues(d Dialect) string {
+	if dv, ok := d.(DefaultValuesDialect); ok {
+		return dv.DefaultValues()
+	}
+	return "default values"
+}
+
+// quoteTable quotes table, which may be qualified by a schema, with d.
+func quoteTable(d Dialect, table string) string {
+	if q, ok := d.(TableQuoter); ok {
+		return q.QuoteTable(table)
+	}
+	parts := strings.Split(table, ".")
+	for i, p := range parts {
+		parts[i] = d.QuoteField(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// unqualified returns table without its schema.
+func unqualified(table string) string {
+	return table[strings.LastIndex(table, ".")+1:]
+}
+
+// CommentDialect is implemented by dialects which can store comments on
+// tables and columns.  See TableMap.SetComment and ColumnMap.SetComment.
+type CommentDialect interface {
+	// ColumnCommentStr returns the string to append to the definition of
+	// a column with comment, if comments are part of it.
+	ColumnCommentStr(comment string) string
+
+	// CommentStatements returns the statements storing the comments of t
+	// and its columns which are not part of its create table statement,
+	// without terminators;  they are ended like the other statements modl
+	// generates.  See Terminator.
+	CommentStatements(t *TableMap) []string
+}
+
+// Retrier is implemented by dialects which can recognize transient errors
+// that are worth retrying, such as a busy or locked database.
+type Retrier interface {
+	// RetryDelay returns how long to wait before making retry number
+	// attempt (starting at 1) of an operation which failed with err, and
+	// false if it should not be retried.
+	RetryDelay(attempt int, err error) (time.Duration, bool)
+}
+
+// GeneratedColumnDialect is implemented by dialects whose generated
+// column definitions differ from the standard "generated always as (expr)
+// stored" or "virtual".  See ColumnMap.SetGenerated.
+type GeneratedColumnDialect interface {
+	// GeneratedColumnStr returns the string to append to the definition of
+	// a column generated from expr.
+	GeneratedColumnStr(expr string, stored bool) string
+}
+
+// generatedColumnStr returns the standard definition of a column generated
+// from expr.
+func generatedColumnStr(expr string, stored bool) string {
+	if stored {
+		return " generated always as (" + expr + ") stored"
+	}
+	return " generated always as (" + expr + ") virtual"
+}
+
+// GeneratedColumnStr always returns a stored column, as postgres before
+// version 18 cannot compute generated columns when they are read.
+func (d PostgresDialect) GeneratedColumnStr(expr string, stored bool) string {
+	return generatedColumnStr(expr, true)
+}
+
+// quoteValues returns vals as a comma separated list of string literals.
+func quoteValues(vals []string) string {
+	quoted := make([]string, len(vals))
+	for i, v := range vals {
+		quoted[i] = "'" + strings.Replace(v, "'", "''", -1) + "'"
+	}
+	return strings.Join(quoted, ",")
+}
+
+// VersionChecker is implemented by dialects which can verify that they
+// support the version of the database server they are connected to.  It
+// is used by DbMap.HealthCheck.
+type VersionChecker interface {
+	// VersionQuery returns a query which selects the server's version.
+	VersionQuery() string
+
+	// CheckVersion returns an error if version, as returned by the
+	// VersionQuery, is not supported.
+	CheckVersion(version string) error
 }
 
 func standardInsertAutoIncr(e SqlExecutor, insertSql string, params ...interface{}) (int64, error) {
@@ -85,6 +242,16 @@ func standardAutoIncrAny(e SqlExecutor, insertSql string, dest interface{}, para
 // SqliteDialect implements the Dialect interface for Sqlite3.
 type SqliteDialect struct {
 	suffix string
+
+	// BusyRetries is the number of times statements which fail because
+	// the database is busy or locked are retried.  Statements run inside
+	// of a transaction, and commits, are not retried;  InTransaction runs
+	// the whole transaction again instead.
+	BusyRetries int
+
+	// BusyBackoff is the delay before the first retry, which doubles on
+	// each further attempt.  It defaults to 10ms.
+	BusyBackoff time.Duration
 }
 
 // DriverName returns the driverName for sqlite.
@@ -94,14 +261,23 @@ func (d SqliteDialect) DriverName() string {
 
 // ToSqlType maps go types to sqlite types.
 func (d SqliteDialect) ToSqlType(col *ColumnMap) string {
-	switch col.gotype.Kind() {
-	case reflect.Bool:
+	// only a column declared as exactly "integer primary key" is an alias
+	// for the rowid and can be autoincrement
+	if col.isAutoIncr {
 		return "integer"
+	}
+	if t := numericType(col, "numeric"); t != "" {
+		return t
+	}
+	if isBool(col.gotype) {
+		return "integer"
+	}
+	switch col.gotype.Kind() {
 	case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return "integer"
 	case reflect.Float64, reflect.Float32:
 		return "real"
-	case reflect.Slice:
+	case reflect.Slice, reflect.Array:
 		if col.gotype.Elem().Kind() == reflect.Uint8 {
 			return "blob"
 		}
@@ -112,7 +288,7 @@ func (d SqliteDialect) ToSqlType(col *ColumnMap) string {
 		return "integer"
 	case "NullableFloat64":
 		return "real"
-	case "NullableBool":
+	case "NullBool", "NullableBool":
 		return "integer"
 	case "NullableBytes":
 		return "blob"
@@ -144,6 +320,54 @@ func (d SqliteDialect) CreateTableSuffix() string {
 	return d.suffix
 }
 
+// TableSuffix returns d.suffix, followed by "without rowid" for tables which
+// have been marked with SetWithoutRowID.
+func (d SqliteDialect) TableSuffix(t *TableMap) string {
+	if t.WithoutRowID {
+		return d.suffix + " without rowid"
+	}
+	return d.suffix
+}
+
+// ColumnAutoIncrStr returns "autoincrement" for a column which is the sole
+// primary key of a rowid table, and "" otherwise, as sqlite does not allow
+// autoincrement anywhere else.
+func (d SqliteDialect) ColumnAutoIncrStr(c *ColumnMap) string {
+	if c.table.WithoutRowID || len(c.table.Keys) != 1 {
+		return ""
+	}
+	return d.AutoIncrStr()
+}
+
+// RetryDelay retries errors caused by a busy or locked database up to
+// BusyRetries times, with an exponential backoff.
+func (d SqliteDialect) RetryDelay(attempt int, err error) (time.Duration, bool) {
+	if attempt > d.BusyRetries || !isSqliteBusy(err) {
+		return 0, false
+	}
+	backoff := d.BusyBackoff
+	if backoff <= 0 {
+		backoff = 10 * time.Millisecond
+	}
+	return backoff << uint(attempt-1), true
+}
+
+// isSqliteBusy returns true if err was caused by SQLITE_BUSY or
+// SQLITE_LOCKED.  The error text is used so that modl does not depend on
+// a particular sqlite driver.
+func isSqliteBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, s := range []string{"database is locked", "database table is locked", "SQLITE_BUSY", "SQLITE_LOCKED"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
 // BindVar returns "?", the simpler of the sqlite bindvars.
 func (d SqliteDialect) BindVar(i int) string {
 	return "?"
@@ -158,9 +382,9 @@ func (d SqliteDialect) InsertAutoIncrAny(e SqlExecutor, insertSql string, dest i
 	return standardAutoIncrAny(e, insertSql, dest, params...)
 }
 
-// QuoteField quotes f with "" for sqlite
+// QuoteField quotes f with "" for sqlite, doubling any quotes in f.
 func (d SqliteDialect) QuoteField(f string) string {
-	return `"` + f + `"`
+	return `"` + strings.Replace(f, `"`, `""`, -1) + `"`
 }
 
 // TruncateClause returns the truncate clause for sqlite.  There is no TRUNCATE
@@ -173,7 +397,38 @@ func (d SqliteDialect) TruncateClause() string {
 // RestartIdentityClause restarts the sqlite_sequence for the provided table.
 // It is executed by TruncateTable as a separate query.
 func (d SqliteDialect) RestartIdentityClause(table string) string {
-	return "; DELETE FROM sqlite_sequence WHERE name='" + table + "'"
+	return "; DELETE FROM sqlite_sequence WHERE name=" + quoteValues([]string{unqualified(table)})
+}
+
+// SupportsReturning returns false, as "returning" requires sqlite 3.35.
+func (d SqliteDialect) SupportsReturning() bool {
+	return false
+}
+
+// SupportsLastInsertId returns true.
+func (d SqliteDialect) SupportsLastInsertId() bool {
+	return true
+}
+
+// SupportsSavepoints returns true.
+func (d SqliteDialect) SupportsSavepoints() bool {
+	return true
+}
+
+// MaxBindParams returns 999, the default SQLITE_MAX_VARIABLE_NUMBER prior to
+// sqlite 3.32.
+func (d SqliteDialect) MaxBindParams() int {
+	return 999
+}
+
+// VersionQuery selects sqlite_version().
+func (d SqliteDialect) VersionQuery() string {
+	return "select sqlite_version();"
+}
+
+// CheckVersion requires sqlite 3.8.2, which added without rowid tables.
+func (d SqliteDialect) CheckVersion(version string) error {
+	return checkMinVersion("sqlite", version, "3.8.2")
 }
 
 // -- PostgreSQL
@@ -190,10 +445,14 @@ func (d PostgresDialect) DriverName() string {
 
 // ToSqlType maps go types to postgres types.
 func (d PostgresDialect) ToSqlType(col *ColumnMap) string {
+	if t := numericType(col, "numeric"); t != "" {
+		return t
+	}
 
-	switch col.gotype.Kind() {
-	case reflect.Bool:
+	if isBool(col.gotype) {
 		return "boolean"
+	}
+	switch col.gotype.Kind() {
 	case reflect.Int, reflect.Int16, reflect.Int32, reflect.Uint16, reflect.Uint32:
 		if col.isAutoIncr {
 			return "serial"
@@ -206,7 +465,8 @@ func (d PostgresDialect) ToSqlType(col *ColumnMap) string {
 		return "bigint"
 	case reflect.Float64, reflect.Float32:
 		return "real"
-	case reflect.Slice:
+	case reflect.Slice, reflect.Array:
+		// bytea has no length, so MaxSize is not used
 		if col.gotype.Elem().Kind() == reflect.Uint8 {
 			return "bytea"
 		}
@@ -217,11 +477,13 @@ func (d PostgresDialect) ToSqlType(col *ColumnMap) string {
 		return "bigint"
 	case "NullableFloat64":
 		return "double"
+	case "NullBool":
+		return "boolean"
 	case "NullableBool":
 		return "smallint"
 	case "NullableBytes":
 		return "bytea"
-	case "Time", "Nulltime":
+	case "Time", "NullTime":
 		return "timestamp with time zone"
 	}
 
@@ -280,9 +542,9 @@ func (d PostgresDialect) InsertAutoIncrAny(e SqlExecutor, insertSql string, dest
 	return standardAutoIncrAny(e, insertSql, dest, params...)
 }
 
-// QuoteField quotes f with ""
+// QuoteField quotes f with "", doubling any quotes in f.
 func (d PostgresDialect) QuoteField(f string) string {
-	return `"` + sqlx.NameMapper(f) + `"`
+	return `"` + strings.Replace(sqlx.NameMapper(f), `"`, `""`, -1) + `"`
 }
 
 // TruncateClause returns 'truncate'
@@ -290,12 +552,65 @@ func (d PostgresDialect) TruncateClause() string {
 	return "truncate"
 }
 
+// ColumnCommentStr returns the empty string, as postgres stores comments
+// with separate statements.
+func (d PostgresDialect) ColumnCommentStr(comment string) string {
+	return ""
+}
+
+// CommentStatements returns "comment on" statements for t and each of its
+// columns with a comment.
+func (d PostgresDialect) CommentStatements(t *TableMap) []string {
+	var stmts []string
+	table := quoteTable(d, t.qualifiedName())
+	if len(t.comment) > 0 {
+		stmts = append(stmts, fmt.Sprintf("comment on table %s is %s", table, quoteValues([]string{t.comment})))
+	}
+	for _, col := range t.Columns {
+		if !col.Transient && len(col.comment) > 0 {
+			stmts = append(stmts, fmt.Sprintf("comment on column %s.%s is %s", table, d.QuoteField(col.ColumnName), quoteValues([]string{col.comment})))
+		}
+	}
+	return stmts
+}
+
 // RestartIdentityClause returns 'restart identity', which will restart serial
 // sequences for this table at the same time as a truncation is performed.
 func (d PostgresDialect) RestartIdentityClause(table string) string {
 	return "restart identity"
 }
 
+// SupportsReturning returns true.
+func (d PostgresDialect) SupportsReturning() bool {
+	return true
+}
+
+// SupportsLastInsertId returns false;  auto-increment values are read back
+// using a "returning" clause instead.
+func (d PostgresDialect) SupportsLastInsertId() bool {
+	return false
+}
+
+// SupportsSavepoints returns true.
+func (d PostgresDialect) SupportsSavepoints() bool {
+	return true
+}
+
+// MaxBindParams returns 65535, the limit of the wire protocol.
+func (d PostgresDialect) MaxBindParams() int {
+	return 65535
+}
+
+// VersionQuery shows the server_version.
+func (d PostgresDialect) VersionQuery() string {
+	return "show server_version;"
+}
+
+// CheckVersion requires PostgreSQL 8.2, which added "returning" clauses.
+func (d PostgresDialect) CheckVersion(version string) error {
+	return checkMinVersion("PostgreSQL", version, "8.2")
+}
+
 // -- MySQL
 
 // MySQLDialect is an implementation of Dialect for MySQL databases.
@@ -316,18 +631,25 @@ func (d MySQLDialect) DriverName() string {
 
 // ToSqlType maps go types to MySQL types.
 func (d MySQLDialect) ToSqlType(col *ColumnMap) string {
+	if len(col.enumValues) > 0 {
+		return "enum(" + quoteValues(col.enumValues) + ")"
+	}
+	if t := numericType(col, "decimal(65,30)"); t != "" {
+		return t
+	}
+	if isBool(col.gotype) {
+		return "tinyint(1)"
+	}
 	switch col.gotype.Kind() {
-	case reflect.Bool:
-		return "boolean"
 	case reflect.Int, reflect.Int16, reflect.Int32, reflect.Uint16, reflect.Uint32:
 		return "int"
 	case reflect.Int64, reflect.Uint64:
 		return "bigint"
 	case reflect.Float64, reflect.Float32:
 		return "double"
-	case reflect.Slice:
+	case reflect.Slice, reflect.Array:
 		if col.gotype.Elem().Kind() == reflect.Uint8 {
-			return "mediumblob"
+			return mysqlBinaryType(col)
 		}
 	}
 
@@ -336,6 +658,8 @@ func (d MySQLDialect) ToSqlType(col *ColumnMap) string {
 		return "bigint"
 	case "NullableFloat64":
 		return "double"
+	case "NullBool":
+		return "tinyint(1)"
 	case "NullableBool":
 		return "tinyint"
 	case "NullableBytes":
@@ -351,6 +675,26 @@ func (d MySQLDialect) ToSqlType(col *ColumnMap) string {
 	return fmt.Sprintf("varchar(%d)", maxsize)
 }
 
+// mysqlBinaryType returns the type of a byte slice or array column:  a
+// binary of the array's length, a varbinary for a MaxSize of up to 255, the
+// smallest blob type holding MaxSize bytes, or mediumblob without one.
+func mysqlBinaryType(col *ColumnMap) string {
+	size := col.MaxSize
+	switch {
+	case col.gotype.Kind() == reflect.Array:
+		return fmt.Sprintf("binary(%d)", col.gotype.Len())
+	case size < 1:
+		return "mediumblob"
+	case size <= 255:
+		return fmt.Sprintf("varbinary(%d)", size)
+	case size <= 65535:
+		return "blob"
+	case size <= 16777215:
+		return "mediumblob"
+	}
+	return "longblob"
+}
+
 // AutoIncrStr returns "auto_increment".
 func (d MySQLDialect) AutoIncrStr() string {
 	return "auto_increment"
@@ -371,6 +715,42 @@ func (d MySQLDialect) CreateTableSuffix() string {
 	return fmt.Sprintf(" engine=%s charset=%s", d.Engine, d.Encoding)
 }
 
+// TableSuffix returns the engine, charset and collation for t, using the
+// values set on the TableMap where present and those on d otherwise.
+func (d MySQLDialect) TableSuffix(t *TableMap) string {
+	engine, charset := d.Engine, d.Encoding
+	if len(t.Engine) > 0 {
+		engine = t.Engine
+	}
+	if len(t.Charset) > 0 {
+		charset = t.Charset
+	}
+	suffix := fmt.Sprintf(" engine=%s charset=%s", engine, charset)
+	if len(t.Collation) > 0 {
+		suffix += " collate=" + t.Collation
+	}
+	if len(t.comment) > 0 {
+		suffix += " comment=" + quoteValues([]string{t.comment})
+	}
+	return suffix
+}
+
+// ColumnCommentStr returns a comment clause.
+func (d MySQLDialect) ColumnCommentStr(comment string) string {
+	return " comment " + quoteValues([]string{comment})
+}
+
+// CommentStatements returns nothing, as MySQL's comments are part of its
+// create table statements.
+func (d MySQLDialect) CommentStatements(t *TableMap) []string {
+	return nil
+}
+
+// ColumnAutoIncrStr returns "auto_increment".
+func (d MySQLDialect) ColumnAutoIncrStr(c *ColumnMap) string {
+	return d.AutoIncrStr()
+}
+
 // BindVar returns "?"
 func (d MySQLDialect) BindVar(i int) string {
 	return "?"
@@ -386,9 +766,15 @@ func (d MySQLDialect) InsertAutoIncrAny(e SqlExecutor, insertSql string, dest in
 	return standardAutoIncrAny(e, insertSql, dest, params...)
 }
 
-// QuoteField quotes f using ``.
+// DefaultValues returns "() values ()", as MySQL does not support
+// "default values".
+func (d MySQLDialect) DefaultValues() string {
+	return "() values ()"
+}
+
+// QuoteField quotes f using ``, doubling any backticks in f.
 func (d MySQLDialect) QuoteField(f string) string {
-	return "`" + f + "`"
+	return "`" + strings.Replace(f, "`", "``", -1) + "`"
 }
 
 // FIXME: use sqlx's rebind, which was written after it had been created for modl
@@ -408,6 +794,19 @@ func ReBind(query string, dialect Dialect) string {
 	return query
 }
 
+func hasSliceArg(args []interface{}) bool {
+	for _, a := range args {
+		if _, ok := a.(driver.Valuer); ok {
+			continue
+		}
+		t := reflect.TypeOf(a)
+		if t != nil && t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 {
+			return true
+		}
+	}
+	return false
+}
+
 // TruncateClause returns 'truncate'.
 func (d MySQLDialect) TruncateClause() string {
 	return "truncate"
@@ -416,5 +815,42 @@ func (d MySQLDialect) TruncateClause() string {
 // RestartIdentityClause alters the table's AUTO_INCREMENT value after truncation,
 // as MySQL doesn't have an identity clause for the truncate statement.
 func (d MySQLDialect) RestartIdentityClause(table string) string {
-	return "; alter table " + table + " AUTO_INCREMENT = 1"
+	return "; alter table " + quoteTable(d, table) + " AUTO_INCREMENT = 1"
+}
+
+// SupportsReturning returns false.
+func (d MySQLDialect) SupportsReturning() bool {
+	return false
+}
+
+// SupportsLastInsertId returns true.
+func (d MySQLDialect) SupportsLastInsertId() bool {
+	return true
+}
+
+// SupportsSavepoints returns true.
+func (d MySQLDialect) SupportsSavepoints() bool {
+	return true
+}
+
+// MaxBindParams returns 65535, the limit on placeholders in a prepared
+// statement.
+func (d MySQLDialect) MaxBindParams() int {
+	return 65535
+}
+
+// SupportsEnum returns true.
+func (d MySQLDialect) SupportsEnum() bool {
+	return true
+}
+
+// VersionQuery selects version().
+func (d MySQLDialect) VersionQuery() string {
+	return "select version();"
+}
+
+// CheckVersion requires MySQL 5.0.3, which added varchar columns longer
+// than 255 characters.
+func (d MySQLDialect) CheckVersion(version string) error {
+	return checkMinVersion("MySQL", version, "5.0.3")
 }
@@ -0,0 +1,70 @@
+package modl
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrDryRun is returned by calls which cannot be completed in dry run mode
+// because they need the rows a statement returns, such as inserts of rows
+// whose keys are returned by the database on postgres.
+var ErrDryRun = errors.New("modl: statement not run in dry run mode")
+
+// errDryRun is returned by tracingHandle.run for captured statements.
+var errDryRun = errors.New("modl: statement captured")
+
+// dryRun holds the statements captured in dry run mode.
+type dryRun struct {
+	mu    sync.Mutex
+	on    bool
+	stmts []Statement
+}
+
+// DryRun turns dry run mode on or off.  In dry run mode, statements are
+// captured instead of being sent to the database, after they have passed
+// through the DbMap's middleware, and can be inspected with Captured:
+//
+//	dbmap.DryRun(true)
+//	dbmap.Insert(&person)
+//	for _, stmt := range dbmap.Captured() {
+//		fmt.Println(stmt.Query, stmt.Args)
+//	}
+//
+// Selects return no rows, Get returns ErrNotFound, and Execs report one
+// row affected, so that hooks and optimistic locking proceed as if the
+// statements had succeeded.  Transactions are still begun and ended on
+// the database, but no statements are run in them.
+func (m *DbMap) DryRun(on bool) {
+	m.dryRun.mu.Lock()
+	defer m.dryRun.mu.Unlock()
+	m.dryRun.on = on
+}
+
+// Captured returns the statements captured in dry run mode since the last
+// call to Captured, in the order they would have been run.
+func (m *DbMap) Captured() []Statement {
+	m.dryRun.mu.Lock()
+	defer m.dryRun.mu.Unlock()
+	stmts := m.dryRun.stmts
+	m.dryRun.stmts = nil
+	return stmts
+}
+
+// capture records a copy of stmt and returns true if dry run mode is on.
+func (d *dryRun) capture(stmt *Statement) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.on {
+		return false
+	}
+	c := *stmt
+	c.Args = append([]interface{}(nil), stmt.Args...)
+	d.stmts = append(d.stmts, c)
+	return true
+}
+
+// dryRunResult is the result of a captured Exec.
+type dryRunResult struct{}
+
+func (dryRunResult) LastInsertId() (int64, error) { return 0, nil }
+func (dryRunResult) RowsAffected() (int64, error) { return 1, nil }
@@ -0,0 +1,167 @@
+package modl
+
+import (
+	"reflect"
+	"sync"
+)
+
+// A ChangeEvent describes a row written by Insert, Update or Delete.
+type ChangeEvent struct {
+	Table string
+	Op    Operation
+	// Keys are the primary key values of the row.
+	Keys []interface{}
+	// Old is a copy of the row before an Update, if the table has been set
+	// up with SetOldSnapshots or SetOldRows, or it was passed to Update
+	// with WithOld, or the row passed to Delete.  New is a copy
+	// of the row after an Insert or Update.  Both are pointers to the
+	// table's type, or nil.
+	Old interface{}
+	New interface{}
+}
+
+// eventBus holds the subscribers of a DbMap.
+type eventBus struct {
+	mu   sync.RWMutex
+	next int
+	subs []subscriber
+}
+
+type subscriber struct {
+	id int
+	fn func(ChangeEvent)
+}
+
+// Subscribe registers fn to be called with a ChangeEvent for each row
+// written through the DbMap.  Rows written outside of a transaction are
+// delivered as soon as they are written;  those written in a Transaction
+// are held until it is committed, and dropped if it is rolled back.
+// Events are delivered in order, on the goroutine which wrote the rows or
+// committed the transaction, so fn should not block.
+//
+// Rows written with Exec, or loaded by a BulkLoader in CopyInsert, do not
+// raise events.  Subscribe returns a function which unregisters fn.
+func (m *DbMap) Subscribe(fn func(ChangeEvent)) (unsubscribe func()) {
+	b := &m.events
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	// subs is copied on write, so that deliver can use it unlocked
+	b.subs = append(b.subs[:len(b.subs):len(b.subs)], subscriber{id, fn})
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		subs := make([]subscriber, 0, len(b.subs))
+		for _, s := range b.subs {
+			if s.id != id {
+				subs = append(subs, s)
+			}
+		}
+		b.subs = subs
+	}
+}
+
+// SetOldSnapshots controls whether the ChangeEvents of Updates to this
+// table carry the row as it was before the update.  The row is read before
+// it is updated, which costs a query per row, so it is off by default.  It
+// has no effect while the DbMap has no subscribers.
+func (t *TableMap) SetOldSnapshots(b bool) *TableMap {
+	t.oldSnapshots = b
+	return t
+}
+
+// SetOldRows makes Updates of this table read each row as it is before
+// the update, unless it was passed with WithOld, and pass it to its
+// Validate, PreUpdate and PostUpdate hooks in HookContext.Old, eg. to audit
+// the fields which changed.  It costs a query per row, so it is off by
+// default.
+func (t *TableMap) SetOldRows(b bool) *TableMap {
+	t.oldRows = b
+	return t
+}
+
+// subscribed returns true if any subscribers are registered.
+func (m *DbMap) subscribed() bool {
+	m.events.mu.RLock()
+	defer m.events.mu.RUnlock()
+	return len(m.events.subs) > 0
+}
+
+// deliver calls the subscribers with each of events.
+func (m *DbMap) deliver(events []ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	m.events.mu.RLock()
+	subs := m.events.subs
+	m.events.mu.RUnlock()
+	for _, ev := range events {
+		for _, s := range subs {
+			s.fn(ev)
+		}
+	}
+}
+
+// publish delivers ev, or holds it until commit if e is a Transaction.
+func (m *DbMap) publish(e SqlExecutor, ev ChangeEvent) {
+	if tx, ok := e.(*Transaction); ok {
+		tx.events = append(tx.events, ev)
+		return
+	}
+	m.deliver([]ChangeEvent{ev})
+}
+
+// changed publishes a ChangeEvent for elem, a row of t, if there are
+// subscribers, and invalidates cached query results of t and the cached
+// row.  old is the row before the change, if it was read.
+func (t *TableMap) changed(e SqlExecutor, op Operation, elem reflect.Value, old interface{}) {
+	m := dbmapOf(e)
+	if m == nil {
+		return
+	}
+	m.written(e, t.TableName)
+	t.writeCache(e, op, elem)
+	if !m.subscribed() {
+		return
+	}
+	ev := ChangeEvent{Table: t.TableName, Op: op, Keys: t.keyValues(elem), Old: old}
+	if op == OpDelete {
+		ev.Old = snapshot(elem)
+	} else {
+		ev.New = snapshot(elem)
+	}
+	m.publish(e, ev)
+}
+
+// oldSnapshot returns the row ptr, whose element is elem, is about to
+// overwrite:  the one passed with WithOld, or else the row read from the
+// database if the table has been set up with SetOldRows, or with
+// SetOldSnapshots and there are subscribers.  It returns nil if the row
+// does not exist.
+func (t *TableMap) oldSnapshot(e SqlExecutor, ptr interface{}, elem reflect.Value, opts *queryOptions) (interface{}, error) {
+	if old, ok := opts.old[ptr]; ok {
+		return old, nil
+	}
+	m := dbmapOf(e)
+	if m == nil || !t.oldRows && !(t.oldSnapshots && m.subscribed()) {
+		return nil, nil
+	}
+	old := reflect.New(t.gotype).Interface()
+	keys := append(t.keyValues(elem), NoHooks(), Primary())
+	err := get(m, e, old, append(keys, opts.passOn()...)...)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// snapshot returns a pointer to a copy of elem.
+func snapshot(elem reflect.Value) interface{} {
+	p := reflect.New(elem.Type())
+	p.Elem().Set(elem)
+	return p.Interface()
+}
@@ -0,0 +1,115 @@
+package modl
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Explainer is implemented by Dialects which can show how the database
+// runs a query.  It is used by DbMap.Explain.
+type Explainer interface {
+	// ExplainQuery returns a statement which selects the plan of query.
+	// If analyze is true and the database supports it, the statement also
+	// runs query and reports what it actually cost.
+	ExplainQuery(query string, analyze bool) string
+}
+
+// An ExplainRow is a row of the output of EXPLAIN, by column name.
+// Text columns are returned as strings.
+type ExplainRow map[string]interface{}
+
+// Analyze makes Explain run the query and include its actual costs, on
+// databases which support it.  Explaining a write with Analyze performs
+// it, so such queries should be explained in a Transaction which is
+// rolled back.
+func Analyze() QueryOption {
+	return func(o *queryOptions) {
+		o.analyze = true
+	}
+}
+
+// Explain returns the plan the database would use to run query with args,
+// as the rows of the Dialect's EXPLAIN statement.  QueryOptions may be
+// passed along with args.  The Dialect must implement Explainer.
+func (m *DbMap) Explain(query string, args ...interface{}) ([]ExplainRow, error) {
+	return explain(m, m, query, args...)
+}
+
+func explain(m *DbMap, e SqlExecutor, query string, args ...interface{}) ([]ExplainRow, error) {
+	ex, ok := m.Dialect.(Explainer)
+	if !ok {
+		return nil, fmt.Errorf("modl: %T cannot explain queries", m.Dialect)
+	}
+	args, opts := splitOptions(args)
+	query, args, err := m.rewrite(query, args, opts)
+	if err != nil {
+		return nil, err
+	}
+	h, done := opts.handleFor(e, !opts.analyze)
+	defer done()
+	rows, err := h.Queryx(ex.ExplainQuery(query, opts.analyze), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanExplain(rows.Rows)
+}
+
+// explainSlow returns the plan of a slow query which was run with args on
+// c, or nil if it cannot be explained.
+func (m *DbMap) explainSlow(ctx context.Context, c cursor, query string, args []interface{}) []ExplainRow {
+	ex, ok := m.Dialect.(Explainer)
+	if !ok {
+		return nil
+	}
+	rows, err := c.QueryxContext(ctx, ex.ExplainQuery(query, false), args...)
+	if err != nil {
+		return nil
+	}
+	plan, _ := scanExplain(rows)
+	return plan
+}
+
+// scanExplain reads and closes the rows of an EXPLAIN statement.
+func scanExplain(rows *sqlx.Rows) ([]ExplainRow, error) {
+	defer rows.Close()
+	var plan []ExplainRow
+	for rows.Next() {
+		row := ExplainRow{}
+		if err := rows.MapScan(row); err != nil {
+			return nil, err
+		}
+		for k, v := range row {
+			if b, ok := v.([]byte); ok {
+				row[k] = string(b)
+			}
+		}
+		plan = append(plan, row)
+	}
+	return plan, rows.Err()
+}
+
+// ExplainQuery returns query prefixed with EXPLAIN QUERY PLAN.  sqlite
+// cannot analyze queries.
+func (d SqliteDialect) ExplainQuery(query string, analyze bool) string {
+	return "EXPLAIN QUERY PLAN " + query
+}
+
+// ExplainQuery returns query prefixed with EXPLAIN, or EXPLAIN (ANALYZE).
+func (d PostgresDialect) ExplainQuery(query string, analyze bool) string {
+	if analyze {
+		return "EXPLAIN (ANALYZE) " + query
+	}
+	return "EXPLAIN " + query
+}
+
+// ExplainQuery returns query prefixed with EXPLAIN, or EXPLAIN ANALYZE,
+// which needs MySQL 8.0.18 or later.
+func (d MySQLDialect) ExplainQuery(query string, analyze bool) string {
+	if analyze {
+		return "EXPLAIN ANALYZE " + query
+	}
+	return "EXPLAIN " + query
+}
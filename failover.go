@@ -0,0 +1,241 @@
+package modl
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// FailoverDialect is implemented by dialects which can recognize errors
+// meaning that a primary database can no longer be used, eg. because it
+// is shutting down or has become a read-only standby.  A DbMap with
+// several primaries moves on to the next on such errors;  otherwise only
+// errors from connections which failed are.  See SetPrimaries.
+type FailoverDialect interface {
+	IsFatal(err error) bool
+}
+
+// A FailoverEvent reports that a DbMap has moved from one of its primaries
+// to another.  From and To are their indexes in the order passed to
+// SetPrimaries.  Err is the error which caused the failover, or the one
+// passed to Failover.
+type FailoverEvent struct {
+	From, To int
+	Err      error
+}
+
+// primaries are the databases a DbMap fails over between, and the index of
+// the one statements are run on.
+type primaries struct {
+	dbs     []*sqlx.DB
+	current int32
+}
+
+// SetPrimaries makes the DbMap run statements on the first of dbs, and move
+// on to the next, in order, when one fails with an error which is fatal:
+// a connection error, or one recognized by the Dialect's FailoverDialect,
+// eg. for postgres a server shutting down or a standby refusing writes.
+// Reads which fail this way are run again on the next primary, as are
+// writes which failed before they were sent, and Begin, but other writes
+// are not, as they may have been made before the primary failed;  the
+// error is returned, and the next statements are run on the next primary.
+// Statements in a Transaction are not run again either.  Each failover
+// is reported to FailoverLogger.  Db and Dbx remain the first of dbs.  It
+// panics if dbs is empty.
+//
+//	dbmap := modl.NewDbMap(db1, modl.PostgresDialect{}).SetPrimaries(db1, db2)
+func (m *DbMap) SetPrimaries(dbs ...*sql.DB) *DbMap {
+	if len(dbs) == 0 {
+		panic("modl: SetPrimaries needs at least one database")
+	}
+	driverName := m.Dialect.DriverName()
+	if m.Dbx != nil {
+		driverName = m.Dbx.DriverName()
+	}
+	p := &primaries{}
+	for _, db := range dbs {
+		if m.Dbx != nil && db == m.Db {
+			p.dbs = append(p.dbs, m.Dbx)
+		} else {
+			p.dbs = append(p.dbs, sqlx.NewDb(db, driverName))
+		}
+	}
+	m.Db, m.Dbx = dbs[0], p.dbs[0]
+	m.primaries = p
+	return m
+}
+
+// OpenPrimaries opens the databases dsns with sql.Open and returns a DbMap
+// which fails over between them, with the Dialect for driverName.  See
+// SetPrimaries.
+func OpenPrimaries(driverName string, dsns ...string) (*DbMap, error) {
+	if len(dsns) == 0 {
+		return nil, fmt.Errorf("modl: OpenPrimaries needs at least one data source")
+	}
+	m, err := Open(driverName, dsns[0])
+	if err != nil {
+		return nil, err
+	}
+	dbs := []*sql.DB{m.Db}
+	for _, dsn := range dsns[1:] {
+		db, err := sql.Open(driverName, dsn)
+		if err != nil {
+			for _, db := range dbs {
+				db.Close()
+			}
+			return nil, err
+		}
+		dbs = append(dbs, db)
+	}
+	return m.SetPrimaries(dbs...), nil
+}
+
+// PrimaryIndex returns the index of the primary statements are run on, in
+// the order passed to SetPrimaries, or 0 if it has not been called.
+func (m *DbMap) PrimaryIndex() int {
+	if m.primaries == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&m.primaries.current))
+}
+
+// Failover moves the DbMap on to its next primary, eg. when a health check
+// finds the current one down.  err, which may be nil, is reported to
+// FailoverLogger.  It does nothing if the DbMap has a single primary.
+func (m *DbMap) Failover(err error) {
+	if p := m.primaries; p != nil {
+		m.moveOn(int(atomic.LoadInt32(&p.current)), err)
+	}
+}
+
+// primary returns the database statements run outside of a transaction
+// are sent to.
+func (m *DbMap) primary() *sqlx.DB {
+	if p := m.primaries; p != nil {
+		return p.dbs[atomic.LoadInt32(&p.current)]
+	}
+	return m.Dbx
+}
+
+// databases returns the DbMap's primaries.
+func (m *DbMap) databases() []*sqlx.DB {
+	if p := m.primaries; p != nil {
+		return p.dbs
+	}
+	return []*sqlx.DB{m.Dbx}
+}
+
+// moveOn makes the primary after the one at index from current, unless it
+// has already been moved on from, and reports it.
+func (m *DbMap) moveOn(from int, err error) {
+	p := m.primaries
+	if len(p.dbs) < 2 {
+		return
+	}
+	to := (from + 1) % len(p.dbs)
+	if !atomic.CompareAndSwapInt32(&p.current, int32(from), int32(to)) {
+		return
+	}
+	if m.FailoverLogger != nil {
+		m.FailoverLogger(FailoverEvent{From: from, To: to, Err: err})
+	}
+}
+
+// failover moves the DbMap on from db, one of its primaries on which a
+// statement failed with err, if err is fatal, and returns the primary to
+// run it on again, or nil if it should not be run again.  Writes are only
+// run again if err shows they were not sent.
+func (m *DbMap) failover(db *sqlx.DB, err error, write bool) *sqlx.DB {
+	p := m.primaries
+	if p == nil || len(p.dbs) < 2 || !m.isFatal(err) {
+		return nil
+	}
+	from := -1
+	for i, pdb := range p.dbs {
+		if pdb == db {
+			from = i
+		}
+	}
+	if from < 0 {
+		return nil
+	}
+	m.moveOn(from, err)
+	if write && !notSent(err) {
+		return nil
+	}
+	return m.primary()
+}
+
+// onPrimary runs fn on the current primary, and on the next ones for as
+// long as it fails with fatal errors.  fn must not make changes before it
+// fails.
+func (m *DbMap) onPrimary(fn func(db *sqlx.DB) error) error {
+	db := m.primary()
+	err := fn(db)
+	for tries := 1; err != nil && tries < len(m.databases()); tries++ {
+		if db = m.failover(db, err, false); db == nil {
+			break
+		}
+		err = fn(db)
+	}
+	return err
+}
+
+// isFatal returns true if err means that the primary it came from cannot
+// be used.
+func (m *DbMap) isFatal(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if isConnectionError(err) {
+		return true
+	}
+	f, ok := m.Dialect.(FailoverDialect)
+	return ok && f.IsFatal(err)
+}
+
+// isConnectionError returns true if err was caused by a connection to the
+// database failing, or not being made.
+func isConnectionError(err error) bool {
+	var ne net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &ne)
+}
+
+// notSent returns true if err shows that the statement which failed with
+// it was not sent to the database:  database/sql's drivers return
+// driver.ErrBadConn only then, and a connection which could not be made
+// has sent nothing.
+func notSent(err error) bool {
+	var op *net.OpError
+	return errors.Is(err, driver.ErrBadConn) || errors.As(err, &op) && op.Op == "dial"
+}
+
+// IsFatal recognizes the errors of a server which is shutting down or
+// cannot accept connections, of lost connections, and of a standby
+// refusing writes, by their SQLSTATE.
+func (d PostgresDialect) IsFatal(err error) bool {
+	var e interface{ SQLState() string }
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch code := e.SQLState(); {
+	case strings.HasPrefix(code, "08"):
+		// connection exceptions
+		return true
+	case code == "57P01", code == "57P02", code == "57P03":
+		// admin_shutdown, crash_shutdown, cannot_connect_now
+		return true
+	case code == "25006":
+		// read_only_sql_transaction, from a demoted primary
+		return true
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package modl
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// DefineFinder registers query as the table's finder called name, which
+// Find runs.  In query, %cols% is replaced by the table's select list and
+// %table% by its quoted name, so that finders follow the mapping:
+//
+//	table.DefineFinder("ActiveByOrg", "select %cols% from %table% where org_id=? and active=true")
+//
+// Defining a finder again replaces it.
+func (t *TableMap) DefineFinder(name, query string) *TableMap {
+	if t.finders == nil {
+		t.finders = map[string]string{}
+	}
+	t.finders[name] = query
+	return t
+}
+
+// finderQuery returns the table's finder called name, expanded.
+func (t *TableMap) finderQuery(name string) (string, bool) {
+	query, ok := t.finders[name]
+	if !ok {
+		return "", false
+	}
+	r := strings.NewReplacer("%cols%", t.SelectColumnList(""), "%table%", quoteTable(t.dbmap.Dialect, t.qualifiedName()))
+	return r.Replace(query), true
+}
+
+// Find runs the finder called name of the table for dest, which is
+// registered with AddTable, with args, which may include QueryOptions.
+// If dest is a pointer to a slice, the rows are bound to it like Select;
+// otherwise the single row is bound to it like SelectOne.  See
+// TableMap.DefineFinder.
+func (m *DbMap) Find(dest interface{}, name string, args ...interface{}) error {
+	return find(m, m, dest, name, args...)
+}
+
+func find(m *DbMap, e SqlExecutor, dest interface{}, name string, args ...interface{}) error {
+	table := m.TableFor(dest)
+	if table == nil {
+		return fmt.Errorf("modl: no table found for %T", dest)
+	}
+	query, ok := table.finderQuery(name)
+	if !ok {
+		return fmt.Errorf("modl: table %s has no finder %s", table.TableName, name)
+	}
+	if reflect.Indirect(reflect.ValueOf(dest)).Kind() == reflect.Slice {
+		return hookedselect(m, e, dest, query, args...)
+	}
+	return hookedget(m, e, dest, query, args...)
+}
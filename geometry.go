@@ -0,0 +1,175 @@
+package modl
+
+import (
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+)
+
+// Geometry is a spatial value.  Columns holding a Geometry or *Geometry
+// are written and read as well-known text by Dialects which are
+// SpatialDialects, so that they map geometry columns of PostGIS or MySQL:
+//
+//	type Place struct {
+//		ID       int64
+//		Location modl.Geometry
+//	}
+//	dbmap.AddTable(Place{}).SetKeys(true, "ID").ColMap("Location").SetSRID(4326)
+//	dbmap.Insert(&Place{Location: modl.Geometry{WKT: "POINT(-71.06 42.36)"}})
+//
+// Other dialects store the text as it is.
+type Geometry struct {
+	// WKT is the geometry in well-known text, eg. "POINT(1 2)".
+	WKT string
+	// WKB holds the geometry as the database returns it when it is not
+	// selected as text, eg. by a query written by hand:  PostGIS' EWKB, or
+	// MySQL's SRID followed by WKB.  It is written if WKT is empty.
+	WKB []byte
+}
+
+// IsZero returns true if g holds no geometry;  zero Geometries are written
+// as NULL.
+func (g Geometry) IsZero() bool {
+	return len(g.WKT) == 0 && len(g.WKB) == 0
+}
+
+// Value returns g's well-known text, or its WKB if it has no text.
+func (g Geometry) Value() (driver.Value, error) {
+	switch {
+	case len(g.WKT) > 0:
+		return g.WKT, nil
+	case len(g.WKB) > 0:
+		return g.WKB, nil
+	}
+	return nil, nil
+}
+
+// Scan reads a geometry as well-known text, or as binary, which PostGIS
+// returns hex encoded.
+func (g *Geometry) Scan(src interface{}) error {
+	*g = Geometry{}
+	var b []byte
+	switch s := src.(type) {
+	case nil:
+		return nil
+	case string:
+		b = []byte(s)
+	case []byte:
+		b = s
+	default:
+		return fmt.Errorf("modl: cannot scan a %T into a Geometry", src)
+	}
+	if len(b) > 0 && isWKT(b) {
+		g.WKT = string(b)
+		return nil
+	}
+	if decoded, err := hex.DecodeString(string(b)); err == nil {
+		b = decoded
+	}
+	g.WKB = append([]byte(nil), b...)
+	return nil
+}
+
+// isWKT returns true if b starts with a geometry type's name, as text does
+// and hex encoded and binary geometries do not.
+func isWKT(b []byte) bool {
+	for _, c := range b {
+		switch {
+		case c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+			continue
+		case c == ' ' || c == '(' || c == ';' || c == '=':
+			// "POINT (", "POINT(", or PostGIS' "SRID=4326;POINT("
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// A SpatialDialect is a Dialect with a geometry type.  Columns holding a
+// Geometry are created with GeometryType, written with GeomFromText and
+// selected with GeomAsText.
+type SpatialDialect interface {
+	// GeometryType returns the type of a geometry column in the given
+	// spatial reference system, or in any if srid is 0.
+	GeometryType(srid int) string
+	// GeomFromText returns an expression converting the text bound to "?"
+	// to a geometry in the given spatial reference system.
+	GeomFromText(srid int) string
+	// GeomAsText returns an expression selecting column, which is quoted,
+	// as well-known text.
+	GeomAsText(column string) string
+}
+
+var geometryType = reflect.TypeOf(Geometry{})
+
+func isGeometry(t reflect.Type) bool {
+	return t == geometryType || t == reflect.PtrTo(geometryType)
+}
+
+// SetSRID sets the spatial reference system of a Geometry column, eg. 4326
+// for WGS 84, which CreateTables creates it with and its values are written
+// in.  It panics if the column's field is not a Geometry or *Geometry.
+func (c *ColumnMap) SetSRID(srid int) *ColumnMap {
+	if !isGeometry(c.gotype) {
+		panic(fmt.Sprintf("Column %s of type %s is not a Geometry", c.ColumnName, c.gotype))
+	}
+	c.srid = srid
+	c.table.ResetSql()
+	return c
+}
+
+// spatial returns the DbMap's Dialect if the column holds a Geometry and it
+// is a SpatialDialect, or nil.
+func (c *ColumnMap) spatial() SpatialDialect {
+	if !isGeometry(c.gotype) {
+		return nil
+	}
+	sd, _ := c.table.dbmap.Dialect.(SpatialDialect)
+	return sd
+}
+
+// GeometryType returns "geometry", with a type modifier for the SRID.
+func (d PostgresDialect) GeometryType(srid int) string {
+	if srid > 0 {
+		return fmt.Sprintf("geometry(Geometry,%d)", srid)
+	}
+	return "geometry"
+}
+
+// GeomFromText returns a call of ST_GeomFromText.
+func (d PostgresDialect) GeomFromText(srid int) string {
+	return geomFromText(srid)
+}
+
+// GeomAsText returns a call of ST_AsText.
+func (d PostgresDialect) GeomAsText(column string) string {
+	return "ST_AsText(" + column + ")"
+}
+
+// GeometryType returns "geometry", with the SRID attribute understood by
+// MySQL 8.0.3 and later.
+func (d MySQLDialect) GeometryType(srid int) string {
+	if srid > 0 {
+		return fmt.Sprintf("geometry /*!80003 SRID %d */", srid)
+	}
+	return "geometry"
+}
+
+// GeomFromText returns a call of ST_GeomFromText.
+func (d MySQLDialect) GeomFromText(srid int) string {
+	return geomFromText(srid)
+}
+
+// GeomAsText returns a call of ST_AsText.
+func (d MySQLDialect) GeomAsText(column string) string {
+	return "ST_AsText(" + column + ")"
+}
+
+func geomFromText(srid int) string {
+	if srid > 0 {
+		return fmt.Sprintf("ST_GeomFromText(?, %d)", srid)
+	}
+	return "ST_GeomFromText(?)"
+}
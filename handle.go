@@ -1,17 +1,27 @@
 package modl
 
 import (
+	"context"
 	"database/sql"
+	"reflect"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
 
 // a cursor is either an sqlx.Db or an sqlx.Tx
+type cursor interface {
+	QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error)
+	QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// a handle runs statements on behalf of a DbMap or a Transaction
 type handle interface {
 	Select(dest interface{}, query string, args ...interface{}) error
 	Get(dest interface{}, query string, args ...interface{}) error
-	Queryx(query string, args ...interface{}) (*sqlx.Rows, error)
-	QueryRowx(query string, args ...interface{}) *sqlx.Row
+	Queryx(query string, args ...interface{}) (*queryRows, error)
+	QueryRowx(query string, args ...interface{}) *queryRow
 	Exec(query string, args ...interface{}) (sql.Result, error)
 	/*
 		Query(query string, args ...interface{}) (*sql.Rows, error)
@@ -21,31 +31,252 @@ type handle interface {
 
 // an implmentation of handle which traces using dbmap
 type tracingHandle struct {
-	d *DbMap
-	h handle
+	d   *DbMap
+	h   cursor
+	ctx context.Context
+	// comment is prepended to each statement run on this handle
+	comment string
+	// reuse makes Select reuse the structs pointed to by its destination
+	reuse bool
+}
+
+func newHandle(d *DbMap, h cursor) *tracingHandle {
+	return &tracingHandle{d: d, h: h, ctx: context.Background()}
+}
+
+// prepare applies any per-handle modifications to query.
+func (t *tracingHandle) prepare(query string) string {
+	if len(t.comment) > 0 {
+		query = "/* " + t.comment + " */ " + query
+	}
+	if t.d.Annotator != nil {
+		if c := SQLComment(t.d.Annotator(t.ctx, query)); len(c) > 0 {
+			query = appendComment(query, c)
+		}
+	}
+	return query
+}
+
+// run sends query to the database using fn, through the DbMap's
+// middleware, and takes care of tracing and reporting it.  exec is true
+// for statements which do not return rows.  fn returns the number of rows
+// read or written, or -1 if it is not known.  If the DbMap has a default
+// timeout and the handle's context has no deadline, fn is given a context
+// with that timeout, and its hard timeout is applied on top;  see watch.
+// The context is cancelled when run returns, unless keep is not nil
+// because the statement's results are read afterwards;  *keep is then set
+// to a function cancelling it, which must be called once they have been
+// read.  In dry run mode, the statement is captured instead of being sent,
+// and run returns errDryRun.
+func (t *tracingHandle) run(query string, args []interface{}, keep *func(), exec bool, fn func(ctx context.Context, query string, args []interface{}) (int64, error)) error {
+	ctx, cancel := t.context()
+	cancels := []context.CancelFunc{cancel}
+	release := func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+	if keep != nil {
+		*keep = release
+	} else {
+		defer release()
+	}
+
+	_, isDb := t.h.(*sqlx.DB)
+	stmt := &Statement{Query: t.prepare(query), Args: args, Exec: exec, InTx: !isDb}
+	captured := false
+	err := t.d.chain(func(ctx context.Context, stmt *Statement) error {
+		args, logged := unwrapSensitive(stmt.Args)
+		t.d.trace(stmt.Query, logged...)
+		if captured = t.d.dryRun.capture(stmt); captured {
+			return nil
+		}
+		start := time.Now()
+		ctx, query, watched, cancel := t.watch(ctx, stmt.Query)
+		cancels = append(cancels, cancel)
+		n, err := fn(ctx, query, args)
+		if isDb {
+			for tries := 1; err != nil && tries < len(t.d.databases()); tries++ {
+				db := t.d.failover(t.h.(*sqlx.DB), err, exec)
+				if db == nil {
+					break
+				}
+				t.h = db
+				n, err = fn(ctx, query, args)
+			}
+		}
+		err = watched(err)
+		elapsed := time.Since(start)
+		if t.d.CollectStats {
+			t.d.stats.record(stmt.Query, elapsed, n, err)
+		}
+		var explain func() []ExplainRow
+		if isDb {
+			explain = func() []ExplainRow {
+				return t.d.explainSlow(ctx, t.h, stmt.Query, args)
+			}
+		}
+		t.d.observe(stmt.Query, logged, elapsed, explain)
+		if err != nil {
+			t.d.traceError(stmt.Query, logged, err)
+		}
+		return err
+	})(ctx, stmt)
+	t.d.deadlocked(stmt.Query, stmt.InTx, err)
+	if err == nil && captured {
+		return errDryRun
+	}
+	return err
+}
+
+// context returns the context to run a statement with.
+func (t *tracingHandle) context() (context.Context, context.CancelFunc) {
+	if t.d.defaultTimeout > 0 {
+		if _, ok := t.ctx.Deadline(); !ok {
+			return context.WithTimeout(t.ctx, t.d.defaultTimeout)
+		}
+	}
+	return t.ctx, func() {}
 }
 
 func (t *tracingHandle) Select(dest interface{}, query string, args ...interface{}) error {
-	t.d.trace(query, args...)
-	return t.h.Select(dest, query, args...)
+	err := t.run(query, args, nil, false, func(ctx context.Context, query string, args []interface{}) (int64, error) {
+		rows, err := t.h.QueryxContext(ctx, query, args...)
+		if err != nil {
+			return -1, err
+		}
+		defer rows.Close()
+		v := reflect.Indirect(reflect.ValueOf(dest))
+		n := 0
+		if v.Kind() == reflect.Slice && !t.reuse {
+			n = v.Len()
+		}
+		if err = t.d.scanAll(rows, dest, t.reuse); err != nil {
+			return -1, err
+		}
+		return int64(v.Len() - n), nil
+	})
+	if err == errDryRun {
+		// nothing was read
+		return nil
+	}
+	return err
 }
 
 func (t *tracingHandle) Get(dest interface{}, query string, args ...interface{}) error {
-	t.d.trace(query, args...)
-	return t.h.Get(dest, query, args...)
+	err := t.run(query, args, nil, false, func(ctx context.Context, query string, args []interface{}) (int64, error) {
+		rows, err := t.h.QueryxContext(ctx, query, args...)
+		if err != nil {
+			return -1, err
+		}
+		defer rows.Close()
+		if err = t.d.scanOne(rows, dest); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	})
+	if err == errDryRun {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+func (t *tracingHandle) Queryx(query string, args ...interface{}) (*queryRows, error) {
+	var rows *sqlx.Rows
+	var release func()
+	err := t.run(query, args, &release, false, func(ctx context.Context, query string, args []interface{}) (n int64, err error) {
+		rows, err = t.h.QueryxContext(ctx, query, args...)
+		return -1, err
+	})
+	if err != nil {
+		release()
+		if err == errDryRun {
+			err = ErrDryRun
+		}
+		return nil, err
+	}
+	return &queryRows{Rows: rows, release: release}, nil
+}
+
+func (t *tracingHandle) QueryRowx(query string, args ...interface{}) *queryRow {
+	var row *sqlx.Row
+	var release func()
+	t.run(query, args, &release, false, func(ctx context.Context, query string, args []interface{}) (int64, error) {
+		row = t.h.QueryRowxContext(ctx, query, args...)
+		return -1, row.Err()
+	})
+	if row == nil {
+		// the statement was captured by a dry run
+		release()
+		return nil
+	}
+	return &queryRow{Row: row, release: release}
+}
+
+// queryRows are the rows read by Queryx;  closing them cancels the context
+// they were read with.
+type queryRows struct {
+	*sqlx.Rows
+	release func()
+}
+
+func (r *queryRows) Close() error {
+	defer r.release()
+	return r.Rows.Close()
+}
+
+// queryRow is the row read by QueryRowx;  scanning it cancels the context
+// it was read with.
+type queryRow struct {
+	*sqlx.Row
+	release func()
+}
+
+func (r *queryRow) Scan(dest ...interface{}) error {
+	defer r.release()
+	return r.Row.Scan(dest...)
+}
+
+func (r *queryRow) StructScan(dest interface{}) error {
+	defer r.release()
+	return r.Row.StructScan(dest)
 }
 
-func (t *tracingHandle) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
-	t.d.trace(query, args...)
-	return t.h.Queryx(query, args...)
+func (r *queryRow) MapScan(dest map[string]interface{}) error {
+	defer r.release()
+	return r.Row.MapScan(dest)
 }
 
-func (t *tracingHandle) QueryRowx(query string, args ...interface{}) *sqlx.Row {
-	t.d.trace(query, args...)
-	return t.h.QueryRowx(query, args...)
+func (r *queryRow) SliceScan() ([]interface{}, error) {
+	defer r.release()
+	return r.Row.SliceScan()
 }
 
-func (t *tracingHandle) Exec(query string, args ...interface{}) (sql.Result, error) {
-	t.d.trace(query, args...)
-	return t.h.Exec(query, args...)
+func (t *tracingHandle) Exec(query string, args ...interface{}) (res sql.Result, err error) {
+	err = t.run(query, args, nil, true, func(ctx context.Context, query string, args []interface{}) (int64, error) {
+		exec := func() (err error) {
+			res, err = t.h.ExecContext(ctx, query, args...)
+			return err
+		}
+		// statements inside of a transaction cannot safely be retried alone
+		var err error
+		if _, isDb := t.h.(*sqlx.DB); isDb {
+			err = t.d.retry(exec)
+		} else {
+			err = exec()
+		}
+		if err != nil {
+			return -1, err
+		}
+		if !t.d.CollectStats {
+			return -1, nil
+		}
+		// drivers which cannot count the rows do not fail the statement
+		n, _ := res.RowsAffected()
+		return n, nil
+	})
+	if err == errDryRun {
+		return dryRunResult{}, nil
+	}
+	return res, err
 }
@@ -0,0 +1,110 @@
+package modl
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SetMaxOpenConns sets the maximum number of open connections to the
+// database.  See sql.DB.SetMaxOpenConns.
+func (m *DbMap) SetMaxOpenConns(n int) {
+	for _, db := range m.databases() {
+		db.SetMaxOpenConns(n)
+	}
+}
+
+// SetMaxIdleConns sets the maximum number of idle connections kept in the
+// connection pool.  See sql.DB.SetMaxIdleConns.
+func (m *DbMap) SetMaxIdleConns(n int) {
+	for _, db := range m.databases() {
+		db.SetMaxIdleConns(n)
+	}
+}
+
+// SetConnMaxLifetime sets the maximum amount of time a connection may be
+// reused.  See sql.DB.SetConnMaxLifetime.
+func (m *DbMap) SetConnMaxLifetime(d time.Duration) {
+	for _, db := range m.databases() {
+		db.SetConnMaxLifetime(d)
+	}
+}
+
+// Ping verifies that the database is reachable.
+func (m *DbMap) Ping() error {
+	return m.HealthCheck(context.Background())
+}
+
+// HealthCheck verifies that the database is reachable within ctx and, if
+// the Dialect implements VersionChecker, that the server's version is one
+// the Dialect supports.
+func (m *DbMap) HealthCheck(ctx context.Context) error {
+	err := m.onPrimary(func(db *sqlx.DB) error {
+		return db.PingContext(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	vc, ok := m.Dialect.(VersionChecker)
+	if !ok {
+		return nil
+	}
+	var version string
+	if err := m.SelectOne(&version, vc.VersionQuery(), WithContext(ctx), Primary()); err != nil {
+		return err
+	}
+	return vc.CheckVersion(version)
+}
+
+// compareVersions compares the dotted version strings a and b, returning
+// -1, 0 or 1.  Anything following the leading numeric part of a version,
+// such as "-log" or " (Debian ...)", is ignored.
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	end := strings.IndexFunc(v, func(r rune) bool {
+		return r != '.' && (r < '0' || r > '9')
+	})
+	if end >= 0 {
+		v = v[:end]
+	}
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// checkMinVersion returns an error if version is older than min.
+func checkMinVersion(name, version, min string) error {
+	if compareVersions(version, min) < 0 {
+		return fmt.Errorf("modl: %s version %s is not supported, %s or later is required", name, version, min)
+	}
+	return nil
+}
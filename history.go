@@ -0,0 +1,163 @@
+package modl
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// SetHistory keeps the versions of the table's rows in the table named
+// history, which CreateTables creates with the table's columns and
+// valid_from and valid_to times.  Each row written by Insert or Update is
+// copied to it, valid from the time it was written, and the version it
+// replaces, like the row removed by Delete, is made valid until then.
+// AsOf reads the rows as they were at a time.  Rows written other than by
+// Insert, Update and Delete, eg. with Exec, are not recorded;  write rows
+// in a Transaction to keep the history consistent with them.  To stop
+// keeping a history, call with the empty string.
+func (t *TableMap) SetHistory(history string) *TableMap {
+	t.history = history
+	return t
+}
+
+// historyRow is the type of the rows of history tables, holding a row of
+// the table, at index 1.
+func historyRow(gotype reflect.Type) reflect.Type {
+	return reflect.StructOf([]reflect.StructField{
+		{Name: "HistoryID", Type: reflect.TypeOf(int64(0)), Tag: `db:"history_id"`},
+		{Name: "Row", Type: gotype, Tag: `db:",embed"`},
+		{Name: "ValidFrom", Type: timeType, Tag: `db:"valid_from"`},
+		{Name: "ValidTo", Type: timePtrType, Tag: `db:"valid_to"`},
+	})
+}
+
+// historyTable returns the table's history table, which is not added to
+// the DbMap, or nil if it has none.  Its columns are those of the table,
+// without their keys, defaults and constraints.
+func (t *TableMap) historyTable() *TableMap {
+	if len(t.history) == 0 {
+		return nil
+	}
+	gotype := historyRow(t.gotype)
+	h := &TableMap{gotype: gotype, TableName: t.history, SchemaName: t.SchemaName, dbmap: t.dbmap, mapper: t.mapper}
+	for _, name := range []string{"HistoryID", "ValidFrom", "ValidTo"} {
+		f, _ := gotype.FieldByName(name)
+		h.Columns = append(h.Columns, &ColumnMap{
+			ColumnName: f.Tag.Get("db"),
+			fieldName:  name,
+			fieldIndex: f.Index,
+			gotype:     f.Type,
+			table:      h,
+		})
+	}
+	h.SetKeys(true, "history_id")
+	for _, col := range t.Columns {
+		if col.Transient {
+			continue
+		}
+		c := *col
+		c.table = h
+		c.fieldName = "Row." + col.fieldName
+		c.fieldIndex = append([]int{1}, col.fieldIndex...)
+		c.Unique, c.isPK, c.isAutoIncr, c.readOnly, c.writeOnly = false, false, false, false, false
+		c.createSql, c.defaultExpr, c.checkExpr, c.generatedExpr = "", "", "", ""
+		h.Columns = append(h.Columns, &c)
+	}
+	return h
+}
+
+// recordHistory writes the version of the row elem written by op to the
+// table's history table, if it has one, and ends the version it replaces.
+func (t *TableMap) recordHistory(e SqlExecutor, op Operation, elem reflect.Value) error {
+	if len(t.history) == 0 {
+		return nil
+	}
+	d := t.dbmap.Dialect
+	name := t.history
+	if len(t.SchemaName) > 0 {
+		name = t.SchemaName + "." + name
+	}
+	history := quoteTable(d, name)
+	now := time.Now().UTC()
+	keys := t.keyValues(elem)
+
+	if op != OpInsert {
+		s := bytes.Buffer{}
+		s.WriteString(fmt.Sprintf("update %s set %s=%s where ", history, d.QuoteField("valid_to"), d.BindVar(0)))
+		t.writeKeyCondition(&s, 1)
+		s.WriteString(fmt.Sprintf(" and %s is null", d.QuoteField("valid_to")))
+		if _, err := t.exec(e, s.String(), append([]interface{}{now}, keys...)...); err != nil {
+			return err
+		}
+	}
+	if op == OpDelete {
+		return nil
+	}
+
+	s := bytes.Buffer{}
+	cols := bytes.Buffer{}
+	for _, col := range t.Columns {
+		if !col.Transient {
+			cols.WriteString(d.QuoteField(col.ColumnName))
+			cols.WriteString(",")
+		}
+	}
+	s.WriteString(fmt.Sprintf("insert into %s (%s%s) select %s%s from %s where ", history,
+		cols.String(), d.QuoteField("valid_from"), cols.String(), d.BindVar(0), quoteTable(d, t.qualifiedName())))
+	t.writeKeyCondition(&s, 1)
+	_, err := t.exec(e, s.String(), append([]interface{}{now}, keys...)...)
+	return err
+}
+
+// writeKeyCondition writes a condition matching the table's keys, with
+// bindvars starting at offset.
+func (t *TableMap) writeKeyCondition(s *bytes.Buffer, offset int) {
+	d := t.dbmap.Dialect
+	for i, col := range t.Keys {
+		if i > 0 {
+			s.WriteString(" and ")
+		}
+		s.WriteString(d.QuoteField(col.ColumnName))
+		s.WriteString("=")
+		s.WriteString(d.BindVar(offset + i))
+	}
+}
+
+// AsOf selects the rows of a table kept with SetHistory as they were at
+// the time at into dest, a pointer to a slice of the table's type or of
+// pointers to it.  where, if it is not empty, is a condition on the
+// table's columns, with bindvars for args, which may also include
+// QueryOptions.
+func (m *DbMap) AsOf(dest interface{}, at time.Time, where string, args ...interface{}) error {
+	return asOf(m, m, dest, at, where, args...)
+}
+
+func asOf(m *DbMap, e SqlExecutor, dest interface{}, at time.Time, where string, args ...interface{}) error {
+	t := reflect.TypeOf(dest)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("modl: AsOf needs a pointer to a slice, got %T", dest)
+	}
+	t = t.Elem().Elem()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	table := m.TableForType(t)
+	if table == nil {
+		return fmt.Errorf("modl: no table found for %v", t)
+	}
+	h := table.historyTable()
+	if h == nil {
+		return fmt.Errorf("modl: table %s keeps no history", table.TableName)
+	}
+
+	d := m.Dialect
+	validFrom, validTo := d.QuoteField("valid_from"), d.QuoteField("valid_to")
+	query := fmt.Sprintf("select %s from %s where %s <= ? and (%s is null or %s > ?)",
+		table.SelectColumnList(""), quoteTable(d, h.qualifiedName()), validFrom, validTo, validTo)
+	if len(where) > 0 {
+		query += " and (" + where + ")"
+	}
+	at = at.UTC()
+	return hookedselect(m, e, dest, query, append([]interface{}{at, at}, args...)...)
+}
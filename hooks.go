@@ -1,9 +1,111 @@
 package modl
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 )
 
+// Operation names the kind of statement a hook is run for.
+type Operation string
+
+// The operations hooks are run for.
+const (
+	OpInsert Operation = "insert"
+	OpUpdate Operation = "update"
+	OpDelete Operation = "delete"
+	OpGet    Operation = "get"
+)
+
+// HookContext is passed to the context variants of hooks, like
+// PreInsertCtx.  It is the context the call was made with, see WithContext,
+// along with the table and operation the hook is run for.
+//
+// The Validate, PreUpdate and PostUpdate hooks of an Update are passed the
+// row as it was before the update in Old, a pointer to the table's type,
+// when it was passed to Update with WithOld or read because of SetOldRows
+// or SetOldSnapshots;  otherwise Old is nil.
+type HookContext struct {
+	context.Context
+	Table *TableMap
+	Op    Operation
+	Old   interface{}
+}
+
+// Validator is an interface used to determine if a table type implements
+// a Validate hook.  Validate is run by Insert, Update and Save before the
+// PreInsert or PreUpdate hook, and if it returns an error, the row is not
+// written.  Returning a ValidationError lets callers tell which fields
+// were invalid.
+type Validator interface {
+	Validate(SqlExecutor) error
+}
+
+// ValidatorCtx is implemented by table types with a Validate hook which
+// needs the call's context.  It is used instead of Validator.
+type ValidatorCtx interface {
+	ValidateCtx(HookContext, SqlExecutor) error
+}
+
+// FieldError is a message about an invalid field.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationError is returned by Validate hooks to describe each of the
+// fields of a row which are invalid.  Messages are added with Add, and Err
+// returns nil if there are none:
+//
+//	func (p *Person) Validate(e modl.SqlExecutor) error {
+//		var verr modl.ValidationError
+//		if p.Name == "" {
+//			verr.Add("Name", "is required")
+//		}
+//		return verr.Err()
+//	}
+//
+// Insert and Update set TableName if the hook leaves it empty.
+type ValidationError struct {
+	TableName string
+	Errors    []FieldError
+}
+
+// Add adds a message about field.
+func (e *ValidationError) Add(field, message string) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: message})
+}
+
+// Err returns e if it has any messages, or else nil.
+func (e ValidationError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Messages returns the messages about field.
+func (e ValidationError) Messages(field string) []string {
+	var msgs []string
+	for _, fe := range e.Errors {
+		if fe.Field == field {
+			msgs = append(msgs, fe.Message)
+		}
+	}
+	return msgs
+}
+
+// Error lists the messages of each invalid field.
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Field + " " + fe.Message
+	}
+	return fmt.Sprintf("invalid %s: %s", e.TableName, strings.Join(msgs, "; "))
+}
+
 // PreInserter is an interface used to determine if a table type implements
 // a PreInsert hook
 type PreInserter interface {
@@ -46,6 +148,247 @@ type PostDeleter interface {
 	PostDelete(SqlExecutor) error
 }
 
+// PreInserterCtx is implemented by table types with a PreInsert hook which
+// needs the call's context.  It is used instead of PreInserter.
+type PreInserterCtx interface {
+	PreInsertCtx(HookContext, SqlExecutor) error
+}
+
+// PostInserterCtx is implemented by table types with a PostInsert hook
+// which needs the call's context.  It is used instead of PostInserter.
+type PostInserterCtx interface {
+	PostInsertCtx(HookContext, SqlExecutor) error
+}
+
+// PostGetterCtx is implemented by table types with a PostGet hook which
+// needs the call's context.  It is used instead of PostGetter.
+type PostGetterCtx interface {
+	PostGetCtx(HookContext, SqlExecutor) error
+}
+
+// PreUpdaterCtx is implemented by table types with a PreUpdate hook which
+// needs the call's context.  It is used instead of PreUpdater.
+type PreUpdaterCtx interface {
+	PreUpdateCtx(HookContext, SqlExecutor) error
+}
+
+// PostUpdaterCtx is implemented by table types with a PostUpdate hook
+// which needs the call's context.  It is used instead of PostUpdater.
+type PostUpdaterCtx interface {
+	PostUpdateCtx(HookContext, SqlExecutor) error
+}
+
+// PreDeleterCtx is implemented by table types with a PreDelete hook which
+// needs the call's context.  It is used instead of PreDeleter.
+type PreDeleterCtx interface {
+	PreDeleteCtx(HookContext, SqlExecutor) error
+}
+
+// PostDeleterCtx is implemented by table types with a PostDelete hook
+// which needs the call's context.  It is used instead of PostDeleter.
+type PostDeleterCtx interface {
+	PostDeleteCtx(HookContext, SqlExecutor) error
+}
+
+// HookEvent names the hooks which can be added to a table with AddHook.
+type HookEvent int
+
+// The events hooks are run for, like the methods of Validator, PreInserter
+// and the other hook interfaces.
+const (
+	ValidateEvent HookEvent = iota
+	PreInsertEvent
+	PostInsertEvent
+	PostGetEvent
+	PreUpdateEvent
+	PostUpdateEvent
+	PreDeleteEvent
+	PostDeleteEvent
+)
+
+// A HookFunc is a hook added to a table with AddHook.  row is a pointer to
+// the struct being written or read.
+type HookFunc func(hc HookContext, e SqlExecutor, row interface{}) error
+
+// SkipOperation is returned by a PreInsert, PreUpdate or PreDelete hook to
+// leave its row unwritten without failing:  the row is not written, its
+// Post hooks are not run, and the call returns no error, counting no rows
+// for it.  Reason is for logging.
+//
+//	func (a *Account) PreDelete(e modl.SqlExecutor) error {
+//		if a.Protected {
+//			return modl.SkipOperation{Reason: "account is protected"}
+//		}
+//		return nil
+//	}
+type SkipOperation struct {
+	Reason string
+}
+
+func (s SkipOperation) Error() string {
+	if s.Reason == "" {
+		return "modl: operation skipped"
+	}
+	return "modl: operation skipped: " + s.Reason
+}
+
+// errSkipped is returned by updateOne for a row whose PreUpdate hook
+// returned a SkipOperation, so that Save does not insert it instead.
+var errSkipped = errors.New("modl: update skipped")
+
+// skipped returns true if err is a SkipOperation.
+func skipped(err error) bool {
+	var skip SkipOperation
+	return errors.As(err, &skip)
+}
+
+// AddHook adds fn to the hooks run for event on the table's rows.  A table
+// may have any number of hooks for each event:  the row's own method, eg.
+// PreInsert, is run first, then the hooks added with AddHook, in the order
+// they were added.  The first error returned stops the others from running.
+func (t *TableMap) AddHook(event HookEvent, fn HookFunc) *TableMap {
+	if t.hooks == nil {
+		t.hooks = map[HookEvent][]HookFunc{}
+	}
+	t.hooks[event] = append(t.hooks[event], fn)
+	switch event {
+	case ValidateEvent:
+		t.CanValidate = true
+	case PreInsertEvent:
+		t.CanPreInsert = true
+	case PostInsertEvent:
+		t.CanPostInsert = true
+	case PostGetEvent:
+		t.CanPostGet = true
+	case PreUpdateEvent:
+		t.CanPreUpdate = true
+	case PostUpdateEvent:
+		t.CanPostUpdate = true
+	case PreDeleteEvent:
+		t.CanPreDelete = true
+	case PostDeleteEvent:
+		t.CanPostDelete = true
+	}
+	return t
+}
+
+type hook int
+
+const (
+	validateInsert hook = iota
+	validateUpdate
+	preInsert
+	postInsert
+	postGet
+	preUpdate
+	postUpdate
+	preDelete
+	postDelete
+)
+
+// event returns the HookEvent of h, and the operation it is run for.
+func (h hook) event() (HookEvent, Operation) {
+	switch h {
+	case validateInsert:
+		return ValidateEvent, OpInsert
+	case validateUpdate:
+		return ValidateEvent, OpUpdate
+	case preInsert:
+		return PreInsertEvent, OpInsert
+	case postInsert:
+		return PostInsertEvent, OpInsert
+	case postGet:
+		return PostGetEvent, OpGet
+	case preUpdate:
+		return PreUpdateEvent, OpUpdate
+	case postUpdate:
+		return PostUpdateEvent, OpUpdate
+	case preDelete:
+		return PreDeleteEvent, OpDelete
+	}
+	return PostDeleteEvent, OpDelete
+}
+
+// runHook runs hook h on ptr:  its own method, preferring the context
+// variant, and then the hooks added with AddHook.
+func (t *TableMap) runHook(h hook, ctx context.Context, e SqlExecutor, ptr interface{}) error {
+	return t.runUpdateHook(h, ctx, e, ptr, nil)
+}
+
+// runUpdateHook runs hook h on ptr, an updated row, with old, the row as it
+// was before the update, or nil.
+func (t *TableMap) runUpdateHook(h hook, ctx context.Context, e SqlExecutor, ptr, old interface{}) error {
+	event, op := h.event()
+	hc := HookContext{Context: ctx, Table: t, Op: op, Old: old}
+	err := runMethodHook(event, hc, e, ptr)
+	for _, fn := range t.hooks[event] {
+		if err != nil {
+			break
+		}
+		err = fn(hc, e, ptr)
+	}
+	if verr, ok := err.(ValidationError); ok && event == ValidateEvent && verr.TableName == "" {
+		verr.TableName = t.TableName
+		err = verr
+	}
+	return err
+}
+
+// runMethodHook runs the method of ptr for event, if it has one.
+func runMethodHook(event HookEvent, hc HookContext, e SqlExecutor, ptr interface{}) error {
+	switch event {
+	case ValidateEvent:
+		if x, ok := ptr.(ValidatorCtx); ok {
+			return x.ValidateCtx(hc, e)
+		} else if x, ok := ptr.(Validator); ok {
+			return x.Validate(e)
+		}
+	case PreInsertEvent:
+		if x, ok := ptr.(PreInserterCtx); ok {
+			return x.PreInsertCtx(hc, e)
+		} else if x, ok := ptr.(PreInserter); ok {
+			return x.PreInsert(e)
+		}
+	case PostInsertEvent:
+		if x, ok := ptr.(PostInserterCtx); ok {
+			return x.PostInsertCtx(hc, e)
+		} else if x, ok := ptr.(PostInserter); ok {
+			return x.PostInsert(e)
+		}
+	case PostGetEvent:
+		if x, ok := ptr.(PostGetterCtx); ok {
+			return x.PostGetCtx(hc, e)
+		} else if x, ok := ptr.(PostGetter); ok {
+			return x.PostGet(e)
+		}
+	case PreUpdateEvent:
+		if x, ok := ptr.(PreUpdaterCtx); ok {
+			return x.PreUpdateCtx(hc, e)
+		} else if x, ok := ptr.(PreUpdater); ok {
+			return x.PreUpdate(e)
+		}
+	case PostUpdateEvent:
+		if x, ok := ptr.(PostUpdaterCtx); ok {
+			return x.PostUpdateCtx(hc, e)
+		} else if x, ok := ptr.(PostUpdater); ok {
+			return x.PostUpdate(e)
+		}
+	case PreDeleteEvent:
+		if x, ok := ptr.(PreDeleterCtx); ok {
+			return x.PreDeleteCtx(hc, e)
+		} else if x, ok := ptr.(PreDeleter); ok {
+			return x.PreDelete(e)
+		}
+	case PostDeleteEvent:
+		if x, ok := ptr.(PostDeleterCtx); ok {
+			return x.PostDeleteCtx(hc, e)
+		} else if x, ok := ptr.(PostDeleter); ok {
+			return x.PostDelete(e)
+		}
+	}
+	return nil
+}
+
 // Determine which hooks are supported by the mapper struct i
 func (t *TableMap) setupHooks(i interface{}) {
 	// These hooks must be implemented on a pointer, so if a value is passed in
@@ -56,11 +399,19 @@ func (t *TableMap) setupHooks(i interface{}) {
 		ptr = reflect.New(reflect.ValueOf(i).Type()).Interface()
 	}
 
-	_, t.CanPreInsert = ptr.(PreInserter)
-	_, t.CanPostInsert = ptr.(PostInserter)
-	_, t.CanPostGet = ptr.(PostGetter)
-	_, t.CanPreUpdate = ptr.(PreUpdater)
-	_, t.CanPostUpdate = ptr.(PostUpdater)
-	_, t.CanPreDelete = ptr.(PreDeleter)
-	_, t.CanPostDelete = ptr.(PostDeleter)
+	t.CanValidate = implements(ptr, (*Validator)(nil), (*ValidatorCtx)(nil))
+	t.CanPreInsert = implements(ptr, (*PreInserter)(nil), (*PreInserterCtx)(nil))
+	t.CanPostInsert = implements(ptr, (*PostInserter)(nil), (*PostInserterCtx)(nil))
+	t.CanPostGet = implements(ptr, (*PostGetter)(nil), (*PostGetterCtx)(nil))
+	t.CanPreUpdate = implements(ptr, (*PreUpdater)(nil), (*PreUpdaterCtx)(nil))
+	t.CanPostUpdate = implements(ptr, (*PostUpdater)(nil), (*PostUpdaterCtx)(nil))
+	t.CanPreDelete = implements(ptr, (*PreDeleter)(nil), (*PreDeleterCtx)(nil))
+	t.CanPostDelete = implements(ptr, (*PostDeleter)(nil), (*PostDeleterCtx)(nil))
+}
+
+// implements returns true if i implements either of the interfaces pointed
+// to by a and b.
+func implements(i interface{}, a, b interface{}) bool {
+	t := reflect.TypeOf(i)
+	return t.Implements(reflect.TypeOf(a).Elem()) || t.Implements(reflect.TypeOf(b).Elem())
 }
@@ -0,0 +1,190 @@
+package modl
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SelectJoin runs query, which joins tables registered with AddTable, and
+// binds its rows to dest, a pointer to a slice of structs, or of pointers
+// to structs, composed of the tables' types:
+//
+//	type PersonInvoice struct {
+//		Person  Person
+//		Invoice *Invoice `db:"inv_"`
+//	}
+//	query := "select " + people.JoinColumnList("p", "person_") + "," +
+//		invoices.JoinColumnList("i", "inv_") +
+//		" from person p left join invoice i on i.personid = p.id"
+//	err := dbmap.SelectJoin(&rows, query)
+//
+// Each field of a table's type is filled from the columns named with its
+// prefix, which is the field's db tag, or its mapped name followed by "_".
+// Pointer fields are left nil if all of their columns are NULL, as for
+// the unmatched side of an outer join.  Other fields are bound to the
+// column they are mapped to, like Select.  PostGet hooks are run on the
+// rows of each table.  See TableMap.JoinColumnList.
+func (m *DbMap) SelectJoin(dest interface{}, query string, args ...interface{}) error {
+	return selectJoin(m, m, dest, query, args...)
+}
+
+// joinPart is a field of the composite type, and the fields of the union
+// row its columns are scanned into.
+type joinPart struct {
+	index []int
+	table *TableMap
+	// for tables, the columns of the table;  otherwise a single field
+	columns []variantColumn
+	ptr     bool
+}
+
+func selectJoin(m *DbMap, e SqlExecutor, dest interface{}, query string, args ...interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("modl: SelectJoin expected a pointer to a slice, got %T", dest)
+	}
+	elemType := v.Elem().Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return fmt.Errorf("modl: SelectJoin expected a slice of structs, got %T", dest)
+	}
+	_, opts := splitOptions(args)
+
+	// rows are scanned into a struct with a pointer field for each column,
+	// or the value a codec decodes, and copied into the parts they are for
+	var fields []reflect.StructField
+	addField := func(name string, typ reflect.Type) int {
+		f := len(fields)
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("F%d", f),
+			Type: typ,
+			Tag:  reflect.StructTag(fmt.Sprintf(`db:"%s"`, name)),
+		})
+		return f
+	}
+	var parts []joinPart
+	for i := 0; i < elemType.NumField(); i++ {
+		sf := elemType.Field(i)
+		if len(sf.PkgPath) > 0 {
+			continue
+		}
+		tag := sf.Tag.Get("db")
+		if tag == "-" {
+			continue
+		}
+		part := joinPart{index: sf.Index}
+		typ := sf.Type
+		if typ.Kind() == reflect.Ptr {
+			part.ptr = true
+			typ = typ.Elem()
+		}
+		if table := m.TableForType(typ); table != nil {
+			prefix := tag
+			if len(prefix) == 0 {
+				prefix = sqlx.NameMapper(sf.Name) + "_"
+			}
+			part.table = table
+			for _, col := range table.Columns {
+				if !col.isSelected() {
+					continue
+				}
+				ft := reflect.PtrTo(col.gotype)
+				if col.getCodec(m) != nil {
+					ft = reflect.TypeOf((*interface{})(nil)).Elem()
+				}
+				f := addField(prefix+col.ColumnName, ft)
+				part.columns = append(part.columns, variantColumn{col, f})
+			}
+		} else {
+			name := tag
+			if len(name) == 0 {
+				name = sqlx.NameMapper(sf.Name)
+			}
+			f := addField(name, reflect.PtrTo(sf.Type))
+			part.columns = []variantColumn{{nil, f}}
+		}
+		parts = append(parts, part)
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("modl: SelectJoin found no fields in %v", elemType)
+	}
+
+	rows := reflect.New(reflect.SliceOf(reflect.StructOf(fields)))
+	if err := e.Select(rows.Interface(), query, args...); err != nil {
+		return err
+	}
+
+	rows = rows.Elem()
+	out := v.Elem()
+	for r := 0; r < rows.Len(); r++ {
+		row := rows.Index(r)
+		elem := reflect.New(elemType)
+		for _, part := range parts {
+			field := elem.Elem().FieldByIndex(part.index)
+			if part.table == nil {
+				if p := row.Field(part.columns[0].field); !p.IsNil() {
+					field.Set(p.Elem())
+				}
+				continue
+			}
+			target, err := part.fill(m, row)
+			if err != nil {
+				return err
+			}
+			if !target.IsValid() {
+				continue
+			}
+			if part.ptr {
+				field.Set(target)
+			} else {
+				field.Set(target.Elem())
+				target = field.Addr()
+			}
+			if part.table.CanPostGet && !opts.noHooks {
+				if err := part.table.runHook(postGet, opts.context(), e, target.Interface()); err != nil {
+					return err
+				}
+			}
+		}
+		if isPtr {
+			out.Set(reflect.Append(out, elem))
+		} else {
+			out.Set(reflect.Append(out, elem.Elem()))
+		}
+	}
+	return nil
+}
+
+// fill returns a pointer to a new row of the part's table holding its
+// columns of row, read by m, or the zero Value if they are all NULL.
+func (part joinPart) fill(m *DbMap, row reflect.Value) (reflect.Value, error) {
+	null := true
+	for _, vc := range part.columns {
+		if !row.Field(vc.field).IsNil() {
+			null = false
+			break
+		}
+	}
+	if null {
+		return reflect.Value{}, nil
+	}
+	target := reflect.New(part.table.gotype)
+	for _, vc := range part.columns {
+		field := target.Elem().FieldByIndex(vc.col.fieldIndex)
+		if codec := vc.col.getCodec(m); codec != nil {
+			if err := codec.decode(field, row.Field(vc.field).Interface()); err != nil {
+				return reflect.Value{}, fmt.Errorf("column %s: %v", vc.col.ColumnName, err)
+			}
+			continue
+		}
+		if p := row.Field(vc.field); !p.IsNil() {
+			field.Set(p.Elem())
+		}
+	}
+	return target, nil
+}
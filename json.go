@@ -0,0 +1,188 @@
+package modl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// SelectJSON runs query and writes its rows to w as a JSON array of
+// objects keyed by column name, or as newline delimited JSON if the
+// NDJSON option is passed in args.  Rows are written as they are read, so
+// large results are not held in memory.  Text columns are written as
+// strings, and binary values which are not valid UTF-8 as base64 strings.
+// Returns the number of rows written.
+func (m *DbMap) SelectJSON(w io.Writer, query string, args ...interface{}) (int64, error) {
+	return selectJSON(m, m, w, query, args...)
+}
+
+// NDJSON makes SelectJSON write one JSON object per line, rather than a
+// JSON array.
+func NDJSON() QueryOption {
+	return func(o *queryOptions) {
+		o.ndjson = true
+	}
+}
+
+func selectJSON(m *DbMap, e SqlExecutor, w io.Writer, query string, args ...interface{}) (int64, error) {
+	args, opts := splitOptions(args)
+	query, args, err := m.rewrite(query, args, opts)
+	if err != nil {
+		return -1, err
+	}
+	h, done := opts.handleFor(e, true)
+	defer done()
+
+	rows, err := h.Queryx(query, args...)
+	if err != nil {
+		return -1, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return -1, err
+	}
+	names := make([][]byte, len(columns))
+	for i, c := range columns {
+		names[i], _ = json.Marshal(c)
+	}
+
+	bw := bufio.NewWriter(w)
+	if !opts.ndjson {
+		bw.WriteByte('[')
+	}
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		if n > 0 && !opts.ndjson {
+			bw.WriteByte(',')
+		}
+		bw.WriteByte('{')
+		for i, v := range values {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			bw.Write(names[i])
+			bw.WriteByte(':')
+			if b, ok := v.([]byte); ok && utf8.Valid(b) {
+				v = string(b)
+			}
+			data, err := json.Marshal(v)
+			if err != nil {
+				return n, fmt.Errorf("column %s: %v", columns[i], err)
+			}
+			bw.Write(data)
+		}
+		bw.WriteByte('}')
+		if opts.ndjson {
+			bw.WriteByte('\n')
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	if !opts.ndjson {
+		bw.WriteByte(']')
+	}
+	return n, bw.Flush()
+}
+
+// InsertJSON reads rows of table from r, a JSON array of objects or
+// newline delimited JSON objects keyed by column or field name, as written
+// by SelectJSON, and inserts them with CopyInsert.  Values are decoded into
+// the fields of the table's type like encoding/json, and strings are also
+// accepted for fields of other types, eg. numbers or times.  Returns the
+// number of rows inserted.
+func (m *DbMap) InsertJSON(r io.Reader, table *TableMap) (int64, error) {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	array := false
+	for {
+		c, err := br.Peek(1)
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return -1, err
+		}
+		switch c[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+			continue
+		case '[':
+			array = true
+			if _, err := dec.Token(); err != nil {
+				return -1, err
+			}
+		}
+		break
+	}
+
+	columns := map[string]*ColumnMap{}
+	for _, col := range table.Columns {
+		if col.isWritten() {
+			columns[strings.ToLower(col.ColumnName)] = col
+			columns[strings.ToLower(col.fieldName)] = col
+		}
+	}
+
+	rows := reflect.New(reflect.SliceOf(table.gotype)).Elem()
+	for n := 1; dec.More(); n++ {
+		var object map[string]json.RawMessage
+		if err := dec.Decode(&object); err != nil {
+			return -1, fmt.Errorf("modl: JSON row %d: %v", n, err)
+		}
+		elem := reflect.New(table.gotype).Elem()
+		for name, raw := range object {
+			col, ok := columns[strings.ToLower(name)]
+			if !ok {
+				return -1, fmt.Errorf("modl: JSON row %d: table %s has no column %s", n, table.TableName, name)
+			}
+			if err := decodeJSONField(m, col, elem.FieldByIndex(col.fieldIndex), raw); err != nil {
+				return -1, fmt.Errorf("modl: JSON row %d, column %s: %v", n, col.ColumnName, err)
+			}
+		}
+		rows = reflect.Append(rows, elem)
+	}
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return -1, err
+		}
+	}
+	if rows.Len() == 0 {
+		return 0, nil
+	}
+	return m.CopyInsert(table, rows.Interface())
+}
+
+// decodeJSONField sets field, a field of col, to the JSON value raw, read
+// for m.
+func decodeJSONField(m *DbMap, col *ColumnMap, field reflect.Value, raw json.RawMessage) error {
+	if string(raw) == "null" {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	err := json.Unmarshal(raw, field.Addr().Interface())
+	if err == nil {
+		return nil
+	}
+	// strings are read like CSV fields, so that text written by
+	// SelectJSON for eg. numbers and decimals can be read back
+	var text string
+	if json.Unmarshal(raw, &text) != nil {
+		return err
+	}
+	return parseColumn(m, col, field, text)
+}
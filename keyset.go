@@ -0,0 +1,95 @@
+package modl
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/jmoiron/sqlx/reflectx"
+)
+
+// KeysetCursor describes a page of results for SelectKeyset.  Rather than
+// skipping rows with OFFSET, which gets slower the further a query pages,
+// each page selects the rows ordered after the last row of the previous
+// one.
+type KeysetCursor struct {
+	// Column orders the results.  Its values must be unique, like those of
+	// a primary key, and it must be one of the query's result columns.
+	Column string
+	// After is the value of Column in the last row of the previous page,
+	// or nil for the first page.
+	After interface{}
+	// Limit is the most rows a page holds;  0 means no limit.
+	Limit int
+	// Desc orders the results by Column descending.
+	Desc bool
+	// End is set on the cursor SelectKeyset returns for the last page.
+	End bool
+}
+
+// SelectKeyset runs query for the page of results described by cursor,
+// binding them to dest like Select, and returns the cursor for the next
+// page.  Unlike Select, it replaces the elements of dest with the page.  query is wrapped in a subquery which is filtered by, ordered by
+// and limited on the cursor's Column, so it should not order or limit the
+// results itself:
+//
+//	cursor := modl.KeysetCursor{Column: "id", Limit: 100}
+//	for !cursor.End {
+//		cursor, err = dbmap.SelectKeyset(&people, "select * from people", cursor)
+//		...
+//	}
+func (m *DbMap) SelectKeyset(dest interface{}, query string, cursor KeysetCursor, args ...interface{}) (KeysetCursor, error) {
+	return selectKeyset(m, m, dest, query, cursor, args...)
+}
+
+func selectKeyset(m *DbMap, e SqlExecutor, dest interface{}, query string, cursor KeysetCursor, args ...interface{}) (KeysetCursor, error) {
+	column := m.Dialect.QuoteField(cursor.Column)
+	op, order := ">", "asc"
+	if cursor.Desc {
+		op, order = "<", "desc"
+	}
+
+	query = fmt.Sprintf("select * from (%s) modl_keyset", query)
+	if cursor.After != nil {
+		rest, opts := splitOptions(args)
+		// rewritten queries and those with slice args use "?" bindvars,
+		// which are rebound for the dialect afterwards
+		bindvar := "?"
+		if (!m.rewrites() || opts.raw) && !hasSliceArg(rest) {
+			bindvar = m.Dialect.BindVar(len(rest))
+		}
+		query += fmt.Sprintf(" where %s %s %s", column, op, bindvar)
+		args = append(args[:len(args):len(args)], cursor.After)
+	}
+	query += fmt.Sprintf(" order by %s %s", column, order)
+	if cursor.Limit > 0 {
+		query += fmt.Sprintf(" limit %d", cursor.Limit)
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(dest))
+	if v.Kind() == reflect.Slice {
+		v.SetLen(0)
+	}
+	if err := hookedselect(m, e, dest, query, args...); err != nil {
+		return cursor, err
+	}
+
+	next := cursor
+	n := v.Len()
+	if n == 0 || cursor.Limit == 0 || n < cursor.Limit {
+		next.End = true
+	}
+	if n == 0 {
+		return next, nil
+	}
+	last := reflect.Indirect(v.Index(n - 1))
+	if isScannable(m.Dbx.Mapper, last.Type()) {
+		next.After = last.Interface()
+		return next, nil
+	}
+	fi := m.Dbx.Mapper.TypeMap(last.Type()).GetByPath(cursor.Column)
+	if fi == nil {
+		return cursor, fmt.Errorf("modl: keyset column %s is not a field of %v", cursor.Column, last.Type())
+	}
+	next.After = reflectx.FieldByIndexesReadOnly(last, fi.Index).Interface()
+	return next, nil
+}
@@ -0,0 +1,210 @@
+package modl
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// A Loader coalesces the Loads of rows of a table by key made within a
+// short window, eg. by the resolvers of a GraphQL query, into a single
+// select of the rows with any of the keys, and keeps the rows it has
+// loaded, so that each key is read at most once.  It is meant to live for
+// a request:  rows written after they are loaded are not reloaded, unless
+// they are cleared with Clear.  A Loader is safe for concurrent use.
+//
+//	users := dbmap.NewLoader(User{}, time.Millisecond)
+//	var u User
+//	err := users.Load(&u, order.UserID)
+type Loader struct {
+	dbmap    *DbMap
+	table    *TableMap
+	wait     time.Duration
+	maxBatch int
+
+	mu    sync.Mutex
+	batch *loaderBatch
+	rows  map[interface{}]*loaderBatch
+}
+
+// loaderBatch is a select of the rows with keys, which closes done when
+// it has run.
+type loaderBatch struct {
+	keys       []interface{}
+	dispatched bool
+	done       chan struct{}
+	rows       map[interface{}]reflect.Value
+	err        error
+}
+
+// NewLoader returns a Loader of the rows of the table of i, a struct or
+// pointer to a struct registered with AddTable, which waits for wait after
+// the first Load of a batch for more before selecting them.  It panics if
+// the table is not registered or does not have a single key.
+func (m *DbMap) NewLoader(i interface{}, wait time.Duration) *Loader {
+	table := m.TableFor(i)
+	if table == nil {
+		panic(fmt.Sprintf("No table found for %T", i))
+	}
+	if len(table.Keys) != 1 {
+		panic(fmt.Sprintf("Table %s needs a single key to be loaded", table.TableName))
+	}
+	return &Loader{dbmap: m, table: table, wait: wait, maxBatch: 100, rows: map[interface{}]*loaderBatch{}}
+}
+
+// SetMaxBatch sets the largest number of keys selected together, 100 by
+// default.  A batch reaching it is selected without waiting.
+func (l *Loader) SetMaxBatch(n int) *Loader {
+	l.maxBatch = n
+	return l
+}
+
+// Load sets dest, a pointer to a struct of the Loader's table, to the row
+// with key, waiting for it to be selected with the other keys of its
+// batch.  Like Get, it returns ErrNotFound if there is no such row, and
+// runs the row's PostGet hook when it is selected.
+func (l *Loader) Load(dest interface{}, key interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Type() != l.table.gotype {
+		return fmt.Errorf("modl: Loader of %s cannot load into a %T", l.table.TableName, dest)
+	}
+	k := loaderKey(key)
+	l.mu.Lock()
+	b, ok := l.rows[k]
+	if !ok {
+		b = l.batch
+		if b == nil {
+			b = &loaderBatch{done: make(chan struct{})}
+			l.batch = b
+			time.AfterFunc(l.wait, func() { l.dispatch(b) })
+		}
+		b.keys = append(b.keys, key)
+		l.rows[k] = b
+	}
+	full := l.batch == b && len(b.keys) >= l.maxBatch
+	l.mu.Unlock()
+	if full {
+		l.dispatch(b)
+	}
+
+	<-b.done
+	if b.err != nil {
+		return b.err
+	}
+	row, ok := b.rows[k]
+	if !ok {
+		return ErrNotFound
+	}
+	v.Elem().Set(row)
+	return nil
+}
+
+// Clear forgets the row loaded with key, so that it is selected again by
+// its next Load, or all rows if no key is given.
+func (l *Loader) Clear(keys ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(keys) == 0 {
+		l.rows = map[interface{}]*loaderBatch{}
+		return
+	}
+	for _, key := range keys {
+		delete(l.rows, loaderKey(key))
+	}
+}
+
+// dispatch selects the rows of b, if they have not been selected.
+func (l *Loader) dispatch(b *loaderBatch) {
+	l.mu.Lock()
+	if l.batch == b {
+		l.batch = nil
+	}
+	if b.dispatched {
+		l.mu.Unlock()
+		return
+	}
+	b.dispatched = true
+	l.mu.Unlock()
+
+	b.rows, b.err = l.load(b.keys)
+	if b.err != nil {
+		// keys which failed are selected again by their next Load
+		l.mu.Lock()
+		for _, key := range b.keys {
+			if k := loaderKey(key); l.rows[k] == b {
+				delete(l.rows, k)
+			}
+		}
+		l.mu.Unlock()
+	}
+	close(b.done)
+}
+
+// load selects the rows with keys, in chunks which fit the Dialect's
+// limit on bind parameters, and returns them by key.
+func (l *Loader) load(keys []interface{}) (map[interface{}]reflect.Value, error) {
+	t, m := l.table, l.dbmap
+	d := m.Dialect
+	scope, err := t.scopeArgs(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	n := d.MaxBindParams() - len(scope)
+	if n < 1 {
+		n = 1
+	}
+
+	rows := map[interface{}]reflect.Value{}
+	for len(keys) > 0 {
+		chunk := keys
+		if len(chunk) > n {
+			chunk = chunk[:n]
+		}
+		keys = keys[len(chunk):]
+
+		s := bytes.Buffer{}
+		s.WriteString("select ")
+		s.WriteString(t.SelectColumnList(""))
+		s.WriteString(" from ")
+		s.WriteString(quoteTable(d, t.qualifiedName()))
+		s.WriteString(" where ")
+		s.WriteString(d.QuoteField(t.Keys[0].ColumnName))
+		s.WriteString(" in (")
+		for i := range chunk {
+			if i > 0 {
+				s.WriteString(",")
+			}
+			s.WriteString(d.BindVar(i))
+		}
+		s.WriteString(")")
+		t.writeScope(&s, len(chunk))
+
+		dest := reflect.New(reflect.SliceOf(reflect.PtrTo(t.gotype)))
+		args := append(append([]interface{}{}, chunk...), scope...)
+		if err := hookedselect(m, m, dest.Interface(), s.String(), args...); err != nil {
+			return nil, err
+		}
+		for i := 0; i < dest.Elem().Len(); i++ {
+			row := dest.Elem().Index(i).Elem()
+			rows[loaderKey(t.keyValues(row)[0])] = row
+		}
+	}
+	return rows, nil
+}
+
+// loaderKey returns key as a value which is equal to the key of the same
+// row scanned from the database, eg. an int64 for an int key.
+func loaderKey(key interface{}) interface{} {
+	v, err := driver.DefaultParameterConverter.ConvertValue(key)
+	if err != nil {
+		return key
+	}
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
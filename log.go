@@ -0,0 +1,111 @@
+package modl
+
+import (
+	"database/sql"
+	"log"
+)
+
+// LogLevel controls what a DbMap logs once tracing is turned on.
+type LogLevel int
+
+const (
+	// LogOff logs nothing.
+	LogOff LogLevel = iota
+	// LogErrors logs statements which fail, with their args and error.
+	LogErrors
+	// LogStatements logs every statement without its args, as well as
+	// failures.
+	LogStatements
+	// LogArgs logs every statement along with its args, as well as
+	// failures.
+	LogArgs
+)
+
+type tracer struct {
+	logger *log.Logger
+	prefix string
+	level  LogLevel
+}
+
+// sensitiveValue wraps a bound value which should not be logged.
+type sensitiveValue struct {
+	v interface{}
+}
+
+// Sensitive marks a bound value, like a password or token, so that it is
+// replaced by a placeholder wherever modl logs or reports args.  The value
+// itself is still sent to the database:
+//
+//	dbmap.Exec("update users set token=? where id=?", modl.Sensitive(token), id)
+func Sensitive(v interface{}) interface{} {
+	return sensitiveValue{v}
+}
+
+// String keeps sensitive values out of logs which print them directly,
+// eg. from middleware or captured statements.
+func (s sensitiveValue) String() string {
+	return redacted
+}
+
+// unwrapSensitive returns args with any Sensitive values unwrapped, and a
+// copy of args with them redacted which is safe to log.  args is returned
+// for both if it holds no Sensitive values.
+func unwrapSensitive(args []interface{}) ([]interface{}, []interface{}) {
+	var unwrapped, logged []interface{}
+	for i, a := range args {
+		s, ok := a.(sensitiveValue)
+		if !ok {
+			continue
+		}
+		if unwrapped == nil {
+			unwrapped = append([]interface{}{}, args...)
+			logged = append([]interface{}{}, args...)
+		}
+		unwrapped[i] = s.v
+		logged[i] = redacted
+	}
+	if unwrapped == nil {
+		return args, args
+	}
+	return unwrapped, logged
+}
+
+func (m *DbMap) getTracer() *tracer {
+	t, _ := m.tracer.Load().(*tracer)
+	if t == nil || t.logger == nil || t.level == LogOff {
+		return nil
+	}
+	return t
+}
+
+func (m *DbMap) trace(query string, args ...interface{}) {
+	t := m.getTracer()
+	switch {
+	case t == nil:
+	case t.level >= LogArgs:
+		t.logger.Printf("%s%s %v", t.prefix, query, args)
+	case t.level >= LogStatements:
+		t.logger.Printf("%s%s", t.prefix, query)
+	}
+}
+
+// unsupportedField reports a field AddTable has made transient to the
+// UnsupportedFieldLogger, or logs it as a warning.
+func (m *DbMap) unsupportedField(e UnsupportedFieldError) {
+	switch t := m.getTracer(); {
+	case m.UnsupportedFieldLogger != nil:
+		m.UnsupportedFieldLogger(e)
+	case t != nil:
+		t.logger.Printf("%swarning: %v", t.prefix, e)
+	default:
+		log.Printf("warning: %v", e)
+	}
+}
+
+// traceError logs a statement which failed with err.  sql.ErrNoRows is not
+// considered a failure.
+func (m *DbMap) traceError(query string, args []interface{}, err error) {
+	if t := m.getTracer(); t != nil && err != nil && err != sql.ErrNoRows {
+		t.logger.Printf("%s%s %v error: %v", t.prefix, query, args, err)
+	}
+}
@@ -0,0 +1,85 @@
+package modl
+
+import "reflect"
+
+// The accessors below expose the mapping of a table, eg. to admin UIs,
+// validators and documentation generators.  The table's columns and
+// keys are its Columns and Keys fields.
+
+// GoType returns the struct type mapped to the table.
+func (t *TableMap) GoType() reflect.Type {
+	return t.gotype
+}
+
+// VersionColumn returns the column used for optimistic locking, or nil
+// if the table has none.  See SetVersionCol.
+func (t *TableMap) VersionColumn() *ColumnMap {
+	return t.version
+}
+
+// Table returns the table the column belongs to.
+func (c *ColumnMap) Table() *TableMap {
+	return c.table
+}
+
+// FieldName returns the name of the struct field mapped to the column,
+// eg. "Name", or "Address.City" for a field of a struct embedded with
+// a ",embed" tag.
+func (c *ColumnMap) FieldName() string {
+	return c.fieldName
+}
+
+// GoType returns the type of the struct field mapped to the column.
+func (c *ColumnMap) GoType() reflect.Type {
+	return c.gotype
+}
+
+// SqlType returns the type of the column in create table statements:
+// the one set with SetSqlType, or the Dialect's for its field.  A
+// definition set with SetSqlCreate is not parsed.
+func (c *ColumnMap) SqlType() string {
+	if len(c.sqltype) > 0 {
+		return c.sqltype
+	}
+	if sd := c.spatial(); sd != nil {
+		return sd.GeometryType(c.srid)
+	}
+	return c.table.dbmap.Dialect.ToSqlType(c.valueColumn())
+}
+
+// IsKey returns true if the column is one of the table's keys.
+func (c *ColumnMap) IsKey() bool {
+	return c.isPK
+}
+
+// IsAutoIncrement returns true if the database generates the column's
+// values on Insert.
+func (c *ColumnMap) IsAutoIncrement() bool {
+	return c.isAutoIncr
+}
+
+// IsReadOnly and IsWriteOnly return what was set with SetReadOnly and
+// SetWriteOnly.
+func (c *ColumnMap) IsReadOnly() bool {
+	return c.readOnly
+}
+
+func (c *ColumnMap) IsWriteOnly() bool {
+	return c.writeOnly
+}
+
+// Nullable returns true if the column's field can hold NULL:  a pointer
+// or a Null wrapper like sql.NullString.
+func (c *ColumnMap) Nullable() bool {
+	return nullWrapped(c.gotype) != nil
+}
+
+// Default returns the expression set with SetDefault, or "".
+func (c *ColumnMap) Default() string {
+	return c.defaultExpr
+}
+
+// Comment returns the column's comment, or "".
+func (c *ColumnMap) Comment() string {
+	return c.comment
+}
@@ -0,0 +1,49 @@
+package modl
+
+import "context"
+
+// Statement is a statement about to be run, as seen by middleware.
+// Middleware may change Query and Args before passing it on.
+type Statement struct {
+	Query string
+	// Args are the statement's bound values.  Values wrapped with
+	// Sensitive are still wrapped, so they are redacted if printed.
+	Args []interface{}
+	// Exec is true for statements which do not return rows, like
+	// inserts, updates and deletes.
+	Exec bool
+	// InTx is true for statements run in a Transaction.
+	InTx bool
+}
+
+// ExecFunc runs a statement.
+type ExecFunc func(ctx context.Context, stmt *Statement) error
+
+// Use adds middleware around every statement run through the DbMap and
+// its transactions, eg. for circuit breaking, rate limiting or rewriting
+// queries.  Each middleware is given the next ExecFunc in the chain, and
+// returns an ExecFunc which may run code before and after calling it, or
+// not call it at all and return an error instead:
+//
+//	dbmap.Use(func(next modl.ExecFunc) modl.ExecFunc {
+//		return func(ctx context.Context, stmt *modl.Statement) error {
+//			if err := limiter.Wait(ctx); err != nil {
+//				return err
+//			}
+//			return next(ctx, stmt)
+//		}
+//	})
+//
+// Middleware added first runs first.  Use should be called before the
+// DbMap is used.
+func (m *DbMap) Use(middleware ...func(next ExecFunc) ExecFunc) {
+	m.middleware = append(m.middleware, middleware...)
+}
+
+// chain returns fn wrapped in the DbMap's middleware.
+func (m *DbMap) chain(fn ExecFunc) ExecFunc {
+	for i := len(m.middleware) - 1; i >= 0; i-- {
+		fn = m.middleware[i](fn)
+	}
+	return fn
+}
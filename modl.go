@@ -10,9 +10,12 @@ package modl
 // https://github.com/jmoiron/modl
 
 import (
+	"bytes"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"reflect"
+	"sync/atomic"
 )
 
 // NoKeysErr is a special error type returned when modl's CRUD helpers are
@@ -47,6 +50,12 @@ type OptimisticLockError struct {
 	// Version value on the struct passed to Update/Delete. This value is
 	// out of sync with the database.
 	LocalVersion int64
+
+	// Current is a pointer to the row as it is in the database, if
+	// RowExists, so that it can be compared with or merged into the stale
+	// one.  It is nil for the errors of batched writes, which only read the
+	// current versions.
+	Current interface{}
 }
 
 // Error returns a description of the cause of the lock error
@@ -58,6 +67,89 @@ func (e OptimisticLockError) Error() string {
 	return fmt.Sprintf("OptimisticLockError no row found for table=%s keys=%v", e.TableName, e.Keys)
 }
 
+// ErrNotFound is returned by Get and Reload when there is no row with the
+// given keys.  It wraps sql.ErrNoRows, so errors.Is(err, sql.ErrNoRows)
+// also holds for it.
+var ErrNotFound = fmt.Errorf("modl: row not found: %w", sql.ErrNoRows)
+
+// EnumValueError is returned by Insert and Update when a column restricted
+// with SetEnum holds a value which is not one of its allowed values.
+type EnumValueError struct {
+	TableName string
+	Column    string
+	Value     string
+	Allowed   []string
+}
+
+// Error returns a description of the invalid value.
+func (e EnumValueError) Error() string {
+	return fmt.Sprintf("invalid value %q for enum column %s.%s, expected one of %v", e.Value, e.TableName, e.Column, e.Allowed)
+}
+
+// MultiError is returned by Insert, Update and Delete with the
+// ContinueOnError option when any of the elements of their list could not
+// be written.  Errors holds the error for each element, by its position in
+// the list, or nil for the elements which were written.
+type MultiError struct {
+	Errors []error
+}
+
+// Error returns the number of elements which failed, and the first error.
+func (e MultiError) Error() string {
+	var first error
+	n := 0
+	for _, err := range e.Errors {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	return fmt.Sprintf("modl: %d of %d rows failed, first: %v", n, len(e.Errors), first)
+}
+
+// Unwrap returns the errors which occurred, for errors.Is and errors.As.
+func (e MultiError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errors {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// addError sets the error of element i of a list of n elements in errs.
+func addError(errs []error, n, i int, err error) []error {
+	if errs == nil {
+		errs = make([]error, n)
+	}
+	errs[i] = err
+	return errs
+}
+
+// multiError returns a MultiError with errs, or nil if there are none.
+func multiError(errs []error) error {
+	if errs == nil {
+		return nil
+	}
+	return MultiError{Errors: errs}
+}
+
+// RowResult is the result of writing one row, see DbMap.InsertResult.
+type RowResult struct {
+	// Row is the element of the list the result is for.
+	Row interface{}
+	// RowsAffected is the number of rows the statement wrote.
+	RowsAffected int64
+	// LastInsertID is the key generated for the row's auto-increment
+	// column, if it has one.
+	LastInsertID int64
+	// Err is the error inserting the row, if it failed.
+	Err error
+}
+
 // A bindPlan saves a query type (insert, get, updated, delete) so it doesn't
 // have to be re-created every time it's executed.
 type bindPlan struct {
@@ -66,92 +158,236 @@ type bindPlan struct {
 	keyFields   []string
 	versField   string
 	autoIncrIdx int
+	// sensitive marks the argFields which are bound as Sensitive values
+	sensitive []bool
+	// field index paths for argFields, keyFields and versField, so that
+	// binding doesn't have to look fields up by name
+	argIndexes [][]int
+	keyIndexes [][]int
+	versIndex  []int
+	// the columns argFields are bound to
+	argColumns []*ColumnMap
+	// returns the version following the row's current one
+	nextVersion func(int64) int64
+	// the checksum column's field, and the function computing it
+	checksumIndex []int
+	checksum      func(*DbMap, reflect.Value) string
 }
 
-func (plan bindPlan) createBindInstance(elem reflect.Value) bindInstance {
-	bi := bindInstance{query: plan.query, autoIncrIdx: plan.autoIncrIdx, versField: plan.versField}
+// createBindInstance binds elem to the plan's statement, to be run by m.
+func (plan bindPlan) createBindInstance(m *DbMap, elem reflect.Value) bindInstance {
+	bi := bindInstance{query: plan.query, autoIncrIdx: plan.autoIncrIdx, versField: plan.versField, versIndex: plan.versIndex, columns: plan.argColumns}
 	if plan.versField != "" {
-		bi.existingVersion = elem.FieldByName(plan.versField).Int()
+		bi.existingVersion = elem.FieldByIndex(plan.versIndex).Int()
+		bi.newVersion = plan.nextVersion(bi.existingVersion)
+	}
+	if plan.checksumIndex != nil {
+		bi.checksumIndex = plan.checksumIndex
+		bi.existingChecksum = elem.FieldByIndex(plan.checksumIndex).String()
+		bi.newChecksum = plan.checksum(m, elem)
 	}
 
+	bi.args = make([]interface{}, 0, len(plan.argFields))
 	for i := 0; i < len(plan.argFields); i++ {
 		k := plan.argFields[i]
 		if k == versFieldConst {
-			newVer := bi.existingVersion + 1
-			bi.args = append(bi.args, newVer)
+			bi.args = append(bi.args, bi.newVersion)
 			if bi.existingVersion == 0 {
-				elem.FieldByName(plan.versField).SetInt(int64(newVer))
+				elem.FieldByIndex(plan.versIndex).SetInt(bi.newVersion)
 			}
+		} else if k == checksumFieldConst {
+			bi.args = append(bi.args, bi.newChecksum)
+		} else if k == checksumMatchConst {
+			bi.args = append(bi.args, bi.existingChecksum)
+			bi.checksumMatch = true
 		} else {
-			val := elem.FieldByName(k).Interface()
+			val := bindValue(elem.FieldByIndex(plan.argIndexes[i]))
+			if col := plan.argColumns[i]; col != nil {
+				if codec := col.getCodec(m); codec != nil {
+					val = codec.bind(val)
+				}
+			}
+			if plan.sensitive != nil && plan.sensitive[i] {
+				val = Sensitive(val)
+			}
 			bi.args = append(bi.args, val)
 		}
 	}
 
+	bi.keys = make([]interface{}, 0, len(plan.keyFields))
 	for i := 0; i < len(plan.keyFields); i++ {
-		k := plan.keyFields[i]
-		val := elem.FieldByName(k).Interface()
+		val := bindValue(elem.FieldByIndex(plan.keyIndexes[i]))
 		bi.keys = append(bi.keys, val)
 	}
+	if bi.checksumIndex != nil && !bi.checksumMatch {
+		// inserted rows take their checksum like their first version
+		elem.FieldByIndex(bi.checksumIndex).SetString(bi.newChecksum)
+	}
 
 	return bi
 }
 
+var valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+
+// bindValue returns the value of the field f to bind to a statement.  nil
+// pointers are bound as NULL without calling any Value method they have,
+// and fields whose Value method has a pointer receiver are bound by
+// address, so that database/sql finds the method.
+func bindValue(f reflect.Value) interface{} {
+	switch {
+	case f.Kind() == reflect.Ptr && f.IsNil():
+		return nil
+	case f.CanAddr() && !f.Type().Implements(valuerType) && reflect.PtrTo(f.Type()).Implements(valuerType):
+		return f.Addr().Interface()
+	}
+	return f.Interface()
+}
+
+// execArgs returns the args to execute bi's query with for the given
+// call options, including the values of the table's default scope.
+func (bi bindInstance) execArgs(t *TableMap, opts *queryOptions) ([]interface{}, error) {
+	scope, err := t.scopeArgs(opts.context())
+	if err != nil {
+		return nil, err
+	}
+	passOn := opts.passOn()
+	if scope == nil && passOn == nil {
+		return bi.args, nil
+	}
+	args := make([]interface{}, 0, len(bi.args)+len(scope)+len(passOn))
+	args = append(args, bi.args...)
+	args = append(args, scope...)
+	return append(args, passOn...), nil
+}
+
 type bindInstance struct {
 	query           string
 	args            []interface{}
 	keys            []interface{}
 	existingVersion int64
+	newVersion      int64
 	versField       string
+	versIndex       []int
 	autoIncrIdx     int
+	// the columns args are bound to
+	columns []*ColumnMap
+	// the checksum column's field, its value and the value to write, and
+	// whether the statement only matches a row with the current value
+	checksumIndex    []int
+	existingChecksum string
+	newChecksum      string
+	checksumMatch    bool
 }
 
-// SqlExecutor exposes modl operations that can be run from Pre/Post
-// hooks.  This hides whether the current operation that triggered the
-// hook is in a transaction.
-//
-// See the DbMap function docs for each of the functions below for more
-// information.
-type SqlExecutor interface {
+// Queryer is the set of modl operations shared by DbMap and Transaction.
+// Unlike SqlExecutor, it can be implemented outside of modl, so that
+// application code can wrap a DbMap or Transaction to add tracing, retries
+// or tenancy, and still pass it to code taking a Queryer, like the
+// functions of the typed package.
+type Queryer interface {
 	Get(dest interface{}, keys ...interface{}) error
+	GetBy(dest interface{}, key interface{}, opts ...QueryOption) error
 	Insert(list ...interface{}) error
+	InsertResult(list ...interface{}) ([]RowResult, error)
 	Update(list ...interface{}) (int64, error)
 	Delete(list ...interface{}) (int64, error)
+	Save(list ...interface{}) error
+	Reload(list ...interface{}) error
 	Exec(query string, args ...interface{}) (sql.Result, error)
 	Select(dest interface{}, query string, args ...interface{}) error
 	SelectOne(dest interface{}, query string, args ...interface{}) error
+	SelectKeyset(dest interface{}, query string, cursor KeysetCursor, args ...interface{}) (KeysetCursor, error)
+	Exists(i interface{}, keys ...interface{}) (bool, error)
+}
+
+// SqlExecutor exposes modl operations that can be run from Pre/Post
+// hooks.  This hides whether the current operation that triggered the
+// hook is in a transaction.
+//
+// See the DbMap function docs for each of the functions below for more
+// information.
+type SqlExecutor interface {
+	Queryer
 	handle() handle
 }
 
 // Compile-time check that DbMap and Transaction implement the SqlExecutor
-// interface.
+// and Queryer interfaces.
 var (
-        _ SqlExecutor = &DbMap{}
-        _ SqlExecutor = &Transaction{}
+	_ SqlExecutor = &DbMap{}
+	_ SqlExecutor = &Transaction{}
+	_ Queryer     = &DbMap{}
+	_ Queryer     = &Transaction{}
 )
 
+// handleExecutor is an executor whose statements run on h, so that those
+// run by a Dialect carry the options of the call they are made for.
+type handleExecutor struct {
+	SqlExecutor
+	h handle
+}
+
+func (e handleExecutor) handle() handle {
+	return e.h
+}
+
 ///////////////
 
 func hookedget(m *DbMap, e SqlExecutor, dest interface{}, query string, args ...interface{}) error {
-	err := e.handle().Get(dest, query, args...)
+	args, opts := splitOptions(args)
+	query, args, err := m.rewrite(query, args, opts)
+	if err != nil {
+		return err
+	}
+	key, cached := m.lookup(e, dest, query, args, opts)
+	if cached {
+		return nil
+	}
+	h, done := opts.handleFor(e, true)
+	defer done()
+
+	err = h.Get(dest, query, args...)
 	if err != nil {
 		return err
 	}
 
 	table := m.TableFor(dest)
 
-	if table != nil && table.CanPostGet {
-		err = dest.(PostGetter).PostGet(e)
+	if table != nil {
+		err = table.loaded(e, dest, opts)
 		if err != nil {
 			return err
 		}
 	}
+	m.store(key, reflect.ValueOf(dest).Elem(), query)
 	return nil
 }
 
 func hookedselect(m *DbMap, e SqlExecutor, dest interface{}, query string, args ...interface{}) error {
-
-	err := e.handle().Select(dest, query, args...)
+	if t := reflect.TypeOf(dest); t != nil && t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Slice {
+		if chunks := m.splitIn(query, args, true); chunks != nil {
+			return selectChunks(m, e, dest, query, chunks)
+		}
+	}
+	args, opts := splitOptions(args)
+	query, args, err := m.rewrite(query, args, opts)
+	if err != nil {
+		return err
+	}
+	key, cached := m.lookup(e, dest, query, args, opts)
+	if cached {
+		return nil
+	}
+	h, done := opts.handleFor(e, true)
+	defer done()
+
+	// rows are appended to dest, unless it is reused
+	v := reflect.Indirect(reflect.ValueOf(dest))
+	start := 0
+	if v.Kind() == reflect.Slice && !opts.reuse {
+		start = v.Len()
+	}
+	err = h.Select(dest, query, args...)
 	if err != nil {
 		return err
 	}
@@ -159,28 +395,30 @@ func hookedselect(m *DbMap, e SqlExecutor, dest interface{}, query string, args
 	// select can use arbitrary structs for join queries, so we needn't find a table
 	table := m.TableFor(dest)
 
-	if table != nil && table.CanPostGet {
-		var x interface{}
-		v := reflect.ValueOf(dest)
-		if v.Kind() == reflect.Ptr {
-			v = reflect.Indirect(v)
-		}
+	if table != nil && ((table.CanPostGet && !opts.noHooks) || len(table.relations) > 0) {
 		l := v.Len()
-		for i := 0; i < l; i++ {
-			x = v.Index(i).Interface()
-			err = x.(PostGetter).PostGet(e)
+		for i := start; i < l; i++ {
+			x := v.Index(i)
+			if x.Kind() != reflect.Ptr {
+				x = x.Addr()
+			}
+			err = table.loaded(e, x.Interface(), opts)
 			if err != nil {
 				return err
 			}
-
 		}
 	}
+	if v.Kind() == reflect.Slice {
+		v = v.Slice(start, v.Len())
+	}
+	m.store(key, v, query)
 	return nil
 }
 
 func get(m *DbMap, e SqlExecutor, dest interface{}, keys ...interface{}) error {
+	keys, opts := splitOptions(keys)
 
-	table := m.TableFor(dest)
+	table := m.autoTable(dest)
 
 	if table == nil {
 		return fmt.Errorf("could not find table for %v", dest)
@@ -189,171 +427,515 @@ func get(m *DbMap, e SqlExecutor, dest interface{}, keys ...interface{}) error {
 		return &NoKeysErr{table}
 	}
 
+	rc := table.readsCache(e, keys, opts)
+	var gen uint64
+	if rc != nil {
+		if table.getCached(m, rc, dest, keys, opts) {
+			return table.loaded(e, dest, opts)
+		}
+		gen = atomic.LoadUint64(&rc.gen)
+	}
+
 	plan := table.bindGet()
-	err := e.handle().Get(dest, plan.query, keys...)
+	args, err := table.keyArgs(plan, keys, opts)
+	if err != nil {
+		return err
+	}
+	h, done := opts.handleFor(e, true)
+	defer done()
+	err = h.Get(dest, plan.query, args...)
 
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
 	if err != nil {
 		return err
 	}
 
-	if table.CanPostGet {
-		err = dest.(PostGetter).PostGet(e)
-		if err != nil {
-			return err
-		}
+	if rc != nil {
+		table.fillCache(m, rc, gen, reflect.Indirect(reflect.ValueOf(dest)), keys, opts)
 	}
+	return table.loaded(e, dest, opts)
+}
 
-	return nil
+func getBy(m *DbMap, e SqlExecutor, dest interface{}, key interface{}, opts ...QueryOption) error {
+	table := m.autoTable(dest)
+	if table == nil {
+		return fmt.Errorf("could not find table for %v", dest)
+	}
+	keys, err := table.keysFrom(key)
+	if err != nil {
+		return err
+	}
+	for _, o := range opts {
+		keys = append(keys, o)
+	}
+	return get(m, e, dest, keys...)
+}
+
+func exists(m *DbMap, e SqlExecutor, i interface{}, keys ...interface{}) (bool, error) {
+	keys, opts := splitOptions(keys)
+
+	table := m.autoTable(i)
+
+	if table == nil {
+		return false, fmt.Errorf("could not find table for %v", i)
+	}
+	if len(table.Keys) < 1 {
+		return false, &NoKeysErr{table}
+	}
+
+	plan := table.bindExists()
+	keys, err := table.keyArgs(plan, keys, opts)
+	if err != nil {
+		return false, err
+	}
+	h, done := opts.handleFor(e, true)
+	defer done()
+	var one int
+	err = h.Get(&one, plan.query, keys...)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func deletes(m *DbMap, e SqlExecutor, list ...interface{}) (int64, error) {
-	var err error
-	var table *TableMap
-	var elem reflect.Value
+	list, opts := splitOptions(list)
 	var count int64
 
-	for _, ptr := range list {
-		table, elem, err = tableForPointer(m, ptr, true)
+	if opts.batch && !opts.continueOnError && len(list) > 1 {
+		table, elems, err := batchTable(m, list, true)
 		if err != nil {
 			return -1, err
 		}
+		if table != nil {
+			return deleteBatch(e, table, list, elems, opts)
+		}
+	}
 
-		if table.CanPreDelete {
-			err = ptr.(PreDeleter).PreDelete(e)
-			if err != nil {
+	var errs []error
+	for i, ptr := range list {
+		rows, err := deleteOne(m, e, ptr, opts)
+		if err != nil {
+			if !opts.continueOnError {
 				return -1, err
 			}
+			errs = addError(errs, len(list), i, err)
+			continue
 		}
+		count += rows
+	}
+	return count, multiError(errs)
+}
 
-		bi := table.bindDelete(elem)
+// deleteOne deletes ptr, running its hooks, and returns the number of rows
+// deleted.
+func deleteOne(m *DbMap, e SqlExecutor, ptr interface{}, opts *queryOptions) (int64, error) {
+	table, elem, err := tableForPointer(m, ptr, true)
+	if err != nil {
+		return -1, err
+	}
 
-		res, err := e.Exec(bi.query, bi.args...)
-		if err != nil {
+	if table.CanPreDelete {
+		err = table.runHook(preDelete, opts.context(), e, ptr)
+		if skipped(err) {
+			return 0, nil
+		} else if err != nil {
 			return -1, err
 		}
+	}
 
-		rows, err := res.RowsAffected()
-		if err != nil {
-			return -1, err
-		}
+	bi := table.bindDelete(m, elem)
+	args, err := bi.execArgs(table, opts)
+	if err != nil {
+		return -1, err
+	}
 
-		if rows == 0 && bi.existingVersion > 0 {
-			return lockError(m, e, table.TableName, bi.existingVersion, elem, bi.keys...)
-		}
+	res, err := table.exec(e, bi.query, args...)
+	if err != nil {
+		return -1, err
+	}
 
-		count += rows
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
 
-		if table.CanPostDelete {
-			err = ptr.(PostDeleter).PostDelete(e)
-			if err != nil {
-				return -1, err
-			}
+	if rows == 0 && bi.existingVersion > 0 {
+		return lockError(m, e, table.TableName, bi.existingVersion, elem, append(bi.keys, opts.passOn()...)...)
+	}
+
+	if table.CanPostDelete {
+		err = table.runHook(postDelete, opts.context(), e, ptr)
+		if err != nil {
+			return -1, err
 		}
 	}
 
-	return count, nil
+	if rows > 0 {
+		if err := table.recordHistory(e, OpDelete, elem); err != nil {
+			return -1, err
+		}
+		table.changed(e, OpDelete, elem, nil)
+	}
+	return rows, nil
 }
 
 func update(m *DbMap, e SqlExecutor, list ...interface{}) (int64, error) {
-	var err error
-	var table *TableMap
-	var elem reflect.Value
+	list, opts := splitOptions(list)
 	var count int64
 
-	for _, ptr := range list {
-		table, elem, err = tableForPointer(m, ptr, true)
+	if opts.batch && !opts.continueOnError && !opts.omitEmpty && len(list) > 1 {
+		table, elems, err := batchTable(m, list, true)
 		if err != nil {
 			return -1, err
 		}
+		if table != nil && table.checksum == nil {
+			return updateBatch(e, table, list, elems, opts)
+		}
+	}
 
-		if table.CanPreUpdate {
-			err = ptr.(PreUpdater).PreUpdate(e)
-			if err != nil {
+	var errs []error
+	for i, ptr := range list {
+		rows, err := updateOne(m, e, ptr, opts)
+		if err == errSkipped {
+			continue
+		}
+		if err != nil {
+			if !opts.continueOnError {
 				return -1, err
 			}
+			errs = addError(errs, len(list), i, err)
+			continue
 		}
+		count += rows
+	}
+	return count, multiError(errs)
+}
+
+// updateOne updates ptr, running its hooks, and returns the number of rows
+// updated, or errSkipped if its PreUpdate hook skipped it.
+func updateOne(m *DbMap, e SqlExecutor, ptr interface{}, opts *queryOptions) (int64, error) {
+	table, elem, err := tableForPointer(m, ptr, true)
+	if err != nil {
+		return -1, err
+	}
 
-		bi := table.bindUpdate(elem)
+	old, err := table.oldSnapshot(e, ptr, elem, opts)
+	if err != nil {
+		return -1, err
+	}
+
+	if table.CanValidate {
+		err = table.runUpdateHook(validateUpdate, opts.context(), e, ptr, old)
 		if err != nil {
 			return -1, err
 		}
+	}
 
-		res, err := e.Exec(bi.query, bi.args...)
-		if err != nil {
+	if table.CanPreUpdate {
+		err = table.runUpdateHook(preUpdate, opts.context(), e, ptr, old)
+		if skipped(err) {
+			return 0, errSkipped
+		} else if err != nil {
 			return -1, err
 		}
+	}
+
+	err = table.checkEnums(elem)
+	if err != nil {
+		return -1, err
+	}
+
+	bi := table.bindUpdate(m, elem, opts.omitEmpty)
+	args, err := bi.execArgs(table, opts)
+	if err != nil {
+		return -1, err
+	}
+
+	res, err := table.exec(e, bi.query, args...)
+	if err != nil {
+		return -1, err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+
+	if rows == 0 && (bi.existingVersion > 0 || bi.checksumMatch) {
+		return lockError(m, e, table.TableName,
+			bi.existingVersion, elem, append(bi.keys, opts.passOn()...)...)
+	}
+
+	if bi.versField != "" {
+		elem.FieldByIndex(bi.versIndex).SetInt(bi.newVersion)
+	}
+	if bi.checksumIndex != nil {
+		elem.FieldByIndex(bi.checksumIndex).SetString(bi.newChecksum)
+	}
+
+	if table.CanPostUpdate {
+		err = table.runUpdateHook(postUpdate, opts.context(), e, ptr, old)
 
-		rows, err := res.RowsAffected()
 		if err != nil {
 			return -1, err
 		}
+	}
 
-		if rows == 0 && bi.existingVersion > 0 {
-			return lockError(m, e, table.TableName,
-				bi.existingVersion, elem, bi.keys...)
+	if rows > 0 {
+		if err := table.recordHistory(e, OpUpdate, elem); err != nil {
+			return -1, err
 		}
+		table.changed(e, OpUpdate, elem, old)
+	}
+	return rows, nil
+}
+
+func insert(m *DbMap, e SqlExecutor, list ...interface{}) error {
+	list, opts := splitOptions(list)
 
-		if bi.versField != "" {
-			elem.FieldByName(bi.versField).SetInt(bi.existingVersion + 1)
+	if opts.batch && !opts.continueOnError && len(list) > 1 {
+		table, elems, err := batchTable(m, list, false)
+		if err != nil {
+			return err
+		}
+		if table != nil && table.canBatchInsert(opts) {
+			return insertBatch(e, table, list, elems, opts)
 		}
+	}
 
-		count += rows
+	var errs []error
+	for i, ptr := range list {
+		if r := insertOne(m, e, ptr, opts); r.Err != nil {
+			if !opts.continueOnError {
+				return r.Err
+			}
+			errs = addError(errs, len(list), i, r.Err)
+		}
+	}
+	return multiError(errs)
+}
 
-		if table.CanPostUpdate {
-			err = ptr.(PostUpdater).PostUpdate(e)
+func insertResult(m *DbMap, e SqlExecutor, list ...interface{}) ([]RowResult, error) {
+	list, opts := splitOptions(list)
+	var err error
+	results := make([]RowResult, len(list))
+	for i, ptr := range list {
+		results[i] = insertOne(m, e, ptr, opts)
+		if err == nil {
+			err = results[i].Err
+		}
+	}
+	return results, err
+}
 
-			if err != nil {
-				return -1, err
+// insertOne inserts ptr, running its hooks.
+func insertOne(m *DbMap, e SqlExecutor, ptr interface{}, opts *queryOptions) RowResult {
+	r := RowResult{Row: ptr}
+	table, elem, err := tableForPointer(m, ptr, false)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+
+	if table.CanValidate {
+		r.Err = table.runHook(validateInsert, opts.context(), e, ptr)
+		if r.Err != nil {
+			return r
+		}
+	}
+
+	if table.CanPreInsert {
+		r.Err = table.runHook(preInsert, opts.context(), e, ptr)
+		if skipped(r.Err) {
+			r.Err = nil
+			return r
+		} else if r.Err != nil {
+			return r
+		}
+	}
+
+	r.Err = table.checkEnums(elem)
+	if r.Err != nil {
+		return r
+	}
+
+	bi := table.bindInsert(m, elem, opts.explicitKeys)
+	refresh := opts.returningAll || table.returningAll
+
+	if r.Err = table.breaker.allow(); r.Err != nil {
+		return r
+	}
+	h, done := opts.handleFor(e, false)
+	defer done()
+	if refresh && m.Dialect.SupportsReturning() {
+		r.Err = h.Get(ptr, table.returningAllQuery(bi), bi.args...)
+		table.breaker.record(r.Err)
+		if r.Err != nil {
+			return r
+		}
+		r.RowsAffected = 1
+		if bi.autoIncrIdx > -1 {
+			f := elem.FieldByIndex(table.Columns[bi.autoIncrIdx].fieldIndex)
+			if f.CanInt() {
+				r.LastInsertID = f.Int()
 			}
 		}
+	} else if bi.autoIncrIdx > -1 {
+		id, err := m.Dialect.InsertAutoIncr(handleExecutor{e, h}, bi.query, bi.args...)
+		table.breaker.record(err)
+		if err != nil {
+			r.Err = err
+			return r
+		}
+		f := elem.FieldByIndex(table.Columns[bi.autoIncrIdx].fieldIndex)
+		k := f.Kind()
+		if (k == reflect.Int) || (k == reflect.Int16) || (k == reflect.Int32) || (k == reflect.Int64) {
+			f.SetInt(id)
+		} else {
+			r.Err = fmt.Errorf("modl: Cannot set autoincrement value on non-Int field. SQL=%s  autoIncrIdx=%d", bi.query, bi.autoIncrIdx)
+			return r
+		}
+		r.RowsAffected, r.LastInsertID = 1, id
+	} else {
+		res, err := e.Exec(bi.query, append(bi.args, opts.passOn()...)...)
+		table.breaker.record(err)
+		if err != nil {
+			r.Err = err
+			return r
+		}
+		r.RowsAffected, r.Err = res.RowsAffected()
+		if r.Err != nil {
+			return r
+		}
+	}
+
+	if refresh && !m.Dialect.SupportsReturning() {
+		r.Err = get(m, e, ptr, append(append(table.keyValues(elem), NoHooks()), opts.passOn()...)...)
+		if r.Err != nil {
+			return r
+		}
 	}
-	return count, nil
+
+	if table.CanPostInsert {
+		r.Err = table.runHook(postInsert, opts.context(), e, ptr)
+		if r.Err != nil {
+			return r
+		}
+	}
+
+	if r.Err = table.recordHistory(e, OpInsert, elem); r.Err != nil {
+		return r
+	}
+	table.changed(e, OpInsert, elem, nil)
+	return r
 }
 
-func insert(m *DbMap, e SqlExecutor, list ...interface{}) error {
-	var err error
-	var table *TableMap
-	var elem reflect.Value
+func save(m *DbMap, e SqlExecutor, list ...interface{}) error {
+	var opts, ptrs []interface{}
+	for _, i := range list {
+		if _, ok := i.(QueryOption); ok {
+			opts = append(opts, i)
+		} else {
+			ptrs = append(ptrs, i)
+		}
+	}
 
-	for _, ptr := range list {
-		table, elem, err = tableForPointer(m, ptr, false)
+	_, options := splitOptions(opts)
+	for _, ptr := range ptrs {
+		table, elem, err := tableForPointer(m, ptr, true)
 		if err != nil {
 			return err
 		}
+		args := append([]interface{}{ptr}, opts...)
 
-		if table.CanPreInsert {
-			err = ptr.(PreInserter).PreInsert(e)
-			if err != nil {
+		var isNew bool
+		if table.version != nil {
+			isNew = elem.FieldByIndex(table.version.fieldIndex).Int() == 0
+		} else {
+			isNew = true
+			for _, col := range table.Keys {
+				if !elem.FieldByIndex(col.fieldIndex).IsZero() {
+					isNew = false
+				}
+			}
+		}
+		if isNew {
+			if err = insert(m, e, args...); err != nil {
 				return err
 			}
+			continue
 		}
 
-		bi := table.bindInsert(elem)
-
-		if bi.autoIncrIdx > -1 {
-			id, err := m.Dialect.InsertAutoIncr(e, bi.query, bi.args...)
-			if err != nil {
+		count, err := updateOne(m, e, ptr, options)
+		if err == errSkipped {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// without a version column, a row with keys that has never been
+		// saved looks the same as one which exists, so insert it if there
+		// is no row with its keys, even outside of the table's scope
+		if count == 0 && table.version == nil {
+			found, err := table.rowExists(e, elem, options)
+			if err != nil || found {
 				return err
 			}
-			f := elem.Field(bi.autoIncrIdx)
-			k := f.Kind()
-			if (k == reflect.Int) || (k == reflect.Int16) || (k == reflect.Int32) || (k == reflect.Int64) {
-				f.SetInt(id)
-			} else {
-				return fmt.Errorf("modl: Cannot set autoincrement value on non-Int field. SQL=%s  autoIncrIdx=%d", bi.query, bi.autoIncrIdx)
-			}
-		} else {
-			_, err := e.Exec(bi.query, bi.args...)
-			if err != nil {
+			if err = insert(m, e, append(args, ExplicitKeys())...); err != nil {
 				return err
 			}
 		}
+	}
+	return nil
+}
 
-		if table.CanPostInsert {
-			err = ptr.(PostInserter).PostInsert(e)
-			if err != nil {
-				return err
-			}
+// rowExists returns true if the table has a row with the keys of elem,
+// whether or not it is in the table's scope.
+func (t *TableMap) rowExists(e SqlExecutor, elem reflect.Value, opts *queryOptions) (bool, error) {
+	d := t.dbmap.Dialect
+	s := bytes.Buffer{}
+	s.WriteString("select 1 from ")
+	s.WriteString(quoteTable(d, t.qualifiedName()))
+	s.WriteString(" where ")
+	for x, col := range t.Keys {
+		if x > 0 {
+			s.WriteString(" and ")
+		}
+		s.WriteString(d.QuoteField(col.ColumnName))
+		s.WriteString("=")
+		s.WriteString(d.BindVar(x))
+	}
+	h, done := opts.handleFor(e, false)
+	defer done()
+	var one int
+	err := h.Get(&one, s.String(), t.keyValues(elem)...)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func reload(m *DbMap, e SqlExecutor, list ...interface{}) error {
+	var opts, ptrs []interface{}
+	for _, i := range list {
+		if _, ok := i.(QueryOption); ok {
+			opts = append(opts, i)
+		} else {
+			ptrs = append(ptrs, i)
+		}
+	}
+
+	for _, ptr := range ptrs {
+		table, elem, err := tableForPointer(m, ptr, true)
+		if err != nil {
+			return err
+		}
+		keys := append(table.keyValues(elem), opts...)
+		if err = get(m, e, ptr, keys...); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -362,14 +944,15 @@ func insert(m *DbMap, e SqlExecutor, list ...interface{}) error {
 func lockError(m *DbMap, e SqlExecutor, tableName string, existingVer int64, elem reflect.Value, keys ...interface{}) (int64, error) {
 
 	dest := reflect.New(elem.Type()).Interface()
-	err := get(m, e, dest, keys...)
-	if err != nil {
-		return -1, err
-	}
+	err := get(m, e, dest, append(keys, Primary())...)
+	keys, _ = splitOptions(keys)
 
-	ole := OptimisticLockError{tableName, keys, true, existingVer}
-	if dest == nil {
+	ole := OptimisticLockError{TableName: tableName, Keys: keys, RowExists: true, LocalVersion: existingVer, Current: dest}
+	if err == ErrNotFound {
 		ole.RowExists = false
+		ole.Current = nil
+	} else if err != nil {
+		return -1, err
 	}
 	return -1, ole
 }
@@ -2,16 +2,30 @@ package modl
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"math/big"
+	"net"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+
 	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -65,6 +79,42 @@ type WithStringPk struct {
 
 type CustomStringType string
 
+// PtrValuer implements driver.Valuer and sql.Scanner with pointer receivers
+// and stores its value reversed.
+type PtrValuer struct {
+	S string
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func (p *PtrValuer) Value() (driver.Value, error) {
+	return reverse(p.S), nil
+}
+
+func (p *PtrValuer) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case string:
+		p.S = reverse(v)
+	case []byte:
+		p.S = reverse(string(v))
+	default:
+		return fmt.Errorf("cannot scan %T into PtrValuer", src)
+	}
+	return nil
+}
+
+type WithValuers struct {
+	ID       int64
+	Value    PtrValuer
+	MaybeNil *PtrValuer
+}
+
 func (p *Person) PreInsert(s SqlExecutor) error {
 	p.Created = time.Now().UnixNano()
 	p.Updated = p.Created
@@ -239,8 +289,10 @@ func TestOptimisticLocking(t *testing.T) {
 
 	p1.LName = "Howard"
 	count, err := dbmap.Update(p1)
-	if _, ok := err.(OptimisticLockError); !ok {
+	if ole, ok := err.(OptimisticLockError); !ok {
 		t.Errorf("update - Expected OptimisticLockError, got: %v", err)
+	} else if cur, _ := ole.Current.(*Person); cur == nil || cur.Version != 2 {
+		t.Errorf("update - Expected the current row at version 2, got: %v", ole.Current)
 	}
 	if count != -1 {
 		t.Errorf("update - Expected -1 count, got: %d", count)
@@ -253,6 +305,12 @@ func TestOptimisticLocking(t *testing.T) {
 	if count != -1 {
 		t.Errorf("delete - Expected -1 count, got: %d", count)
 	}
+
+	_del(dbmap, p2)
+	_, err = dbmap.Update(p1)
+	if ole, ok := err.(OptimisticLockError); !ok || ole.RowExists || ole.Current != nil {
+		t.Errorf("update - Expected OptimisticLockError for a deleted row, got: %v", err)
+	}
 }
 
 // what happens if a legacy table has a null value?
@@ -286,718 +344,5337 @@ func TestColMapCreateSql(t *testing.T) {
 }
 
 // what happens if a legacy table has a null value?
-func TestNullValues(t *testing.T) {
-	dbmap := initDbMapNulls()
+func TestVersionStrategy(t *testing.T) {
+	dbmap := initDbMap()
 	defer dbmap.Cleanup()
+	dbmap.TableFor(&Person{}).SetVersionInitial(100).SetVersionStrategy(func(v int64) int64 { return v + 10 })
 
-	// insert a row directly
-	_, err := dbmap.Exec(`insert into tablewithnull values (10, null, null, null, null, null)`)
-	if err != nil {
-		panic(err)
+	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
+	_insert(dbmap, p1)
+	if p1.Version != 100 {
+		t.Errorf("Expected initial version 100, got %d", p1.Version)
 	}
+	p2 := &Person{0, 0, 0, "Jane", "Smith", 0}
+	_insert(dbmap, p2)
 
-	// try to load it
-	expected := &TableWithNull{ID: 10}
-	t1 := &TableWithNull{}
-	MustGet(dbmap, t1, 10)
-	if !reflect.DeepEqual(expected, t1) {
-		t.Errorf("%v != %v", expected, t1)
+	stale := *p1
+	_update(dbmap, p1)
+	if p1.Version != 110 {
+		t.Errorf("Expected version 110, got %d", p1.Version)
+	}
+	if _, err := dbmap.Update(&stale); err == nil {
+		t.Errorf("Expected an OptimisticLockError updating a stale row")
 	}
 
-	// update it
-	t1.Str = sql.NullString{"hi", true}
-	expected.Str = t1.Str
-	t1.Int64 = sql.NullInt64{999, true}
-	expected.Int64 = t1.Int64
-	t1.Float64 = sql.NullFloat64{53.33, true}
-	expected.Float64 = t1.Float64
-	t1.Bool = sql.NullBool{true, true}
-	expected.Bool = t1.Bool
-	t1.Bytes = []byte{1, 30, 31, 33}
-	expected.Bytes = t1.Bytes
-	_update(dbmap, t1)
+	if _, err := dbmap.Update(p1, p2, Batch()); err != nil {
+		t.Fatal(err)
+	}
+	if p1.Version != 120 || p2.Version != 110 {
+		t.Errorf("Expected batched versions 120 and 110, got %d and %d", p1.Version, p2.Version)
+	}
 
-	MustGet(dbmap, t1, 10)
-	if t1.Str.String != "hi" {
-		t.Errorf("%s != hi", t1.Str.String)
+	if v := TimestampVersion(0); v <= 0 {
+		t.Errorf("Expected a timestamp version, got %d", v)
 	}
-	if !reflect.DeepEqual(expected, t1) {
-		t.Errorf("%v != %v", expected, t1)
+	if v := TimestampVersion(math.MaxInt64 - 1); v != math.MaxInt64 {
+		t.Errorf("Expected a timestamp version ahead of the clock to be incremented, got %d", v)
 	}
 }
 
-func TestColumnProps(t *testing.T) {
-	dbmap := newDbMap()
-	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
-	t1 := dbmap.AddTable(Invoice{}).SetKeys(true, "ID")
-	//t1.ColMap("Created").Rename("date_created")
-	t1.ColMap("Updated").SetTransient(true)
-	t1.ColMap("Memo").SetMaxSize(10)
-	t1.ColMap("PersonID").SetUnique(true)
+func TestFind(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	table := dbmap.TableFor(&Person{})
+	table.DefineFinder("ByLName", "select %cols% from %table% where lname=? order by fname")
 
-	err := dbmap.CreateTables()
-	if err != nil {
-		panic(err)
+	for _, name := range []string{"Bob", "Alice", "Carol"} {
+		_insert(dbmap, &Person{FName: name, LName: "Smith"})
 	}
-	defer dbmap.Cleanup()
+	_insert(dbmap, &Person{FName: "Dave", LName: "Jones"})
 
-	// test transient
-	inv := &Invoice{0, 0, 1, "my invoice", 0, true}
-	_insert(dbmap, inv)
-	inv2 := Invoice{}
-	MustGet(dbmap, &inv2, inv.ID)
-	if inv2.Updated != 0 {
-		t.Errorf("Saved transient column 'Updated'")
+	var people []Person
+	if err := dbmap.Find(&people, "ByLName", "Smith"); err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 3 || people[0].FName != "Alice" {
+		t.Errorf("Expected 3 Smiths starting with Alice, got %v", people)
 	}
 
-	// test max size
-	inv2.Memo = "this memo is too long"
-	err = dbmap.Insert(inv2)
-	if err == nil {
-		t.Errorf("max size exceeded, but Insert did not fail.")
+	var p Person
+	if err := dbmap.Find(&p, "ByLName", "Jones"); err != nil {
+		t.Fatal(err)
+	}
+	if p.FName != "Dave" {
+		t.Errorf("Expected Dave, got %v", p)
 	}
 
-	// test unique - same person id
-	inv = &Invoice{0, 0, 1, "my invoice2", 0, false}
-	err = dbmap.Insert(inv)
-	if err == nil {
-		t.Errorf("same PersonID inserted, but Insert did not fail.")
+	if err := dbmap.Find(&people, "Missing"); err == nil {
+		t.Errorf("Expected an error running an undefined finder")
 	}
 }
 
-func TestRawSelect(t *testing.T) {
+func TestColumnLists(t *testing.T) {
 	dbmap := initDbMap()
 	defer dbmap.Cleanup()
+	table := dbmap.TableFor(&Person{})
+	q := dbmap.Dialect.QuoteField
 
-	p1 := &Person{0, 0, 0, "bob", "smith", 0}
-	_insert(dbmap, p1)
-
-	inv1 := &Invoice{0, 0, 0, "xmas order", p1.ID, true}
-	_insert(dbmap, inv1)
-
-	expected := &InvoicePersonView{inv1.ID, p1.ID, inv1.Memo, p1.FName, 0}
+	want := "p." + q("id") + ",p." + q("created")
+	if cols := table.SelectColumnList("p"); !strings.HasPrefix(cols, want) {
+		t.Errorf("Expected select columns starting with %s, got %s", want, cols)
+	}
+	if cols := table.InsertColumnList(); !strings.HasPrefix(cols, q("created")+",") {
+		t.Errorf("Expected insert columns without the auto-increment key, got %s", cols)
+	}
 
-	query := "select i.id invoiceid, p.id personid, i.memo, p.fname " +
-		"from invoice_test i, person_test p " +
-		"where i.personid = p.id"
-	list := []InvoicePersonView{}
-	MustSelect(dbmap, &list, query)
-	if len(list) != 1 {
-		t.Errorf("len(list) != 1: %d", len(list))
-	} else if !reflect.DeepEqual(expected, &list[0]) {
-		t.Errorf("%v != %v", expected, list[0])
+	p := &Person{FName: "Bob", LName: "Smith"}
+	_insert(dbmap, p)
+	_insert(dbmap, &Invoice{PersonID: p.ID, Memo: "bob's"})
+	var people []Person
+	query := "select " + table.SelectColumnList("p") + " from person_test p join invoice_test i on i.personid = p.id"
+	if err := dbmap.Select(&people, query); err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 1 || people[0].FName != "Bob" {
+		t.Errorf("Expected Bob, got %v", people)
 	}
 }
 
-func TestHooks(t *testing.T) {
+type PersonInvoice struct {
+	Person  Person
+	Invoice *Invoice `db:"inv_"`
+	Count   int64
+}
+
+func TestSelectJoin(t *testing.T) {
 	dbmap := initDbMap()
 	defer dbmap.Cleanup()
-
-	p1 := &Person{0, 0, 0, "bob", "smith", 0}
-	_insert(dbmap, p1)
-	if p1.Created == 0 || p1.Updated == 0 {
-		t.Errorf("p1.PreInsert() didn't run: %v", p1)
-	} else if p1.LName != "postinsert" {
-		t.Errorf("p1.PostInsert() didn't run: %v", p1)
+	people := dbmap.TableFor(&Person{})
+	invoices := dbmap.TableFor(&Invoice{})
+
+	bob := &Person{FName: "Bob", LName: "Smith"}
+	jane := &Person{FName: "Jane", LName: "Smith"}
+	_insert(dbmap, bob, jane)
+	_insert(dbmap, &Invoice{Memo: "bob's", PersonID: bob.ID, IsPaid: true})
+
+	query := "select " + people.JoinColumnList("p", "person_") + "," +
+		invoices.JoinColumnList("i", "inv_") + ", 2 as count" +
+		" from person_test p left join invoice_test i on i.personid = p.id order by p.fname"
+	var rows []PersonInvoice
+	if err := dbmap.SelectJoin(&rows, query); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(rows))
+	}
+	if rows[0].Person.ID != bob.ID || rows[0].Invoice == nil || rows[0].Invoice.Memo != "bob's" || !rows[0].Invoice.IsPaid {
+		t.Errorf("Expected Bob and his invoice, got %+v, %+v", rows[0].Person, rows[0].Invoice)
+	}
+	if rows[0].Count != 2 {
+		t.Errorf("Expected count 2, got %d", rows[0].Count)
+	}
+	if rows[1].Person.FName != "Jane" || rows[1].Invoice != nil {
+		t.Errorf("Expected Jane without an invoice, got %+v, %+v", rows[1].Person, rows[1].Invoice)
 	}
 
-	MustGet(dbmap, p1, p1.ID)
-	if p1.LName != "postget" {
-		t.Errorf("p1.PostGet() didn't run: %v", p1)
+	var ptrs []*PersonInvoice
+	if err := dbmap.SelectJoin(&ptrs, query); err != nil || len(ptrs) != 2 {
+		t.Errorf("Expected 2 rows, got %d, %v", len(ptrs), err)
 	}
+}
 
-	p1.LName = "smith"
-	_update(dbmap, p1)
-	if p1.FName != "preupdate" {
-		t.Errorf("p1.PreUpdate() didn't run: %v", p1)
-	} else if p1.LName != "postupdate" {
-		t.Errorf("p1.PostUpdate() didn't run: %v", p1)
+type Author struct {
+	ID    int64
+	Name  string
+	Books func() ([]*Book, error)
+}
+
+type Book struct {
+	ID       int64
+	AuthorID int64
+	Title    string
+	Author   func() (*Author, error)
+}
+
+func TestLazyRelations(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists author_test")
+	dbmap.Exec("drop table if exists book_test")
+	dbmap.AddTableWithName(Author{}, "author_test").SetKeys(true, "ID").HasMany("Books", Book{}, "authorid")
+	dbmap.AddTableWithName(Book{}, "book_test").SetKeys(true, "ID").BelongsTo("Author", Author{}, "AuthorID")
+	err := dbmap.CreateTables()
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer dbmap.Cleanup()
 
-	var persons []*Person
-	bindVar := dbmap.Dialect.BindVar(0)
-	MustSelect(dbmap, &persons, "select * from person_test where id = "+bindVar, p1.ID)
-	if persons[0].LName != "postget" {
-		t.Errorf("p1.PostGet() didn't run after select: %v", p1)
+	a := &Author{Name: "Le Guin"}
+	_insert(dbmap, a)
+	_insert(dbmap, &Book{AuthorID: a.ID, Title: "The Dispossessed"}, &Book{AuthorID: a.ID, Title: "The Lathe of Heaven"})
+	_insert(dbmap, &Book{Title: "Anonymous"})
+
+	a2 := &Author{}
+	MustGet(dbmap, a2, a.ID)
+	books, err := a2.Books()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 2 || books[0].Author == nil {
+		t.Fatalf("Expected 2 books with lazy authors, got %v", books)
+	}
+	author, err := books[0].Author()
+	if err != nil || author == nil || author.Name != "Le Guin" {
+		t.Errorf("Expected the book's author, got %v, %v", author, err)
 	}
 
-	_del(dbmap, p1)
-	if p1.FName != "predelete" {
-		t.Errorf("p1.PreDelete() didn't run: %v", p1)
-	} else if p1.LName != "postdelete" {
-		t.Errorf("p1.PostDelete() didn't run: %v", p1)
+	// the first result is kept
+	_insert(dbmap, &Book{AuthorID: a.ID, Title: "Always Coming Home"})
+	if books, _ = a2.Books(); len(books) != 2 {
+		t.Errorf("Expected the loaded books to be kept, got %d", len(books))
 	}
 
-	// Test error case
-	p2 := &Person{0, 0, 0, "badname", "", 0}
-	err := dbmap.Insert(p2)
-	if err == nil {
-		t.Errorf("p2.PreInsert() didn't return an error")
+	var all []Book
+	MustSelect(dbmap, &all, "select * from book_test where authorid = 0")
+	if len(all) != 1 {
+		t.Fatalf("Expected 1 book without an author, got %d", len(all))
+	}
+	if author, err := all[0].Author(); author != nil || err != nil {
+		t.Errorf("Expected no author, got %v, %v", author, err)
 	}
 }
 
-func TestTransaction(t *testing.T) {
-	dbmap := initDbMap()
+func TestSession(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists author_test")
+	dbmap.Exec("drop table if exists book_test")
+	dbmap.AddTableWithName(Book{}, "book_test").SetKeys(false, "ID").BelongsTo("Author", Author{}, "AuthorID")
+	dbmap.AddTableWithName(Author{}, "author_test").SetKeys(false, "ID").HasMany("Books", Book{}, "authorid")
+	err := dbmap.CreateTables()
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer dbmap.Cleanup()
 
-	inv1 := &Invoice{0, 100, 200, "t1", 0, true}
-	inv2 := &Invoice{0, 100, 200, "t2", 0, false}
+	var logBuffer bytes.Buffer
+	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", log.Lmicroseconds))
 
-	trans, err := dbmap.Begin()
-	if err != nil {
-		panic(err)
+	s := dbmap.NewSession()
+	book := &Book{ID: 1, AuthorID: 1, Title: "The Dispossessed"}
+	author := &Author{ID: 1, Name: "Le Guin"}
+	// the book is added first, but its author must be inserted before it
+	if err = s.Add(book, author); err != nil {
+		t.Fatal(err)
 	}
-	trans.Insert(inv1, inv2)
-	err = trans.Commit()
-	if err != nil {
-		panic(err)
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	trace := logBuffer.String()
+	if a, b := strings.Index(trace, "author_test"), strings.Index(trace, "book_test"); a < 0 || b < a {
+		t.Errorf("Expected the author to be inserted before the book, got %s", trace)
 	}
 
-	obj := &Invoice{}
-	err = dbmap.Get(obj, inv1.ID)
-	if err != nil {
-		panic(err)
+	dbmap.TraceOff()
+	var books []*Book
+	if err = s.Select(&books, "select * from book_test"); err != nil {
+		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(inv1, obj) {
-		t.Errorf("%v != %v", inv1, obj)
+	if i, u, d := s.Pending(); i+u+d != 0 {
+		t.Errorf("Expected no pending changes, got %d, %d, %d", i, u, d)
 	}
-	err = dbmap.Get(obj, inv2.ID)
-	if err != nil {
-		panic(err)
+	books[0].Title = "The Left Hand of Darkness"
+	if _, u, _ := s.Pending(); u != 1 {
+		t.Errorf("Expected 1 pending update, got %d", u)
 	}
-	if !reflect.DeepEqual(inv2, obj) {
-		t.Errorf("%v != %v", inv2, obj)
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b := &Book{}
+	MustGet(dbmap, b, 1)
+	if b.Title != "The Left Hand of Darkness" {
+		t.Errorf("Expected the title to be updated, got %q", b.Title)
+	}
+
+	// the book is deleted before its author
+	if err = s.Remove(author, books[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	if err = dbmap.SelectOne(&n, "select count(*) from author_test"); err != nil || n != 0 {
+		t.Errorf("Expected no authors, got %d, %v", n, err)
+	}
+	if i, u, d := s.Pending(); i+u+d != 0 {
+		t.Errorf("Expected no pending changes, got %d, %d, %d", i, u, d)
 	}
 }
 
-func TestMultiple(t *testing.T) {
+func TestCSV(t *testing.T) {
 	dbmap := initDbMap()
 	defer dbmap.Cleanup()
+	table := dbmap.TableFor(&Invoice{})
+	_insert(dbmap, &Invoice{Created: 1, Memo: "first, \"quoted\"", IsPaid: true}, &Invoice{Created: 2, Memo: "second"})
 
-	inv1 := &Invoice{0, 100, 200, "a", 0, false}
-	inv2 := &Invoice{0, 100, 200, "b", 0, true}
-	_insert(dbmap, inv1, inv2)
+	var buf bytes.Buffer
+	n, err := table.ExportCSV(dbmap, &buf, "date_created > ?", 0, CSVOptions{Columns: []string{"Created", "memo", "ispaid"}})
+	if err != nil || n != 2 {
+		t.Fatalf("Expected to export 2 rows, got %d, %v", n, err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || lines[0] != "date_created,memo,ispaid" || lines[1] != `1,"first, ""quoted""",true` {
+		t.Errorf("Unexpected CSV %q", buf.String())
+	}
 
-	inv1.Memo = "c"
-	inv2.Memo = "d"
-	_update(dbmap, inv1, inv2)
+	tsv := "memo\tispaid\tdate_created\nimported\ttrue\t3\nnull memo\t\t4\n"
+	n, err = table.ImportCSV(dbmap, strings.NewReader(tsv), CSVOptions{Comma: '\t'})
+	if err != nil || n != 2 {
+		t.Fatalf("Expected to import 2 rows, got %d, %v", n, err)
+	}
+	var invoices []Invoice
+	MustSelect(dbmap, &invoices, "select * from invoice_test where date_created > 2 order by date_created")
+	if len(invoices) != 2 || invoices[0].Memo != "imported" || !invoices[0].IsPaid || invoices[1].IsPaid {
+		t.Errorf("Unexpected imported rows %v", invoices)
+	}
 
-	count := _del(dbmap, inv1, inv2)
-	if count != 2 {
-		t.Errorf("%d != 2", count)
+	if _, err = table.ImportCSV(dbmap, strings.NewReader("nope\n1\n"), CSVOptions{}); err == nil {
+		t.Errorf("Expected an error importing an unknown column")
+	}
+
+	// rows written in a transaction are exported by it
+	tx, err := dbmap.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err = tx.Insert(&Invoice{Created: 5, Memo: "uncommitted"}); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	n, err = table.ExportCSV(tx, &buf, "date_created = ?", 5, CSVOptions{Columns: []string{"memo"}, NoHeader: true})
+	if err != nil || n != 1 || strings.TrimSpace(buf.String()) != "uncommitted" {
+		t.Errorf("Expected the transaction's row to be exported, got %d %q %v", n, buf.String(), err)
 	}
 }
 
-func TestCrud(t *testing.T) {
+func TestJSON(t *testing.T) {
 	dbmap := initDbMap()
 	defer dbmap.Cleanup()
+	table := dbmap.TableFor(&Invoice{})
+	_insert(dbmap, &Invoice{Created: 1, Memo: "first", IsPaid: true}, &Invoice{Created: 2, Memo: "second"})
 
-	inv := &Invoice{0, 100, 200, "first order", 0, true}
-
-	// INSERT row
-	_insert(dbmap, inv)
-	if inv.ID == 0 {
-		t.Errorf("inv.ID was not set on INSERT")
-		return
+	var buf bytes.Buffer
+	n, err := dbmap.SelectJSON(&buf, "select memo, date_created from invoice_test order by date_created")
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 rows, got %d, %v", n, err)
 	}
-
-	// SELECT row
-	inv2 := &Invoice{}
-	MustGet(dbmap, inv2, inv.ID)
-	if !reflect.DeepEqual(inv, inv2) {
-		t.Errorf("%v != %v", inv, inv2)
+	if buf.String() != `[{"memo":"first","date_created":1},{"memo":"second","date_created":2}]` {
+		t.Errorf("Unexpected JSON %s", buf.String())
 	}
 
-	// UPDATE row and SELECT
-	inv.Memo = "second order"
-	inv.Created = 999
-	inv.Updated = 11111
-	count := _update(dbmap, inv)
-	if count != 1 {
-		t.Errorf("update 1 != %d", count)
+	buf.Reset()
+	if _, err = dbmap.SelectJSON(&buf, "select memo from invoice_test where date_created = ?", 2, NDJSON()); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "{\"memo\":\"second\"}\n" {
+		t.Errorf("Unexpected NDJSON %q", buf.String())
 	}
 
-	MustGet(dbmap, inv2, inv.ID)
+	n, err = dbmap.InsertJSON(strings.NewReader(` [{"memo": "third", "date_created": 3, "IsPaid": true}, {"memo": "fourth", "date_created": "4", "ispaid": null}]`), table)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected to insert 2 rows, got %d, %v", n, err)
+	}
+	n, err = dbmap.InsertJSON(strings.NewReader("{\"memo\": \"fifth\", \"date_created\": 5}\n{\"memo\": \"sixth\", \"date_created\": 6}\n"), table)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected to insert 2 NDJSON rows, got %d, %v", n, err)
+	}
+	var invoices []Invoice
+	MustSelect(dbmap, &invoices, "select * from invoice_test where date_created > 2 order by date_created")
+	if len(invoices) != 4 || invoices[0].Memo != "third" || !invoices[0].IsPaid || invoices[1].Created != 4 || invoices[3].Memo != "sixth" {
+		t.Errorf("Unexpected inserted rows %v", invoices)
+	}
+}
+
+func TestExecScript(t *testing.T) {
+	splits := []struct {
+		script string
+		q      scriptQuoting
+		stmts  []string
+	}{
+		{"select 1; select 2", scriptQuoting{}, []string{"select 1", "select 2"}},
+		{"select ';'; -- a; comment\nselect /* ; */ 2;;", scriptQuoting{}, []string{"select ';'", "-- a; comment\nselect /* ; */ 2"}},
+		{`select "a;b" from t`, scriptQuoting{}, []string{`select "a;b" from t`}},
+		{"select 'it\\';s';", scriptQuoting{backslashes: true}, []string{"select 'it\\';s'"}},
+		{"create function f() returns int as $$ select 1; $$ language sql; select 2", scriptQuoting{dollars: true},
+			[]string{"create function f() returns int as $$ select 1; $$ language sql", "select 2"}},
+		{"select 1;\nDELIMITER //\ncreate trigger t begin set x = 1; end//\ndelimiter ;\nselect 2;", scriptQuoting{delimiters: true},
+			[]string{"select 1", "create trigger t begin set x = 1; end", "select 2"}},
+	}
+	for _, s := range splits {
+		if stmts := splitScript(s.script, s.q); !reflect.DeepEqual(stmts, s.stmts) {
+			t.Errorf("splitScript(%q) = %q, expected %q", s.script, stmts, s.stmts)
+		}
+	}
+
+	dbmap := newDbMap()
+	defer dbmap.Cleanup()
+	dbmap.Exec("drop table if exists script_test")
+	err := dbmap.ExecScript(`
+		create table script_test (id integer primary key, name varchar(20));
+		insert into script_test values (1, 'a;b');
+		-- a comment; with a semicolon
+		insert into script_test values (2, 'c');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Exec("drop table script_test")
+	var names []string
+	if err := dbmap.Select(&names, "select name from script_test order by id"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"a;b", "c"}) {
+		t.Errorf("Unexpected rows %q", names)
+	}
+	if err := dbmap.ExecScript("insert into script_test values (3, 'd'); insert into missing values (1)"); err == nil {
+		t.Error("Expected an error from the second statement")
+	}
+}
+
+type Keyword struct {
+	ID    int64
+	From  string `db:"from"`
+	Group int64  `db:"group"`
+}
+
+func TestQuoting(t *testing.T) {
+	quoted := []struct {
+		d     Dialect
+		table string
+		field string
+	}{
+		{SqliteDialect{}, `"main"."order"`, `"a""b"`},
+		{PostgresDialect{}, `"public"."order"`, `"a""b"`},
+		{MySQLDialect{}, "`main`.`order`", "`a\"b`"},
+	}
+	for _, q := range quoted {
+		schema := "main"
+		if _, ok := q.d.(PostgresDialect); ok {
+			schema = "public"
+		}
+		if s := quoteTable(q.d, schema+".order"); s != q.table {
+			t.Errorf("%T quoted table as %s, expected %s", q.d, s, q.table)
+		}
+		if s := q.d.QuoteField(`a"b`); s != q.field {
+			t.Errorf("%T quoted field as %s, expected %s", q.d, s, q.field)
+		}
+	}
+	if s := (MySQLDialect{}).QuoteField("a`b"); s != "`a``b`" {
+		t.Errorf("MySQLDialect quoted field as %s", s)
+	}
+
+	dbmap := newDbMap()
+	defer dbmap.Cleanup()
+	name := "order"
+	switch dbmap.Dialect.(type) {
+	case SqliteDialect:
+		name = "main.order"
+	case PostgresDialect:
+		name = "public.order"
+	}
+	dbmap.AddTableWithName(Keyword{}, name).SetKeys(true, "ID")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	k := &Keyword{From: "here", Group: 1}
+	_insert(dbmap, k)
+	k.Group = 2
+	_update(dbmap, k)
+	k2 := &Keyword{}
+	MustGet(dbmap, k2, k.ID)
+	if !reflect.DeepEqual(k, k2) {
+		t.Errorf("%v != %v", k, k2)
+	}
+	if _, err := dbmap.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbmap.TruncateTablesIdentityRestart(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetSchema(t *testing.T) {
+	dbmap := newDbMap()
+	defer dbmap.Cleanup()
+	schema := "main"
+	switch dbmap.Dialect.(type) {
+	case PostgresDialect:
+		schema = "public"
+	case MySQLDialect:
+		if err := dbmap.Dbx.Get(&schema, "select database()"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dbmap.AddTableWithName(Keyword{}, "keyword_schema").SetKeys(true, "ID").SetSchema(schema)
+	stmts, err := dbmap.CreateTablesSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	qualified := dbmap.Dialect.QuoteField(schema) + "." + dbmap.Dialect.QuoteField("keyword_schema")
+	if len(stmts) != 1 || !strings.Contains(stmts[0], qualified) {
+		t.Errorf("Expected %s in %q", qualified, stmts)
+	}
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	k := &Keyword{From: "there", Group: 3}
+	_insert(dbmap, k)
+	k.From = "here"
+	_update(dbmap, k)
+	k2 := &Keyword{}
+	MustGet(dbmap, k2, k.ID)
+	if !reflect.DeepEqual(k, k2) {
+		t.Errorf("%v != %v", k, k2)
+	}
+	if _, err := dbmap.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStalePlans(t *testing.T) {
+	dbmap := newDbMap()
+	defer dbmap.Cleanup()
+	table := dbmap.AddTableWithName(Keyword{}, "keyword_stale").SetKeys(true, "ID")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	k := &Keyword{From: "here", Group: 1}
+	_insert(dbmap, k)
+	MustGet(dbmap, &Keyword{}, k.ID)
+
+	// changing the mapping without ResetSql rebuilds the cached plans
+	table.ColMap("Group").Transient = true
+	k2 := &Keyword{From: "there", Group: 2}
+	_insert(dbmap, k2)
+	k3 := &Keyword{}
+	MustGet(dbmap, k3, k2.ID)
+	if k3.From != "there" || k3.Group != 0 {
+		t.Errorf("Expected the transient column to be left out, got %v", k3)
+	}
+	if strings.Contains(table.bindGet().query, "group") {
+		t.Errorf("Get still selects the transient column: %s", table.bindGet().query)
+	}
+}
+
+type Contraption struct {
+	ID      int64
+	Name    string
+	Labels  map[string]string
+	Done    chan bool
+	Origin  struct{ City string }
+	Parts   []string
+	Friends func() ([]Person, error)
+}
+
+func TestUnsupportedFields(t *testing.T) {
+	dbmap := newDbMap()
+	defer dbmap.Cleanup()
+	var reported []string
+	dbmap.UnsupportedFieldLogger = func(e UnsupportedFieldError) {
+		reported = append(reported, e.Field)
+	}
+	table := dbmap.AddTableWithName(Contraption{}, "contraption_test").SetKeys(true, "ID")
+	if !reflect.DeepEqual(reported, []string{"Labels", "Done", "Origin", "Parts"}) {
+		t.Errorf("Unexpected unsupported fields %v", reported)
+	}
+	for _, field := range append(reported, "Friends") {
+		if !table.ColMap(field).Transient {
+			t.Errorf("Expected %s to be transient", field)
+		}
+	}
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	g := &Contraption{Name: "widget", Labels: map[string]string{"a": "b"}}
+	_insert(dbmap, g)
+	g2 := &Contraption{}
+	MustGet(dbmap, g2, g.ID)
+	if g2.Name != "widget" || g2.Labels != nil {
+		t.Errorf("Unexpected row %v", g2)
+	}
+
+	// without a logger they are traced as warnings, unless tagged db:"-" or
+	// unexported
+	type gadget struct {
+		ID     int64
+		Labels map[string]string
+		Notes  map[string]string `db:"-"`
+		cache  map[string]string
+	}
+	var logBuffer bytes.Buffer
+	dbmap2 := newDbMap()
+	defer dbmap2.Dbx.Close()
+	dbmap2.TraceOnLevel("", log.New(&logBuffer, "", 0), LogErrors)
+	dbmap2.AddTableWithName(gadget{}, "gadget_test")
+	if logged := logBuffer.String(); !strings.Contains(logged, "warning: modl: field Labels of table gadget_test") || strings.Contains(logged, "Notes") || strings.Contains(logged, "cache") {
+		t.Errorf("Unexpected warnings %q", logged)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dbmap := newDbMap()
+	defer dbmap.Cleanup()
+	dbmap.AddTableWithName(Keyword{}, "keyword_versions").SetKeys(true, "ID").SetHistory("keyword_history")
+	dbmap.Exec("drop table if exists keyword_history")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	k := &Keyword{From: "first", Group: 1}
+	other := &Keyword{From: "other", Group: 1}
+	_insert(dbmap, k, other)
+	time.Sleep(10 * time.Millisecond)
+	t1 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	k.From = "second"
+	_update(dbmap, k)
+	time.Sleep(10 * time.Millisecond)
+	t2 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := dbmap.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		at       time.Time
+		expected []string
+	}{
+		{t1.Add(-time.Hour), nil},
+		{t1, []string{"first", "other"}},
+		{t2, []string{"second", "other"}},
+		{time.Now(), []string{"other"}},
+	} {
+		var rows []Keyword
+		if err := dbmap.AsOf(&rows, tt.at, ""); err != nil {
+			t.Fatal(err)
+		}
+		var froms []string
+		for _, r := range rows {
+			froms = append(froms, r.From)
+		}
+		sort.Strings(froms)
+		sort.Strings(tt.expected)
+		if !reflect.DeepEqual(froms, tt.expected) {
+			t.Errorf("Expected %v as of %v, got %v", tt.expected, tt.at, froms)
+		}
+	}
+
+	var rows []*Keyword
+	if err := dbmap.AsOf(&rows, t2, "id=?", k.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].From != "second" {
+		t.Errorf("Unexpected rows %v", rows)
+	}
+	plain := &DbMap{Dialect: dbmap.Dialect}
+	plain.AddTableWithName(Keyword{}, "keyword_versions").SetKeys(true, "ID")
+	if err := plain.AsOf(&rows, t2, ""); err == nil {
+		t.Error("Expected an error reading the history of a table without one")
+	}
+}
+
+type Document struct {
+	ID    int64
+	Title string
+	Body  string
+	ETag  string
+}
+
+func TestChecksum(t *testing.T) {
+	dbmap := newDbMap()
+	defer dbmap.Cleanup()
+	dbmap.AddTableWithName(Document{}, "document_test").SetKeys(true, "ID").SetChecksumCol("ETag")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Document{Title: "Draft", Body: "..."}
+	d2 := &Document{Title: "Draft", Body: "..."}
+	_insert(dbmap, d, d2)
+	if len(d.ETag) == 0 || d.ETag != d2.ETag {
+		t.Errorf("Expected equal checksums of equal rows, got %q and %q", d.ETag, d2.ETag)
+	}
+	read := &Document{}
+	MustGet(dbmap, read, d.ID)
+	if read.ETag != d.ETag {
+		t.Errorf("Expected the stored checksum %q, got %q", d.ETag, read.ETag)
+	}
+
+	d.Body = "Final"
+	_update(dbmap, d)
+	if d.ETag == read.ETag {
+		t.Errorf("Expected the checksum to change")
+	}
+
+	// read is out of date, so updating it fails
+	read.Title = "Stale"
+	_, err := dbmap.Update(read)
+	if ole, ok := err.(OptimisticLockError); !ok || !ole.RowExists {
+		t.Errorf("Expected an OptimisticLockError, got %v", err)
+	}
+	MustGet(dbmap, read, d.ID)
+	if !reflect.DeepEqual(read, d) {
+		t.Errorf("%v != %v", read, d)
+	}
+}
+
+func TestLoader(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	var mu sync.Mutex
+	var selects int
+	dbmap.Use(func(next ExecFunc) ExecFunc {
+		return func(ctx context.Context, stmt *Statement) error {
+			if strings.Contains(stmt.Query, "invoice_test") && strings.HasPrefix(stmt.Query, "select") {
+				mu.Lock()
+				selects++
+				mu.Unlock()
+			}
+			return next(ctx, stmt)
+		}
+	})
+
+	var invoices []*Invoice
+	for i := 0; i < 3; i++ {
+		inv := &Invoice{Memo: fmt.Sprintf("invoice %d", i)}
+		_insert(dbmap, inv)
+		invoices = append(invoices, inv)
+	}
+
+	loader := dbmap.NewLoader(Invoice{}, 10*time.Millisecond)
+	keys := []int64{invoices[0].ID, invoices[1].ID, invoices[2].ID, invoices[0].ID, -1}
+	loaded := make([]Invoice, len(keys))
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key int64) {
+			defer wg.Done()
+			errs[i] = loader.Load(&loaded[i], key)
+		}(i, key)
+	}
+	wg.Wait()
+
+	if selects != 1 {
+		t.Errorf("Expected the loads to be coalesced into 1 select, got %d", selects)
+	}
+	for i, inv := range invoices {
+		if errs[i] != nil || !reflect.DeepEqual(&loaded[i], inv) {
+			t.Errorf("Expected %v, got %v, %v", inv, loaded[i], errs[i])
+		}
+	}
+	if errs[3] != nil || loaded[3].ID != invoices[0].ID {
+		t.Errorf("Expected a repeated key to load its row, got %v, %v", loaded[3], errs[3])
+	}
+	if errs[4] != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing key, got %v", errs[4])
+	}
+
+	// loaded rows are kept until cleared
+	var inv Invoice
+	if err := loader.Load(&inv, int(invoices[1].ID)); err != nil || selects != 1 {
+		t.Errorf("Expected a loaded row without a select, got %d selects, %v", selects, err)
+	}
+	loader.Clear(invoices[1].ID)
+	if err := loader.Load(&inv, invoices[1].ID); err != nil || selects != 2 {
+		t.Errorf("Expected a cleared row to be selected again, got %d selects, %v", selects, err)
+	}
+
+	// a full batch is selected without waiting
+	loader = dbmap.NewLoader(Invoice{}, time.Hour).SetMaxBatch(1)
+	if err := loader.Load(&inv, invoices[2].ID); err != nil || inv.Memo != "invoice 2" {
+		t.Errorf("Expected invoice 2, got %v, %v", inv, err)
+	}
+}
+
+// fakeRedis is a RedisClient keeping values in a map.
+type fakeRedis struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (r *fakeRedis) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch args[0] {
+	case "MGET":
+		if v, ok := r.values[args[1].(string)]; ok {
+			return []interface{}{string(v)}, nil
+		}
+		return []interface{}{nil}, nil
+	case "SET":
+		r.values[args[1].(string)] = args[2].([]byte)
+		return "OK", nil
+	case "DEL":
+		for _, key := range args[1:] {
+			delete(r.values, key.(string))
+		}
+		return int64(len(args) - 1), nil
+	}
+	return nil, fmt.Errorf("unexpected command %v", args[0])
+}
+
+// racingCache runs beforeSet once, before the next Set, to write the row
+// being stored concurrently.
+type racingCache struct {
+	Cache
+	beforeSet func()
+}
+
+func (c *racingCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if fn := c.beforeSet; fn != nil {
+		c.beforeSet = nil
+		fn()
+	}
+	return c.Cache.Set(ctx, key, value, ttl)
+}
+
+func TestRowCacheFillRace(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	cache := &racingCache{Cache: NewRedisCache(&fakeRedis{values: map[string][]byte{}}, "")}
+	table := dbmap.TableFor(WithTime{})
+	w := &WithTime{Time: time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)}
+	_insert(dbmap, w)
+	table.SetCache(cache, 0)
+
+	// the row is updated after it is read on a miss, but before it is
+	// stored, so that the update is stored first
+	updated := *w
+	updated.Time = w.Time.Add(time.Hour)
+	cache.beforeSet = func() { _update(dbmap, &updated) }
+	read := &WithTime{}
+	MustGet(dbmap, read, w.ID)
+	MustGet(dbmap, read, w.ID)
+	if !read.Time.Equal(updated.Time) {
+		t.Errorf("Expected the updated row, got the stale %v", read.Time)
+	}
+}
+
+func TestRowCache(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	redis := &fakeRedis{values: map[string][]byte{}}
+	dbmap.TableFor(WithTime{}).SetCache(NewRedisCache(redis, "app:"), time.Minute)
+	var selects int
+	dbmap.Use(func(next ExecFunc) ExecFunc {
+		return func(ctx context.Context, stmt *Statement) error {
+			if strings.HasPrefix(stmt.Query, "select") && strings.Contains(stmt.Query, "time_test") {
+				selects++
+			}
+			return next(ctx, stmt)
+		}
+	})
+
+	// inserts are written through
+	w := &WithTime{Time: time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)}
+	_insert(dbmap, w)
+	key := fmt.Sprintf("app:time_test:%d", w.ID)
+	if _, ok := redis.values[key]; !ok {
+		t.Fatalf("Expected the row under %s, got %v", key, redis.values)
+	}
+	read := &WithTime{}
+	MustGet(dbmap, read, w.ID)
+	if selects != 0 || !read.Time.Equal(w.Time) || read.ID != w.ID {
+		t.Errorf("Expected %v from the cache, got %v after %d selects", w, read, selects)
+	}
+
+	// rows are read through on a miss
+	delete(redis.values, key)
+	MustGet(dbmap, read, w.ID)
+	MustGet(dbmap, read, w.ID)
+	if selects != 1 || !read.Time.Equal(w.Time) {
+		t.Errorf("Expected 1 select, got %d", selects)
+	}
+
+	w.Time = w.Time.Add(time.Hour)
+	_update(dbmap, w)
+	MustGet(dbmap, read, w.ID)
+	if selects != 1 || !read.Time.Equal(w.Time) {
+		t.Errorf("Expected the updated row from the cache, got %v after %d selects", read, selects)
+	}
+
+	// rows written in a transaction are evicted
+	tx, _ := dbmap.Begin()
+	w.Time = w.Time.Add(time.Hour)
+	if _, err := tx.Update(w); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := redis.values[key]; ok {
+		t.Errorf("Expected a row updated in a transaction to be evicted")
+	}
+	tx.Commit()
+	MustGet(dbmap, read, w.ID)
+	if selects != 2 || !read.Time.Equal(w.Time) {
+		t.Errorf("Expected the committed row to be read, got %v after %d selects", read, selects)
+	}
+
+	_del(dbmap, w)
+	if _, ok := redis.values[key]; ok {
+		t.Errorf("Expected a deleted row to be evicted")
+	}
+	if err := dbmap.Get(read, w.ID); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+// downConnector is a driver.Connector of a database which cannot be
+// reached.
+type downConnector struct {
+	dials int
+}
+
+func (c *downConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.dials++
+	return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+}
+
+func (c *downConnector) Driver() driver.Driver {
+	return nil
+}
+
+func TestFailover(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	live := dbmap.Db
+	down := &downConnector{}
+	downDb := sql.OpenDB(down)
+	defer downDb.Close()
+	var events []FailoverEvent
+	dbmap.FailoverLogger = func(ev FailoverEvent) {
+		events = append(events, ev)
+	}
+	dbmap.SetPrimaries(downDb, live)
+	defer func() {
+		// Cleanup drops the tables of the first primary
+		dbmap.SetPrimaries(live)
+	}()
+
+	// writes which were not sent are run again on the next primary
+	p := &Person{FName: "bob"}
+	if err := dbmap.Insert(p); err != nil {
+		t.Fatal(err)
+	}
+	if down.dials == 0 || dbmap.PrimaryIndex() != 1 {
+		t.Errorf("Expected to fail over to primary 1, got %d", dbmap.PrimaryIndex())
+	}
+	if len(events) != 1 || events[0].From != 0 || events[0].To != 1 || events[0].Err == nil {
+		t.Errorf("Expected a failover from 0 to 1, got %v", events)
+	}
+	read := &Person{}
+	MustGet(dbmap, read, p.ID)
+
+	// Begin fails over too
+	dbmap.Failover(nil)
+	if dbmap.PrimaryIndex() != 0 {
+		t.Errorf("Expected to fail over to primary 0, got %d", dbmap.PrimaryIndex())
+	}
+	tx, err := dbmap.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	if dbmap.PrimaryIndex() != 1 || len(events) != 3 {
+		t.Errorf("Expected Begin to fail over to primary 1, got %d after %v", dbmap.PrimaryIndex(), events)
+	}
+	if err := dbmap.HealthCheck(context.Background()); err != nil {
+		t.Errorf("Expected a healthy primary, got %v", err)
+	}
+}
+
+func TestHardTimeout(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.CollectStats = true
+	dbmap.SetHardTimeout(100 * time.Millisecond)
+
+	p1 := &Person{0, 0, 0, "bob", "smith", 0}
+	_insert(dbmap, p1)
+	MustGet(dbmap, &Person{}, p1.ID)
+
+	slow := "with recursive c(x) as (select 1 union all select x + 1 from c) select count(*) from c"
+	switch dbmap.Dialect.(type) {
+	case PostgresDialect:
+		slow = "select pg_sleep(10)"
+	case MySQLDialect:
+		slow = "select sleep(10)"
+	}
+	// the hard timeout applies even with a later deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	var n []int64
+	err := dbmap.Select(&n, slow, WithContext(ctx))
+	var hte *HardTimeoutError
+	if !errors.As(err, &hte) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a HardTimeoutError, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the statement to be cancelled, took %v", elapsed)
+	}
+	if dbmap.HardTimeouts() != 1 {
+		t.Errorf("Expected 1 hard timeout, got %d", dbmap.HardTimeouts())
+	}
+	for _, qs := range dbmap.Stats() {
+		if qs.HardTimeouts > 0 && qs.Fingerprint != Fingerprint(slow) {
+			t.Errorf("Expected the hard timeout counted for %s, got %s", slow, qs.Fingerprint)
+		}
+	}
+
+	// an earlier deadline is not a hard timeout
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = dbmap.Select(&n, slow, WithContext(ctx))
+	if err == nil || errors.As(err, &hte) {
+		t.Errorf("Expected the call's own deadline to expire, got %v", err)
+	}
+	if dbmap.HardTimeouts() != 1 {
+		t.Errorf("Expected 1 hard timeout, got %d", dbmap.HardTimeouts())
+	}
+}
+
+// cancellingDialect tags statements for the watchdog's backstop.
+type cancellingDialect struct {
+	Dialect
+}
+
+func (cancellingDialect) CancelStatement(tag string) string {
+	return "select 1 where 0 = '" + tag + "'"
+}
+
+func TestHardTimeoutPrepared(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.Dialect = cancellingDialect{dbmap.Dialect}
+	dbmap.SetHardTimeout(time.Minute)
+
+	tx, err := dbmap.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	query := "select 1"
+	_, sent, watched, cancel := newHandle(dbmap, tx.Tx).watch(context.Background(), query)
+	watched(nil)
+	cancel()
+	if sent == query {
+		t.Errorf("Expected a tagged statement, got %s", sent)
+	}
+	// the tags of other DbMaps do not collide with this one's
+	other := NewDbMap(dbmap.Db, dbmap.Dialect).SetHardTimeout(time.Minute)
+	_, otherSent, watched, cancel := newHandle(other, tx.Tx).watch(context.Background(), query)
+	watched(nil)
+	cancel()
+	if otherSent == sent {
+		t.Errorf("Expected distinct tags for distinct DbMaps, got %s", sent)
+	}
+	want := `query like '%/* modl!_watchdog-1 */%' escape '!'`
+	if stmt := (PostgresDialect{}).CancelStatement("modl_watchdog-1"); !strings.Contains(stmt, want) {
+		t.Errorf("Expected the whole escaped comment to be matched, got %s", stmt)
+	}
+
+	// statements prepared for reuse keep their text
+	cache := newStmtCache(tx.Tx)
+	for i := 0; i < 2; i++ {
+		_, sent, watched, cancel = newHandle(dbmap, cache).watch(context.Background(), query)
+		watched(nil)
+		cancel()
+		if sent != query {
+			t.Errorf("Expected an untagged statement, got %s", sent)
+		}
+	}
+	if err := tx.Insert(&Person{0, 0, 0, "bob", "smith", 0}); err != nil {
+		t.Fatal(err)
+	}
+	tx.stmts = cache
+	for i := 0; i < 3; i++ {
+		if err := tx.Insert(&Person{0, 0, 0, "bob", "smith", 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cache.stmts) != 1 {
+		t.Errorf("Expected 1 prepared statement, got %d", len(cache.stmts))
+	}
+}
+
+// deadlockSqlite stands in for a DeadlockDialect with sqlite, whose
+// deadlocks are made up by middleware.
+// pgxError has the fields and methods of pgx's postgres errors.
+type pgxError struct {
+	Code   string
+	Detail string
+}
+
+func (e *pgxError) Error() string    { return e.Detail }
+func (e *pgxError) SQLState() string { return e.Code }
+
+type deadlockSqlite struct {
+	SqliteDialect
+}
+
+func (d deadlockSqlite) IsDeadlock(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "deadlock detected")
+}
+
+func (d deadlockSqlite) DeadlockPeers(ctx context.Context, db *sqlx.DB, err error) ([]string, error) {
+	return []string{"update person_test set FName = 'alice' where id = 1"}, nil
+}
+
+func TestDeadlock(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	dbmap := NewDbMap(db, deadlockSqlite{})
+	defer db.Close()
+	dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "id")
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	var deadlocks []Deadlock
+	dbmap.DeadlockLogger = func(d Deadlock) { deadlocks = append(deadlocks, d) }
+	fail := 0
+	dbmap.Use(func(next ExecFunc) ExecFunc {
+		return func(ctx context.Context, stmt *Statement) error {
+			if fail > 0 && strings.HasPrefix(stmt.Query, "update") {
+				fail--
+				return errors.New("deadlock detected")
+			}
+			return next(ctx, stmt)
+		}
+	})
+
+	p := &Person{0, 0, 0, "bob", "smith", 0}
+	_insert(dbmap, p)
+	fail = 1
+	if _, err := dbmap.Update(p); err == nil {
+		t.Fatal("Expected the update to fail")
+	}
+	if len(deadlocks) != 1 {
+		t.Fatalf("Expected 1 deadlock, got %v", deadlocks)
+	}
+	d := deadlocks[0]
+	if !strings.HasPrefix(d.Statement.Fingerprint, "update") || !reflect.DeepEqual(d.Statement.Tables, []string{"person_test"}) || d.InTx {
+		t.Errorf("Expected the update of person_test outside of a transaction, got %v", d)
+	}
+	if len(d.Peers) != 1 || d.Peers[0].Fingerprint != "update person_test set FName = ? where id = ?" || !reflect.DeepEqual(d.Peers[0].Tables, []string{"person_test"}) {
+		t.Errorf("Expected the peer's update of person_test, got %v", d.Peers)
+	}
+
+	// InTransaction runs the function again after a deadlock
+	dbmap.DeadlockRetries = 2
+	runs := 0
+	fail = 2
+	err = dbmap.InTransaction(func(tx *Transaction) error {
+		runs++
+		_, err := tx.Update(p)
+		return err
+	})
+	if err != nil || runs != 3 {
+		t.Errorf("Expected 3 runs to succeed, got %d %v", runs, err)
+	}
+	if len(deadlocks) != 3 || !deadlocks[2].InTx {
+		t.Errorf("Expected 2 more deadlocks in transactions, got %v", deadlocks)
+	}
+	fail = 3
+	if err := dbmap.InTransaction(func(tx *Transaction) error {
+		_, err := tx.Update(p)
+		return err
+	}); err == nil {
+		t.Error("Expected InTransaction to give up after 2 retries")
+	}
+	fail = 0
+
+	// and after errors the Retrier considers transient
+	dbmap.Dialect = deadlockSqlite{SqliteDialect{BusyRetries: 2, BusyBackoff: time.Millisecond}}
+	runs = 0
+	err = dbmap.InTransaction(func(tx *Transaction) error {
+		if runs++; runs < 3 {
+			return errors.New("database is locked")
+		}
+		return nil
+	})
+	if err != nil || runs != 3 {
+		t.Errorf("Expected 3 runs after busy errors, got %d %v", runs, err)
+	}
+
+	// a panic rolls the transaction back, freeing the only connection
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the panic to continue")
+			}
+		}()
+		dbmap.InTransaction(func(tx *Transaction) error {
+			tx.Insert(&Person{FName: "panicked"})
+			panic("boom")
+		})
+	}()
+	var n int64
+	if err := dbmap.Dbx.Get(&n, "select count(*) from person_test where fname = 'panicked'"); err != nil || n != 0 {
+		t.Errorf("Expected the panicked insert to be rolled back, got %d %v", n, err)
+	}
+
+	detail := "Process 10 waits for ShareLock on transaction 1; blocked by process 11.\nProcess 11 waits for ShareLock on transaction 2; blocked by process 10."
+	if got := pgErrorDetail(fmt.Errorf("update: %w", &pq.Error{Code: "40P01", Detail: detail})); got != detail {
+		t.Errorf("Expected the detail of a lib/pq error, got %q", got)
+	}
+	if got := pgErrorDetail(&pgxError{Code: "40P01", Detail: detail}); got != detail {
+		t.Errorf("Expected the detail of a pgx error, got %q", got)
+	}
+
+	status := `------------------------
+LATEST DETECTED DEADLOCK
+------------------------
+*** (1) TRANSACTION:
+TRANSACTION 1234, ACTIVE 0 sec starting index read
+MySQL thread id 8, OS thread handle 1, query id 100 localhost root updating
+update a set x = 1 where id = 2
+*** (1) WAITING FOR THIS LOCK TO BE GRANTED:
+*** (2) TRANSACTION:
+MySQL thread id 9, OS thread handle 2, query id 101 localhost root updating
+update b set x = 2
+where id = 1
+*** (2) HOLDS THE LOCK(S):
+*** WE ROLL BACK TRANSACTION (1)
+------------
+TRANSACTIONS
+------------
+MySQL thread id 10, OS thread handle 3, query id 102 localhost root starting
+show engine innodb status
+***
+`
+	if peers := innodbDeadlockPeers(status); !reflect.DeepEqual(peers, []string{"update b set x = 2\nwhere id = 1"}) {
+		t.Errorf("Expected the statement of transaction 2, got %q", peers)
+	}
+}
+
+func TestSplitIn(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		p := &Person{0, 0, 0, "bob", "smith", 0}
+		_insert(dbmap, p)
+		ids = append(ids, p.ID)
+	}
+	// pad the ids past the limit on bind parameters with missing ones
+	max := dbmap.Dialect.MaxBindParams()
+	for i := int64(1); len(ids) < max+10; i++ {
+		ids = append(ids, -i)
+	}
+
+	var mu sync.Mutex
+	statements := 0
+	dbmap.Use(func(next ExecFunc) ExecFunc {
+		return func(ctx context.Context, stmt *Statement) error {
+			mu.Lock()
+			statements++
+			mu.Unlock()
+			return next(ctx, stmt)
+		}
+	})
+
+	var people []*Person
+	if err := dbmap.Select(&people, "select * from person_test where id in (?) and FName = ?", ids, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 5 || statements != 2 {
+		t.Errorf("Expected 5 people from 2 statements, got %d from %d", len(people), statements)
+	}
+	// the rows of each statement are appended, as they are by Select
+	people = people[:1]
+	if err := dbmap.Select(&people, "select * from person_test where id in (?) and FName = ?", ids, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 6 {
+		t.Errorf("Expected 6 people after appending, got %d", len(people))
+	}
+	if err := dbmap.Select(&people, "select * from person_test where id in (?) and FName = ?", ids, "bob", ReuseSlice()); err != nil || len(people) != 5 {
+		t.Errorf("Expected a reused slice to be replaced, got %d %v", len(people), err)
+	}
+
+	// rows which are counted cannot be read in chunks
+	if dbmap.splitIn("select count(*) from person_test where id in (?)", []interface{}{ids}, true) != nil {
+		t.Errorf("Expected a count not to be split")
+	}
+	if dbmap.splitIn("delete from person_test where id not in (?)", []interface{}{ids}, false) != nil {
+		t.Errorf("Expected a not in condition not to be split")
+	}
+	// each chunk would match the rows of the other conditions again
+	if dbmap.splitIn("select * from person_test where id in (?) or FName = ?", []interface{}{ids, "bob"}, true) != nil {
+		t.Errorf("Expected an or condition not to be split")
+	}
+	if dbmap.splitIn("select * from person_test where FName = ? and not (id in (?))", []interface{}{"bob", ids}, true) != nil {
+		t.Errorf("Expected a negated condition not to be split")
+	}
+	// names starting with "or" are not or conditions
+	for _, query := range []string{
+		"delete from orders where id in (?)",
+		"delete from t where org_id = ? and id in (?)",
+		"update t set origin = ? where id in (?)",
+	} {
+		args := []interface{}{ids}
+		if strings.Count(query, "?") == 2 {
+			args = []interface{}{int64(1), ids}
+		}
+		if chunks := dbmap.splitIn(query, args, false); len(chunks) != 2 {
+			t.Errorf("Expected %q to be split, got %d chunks", query, len(chunks))
+		}
+	}
+	if chunks := dbmap.splitIn("update person_test set LName = ? where id in ( ? )", []interface{}{"x", ids, WithContext(context.Background())}, false); len(chunks) != 2 || len(chunks[0][1].([]int64)) != max-1 || len(chunks[0]) != 3 {
+		t.Errorf("Expected the ids to be split around the other args, got %d chunks", len(chunks))
+	}
+	for _, query := range []string{
+		"update person_test set LName = ?, FName = '?' where id in (?)",
+		"update person_test set LName = ? /* why? */ where id in (?)",
+		"update person_test set LName = ? -- why?\nwhere id in (?)",
+	} {
+		if chunks := dbmap.splitIn(query, []interface{}{"x", ids}, false); len(chunks) != 2 {
+			t.Errorf("Expected question marks in strings and comments not to be counted in %q", query)
+		}
+	}
+	if chunks := dbmap.splitIn("select * from t where doc ?? 'key' and id in (?)", []interface{}{ids}, false); len(chunks) != 2 {
+		t.Errorf("Expected escaped question marks not to be counted")
+	}
+
+	statements = 0
+	res, err := dbmap.Exec("delete from person_test where id in (?)", ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n != 5 || statements != 2 {
+		t.Errorf("Expected 5 rows deleted by 2 statements, got %d by %d", n, statements)
+	}
+}
+
+type Flag bool
+
+type WithBools struct {
+	ID      int64
+	Active  bool
+	Deleted *bool
+	Flagged Flag
+	Null    sql.NullBool
+}
+
+func TestBools(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists bool_test")
+	table := dbmap.AddTableWithName(WithBools{}, "bool_test").SetKeys(true, "ID")
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
+
+	boolType := dbmap.Dialect.ToSqlType(table.ColMap("Active"))
+	for _, field := range []string{"Deleted", "Flagged", "Null"} {
+		if typ := dbmap.Dialect.ToSqlType(table.ColMap(field)); typ != boolType {
+			t.Errorf("Expected %s to be a %s, got %s", field, boolType, typ)
+		}
+	}
+
+	yes := true
+	b := &WithBools{Active: true, Deleted: &yes, Flagged: true}
+	_insert(dbmap, b)
+	got := &WithBools{}
+	MustGet(dbmap, got, b.ID)
+	if !got.Active || got.Deleted == nil || !*got.Deleted || !bool(got.Flagged) || got.Null.Valid {
+		t.Errorf("Expected the bools to be read back, got %+v", got)
+	}
+
+	// the values of columns which are not booleans, as drivers return them
+	for _, c := range []struct {
+		src  interface{}
+		want bool
+	}{
+		{int64(2), true}, {int64(0), false}, {float64(1), true}, {[]byte("1"), true},
+		{[]byte("0"), false}, {"t", true}, {"no", false}, {[]byte{1}, true}, {[]byte{0}, false}, {"1.0", true},
+	} {
+		var v bool
+		if err := (boolCodec{}).decode(reflect.ValueOf(&v).Elem(), c.src); err != nil || v != c.want {
+			t.Errorf("Expected %#v to be %v, got %v %v", c.src, c.want, v, err)
+		}
+	}
+	var p *bool
+	if err := (boolCodec{}).decode(reflect.ValueOf(&p).Elem(), nil); err != nil || p != nil {
+		t.Errorf("Expected NULL to be nil, got %v %v", p, err)
+	}
+	if err := (boolCodec{}).decode(reflect.ValueOf(&yes).Elem(), nil); err == nil || !yes {
+		t.Errorf("Expected an error reading NULL into a bool, got %v %v", yes, err)
+	}
+	if err := (boolCodec{}).decode(reflect.ValueOf(&yes).Elem(), "maybe"); err == nil {
+		t.Errorf("Expected maybe not to be a bool")
+	}
+}
+
+// NullCents is a user Null wrapper.
+type NullCents struct {
+	Cents int64
+	Valid bool
+}
+
+func (n NullCents) Value() (driver.Value, error) {
+	if !n.Valid {
+		return nil, nil
+	}
+	return n.Cents, nil
+}
+
+func (n *NullCents) Scan(src interface{}) error {
+	var i sql.NullInt64
+	err := i.Scan(src)
+	n.Cents, n.Valid = i.Int64, i.Valid
+	return err
+}
+
+type WithNullables struct {
+	ID      int64
+	Name    sql.NullString
+	Count   sql.NullInt64
+	At      sql.NullTime
+	Total   *int64
+	Seen    *time.Time
+	Balance NullCents
+	Plain   int64
+}
+
+func TestNullableColumns(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists nullable_test")
+	table := dbmap.AddTableWithName(WithNullables{}, "nullable_test").SetKeys(true, "ID")
+	table.ColMap("Plain").SetNotNull(true)
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
+
+	d := dbmap.Dialect
+	plain := &ColumnMap{gotype: reflect.TypeOf(int64(0))}
+	for _, c := range []struct {
+		field string
+		like  interface{}
+	}{
+		{"Name", ""}, {"Count", int64(0)}, {"At", time.Time{}}, {"Total", int64(0)}, {"Seen", time.Time{}}, {"Balance", int64(0)},
+	} {
+		plain.gotype = reflect.TypeOf(c.like)
+		if got, want := d.ToSqlType(table.ColMap(c.field).valueColumn()), d.ToSqlType(plain); got != want {
+			t.Errorf("Expected %s to be a %s, got %s", c.field, want, got)
+		}
+	}
+	stmts, _ := dbmap.CreateTablesSql()
+	if !strings.Contains(stmts[0], d.QuoteField("plain")+" "+d.ToSqlType(table.ColMap("Plain"))+" not null") {
+		t.Errorf("Expected plain to be not null, got %s", stmts[0])
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected SetNotNull to panic for a nullable column")
+			}
+		}()
+		table.ColMap("Count").SetNotNull(true)
+	}()
+
+	empty := &WithNullables{}
+	_insert(dbmap, empty)
+	got := &WithNullables{}
+	MustGet(dbmap, got, empty.ID)
+	if !reflect.DeepEqual(got, empty) {
+		t.Errorf("Expected %+v, got %+v", empty, got)
+	}
+
+	total := int64(42)
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	full := &WithNullables{
+		Name:    sql.NullString{String: "x", Valid: true},
+		Count:   sql.NullInt64{Int64: 7, Valid: true},
+		At:      sql.NullTime{Time: at, Valid: true},
+		Total:   &total,
+		Seen:    &at,
+		Balance: NullCents{Cents: 150, Valid: true},
+		Plain:   1,
+	}
+	_insert(dbmap, full)
+	full.Count.Int64 = 8
+	_update(dbmap, full)
+	var rows []*WithNullables
+	if err := dbmap.Select(&rows, "select * from nullable_test where id = ?", full.ID); err != nil {
+		t.Fatal(err)
+	}
+	got = rows[0]
+	if got.Name != full.Name || got.Count.Int64 != 8 || !got.At.Valid || !got.At.Time.Equal(at) || *got.Total != 42 || !got.Seen.Equal(at) || got.Balance != full.Balance {
+		t.Errorf("Expected %+v, got %+v", full, got)
+	}
+}
+
+func TestColumnMetadata(t *testing.T) {
+	dbmap := &DbMap{Dialect: SqliteDialect{}}
+	table := dbmap.AddTable(Person{}).SetKeys(true, "ID")
+	if table.GoType() != reflect.TypeOf(Person{}) {
+		t.Errorf("table type is %v", table.GoType())
+	}
+	if v := table.VersionColumn(); v == nil || v.FieldName() != "Version" {
+		t.Errorf("version column is %v", v)
+	}
+	id := table.ColMap("ID")
+	if !id.IsKey() || !id.IsAutoIncrement() || id.Table() != table {
+		t.Errorf("ID is not the auto-increment key of its table")
+	}
+	fname := table.ColMap("FName")
+	if fname.IsKey() || fname.Nullable() || fname.GoType().Kind() != reflect.String {
+		t.Errorf("FName: key %v, nullable %v, type %v", fname.IsKey(), fname.Nullable(), fname.GoType())
+	}
+	if typ := fname.SqlType(); typ != "text" {
+		t.Errorf("FName has sql type %q", typ)
+	}
+	if typ := fname.SetSqlType("varchar(32)").SqlType(); typ != "varchar(32)" {
+		t.Errorf("FName has sql type %q after SetSqlType", typ)
+	}
+	if fname.SetReadOnly(true); !fname.IsReadOnly() || fname.IsWriteOnly() {
+		t.Errorf("FName is not read only")
+	}
+}
+
+type HookedRow struct {
+	ID     int64
+	Name   string
+	Frozen bool
+	trail  []string
+}
+
+func (r *HookedRow) PreInsert(SqlExecutor) error {
+	r.trail = append(r.trail, "method")
+	return nil
+}
+
+func (r *HookedRow) PreUpdate(SqlExecutor) error {
+	if r.Frozen {
+		return SkipOperation{Reason: "frozen"}
+	}
+	return nil
+}
+
+func TestHookOrder(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists hooked_test")
+	table := dbmap.AddTableWithName(HookedRow{}, "hooked_test").SetKeys(true, "ID")
+	for _, name := range []string{"first", "second"} {
+		name := name
+		table.AddHook(PreInsertEvent, func(hc HookContext, e SqlExecutor, row interface{}) error {
+			r := row.(*HookedRow)
+			r.trail = append(r.trail, name)
+			if r.Name == "skipped" {
+				return SkipOperation{}
+			}
+			return nil
+		})
+	}
+	table.AddHook(PreDeleteEvent, func(hc HookContext, e SqlExecutor, row interface{}) error {
+		if hc.Op != OpDelete {
+			t.Errorf("Expected a delete, got %s", hc.Op)
+		}
+		if row.(*HookedRow).Frozen {
+			return SkipOperation{Reason: "frozen"}
+		}
+		return nil
+	})
+	if !table.CanPreDelete {
+		t.Errorf("Expected AddHook to set CanPreDelete")
+	}
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
+
+	r := &HookedRow{Name: "a"}
+	_insert(dbmap, r)
+	if got := strings.Join(r.trail, ","); got != "method,first,second" {
+		t.Errorf("Expected hooks to run in order, got %s", got)
+	}
+
+	skipped := &HookedRow{Name: "skipped"}
+	_insert(dbmap, skipped, &HookedRow{Name: "b"})
+	if err := dbmap.Insert(&HookedRow{Name: "skipped"}, &HookedRow{Name: "c"}, Batch()); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	if err := dbmap.Dbx.Get(&count, "select count(*) from hooked_test"); err != nil {
+		t.Fatal(err)
+	}
+	if skipped.ID != 0 || count != 3 {
+		t.Errorf("Expected skipped rows not to be inserted, got %d rows", count)
+	}
+
+	r.Frozen = true
+	if n := _update(dbmap, r); n != 0 {
+		t.Errorf("Expected a skipped update to count no rows, got %d", n)
+	}
+	if err := dbmap.Save(r); err != nil {
+		t.Errorf("Expected a skipped save not to insert the row again, got %v", err)
+	}
+	if n := _del(dbmap, r); n != 0 {
+		t.Errorf("Expected a skipped delete to count no rows, got %d", n)
+	}
+	r.Frozen = false
+	if n := _del(dbmap, r); n != 1 {
+		t.Errorf("Expected to delete 1 row, got %d", n)
+	}
+}
+
+func TestOldRows(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists old_rows_test")
+	table := dbmap.AddTableWithName(HookedRow{}, "old_rows_test").SetKeys(true, "ID")
+	var olds []string
+	table.AddHook(PreUpdateEvent, func(hc HookContext, e SqlExecutor, row interface{}) error {
+		old, _ := hc.Old.(*HookedRow)
+		if old == nil {
+			olds = append(olds, "<nil>")
+		} else {
+			olds = append(olds, old.Name)
+		}
+		return nil
+	})
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
+
+	r := &HookedRow{Name: "a"}
+	_insert(dbmap, r)
+	r.Name = "b"
+	_update(dbmap, r)
+	loaded := &HookedRow{Name: "loaded"}
+	r.Name = "c"
+	if _, err := dbmap.Update(r, WithOld(r, loaded)); err != nil {
+		t.Fatal(err)
+	}
+	table.SetOldRows(true)
+	r.Name = "d"
+	_update(dbmap, r)
+	table.SetOldRows(false)
+
+	s := dbmap.NewSession()
+	var got HookedRow
+	if err := s.Get(&got, r.ID); err != nil {
+		t.Fatal(err)
+	}
+	got.Name = "e"
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "<nil>,loaded,c,d"; strings.Join(olds, ",") != want {
+		t.Errorf("Expected old rows %s, got %s", want, strings.Join(olds, ","))
+	}
+}
+
+func TestSelectToChannel(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	for _, name := range []string{"a", "b", "c"} {
+		_insert(dbmap, &Person{FName: name})
+	}
+
+	rows := make(chan *Person)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- dbmap.SelectToChannel(rows, "select * from person_test order by id")
+	}()
+	n := 0
+	for p := range rows {
+		if p.LName != "postget" {
+			t.Errorf("Expected the PostGet hook to run, got %+v", p)
+		}
+		n++
+	}
+	if err := <-errc; err != nil || n != 3 {
+		t.Errorf("Expected 3 rows, got %d, %v", n, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ids := make(chan int64)
+	go func() {
+		errc <- dbmap.SelectToChannel(ids, "select id from person_test", WithContext(ctx))
+	}()
+	<-ids
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the select to be cancelled, got %v", err)
+	}
+	if _, open := <-ids; open {
+		t.Errorf("Expected the channel to be closed")
+	}
+
+	if err := dbmap.SelectToChannel([]Person{}, "select * from person_test"); err == nil {
+		t.Errorf("Expected an error for a slice")
+	}
+}
+
+func TestNullValues(t *testing.T) {
+	dbmap := initDbMapNulls()
+	defer dbmap.Cleanup()
+
+	// insert a row directly
+	_, err := dbmap.Exec(`insert into tablewithnull values (10, null, null, null, null, null)`)
+	if err != nil {
+		panic(err)
+	}
+
+	// try to load it
+	expected := &TableWithNull{ID: 10}
+	t1 := &TableWithNull{}
+	MustGet(dbmap, t1, 10)
+	if !reflect.DeepEqual(expected, t1) {
+		t.Errorf("%v != %v", expected, t1)
+	}
+
+	// update it
+	t1.Str = sql.NullString{"hi", true}
+	expected.Str = t1.Str
+	t1.Int64 = sql.NullInt64{999, true}
+	expected.Int64 = t1.Int64
+	t1.Float64 = sql.NullFloat64{53.33, true}
+	expected.Float64 = t1.Float64
+	t1.Bool = sql.NullBool{true, true}
+	expected.Bool = t1.Bool
+	t1.Bytes = []byte{1, 30, 31, 33}
+	expected.Bytes = t1.Bytes
+	_update(dbmap, t1)
+
+	MustGet(dbmap, t1, 10)
+	if t1.Str.String != "hi" {
+		t.Errorf("%s != hi", t1.Str.String)
+	}
+	if !reflect.DeepEqual(expected, t1) {
+		t.Errorf("%v != %v", expected, t1)
+	}
+}
+
+func TestColumnProps(t *testing.T) {
+	dbmap := newDbMap()
+	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
+	t1 := dbmap.AddTable(Invoice{}).SetKeys(true, "ID")
+	//t1.ColMap("Created").Rename("date_created")
+	t1.ColMap("Updated").SetTransient(true)
+	t1.ColMap("Memo").SetMaxSize(10)
+	t1.ColMap("PersonID").SetUnique(true)
+
+	err := dbmap.CreateTables()
+	if err != nil {
+		panic(err)
+	}
+	defer dbmap.Cleanup()
+
+	// test transient
+	inv := &Invoice{0, 0, 1, "my invoice", 0, true}
+	_insert(dbmap, inv)
+	inv2 := Invoice{}
+	MustGet(dbmap, &inv2, inv.ID)
+	if inv2.Updated != 0 {
+		t.Errorf("Saved transient column 'Updated'")
+	}
+
+	// test max size
+	inv2.Memo = "this memo is too long"
+	err = dbmap.Insert(inv2)
+	if err == nil {
+		t.Errorf("max size exceeded, but Insert did not fail.")
+	}
+
+	// test unique - same person id
+	inv = &Invoice{0, 0, 1, "my invoice2", 0, false}
+	err = dbmap.Insert(inv)
+	if err == nil {
+		t.Errorf("same PersonID inserted, but Insert did not fail.")
+	}
+}
+
+func TestRawSelect(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	p1 := &Person{0, 0, 0, "bob", "smith", 0}
+	_insert(dbmap, p1)
+
+	inv1 := &Invoice{0, 0, 0, "xmas order", p1.ID, true}
+	_insert(dbmap, inv1)
+
+	expected := &InvoicePersonView{inv1.ID, p1.ID, inv1.Memo, p1.FName, 0}
+
+	query := "select i.id invoiceid, p.id personid, i.memo, p.fname " +
+		"from invoice_test i, person_test p " +
+		"where i.personid = p.id"
+	list := []InvoicePersonView{}
+	MustSelect(dbmap, &list, query)
+	if len(list) != 1 {
+		t.Errorf("len(list) != 1: %d", len(list))
+	} else if !reflect.DeepEqual(expected, &list[0]) {
+		t.Errorf("%v != %v", expected, list[0])
+	}
+}
+
+func TestHooks(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	p1 := &Person{0, 0, 0, "bob", "smith", 0}
+	_insert(dbmap, p1)
+	if p1.Created == 0 || p1.Updated == 0 {
+		t.Errorf("p1.PreInsert() didn't run: %v", p1)
+	} else if p1.LName != "postinsert" {
+		t.Errorf("p1.PostInsert() didn't run: %v", p1)
+	}
+
+	MustGet(dbmap, p1, p1.ID)
+	if p1.LName != "postget" {
+		t.Errorf("p1.PostGet() didn't run: %v", p1)
+	}
+
+	p1.LName = "smith"
+	_update(dbmap, p1)
+	if p1.FName != "preupdate" {
+		t.Errorf("p1.PreUpdate() didn't run: %v", p1)
+	} else if p1.LName != "postupdate" {
+		t.Errorf("p1.PostUpdate() didn't run: %v", p1)
+	}
+
+	var persons []*Person
+	bindVar := dbmap.Dialect.BindVar(0)
+	MustSelect(dbmap, &persons, "select * from person_test where id = "+bindVar, p1.ID)
+	if persons[0].LName != "postget" {
+		t.Errorf("p1.PostGet() didn't run after select: %v", p1)
+	}
+
+	_del(dbmap, p1)
+	if p1.FName != "predelete" {
+		t.Errorf("p1.PreDelete() didn't run: %v", p1)
+	} else if p1.LName != "postdelete" {
+		t.Errorf("p1.PostDelete() didn't run: %v", p1)
+	}
+
+	// Test error case
+	p2 := &Person{0, 0, 0, "badname", "", 0}
+	err := dbmap.Insert(p2)
+	if err == nil {
+		t.Errorf("p2.PreInsert() didn't return an error")
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	inv1 := &Invoice{0, 100, 200, "t1", 0, true}
+	inv2 := &Invoice{0, 100, 200, "t2", 0, false}
+
+	trans, err := dbmap.Begin()
+	if err != nil {
+		panic(err)
+	}
+	trans.Insert(inv1, inv2)
+	err = trans.Commit()
+	if err != nil {
+		panic(err)
+	}
+
+	obj := &Invoice{}
+	err = dbmap.Get(obj, inv1.ID)
+	if err != nil {
+		panic(err)
+	}
+	if !reflect.DeepEqual(inv1, obj) {
+		t.Errorf("%v != %v", inv1, obj)
+	}
+	err = dbmap.Get(obj, inv2.ID)
+	if err != nil {
+		panic(err)
+	}
+	if !reflect.DeepEqual(inv2, obj) {
+		t.Errorf("%v != %v", inv2, obj)
+	}
+}
+
+func TestMultiple(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	inv1 := &Invoice{0, 100, 200, "a", 0, false}
+	inv2 := &Invoice{0, 100, 200, "b", 0, true}
+	_insert(dbmap, inv1, inv2)
+
+	inv1.Memo = "c"
+	inv2.Memo = "d"
+	_update(dbmap, inv1, inv2)
+
+	count := _del(dbmap, inv1, inv2)
+	if count != 2 {
+		t.Errorf("%d != 2", count)
+	}
+}
+
+func TestCrud(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	inv := &Invoice{0, 100, 200, "first order", 0, true}
+
+	// INSERT row
+	_insert(dbmap, inv)
+	if inv.ID == 0 {
+		t.Errorf("inv.ID was not set on INSERT")
+		return
+	}
+
+	// SELECT row
+	inv2 := &Invoice{}
+	MustGet(dbmap, inv2, inv.ID)
+	if !reflect.DeepEqual(inv, inv2) {
+		t.Errorf("%v != %v", inv, inv2)
+	}
+
+	// UPDATE row and SELECT
+	inv.Memo = "second order"
+	inv.Created = 999
+	inv.Updated = 11111
+	count := _update(dbmap, inv)
+	if count != 1 {
+		t.Errorf("update 1 != %d", count)
+	}
+
+	MustGet(dbmap, inv2, inv.ID)
+	if !reflect.DeepEqual(inv, inv2) {
+		t.Errorf("%v != %v", inv, inv2)
+	}
+
+	// DELETE row
+	deleted := _del(dbmap, inv)
+	if deleted != 1 {
+		t.Errorf("Did not delete row with ID: %d", inv.ID)
+		return
+	}
+
+	// VERIFY deleted
+	err := dbmap.Get(inv2, inv.ID)
+	if err != ErrNotFound || !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Found invoice with id: %d after Delete()", inv.ID)
+	}
+}
+
+func TestWithIgnoredColumn(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	ic := &WithIgnoredColumn{-1, 0, 1}
+	_insert(dbmap, ic)
+	expected := &WithIgnoredColumn{0, 1, 1}
+
+	ic2 := &WithIgnoredColumn{}
+	MustGet(dbmap, ic2, ic.ID)
+
+	if !reflect.DeepEqual(expected, ic2) {
+		t.Errorf("%v != %v", expected, ic2)
+	}
+
+	if _del(dbmap, ic) != 1 {
+		t.Errorf("Did not delete row with ID: %d", ic.ID)
+		return
+	}
+
+	err := dbmap.Get(ic2, ic.ID)
+	if err != ErrNotFound {
+		t.Errorf("Found id: %d after Delete() (%#v)", ic.ID, ic2)
+	}
+}
+
+func TestVersionMultipleRows(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	persons := []*Person{
+		&Person{0, 0, 0, "Bob", "Smith", 0},
+		&Person{0, 0, 0, "Jane", "Smith", 0},
+		&Person{0, 0, 0, "Mike", "Smith", 0},
+	}
+
+	_insert(dbmap, persons[0], persons[1], persons[2])
+
+	for x, p := range persons {
+		if p.Version != 1 {
+			t.Errorf("person[%d].Version != 1: %d", x, p.Version)
+		}
+	}
+}
+
+func TestWithStringPk(t *testing.T) {
+	dbmap := newDbMap()
+	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
+	dbmap.AddTableWithName(WithStringPk{}, "string_pk_test").SetKeys(true, "ID")
+	_, err := dbmap.Exec("create table string_pk_test (ID varchar(255), Name varchar(255));")
+	if err != nil {
+		t.Errorf("couldn't create string_pk_test: %v", err)
+	}
+	defer dbmap.Cleanup()
+
+	row := &WithStringPk{"1", "foo"}
+	err = dbmap.Insert(row)
+	if err == nil {
+		t.Errorf("Expected error when inserting into table w/non Int PK and autoincr set true")
+	}
+}
+
+func BenchmarkNativeCrud(b *testing.B) {
+	var err error
+
+	b.StopTimer()
+	dbmap := initDbMapBench()
+	defer dbmap.Cleanup()
+	b.StartTimer()
+
+	insert := "insert into invoice_test (date_created, updated, memo, personid) values (?, ?, ?, ?)"
+	sel := "select id, date_created, updated, memo, personid from invoice_test where id=?"
+	update := "update invoice_test set date_created=?, updated=?, memo=?, personid=? where id=?"
+	delete := "delete from invoice_test where id=?"
+
+	suffix := dbmap.Dialect.AutoIncrInsertSuffix(&ColumnMap{ColumnName: "id"})
+
+	insert = ReBind(insert, dbmap.Dialect) + suffix
+	sel = ReBind(sel, dbmap.Dialect)
+	update = ReBind(update, dbmap.Dialect)
+	delete = ReBind(delete, dbmap.Dialect)
+
+	inv := &Invoice{0, 100, 200, "my memo", 0, false}
+
+	for i := 0; i < b.N; i++ {
+		if len(suffix) == 0 {
+			res, err := dbmap.Db.Exec(insert, inv.Created, inv.Updated, inv.Memo, inv.PersonID)
+			if err != nil {
+				panic(err)
+			}
+
+			newid, err := res.LastInsertId()
+			if err != nil {
+				panic(err)
+			}
+			inv.ID = newid
+		} else {
+			rows, err := dbmap.Db.Query(insert, inv.Created, inv.Updated, inv.Memo, inv.PersonID)
+			if err != nil {
+				panic(err)
+			}
+
+			if rows.Next() {
+				err = rows.Scan(&inv.ID)
+				if err != nil {
+					panic(err)
+				}
+			}
+			rows.Close()
+
+		}
+
+		row := dbmap.Db.QueryRow(sel, inv.ID)
+		err = row.Scan(&inv.ID, &inv.Created, &inv.Updated, &inv.Memo, &inv.PersonID)
+		if err != nil {
+			panic(err)
+		}
+
+		inv.Created = 1000
+		inv.Updated = 2000
+		inv.Memo = "my memo 2"
+		inv.PersonID = 3000
+
+		_, err = dbmap.Db.Exec(update, inv.Created, inv.Updated, inv.Memo,
+			inv.PersonID, inv.ID)
+		if err != nil {
+			panic(err)
+		}
+
+		_, err = dbmap.Db.Exec(delete, inv.ID)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+}
+
+func BenchmarkModlCrud(b *testing.B) {
+	b.StopTimer()
+	dbmap := initDbMapBench()
+	defer dbmap.Cleanup()
+	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
+	b.StartTimer()
+
+	inv := &Invoice{0, 100, 200, "my memo", 0, true}
+	for i := 0; i < b.N; i++ {
+		err := dbmap.Insert(inv)
+		if err != nil {
+			panic(err)
+		}
+
+		inv2 := Invoice{}
+		err = dbmap.Get(&inv2, inv.ID)
+		if err != nil {
+			panic(err)
+		}
+
+		inv2.Created = 1000
+		inv2.Updated = 2000
+		inv2.Memo = "my memo 2"
+		inv2.PersonID = 3000
+		_, err = dbmap.Update(&inv2)
+		if err != nil {
+			panic(err)
+		}
+
+		_, err = dbmap.Delete(&inv2)
+		if err != nil {
+			panic(err)
+		}
+
+	}
+}
+
+func BenchmarkModlSelect(b *testing.B) {
+	b.StopTimer()
+	dbmap := initDbMapBench()
+	defer dbmap.Cleanup()
+	for i := 0; i < 20; i++ {
+		_insert(dbmap, &Invoice{0, 100, 200, "my memo", 0, true})
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		var invoices []Invoice
+		err := dbmap.Select(&invoices, "select * from invoice_test")
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkBindUpdate(b *testing.B) {
+	dbmap := &DbMap{Dialect: SqliteDialect{}}
+	table := dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "id")
+	people := make([]Person, 100)
+	for i := range people {
+		people[i] = Person{int64(i + 1), 100, 200, "bob", "smith", 1}
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for j := range people {
+			table.bindUpdate(dbmap, reflect.ValueOf(&people[j]).Elem(), false)
+		}
+	}
+}
+
+func initDbMapBench() *DbMap {
+	dbmap := newDbMap()
+	dbmap.Db.Exec("drop table if exists invoice_test")
+	dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
+	err := dbmap.CreateTables()
+	if err != nil {
+		panic(err)
+	}
+	return dbmap
+}
+
+func (d *DbMap) Cleanup() {
+	err := d.DropTables()
+	if err != nil {
+		panic(err)
+	}
+	err = d.Dbx.Close()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func initDbMap() *DbMap {
+	dbmap := newDbMap()
+	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
+	dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
+	dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "id")
+	dbmap.AddTableWithName(WithIgnoredColumn{}, "ignored_column_test").SetKeys(true, "id")
+	dbmap.AddTableWithName(WithTime{}, "time_test").SetKeys(true, "ID")
+	err := dbmap.CreateTables()
+	if err != nil {
+		panic(err)
+	}
+
+	return dbmap
+}
+
+func TestTruncateTables(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	err := dbmap.CreateTablesIfNotExists()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Insert some data
+	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
+	dbmap.Insert(p1)
+	inv := &Invoice{0, 0, 1, "my invoice", 0, true}
+	dbmap.Insert(inv)
+
+	err = dbmap.TruncateTables()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Make sure all rows are deleted
+	people := []Person{}
+	invoices := []Invoice{}
+	dbmap.Select(&people, "SELECT * FROM person_test")
+	if len(people) != 0 {
+		t.Errorf("Expected 0 person rows, got %d", len(people))
+	}
+	dbmap.Select(&invoices, "SELECT * FROM invoice_test")
+	if len(invoices) != 0 {
+		t.Errorf("Expected 0 invoice rows, got %d", len(invoices))
+	}
+}
+
+func TestTruncateTablesIdentityRestart(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	err := dbmap.CreateTablesIfNotExists()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Insert some data
+	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
+	dbmap.Insert(p1)
+	inv := &Invoice{0, 0, 1, "my invoice", 0, true}
+	dbmap.Insert(inv)
+
+	err = dbmap.TruncateTablesIdentityRestart()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Make sure all rows are deleted
+	people := []Person{}
+	invoices := []Invoice{}
+	dbmap.Select(&people, "SELECT * FROM person_test")
+	if len(people) != 0 {
+		t.Errorf("Expected 0 person rows, got %d", len(people))
+	}
+	dbmap.Select(&invoices, "SELECT * FROM invoice_test")
+	if len(invoices) != 0 {
+		t.Errorf("Expected 0 invoice rows, got %d", len(invoices))
+	}
+
+	p2 := &Person{0, 0, 0, "Other", "Person", 0}
+	dbmap.Insert(p2)
+	if p2.ID != int64(1) {
+		t.Errorf("Expected new person ID to be equal to 1, was %d", p2.ID)
+	}
+}
+
+func TestSelectBehavior(t *testing.T) {
+	db := initDbMap()
+	defer db.Cleanup()
+
+	p := Person{}
+
+	// check that SelectOne with no rows returns ErrNoRows
+	err := db.SelectOne(&p, "select * from person_test")
+	if err == nil || err != sql.ErrNoRows {
+		t.Fatal(err)
+	}
+
+	// insert and ensure SelectOne works properly
+	bob := Person{0, 0, 0, "Bob", "Smith", 0}
+	db.Insert(&bob)
+
+	err = db.SelectOne(&p, "select * from person_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.FName != "Bob" {
+		t.Errorf("Wrong FName: %s", p.FName)
+	}
+	// there's a post hook on this that sets it to postget, ensure it ran
+	if p.LName != "postget" {
+		t.Errorf("Wrong LName: %s", p.LName)
+	}
+
+	// insert again and ensure SelectOne *does not* error in rows > 1
+	ben := Person{0, 0, 0, "Ben", "Smith", 0}
+	db.Insert(&ben)
+
+	err = db.SelectOne(&p, "select * from person_test ORDER BY fname ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.FName != "Ben" {
+		t.Errorf("Wrong FName: %s", p.FName)
+	}
+}
+
+func TestQuoteTableNames(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	quotedTableName := dbmap.Dialect.QuoteField("person_test")
+
+	// Use a buffer to hold the log to check generated queries
+	var logBuffer bytes.Buffer
+	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", log.Lmicroseconds))
+
+	// Create some rows
+	p1 := &Person{0, 0, 0, "bob", "smith", 0}
+	errorTemplate := "Expected quoted table name %v in query but didn't find it"
+
+	// Check if Insert quotes the table name
+	id := dbmap.Insert(p1)
+	if !bytes.Contains(logBuffer.Bytes(), []byte(quotedTableName)) {
+		t.Log("log:", logBuffer.String())
+		t.Errorf(errorTemplate, quotedTableName)
+	}
+	logBuffer.Reset()
+
+	// Check if Get quotes the table name
+	dbmap.Get(Person{}, id)
+	if !bytes.Contains(logBuffer.Bytes(), []byte(quotedTableName)) {
+		t.Errorf(errorTemplate, quotedTableName)
+	}
+	logBuffer.Reset()
+}
+
+type WithTime struct {
+	ID   int64
+	Time time.Time
+}
+
+func TestWithTime(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	// FIXME: there seems to be a bug with go-sql-driver and timezones?
+	// MySQL doesn't have any timestamp support, but since it is not
+	// sending any, the scan assumes UTC, so the scanner should
+	// probably convert to UTC before storing.  Also, note that time.Time
+	// support requires a special bit to be added to the DSN
+	t1, err := time.Parse("2006-01-02 15:04:05 -0700 MST",
+		"2013-08-09 21:30:43 +0000 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w1 := WithTime{1, t1}
+	dbmap.Insert(&w1)
+
+	w2 := WithTime{}
+	dbmap.Get(&w2, w1.ID)
+
+	if w1.Time.UnixNano() != w2.Time.UnixNano() {
+		t.Errorf("%v != %v", w1, w2)
+	}
+}
+
+func initDbMapNulls() *DbMap {
+	dbmap := newDbMap()
+	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
+	dbmap.AddTable(TableWithNull{}).SetKeys(false, "id")
+	err := dbmap.CreateTables()
+	if err != nil {
+		panic(err)
+	}
+	return dbmap
+}
+
+func newDbMap() *DbMap {
+	dialect, driver := dialectAndDriver()
+	return NewDbMap(connect(driver), dialect)
+}
+
+func connect(driver string) *sql.DB {
+	dsn := os.Getenv("MODL_TEST_DSN")
+	if dsn == "" {
+		panic("MODL_TEST_DSN env variable is not set. Please see README.md")
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		panic("Error connecting to db: " + err.Error())
+	}
+	err = db.Ping()
+	if err != nil {
+		panic("Error connecting to db: " + err.Error())
+	}
+	return db
+}
+
+func dialectAndDriver() (Dialect, string) {
+	switch os.Getenv("MODL_TEST_DIALECT") {
+	case "mysql":
+		return MySQLDialect{"InnoDB", "UTF8"}, "mysql"
+	case "postgres":
+		return PostgresDialect{}, "postgres"
+	case "sqlite":
+		return SqliteDialect{}, "sqlite3"
+	}
+	panic("MODL_TEST_DIALECT env variable is not set or is invalid. Please see README.md")
+}
+
+func _insert(dbmap *DbMap, list ...interface{}) {
+	err := dbmap.Insert(list...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func _update(dbmap *DbMap, list ...interface{}) int64 {
+	count, err := dbmap.Update(list...)
+	if err != nil {
+		panic(err)
+	}
+	return count
+}
+
+func _del(dbmap *DbMap, list ...interface{}) int64 {
+	count, err := dbmap.Delete(list...)
+	if err != nil {
+		panic(err)
+	}
+
+	return count
+}
+
+func MustGet(dbmap *DbMap, i interface{}, keys ...interface{}) {
+	err := dbmap.Get(i, keys...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func MustSelect(dbmap *DbMap, dest interface{}, query string, args ...interface{}) {
+	err := dbmap.Select(dest, query, args...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestQueryOptions(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	var logBuffer bytes.Buffer
+	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", log.Lmicroseconds))
+
+	p1 := &Person{0, 0, 0, "bob", "smith", 0}
+	_insert(dbmap, p1)
+
+	p2 := &Person{}
+	err := dbmap.Get(p2, p1.ID, NoHooks(), WithTimeout(time.Second), Comment("service=test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.LName == "postget" {
+		t.Errorf("PostGet ran despite NoHooks")
+	}
+	if !bytes.Contains(logBuffer.Bytes(), []byte("/* service=test */")) {
+		t.Errorf("Expected comment in query log, got %s", logBuffer.String())
+	}
+
+	// a comment cannot end early to inject sql
+	logBuffer.Reset()
+	err = dbmap.Get(p2, p1.ID, Comment("user=*/ drop table person_test; /*/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(logBuffer.Bytes(), []byte("/* user=* / drop table person_test; / * / */")) {
+		t.Errorf("Expected an escaped comment in query log, got %s", logBuffer.String())
+	}
+
+	// writes run with the call's comment and timeout, whatever the key
+	dbmap.AddTableWithName(Sku{}, "sku_test").SetKeys(false, "ID")
+	if err = dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	var writes []string
+	dbmap.Use(func(next ExecFunc) ExecFunc {
+		return func(ctx context.Context, stmt *Statement) error {
+			if _, ok := ctx.Deadline(); ok && strings.HasPrefix(stmt.Query, "/* service=write */ ") {
+				writes = append(writes, stmt.Query)
+			}
+			return next(ctx, stmt)
+		}
+	})
+	opts := []interface{}{WithTimeout(time.Minute), Comment("service=write")}
+	if err = dbmap.Insert(append([]interface{}{&Sku{ID: "x", Price: 1}}, opts...)...); err != nil {
+		t.Fatal(err)
+	}
+	p1.FName = "robert"
+	if _, err = dbmap.Update(append([]interface{}{p1}, opts...)...); err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != 2 {
+		t.Errorf("Expected the insert and update to run with the options, got %v", writes)
+	}
+
+	var people []*Person
+	err = dbmap.Select(&people, "select * from person_test", Primary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 1 || people[0].LName != "postget" {
+		t.Errorf("Expected 1 person with PostGet run, got %v", people)
+	}
+}
+
+func TestQueryAnnotator(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	var logBuffer bytes.Buffer
+	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", log.Lmicroseconds))
+	dbmap.Annotator = StaticAnnotator(map[string]string{"route": "/people", "app": "modl"})
+
+	p1 := &Person{0, 0, 0, "bob", "smith", 0}
+	_insert(dbmap, p1)
+	MustGet(dbmap, &Person{}, p1.ID)
+
+	expected := "/*app='modl',route='%2Fpeople'*/;"
+	if c := bytes.Count(logBuffer.Bytes(), []byte(expected)); c != 2 {
+		t.Errorf("Expected 2 annotated statements, got %d: %s", c, logBuffer.String())
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	var slow []SlowQuery
+	dbmap.SlowQueryThreshold = time.Nanosecond
+	dbmap.SlowQueryRedactArgs = true
+	dbmap.SlowQueryLogger = func(q SlowQuery) {
+		slow = append(slow, q)
+	}
+
+	p1 := &Person{0, 0, 0, "bob", "smith", 0}
+	_insert(dbmap, p1)
+
+	if len(slow) != 1 {
+		t.Fatalf("Expected 1 slow query, got %d", len(slow))
+	}
+	if len(slow[0].Stack) == 0 || slow[0].Duration <= 0 {
+		t.Errorf("Expected duration and stack on slow query: %v", slow[0])
+	}
+	for _, arg := range slow[0].Args {
+		if arg != redacted {
+			t.Errorf("Expected args to be redacted, got %v", slow[0].Args)
+		}
+	}
+}
+
+func TestSqliteDialect(t *testing.T) {
+	d := SqliteDialect{BusyRetries: 2}
+	dbmap := &DbMap{Dialect: d}
+	table := dbmap.AddTable(Invoice{}).SetKeys(true, "ID").SetWithoutRowID(true)
+
+	if s := d.TableSuffix(table); s != " without rowid" {
+		t.Errorf("Expected without rowid suffix, got %q", s)
+	}
+	if s := d.ColumnAutoIncrStr(table.Keys[0]); s != "" {
+		t.Errorf("Expected no autoincrement on without rowid table, got %q", s)
+	}
+	table.SetWithoutRowID(false)
+	if s := d.ColumnAutoIncrStr(table.Keys[0]); s != "autoincrement" {
+		t.Errorf("Expected autoincrement, got %q", s)
+	}
+
+	busy := fmt.Errorf("database is locked")
+	if _, ok := d.RetryDelay(1, busy); !ok {
+		t.Errorf("Expected busy error to be retried")
+	}
+	if _, ok := d.RetryDelay(3, busy); ok {
+		t.Errorf("Expected retries to stop after BusyRetries")
+	}
+	if _, ok := d.RetryDelay(1, sql.ErrNoRows); ok {
+		t.Errorf("Expected other errors not to be retried")
+	}
+}
+
+func TestMySQLTableOptions(t *testing.T) {
+	d := MySQLDialect{"InnoDB", "UTF8"}
+	dbmap := &DbMap{Dialect: d}
+	table := dbmap.AddTable(Invoice{}).SetKeys(true, "ID")
+
+	if s := d.TableSuffix(table); s != " engine=InnoDB charset=UTF8" {
+		t.Errorf("Unexpected default table suffix %q", s)
+	}
+	table.SetEngine("MEMORY").SetCharset("utf8mb4").SetCollation("utf8mb4_bin")
+	if s := d.TableSuffix(table); s != " engine=MEMORY charset=utf8mb4 collate=utf8mb4_bin" {
+		t.Errorf("Unexpected table suffix %q", s)
+	}
+}
+
+func TestCreateTablesSql(t *testing.T) {
+	dbmap := newDbMap()
+	defer dbmap.Dbx.Close()
+	dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
+	dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "id")
+
+	create, err := dbmap.CreateTablesSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(create) != 2 {
+		t.Fatalf("Expected 2 create statements, got %d", len(create))
+	}
+	quoted := dbmap.Dialect.QuoteField("person_test")
+	if !bytes.Contains([]byte(create[1]), []byte("create table "+quoted)) {
+		t.Errorf("Expected create statement for %s, got %s", quoted, create[1])
+	}
+
+	drop := dbmap.DropTablesSql()
+	if len(drop) != 2 || drop[1] != "drop table "+quoted+";" {
+		t.Errorf("Unexpected drop statements %v", drop)
+	}
+
+	// nothing should have been created
+	_, err = dbmap.Exec("select * from person_test")
+	if err == nil {
+		t.Errorf("Expected person_test not to exist")
+	}
+}
+
+func TestColumnDefaultAndCheck(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists invoice_test")
+	table := dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
+	table.ColMap("Memo").SetDefault("'unset'").SetUseDefault(true)
+	table.ColMap("Updated").SetCheck("updated >= 0")
+	err := dbmap.CreateTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
+
+	inv := &Invoice{0, 100, 200, "", 0, true}
+	_insert(dbmap, inv)
+	inv2 := &Invoice{}
+	MustGet(dbmap, inv2, inv.ID)
+	if inv2.Memo != "unset" {
+		t.Errorf("Expected default memo 'unset', got %q", inv2.Memo)
+	}
+
+	inv = &Invoice{0, 100, -1, "negative", 0, true}
+	if err = dbmap.Insert(inv); err == nil {
+		t.Errorf("Expected check constraint to fail insert")
+	}
+}
+
+type Account struct {
+	ID      int64
+	Name    string
+	Plan    string `db:"plan,omitempty"`
+	Credits int64  `db:",omitempty"`
+}
+
+type Setting struct {
+	Name  string
+	Value string `db:",omitempty"`
+}
+
+func TestOmitEmpty(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists account_test")
+	dbmap.Exec("drop table if exists setting_test")
+	table := dbmap.AddTableWithName(Account{}, "account_test").SetKeys(true, "ID")
+	dbmap.AddTableWithName(Setting{}, "setting_test").SetKeys(false, "Name")
+	table.ColMap("Plan").SetDefault("'free'")
+	table.ColMap("Credits").SetDefault("10")
+	err := dbmap.CreateTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
+
+	if col := table.ColMap("Credits"); col.ColumnName != "credits" {
+		t.Errorf("Expected column credits, got %s", col.ColumnName)
+	}
+
+	a := &Account{Name: "alice"}
+	_insert(dbmap, a)
+	a2 := &Account{}
+	MustGet(dbmap, a2, a.ID)
+	if a2.Plan != "free" || a2.Credits != 10 {
+		t.Errorf("Expected defaults to apply, got %#v", a2)
+	}
+
+	// without OmitEmpty, zero values are written
+	_, err = dbmap.Update(&Account{ID: a.ID, Name: "alice", Credits: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	MustGet(dbmap, a2, a.ID)
+	if a2.Plan != "" || a2.Credits != 5 {
+		t.Errorf("Expected zero plan to be written, got %#v", a2)
+	}
+
+	_, err = dbmap.Update(&Account{ID: a.ID, Name: "bob", Plan: "pro"}, OmitEmpty())
+	if err != nil {
+		t.Fatal(err)
+	}
+	MustGet(dbmap, a2, a.ID)
+	if a2.Name != "bob" || a2.Plan != "pro" || a2.Credits != 5 {
+		t.Errorf("Expected credits to be left alone, got %#v", a2)
+	}
+
+	// every column may be omitted, and the row must still be matched
+	_insert(dbmap, &Setting{Name: "k", Value: "v"})
+	n, err := dbmap.Update(&Setting{Name: "k"}, OmitEmpty())
+	if err != nil || n != 1 {
+		t.Errorf("Expected to update 1 row, got %d, %v", n, err)
+	}
+	s := &Setting{}
+	MustGet(dbmap, s, "k")
+	if s.Value != "v" {
+		t.Errorf("Expected value to be left alone, got %q", s.Value)
+	}
+}
+
+type Counter struct {
+	ID   string `db:"id,omitempty"`
+	Hits int64  `db:",omitempty"`
+}
+
+func TestInsertDefaultValues(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists counter_test")
+	table := dbmap.AddTableWithName(Counter{}, "counter_test").SetKeys(false, "ID")
+	table.ColMap("ID").SetDefault("'total'")
+	table.ColMap("Hits").SetDefault("3")
+	err := dbmap.CreateTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
+
+	// every column is left to its default
+	_insert(dbmap, &Counter{})
+	c := &Counter{}
+	MustGet(dbmap, c, "total")
+	if c.Hits != 3 {
+		t.Errorf("Expected default hits 3, got %#v", c)
+	}
+}
+
+type Login struct {
+	ID       int64
+	Email    string
+	Password string
+	Created  int64
+}
+
+func TestReadOnlyWriteOnly(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists login_test")
+	table := dbmap.AddTableWithName(Login{}, "login_test").SetKeys(true, "ID")
+	table.ColMap("Password").SetWriteOnly(true)
+	table.ColMap("Created").SetReadOnly(true).SetDefault("42")
+	err := dbmap.CreateTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
+
+	l := &Login{Email: "a@example.com", Password: "hash", Created: 7}
+	_insert(dbmap, l)
+	l2 := &Login{}
+	MustGet(dbmap, l2, l.ID)
+	if l2.Password != "" {
+		t.Errorf("Expected write-only password not to be selected, got %q", l2.Password)
+	}
+	if l2.Created != 42 {
+		t.Errorf("Expected read-only created to hold its default, got %d", l2.Created)
+	}
+
+	l.Created = 9
+	l.Password = "newhash"
+	_update(dbmap, l)
+	var password string
+	var created int64
+	err = dbmap.Dbx.QueryRow(dbmap.Dbx.Rebind("select password, created from login_test where id=?"), l.ID).Scan(&password, &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "newhash" || created != 42 {
+		t.Errorf("Expected password newhash and created 42, got %q, %d", password, created)
+	}
+}
+
+type OrderLine struct {
+	ID    int64
+	Qty   int64
+	Price int64
+	Total int64
+}
+
+func TestGeneratedColumn(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists order_line_test")
+	table := dbmap.AddTableWithName(OrderLine{}, "order_line_test").SetKeys(true, "ID")
+	table.ColMap("Total").SetGenerated("qty * price", true)
+	stmts, err := dbmap.CreateTablesSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(stmts, "\n"), "generated always as (qty * price) stored") {
+		t.Errorf("Expected a generated column, got %v", stmts)
+	}
+	err = dbmap.CreateTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
+
+	line := &OrderLine{Qty: 3, Price: 5, Total: 1}
+	_insert(dbmap, line)
+	line.Qty = 4
+	_update(dbmap, line)
+	line2 := &OrderLine{}
+	MustGet(dbmap, line2, line.ID)
+	if line2.Total != 20 {
+		t.Errorf("Expected total 20, got %d", line2.Total)
+	}
+}
+
+func TestEnumColumn(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists invoice_test")
+	table := dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
+	table.ColMap("Memo").SetEnum("open", "paid", "void")
+	err := dbmap.CreateTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
+
+	inv := &Invoice{0, 100, 200, "open", 0, false}
+	_insert(dbmap, inv)
+
+	inv.Memo = "lost"
+	_, err = dbmap.Update(inv)
+	if _, ok := err.(EnumValueError); !ok {
+		t.Errorf("Expected EnumValueError, got %v", err)
+	}
+
+	// the database should enforce the enum as well
+	_, err = dbmap.Exec(ReBind("update invoice_test set memo=? where id=?", dbmap.Dialect), "lost", inv.ID)
+	if err == nil {
+		t.Errorf("Expected database to reject invalid enum value")
+	}
+
+	// only dialects implementing EnumDialect have native enums
+	if supportsEnum(SqliteDialect{}) || supportsEnum(PostgresDialect{}) || !supportsEnum(MySQLDialect{}) {
+		t.Errorf("Unexpected native enum support")
+	}
+}
+
+func TestInsertExplicitKeys(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	inv := &Invoice{500, 100, 200, "imported", 0, true}
+	err := dbmap.Insert(inv, ExplicitKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.ID != 500 {
+		t.Errorf("Expected explicit ID 500 to be kept, got %d", inv.ID)
+	}
+	inv2 := &Invoice{}
+	MustGet(dbmap, inv2, 500)
 	if !reflect.DeepEqual(inv, inv2) {
 		t.Errorf("%v != %v", inv, inv2)
 	}
 
-	// DELETE row
-	deleted := _del(dbmap, inv)
-	if deleted != 1 {
-		t.Errorf("Did not delete row with ID: %d", inv.ID)
-		return
+	// zero ids are still generated
+	dbmap.TableFor(inv).SetExplicitKeys(true)
+	inv3 := &Invoice{0, 100, 200, "generated", 0, true}
+	_insert(dbmap, inv3)
+	if inv3.ID == 0 {
+		t.Errorf("Expected generated ID")
+	}
+}
+
+func TestInsertReturningAll(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.Exec("drop table if exists invoice_test")
+	table := dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
+	table.ColMap("Memo").SetDefault("'unset'").SetUseDefault(true)
+	err := dbmap.CreateTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
+
+	inv := &Invoice{0, 100, 200, "", 0, true}
+	err = dbmap.Insert(inv, ReturningAll())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.ID == 0 || inv.Memo != "unset" {
+		t.Errorf("Expected invoice to be refreshed after insert, got %v", inv)
+	}
+}
+
+func TestSave(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	// Person has a version column
+	p1 := &Person{0, 0, 0, "bob", "smith", 0}
+	err := dbmap.Save(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p1.ID == 0 || p1.Version != 1 {
+		t.Errorf("Expected Save to insert new person, got %v", p1)
+	}
+	p1.FName = "robert"
+	if err = dbmap.Save(p1); err != nil {
+		t.Fatal(err)
+	}
+	if p1.Version != 2 || p1.FName != "preupdate" {
+		t.Errorf("Expected Save to update existing person, got %v", p1)
+	}
+
+	// Invoice has no version column
+	inv := &Invoice{0, 100, 200, "first", 0, true}
+	if err = dbmap.Save(inv); err != nil {
+		t.Fatal(err)
+	}
+	inv.Memo = "second"
+	if err = dbmap.Save(inv); err != nil {
+		t.Fatal(err)
+	}
+	inv2 := &Invoice{}
+	MustGet(dbmap, inv2, inv.ID)
+	if inv2.Memo != "second" {
+		t.Errorf("Expected memo to be updated, got %q", inv2.Memo)
+	}
+
+	// a row with keys which doesn't exist yet is inserted
+	inv3 := &Invoice{1000, 100, 200, "third", 0, true}
+	if err = dbmap.Save(inv3); err != nil {
+		t.Fatal(err)
+	}
+	MustGet(dbmap, inv2, 1000)
+	if inv2.Memo != "third" {
+		t.Errorf("Expected invoice 1000 to be inserted, got %v", inv2)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	p1 := &Person{0, 0, 0, "bob", "smith", 0}
+	_insert(dbmap, p1)
+	p2 := &Person{}
+	MustGet(dbmap, p2, p1.ID)
+	_update(dbmap, p2)
+
+	err := dbmap.Reload(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p1.Version != 2 || p1.FName != "preupdate" || p1.LName != "postget" {
+		t.Errorf("Expected reloaded person with PostGet run, got %v", p1)
+	}
+
+	_del(dbmap, p2)
+	if err = dbmap.Reload(p1); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound reloading deleted row, got %v", err)
+	}
+}
+
+func TestBindSQL(t *testing.T) {
+	dbmap := newDbMap()
+	defer dbmap.Dbx.Close()
+	table := dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "id")
+
+	p := &Person{7, 1, 2, "bob", "smith", 0}
+	query, args, err := table.BindInsertSQL(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quoted := dbmap.Dialect.QuoteField("person_test")
+	if !bytes.HasPrefix([]byte(query), []byte("insert into "+quoted)) {
+		t.Errorf("Unexpected insert query %s", query)
+	}
+	expected := []interface{}{int64(1), int64(2), "bob", "smith", int64(1)}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("%v != %v", args, expected)
+	}
+	if p.Version != 0 {
+		t.Errorf("BindInsertSQL modified its argument: %v", p)
+	}
+
+	_, args, err = table.BindUpdateSQL(*p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 7 || args[5] != int64(7) {
+		t.Errorf("Expected key after updated columns, got %v", args)
+	}
+
+	if _, _, err = table.BindDeleteSQL(&Invoice{}); err == nil {
+		t.Errorf("Expected error binding wrong type")
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	var logBuffer bytes.Buffer
+	dbmap.TraceOnLevel("", log.New(&logBuffer, "modltest:", 0), LogStatements)
+
+	query := ReBind("update person_test set fname=? where id=?", dbmap.Dialect)
+	_, err := dbmap.Exec(query, "secret-name", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(logBuffer.Bytes(), []byte("secret-name")) {
+		t.Errorf("Expected args not to be logged at LogStatements: %s", logBuffer.String())
+	}
+
+	logBuffer.Reset()
+	dbmap.SetLogLevel(LogArgs)
+	_, err = dbmap.Exec(query, Sensitive("secret-name"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(logBuffer.Bytes(), []byte("secret-name")) || !bytes.Contains(logBuffer.Bytes(), []byte(redacted)) {
+		t.Errorf("Expected sensitive arg to be redacted: %s", logBuffer.String())
+	}
+
+	logBuffer.Reset()
+	dbmap.SetLogLevel(LogErrors)
+	dbmap.Exec("select * from no_such_table")
+	dbmap.Get(&Person{}, 0)
+	if c := bytes.Count(logBuffer.Bytes(), []byte("\n")); c != 1 {
+		t.Errorf("Expected only failing statements to be logged: %s", logBuffer.String())
+	}
+}
+
+func TestSensitiveColumns(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	table := dbmap.TableFor(Person{})
+	table.ColMap("LName").SetSensitive(true)
+	table.ResetSql()
+
+	var logBuffer bytes.Buffer
+	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", 0))
+
+	p1 := &Person{0, 0, 0, "bob", "secret-name", 0}
+	_insert(dbmap, p1)
+	p1.LName = "secret-name"
+	_update(dbmap, p1)
+	if bytes.Contains(logBuffer.Bytes(), []byte("secret-name")) {
+		t.Errorf("Expected sensitive column to be redacted: %s", logBuffer.String())
+	}
+	if !bytes.Contains(logBuffer.Bytes(), []byte("bob")) {
+		t.Errorf("Expected other columns to be logged: %s", logBuffer.String())
+	}
+
+	p2 := &Person{}
+	MustGet(dbmap, p2, p1.ID, NoHooks())
+	if p2.LName != "secret-name" {
+		t.Errorf("Expected sensitive values to be stored, got %v", p2)
+	}
+}
+
+func TestSelectInExpansion(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	inv1 := &Invoice{0, 100, 200, "a", 0, false}
+	inv2 := &Invoice{0, 100, 200, "b", 0, true}
+	inv3 := &Invoice{0, 100, 200, "c", 0, true}
+	_insert(dbmap, inv1, inv2, inv3)
+
+	var invoices []Invoice
+	ids := []int64{inv1.ID, inv3.ID}
+	MustSelect(dbmap, &invoices, "select * from invoice_test where id in (?) and updated=? order by id", ids, 200)
+	if len(invoices) != 2 || invoices[0].Memo != "a" || invoices[1].Memo != "c" {
+		t.Errorf("Unexpected invoices %v", invoices)
+	}
+
+	res, err := dbmap.Exec("delete from invoice_test where memo in (?)", []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Errorf("Expected 2 rows deleted, got %d", n)
+	}
+}
+
+func TestDefaultTimeout(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.SetDefaultTimeout(time.Minute)
+
+	p1 := &Person{0, 0, 0, "bob", "smith", 0}
+	_insert(dbmap, p1)
+	MustGet(dbmap, &Person{}, p1.ID)
+
+	// an already expired context fails regardless of the default
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := dbmap.Get(&Person{}, p1.ID, WithContext(ctx)); err == nil {
+		t.Errorf("Expected error running query with cancelled context")
+	}
+}
+
+func TestInsertContext(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.AddTableWithName(WithStringPk{}, "string_pk_test").SetKeys(false, "ID")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	// inserts run with the call's context, like updates and deletes
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := dbmap.Insert(&Person{0, 0, 0, "bob", "smith", 0}, WithContext(ctx)); err == nil {
+		t.Errorf("Expected error inserting with a cancelled context")
+	}
+	if err := dbmap.Insert(&WithStringPk{"a", "first"}, WithContext(ctx)); err == nil {
+		t.Errorf("Expected error inserting with a cancelled context")
+	}
+	if err := dbmap.Insert(&Person{0, 0, 0, "bob", "smith", 0}, ReturningAll(), WithContext(ctx)); err == nil {
+		t.Errorf("Expected error inserting with a cancelled context")
+	}
+	var count int64
+	if err := dbmap.Dbx.Get(&count, "select count(*) from person_test"); err != nil || count != 0 {
+		t.Errorf("Expected no rows inserted, got %d %v", count, err)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	dbmap := newDbMap()
+	defer dbmap.Dbx.Close()
+	dbmap.SetMaxOpenConns(4)
+	dbmap.SetMaxIdleConns(2)
+	dbmap.SetConnMaxLifetime(time.Minute)
+
+	if err := dbmap.HealthCheck(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	if compareVersions("9.6.24 (Debian 9.6.24-1)", "8.2") != 1 {
+		t.Errorf("Expected 9.6.24 to be newer than 8.2")
+	}
+	if compareVersions("5.0-log", "5.0.3") != -1 {
+		t.Errorf("Expected 5.0 to be older than 5.0.3")
+	}
+	if err := (SqliteDialect{}).CheckVersion("3.7.17"); err == nil {
+		t.Errorf("Expected sqlite 3.7.17 to be unsupported")
+	}
+}
+
+func TestScanCache(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	_insert(dbmap, &Invoice{0, 100, 200, "a", 0, false})
+	var invoices []*Invoice
+	for i := 0; i < 2; i++ {
+		invoices = nil
+		MustSelect(dbmap, &invoices, "select id, memo from invoice_test")
+	}
+	if len(invoices) != 1 || invoices[0].Memo != "a" {
+		t.Errorf("Unexpected invoices %v", invoices)
+	}
+
+	entries := 0
+	dbmap.scanCache.Range(func(k, v interface{}) bool {
+		if k.(scanKey).columns == "id,memo" {
+			entries++
+		}
+		return true
+	})
+	if entries != 1 {
+		t.Errorf("Expected 1 cached scan plan for id,memo, got %d", entries)
+	}
+
+	var ids []int64
+	MustSelect(dbmap, &ids, "select id from invoice_test")
+	if len(ids) != 1 || ids[0] != invoices[0].ID {
+		t.Errorf("Unexpected ids %v", ids)
+	}
+	err := dbmap.Select(&invoices, "select id, memo, 1 as extra from invoice_test")
+	if err == nil {
+		t.Errorf("Expected error scanning unknown column")
+	}
+}
+
+func TestScanReuse(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	_insert(dbmap, &Invoice{0, 100, 200, "a", 0, false}, &Invoice{0, 100, 200, "b", 0, false})
+
+	invoices := []Invoice{{Memo: "kept"}}
+	MustSelect(dbmap, &invoices, "select id, memo from invoice_test order by memo")
+	if len(invoices) != 3 || invoices[0].Memo != "kept" || invoices[2].Memo != "b" {
+		t.Errorf("Expected rows appended to the slice, got %v", invoices)
+	}
+	invoices = make([]Invoice, 0, 4)
+	MustSelect(dbmap, &invoices, "select id, memo from invoice_test where memo = 'a'")
+	first := invoices
+	MustSelect(dbmap, &invoices, "select id, memo from invoice_test where memo = 'b'")
+	if len(first) != 1 || first[0].Memo != "a" || len(invoices) != 2 {
+		t.Errorf("Expected an earlier copy of the slice to be kept, got %v", first)
+	}
+
+	invoices = make([]Invoice, 0, 4)
+	invoices = append(invoices, Invoice{Memo: "stale", IsPaid: true})
+	reused := &invoices[:1][0]
+	MustSelect(dbmap, &invoices, "select id, memo from invoice_test order by memo", ReuseSlice())
+	if len(invoices) != 2 || &invoices[0] != reused {
+		t.Errorf("Expected rows scanned into existing backing array")
+	}
+	if invoices[0].Memo != "a" || invoices[0].IsPaid {
+		t.Errorf("Expected reused element to be reset, got %v", invoices[0])
+	}
+
+	var ptrs []*Invoice
+	MustSelect(dbmap, &ptrs, "select id, memo from invoice_test order by memo")
+	p := ptrs[0]
+	ptrs = ptrs[:0]
+	MustSelect(dbmap, &ptrs, "select id, memo from invoice_test order by memo")
+	if ptrs[0] == p {
+		t.Errorf("Expected new structs without ReuseSlice")
+	}
+	p = ptrs[0]
+	MustSelect(dbmap, &ptrs, "select id, memo from invoice_test order by memo", ReuseSlice())
+	if ptrs[0] != p || ptrs[1].Memo != "b" {
+		t.Errorf("Expected structs reused with ReuseSlice")
+	}
+}
+
+func TestBatchUpdateDelete(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	people := []*Person{
+		{0, 0, 0, "a", "a", 0},
+		{0, 0, 0, "b", "b", 0},
+		{0, 0, 0, "c", "c", 0},
+	}
+	for _, p := range people {
+		_insert(dbmap, p)
+	}
+
+	// make the last person stale
+	stale := *people[2]
+	if _, err := dbmap.Update(&stale); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := dbmap.Update(people[0], people[1], people[2], Batch())
+	if count != 2 {
+		t.Errorf("Expected 2 rows updated, got %d", count)
+	}
+	batchErr, ok := err.(BatchLockError)
+	if !ok {
+		t.Fatalf("Expected BatchLockError, got %v", err)
+	}
+	if batchErr.Errors[0] != nil || batchErr.Errors[1] != nil {
+		t.Errorf("Expected first two rows written, got %v", batchErr.Errors)
+	}
+	if ole, ok := batchErr.Errors[2].(OptimisticLockError); !ok || !ole.RowExists {
+		t.Errorf("Expected OptimisticLockError for stale row, got %v", batchErr.Errors[2])
+	}
+	if people[0].Version != 2 || people[0].LName != "postupdate" || people[2].Version != 1 {
+		t.Errorf("Unexpected people after batch update %v %v", people[0], people[2])
+	}
+	p := &Person{}
+	MustGet(dbmap, p, people[1].ID)
+	if p.FName != "preupdate" || p.Version != 2 {
+		t.Errorf("Expected batch update to be written, got %v", p)
+	}
+
+	count, err = dbmap.Delete(people[0], people[1], Batch())
+	if err != nil || count != 2 {
+		t.Errorf("Expected 2 rows deleted, got %d %v", count, err)
+	}
+	if people[1].LName != "postdelete" {
+		t.Errorf("Expected PostDelete to run for batch delete")
+	}
+	d := &Person{0, 0, 0, "d", "d", 0}
+	_insert(dbmap, d)
+	current := *d
+	_update(dbmap, &current)
+	count, err = dbmap.Delete(&stale, d, Batch())
+	batchErr, ok = err.(BatchLockError)
+	if !ok || count != 1 || batchErr.Errors[0] != nil || batchErr.Errors[1] == nil {
+		t.Errorf("Expected BatchLockError for second row and 1 row deleted, got %d %v", count, err)
+	}
+
+	// tables without a version column are deleted with an in list
+	invoices := []*Invoice{{0, 1, 2, "a", 0, false}, {0, 1, 2, "b", 0, false}}
+	_insert(dbmap, invoices[0], invoices[1])
+	invoices[0].Memo, invoices[1].Memo = "c", "d"
+	count, err = dbmap.Update(invoices[0], invoices[1], Batch())
+	if err != nil || count != 2 {
+		t.Errorf("Expected 2 invoices updated, got %d %v", count, err)
+	}
+	var memos []string
+	MustSelect(dbmap, &memos, "select memo from invoice_test order by memo")
+	if !reflect.DeepEqual(memos, []string{"c", "d"}) {
+		t.Errorf("Unexpected memos %v", memos)
+	}
+	count, err = dbmap.Delete(invoices[0], invoices[1], Batch())
+	if err != nil || count != 2 {
+		t.Errorf("Expected 2 invoices deleted, got %d %v", count, err)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.AddTableWithName(WithStringPk{}, "string_pk_test").SetKeys(false, "ID")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, coalesce := range []bool{false, true} {
+		b := dbmap.NewWriteBatch().SetCoalesce(coalesce)
+		p := &Person{0, 0, 0, "bob", "smith", 0}
+		b.Insert(p)
+		rows := []*WithStringPk{{"a", "first"}, {"b", "second"}}
+		b.Insert(rows[0])
+		b.Insert(rows[1])
+		if b.Len() != 3 {
+			t.Errorf("Expected 3 queued writes, got %d", b.Len())
+		}
+		if err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if b.Len() != 0 || p.ID == 0 {
+			t.Errorf("Expected flushed batch and generated key, got %d %v", b.Len(), p)
+		}
+
+		rows[1].Name = "changed"
+		b.Update(rows[1])
+		b.Delete(rows[0])
+		b.Delete(p)
+		if err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		MustSelect(dbmap, &names, "select name from string_pk_test")
+		if !reflect.DeepEqual(names, []string{"changed"}) {
+			t.Errorf("Unexpected rows after flush %v", names)
+		}
+		if _, err := dbmap.Exec("delete from string_pk_test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a failed flush writes nothing and keeps the queue
+	b := dbmap.NewWriteBatch()
+	b.Insert(&WithStringPk{"c", "third"})
+	b.Insert(&Person{0, 0, 0, "badname", "smith", 0})
+	if err := b.Flush(); err == nil {
+		t.Errorf("Expected flush to fail")
+	}
+	if b.Len() != 2 {
+		t.Errorf("Expected queue to be kept, got %d", b.Len())
+	}
+	var count int64
+	err := dbmap.SelectOne(&count, "select count(*) from string_pk_test")
+	if err != nil || count != 0 {
+		t.Errorf("Expected rolled back flush, got %d rows", count)
+	}
+}
+
+func TestInsertBatch(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.AddTableWithName(WithStringPk{}, "string_pk_test").SetKeys(false, "ID")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	var logBuffer bytes.Buffer
+	dbmap.TraceOnLevel("", log.New(&logBuffer, "", 0), LogStatements)
+	err := dbmap.Insert(&WithStringPk{"a", "x"}, &WithStringPk{"b", "y"}, &WithStringPk{"c", "z"}, Batch())
+	dbmap.TraceOff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(logBuffer.Bytes(), []byte("insert into")); n != 1 {
+		t.Errorf("Expected a single insert statement, got %s", logBuffer.String())
+	}
+	var ids []string
+	MustSelect(dbmap, &ids, "select id from string_pk_test order by id")
+	if !reflect.DeepEqual(ids, []string{"a", "b", "c"}) {
+		t.Errorf("Unexpected ids %v", ids)
+	}
+}
+
+func TestCopyInsert(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	people := []Person{{0, 0, 0, "a", "a", 0}, {0, 0, 0, "b", "b", 0}}
+	n, err := dbmap.CopyInsert(dbmap.TableFor(&Person{}), people)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 rows copied, got %d %v", n, err)
+	}
+	var fnames []string
+	MustSelect(dbmap, &fnames, "select fname from person_test order by fname")
+	if !reflect.DeepEqual(fnames, []string{"a", "b"}) {
+		t.Errorf("Unexpected rows after CopyInsert %v", fnames)
+	}
+
+	_, err = dbmap.CopyInsert(dbmap.TableFor(&Person{}), []*Invoice{{}})
+	if err == nil {
+		t.Errorf("Expected error copying rows of the wrong type")
+	}
+
+	var buf bytes.Buffer
+	writeMySQLField(&buf, "a\tb\\c\n")
+	buf.WriteByte(' ')
+	writeMySQLField(&buf, nil)
+	buf.WriteByte(' ')
+	writeMySQLField(&buf, true)
+	if buf.String() != `a\tb\\c\n \N 1` {
+		t.Errorf("Unexpected LOAD DATA encoding %q", buf.String())
+	}
+}
+
+func TestAsyncInserter(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	table := dbmap.TableFor(&Invoice{})
+	a := dbmap.AsyncInserter(table, time.Hour, 2)
+	if err := a.Add(&Invoice{0, 1, 2, "a", 0, false}, &Invoice{0, 1, 2, "b", 0, false}); err != nil {
+		t.Fatal(err)
+	}
+	// a full batch is flushed in the background
+	var count int64
+	for i := 0; i < 100 && count < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+		if err := dbmap.SelectOne(&count, "select count(*) from invoice_test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count != 2 {
+		t.Errorf("Expected full batch to be flushed, got %d rows", count)
+	}
+
+	if err := a.Add(&Person{}); err == nil {
+		t.Errorf("Expected error adding a row of another table")
+	}
+	if err := a.Add((*Invoice)(nil)); err == nil {
+		t.Errorf("Expected error adding a nil row")
+	}
+	a.Add(&Invoice{0, 1, 2, "c", 0, false})
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add(&Invoice{}); err != ErrInserterClosed {
+		t.Errorf("Expected ErrInserterClosed, got %v", err)
+	}
+	if err := dbmap.SelectOne(&count, "select count(*) from invoice_test"); err != nil || count != 3 {
+		t.Errorf("Expected Close to flush remaining rows, got %d rows", count)
+	}
+
+	failed := make(chan []interface{}, 1)
+	a = dbmap.AsyncInserter(dbmap.TableFor(&Person{}), 0, 1).OnError(func(rows []interface{}, err error) {
+		failed <- rows
+	})
+	defer a.Close()
+	a.Add(&Person{0, 0, 0, "badname", "smith", 0})
+	select {
+	case rows := <-failed:
+		if len(rows) != 1 {
+			t.Errorf("Expected failed row passed to OnError, got %v", rows)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected OnError to be called")
+	}
+}
+
+func TestSelectKeyset(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	for i := 0; i < 5; i++ {
+		_insert(dbmap, &Invoice{0, 1, 2, fmt.Sprint(i), 0, i%2 == 0})
+	}
+
+	var memos []string
+	var page []*Invoice
+	cursor := KeysetCursor{Column: "id", Limit: 2}
+	for pages := 0; !cursor.End; pages++ {
+		if pages > 3 {
+			t.Fatalf("Expected 3 pages, cursor %v", cursor)
+		}
+		var err error
+		cursor, err = dbmap.SelectKeyset(&page, "select * from invoice_test", cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, inv := range page {
+			memos = append(memos, inv.Memo)
+		}
+	}
+	if !reflect.DeepEqual(memos, []string{"0", "1", "2", "3", "4"}) {
+		t.Errorf("Unexpected keyset pages %v", memos)
+	}
+
+	var ids []int64
+	query := ReBind("select id from invoice_test where ispaid = ?", dbmap.Dialect)
+	cursor = KeysetCursor{Column: "id", Limit: 1, Desc: true}
+	cursor, err := dbmap.SelectKeyset(&ids, query, cursor, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := ids[0]
+	_, err = dbmap.SelectKeyset(&ids, query, cursor, true)
+	if err != nil || len(ids) != 1 || ids[0] >= first {
+		t.Errorf("Expected descending second page, got %v %v", ids, err)
+	}
+}
+
+func TestValuerScanner(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.AddTableWithName(WithValuers{}, "valuer_test").SetKeys(true, "id")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &WithValuers{Value: PtrValuer{"abc"}}
+	_insert(dbmap, w)
+	var raw sql.NullString
+	if err := dbmap.SelectOne(&raw, "select value from valuer_test"); err != nil || raw.String != "cba" {
+		t.Errorf("Expected pointer receiver Value to be used, got %q", raw.String)
+	}
+	var maybe sql.NullString
+	if err := dbmap.SelectOne(&maybe, "select maybenil from valuer_test"); err != nil || maybe.Valid {
+		t.Errorf("Expected nil pointer to be stored as NULL, got %q", maybe.String)
+	}
+
+	w2 := &WithValuers{}
+	MustGet(dbmap, w2, w.ID)
+	if w2.Value.S != "abc" || w2.MaybeNil != nil {
+		t.Errorf("Expected Get to use Scan, got %v", w2)
+	}
+
+	w2.MaybeNil = &PtrValuer{"xyz"}
+	_update(dbmap, w2)
+	var ws []*WithValuers
+	MustSelect(dbmap, &ws, "select * from valuer_test")
+	if len(ws) != 1 || ws[0].Value.S != "abc" || ws[0].MaybeNil == nil || ws[0].MaybeNil.S != "xyz" {
+		t.Errorf("Expected Select to use Scan, got %v", ws)
+	}
+	if err := dbmap.Reload(w2); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestColumnExprs(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	table := dbmap.TableFor(&Invoice{})
+	table.ColMap("memo").SetInsertExpr("upper(?)").SetSelectExpr("lower(memo) || '!'")
+
+	inv := &Invoice{0, 1, 2, "Hello", 0, false}
+	_insert(dbmap, inv)
+	var memo string
+	if err := dbmap.SelectOne(&memo, "select memo from invoice_test"); err != nil || memo != "HELLO" {
+		t.Errorf("Expected insert expression to be applied, got %q %v", memo, err)
+	}
+
+	inv2 := &Invoice{}
+	MustGet(dbmap, inv2, inv.ID)
+	if inv2.Memo != "hello!" {
+		t.Errorf("Expected select expression to be applied, got %q", inv2.Memo)
+	}
+
+	inv2.Memo = "World"
+	_update(dbmap, inv2)
+	if err := dbmap.SelectOne(&memo, "select memo from invoice_test"); err != nil || memo != "WORLD" {
+		t.Errorf("Expected insert expression to be applied on update, got %q %v", memo, err)
+	}
+
+	query, _, err := table.BindInsertSQL(inv)
+	if err != nil || !strings.Contains(query, "upper(") {
+		t.Errorf("Expected insert expression in insert SQL, got %s %v", query, err)
+	}
+}
+
+func TestFieldCipher(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	oldKey := bytes.Repeat([]byte("k"), 32)
+	newKey := bytes.Repeat([]byte("n"), 32)
+	old, err := NewAESCipher(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := dbmap.TableFor(&Invoice{})
+	table.ColMap("memo").SetCipher(old)
+
+	inv := &Invoice{0, 1, 2, "secret memo", 0, false}
+	_insert(dbmap, inv)
+	var stored string
+	if err = dbmap.SelectOne(&stored, "select memo from invoice_test"); err != nil {
+		t.Fatal(err)
+	}
+	if stored == "secret memo" || strings.Contains(stored, "secret") {
+		t.Errorf("Expected memo to be stored encrypted, got %q", stored)
+	}
+
+	inv2 := &Invoice{}
+	MustGet(dbmap, inv2, inv.ID)
+	if inv2.Memo != "secret memo" {
+		t.Errorf("Expected Get to decrypt memo, got %q", inv2.Memo)
+	}
+
+	// rotate keys; old values can still be read, and saved values use the
+	// new key
+	rotated, err := NewAESCipher(newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.ColMap("memo").SetCipher(rotated)
+	var invoices []Invoice
+	MustSelect(dbmap, &invoices, "select * from invoice_test")
+	if len(invoices) != 1 || invoices[0].Memo != "secret memo" {
+		t.Errorf("Expected Select to decrypt with old key, got %v", invoices)
+	}
+	inv2.Memo = "new memo"
+	_update(dbmap, inv2)
+
+	onlyNew, _ := NewAESCipher(newKey)
+	table.ColMap("memo").SetCipher(onlyNew)
+	MustGet(dbmap, inv2, inv.ID)
+	if inv2.Memo != "new memo" {
+		t.Errorf("Expected updated memo encrypted with new key, got %q", inv2.Memo)
+	}
+
+	table.ColMap("memo").SetCipher(old)
+	if err = dbmap.Get(inv2, inv.ID); err == nil {
+		t.Errorf("Expected error decrypting with an unknown key")
+	}
+
+	// key ids do not reveal a hash of the key
+	sum := sha256.Sum256(newKey)
+	if id := onlyNew.ids[0]; bytes.Equal(id, sum[:keyIDSize]) {
+		t.Errorf("Expected the key id not to be a hash of the key")
+	}
+
+	// a bound value cannot be moved to another column
+	table.ColMap("memo").SetBoundCipher(onlyNew)
+	inv2.Memo = "bound memo"
+	_update(dbmap, inv2)
+	MustGet(dbmap, inv2, inv.ID)
+	if inv2.Memo != "bound memo" {
+		t.Errorf("Expected bound memo to be decrypted, got %q", inv2.Memo)
+	}
+	var sealed []byte
+	if err = dbmap.SelectOne(&sealed, "select memo from invoice_test"); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, _ := base64.StdEncoding.DecodeString(string(sealed))
+	if _, err := onlyNew.Decrypt(ciphertext, []byte(table.TableName+".other")); err == nil {
+		t.Errorf("Expected a bound value not to decrypt for another column")
+	}
+	table.ColMap("memo").SetCipher(onlyNew)
+	if err = dbmap.Get(inv2, inv.ID); err == nil {
+		t.Errorf("Expected a bound value not to decrypt unbound")
+	}
+}
+
+type orgKey struct{}
+
+func TestDefaultScope(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	table := dbmap.TableFor(&Invoice{})
+	table.SetDefaultScope("personid = ?", func(ctx context.Context) ([]interface{}, error) {
+		org, ok := ctx.Value(orgKey{}).(int64)
+		if !ok {
+			return nil, fmt.Errorf("no org in context")
+		}
+		return []interface{}{org}, nil
+	})
+	org1 := WithContext(context.WithValue(context.Background(), orgKey{}, int64(1)))
+	org2 := WithContext(context.WithValue(context.Background(), orgKey{}, int64(2)))
+
+	inv1 := &Invoice{0, 1, 2, "org1", 1, false}
+	inv2 := &Invoice{0, 1, 2, "org2", 2, false}
+	_insert(dbmap, inv1, inv2)
+
+	got := &Invoice{}
+	if err := dbmap.Get(got, inv1.ID, org1); err != nil || got.Memo != "org1" {
+		t.Errorf("Expected to get invoice in scope, got %v %v", got, err)
+	}
+	if err := dbmap.Get(got, inv1.ID, org2); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for invoice out of scope, got %v", err)
+	}
+	if ok, err := dbmap.Exists(got, inv1.ID, org2); ok || err != nil {
+		t.Errorf("Expected invoice out of scope not to exist, got %v %v", ok, err)
+	}
+	if ok, err := dbmap.Exists(got, inv1.ID, org1); !ok || err != nil {
+		t.Errorf("Expected invoice in scope to exist, got %v %v", ok, err)
+	}
+	if err := dbmap.Get(got, inv1.ID); err == nil {
+		t.Errorf("Expected scope resolver error without an org")
+	}
+
+	inv1.Memo = "changed"
+	if n, err := dbmap.Update(inv1, org2); err != nil || n != 0 {
+		t.Errorf("Expected update out of scope to change nothing, got %d %v", n, err)
+	}
+	if n, err := dbmap.Update(inv1, org1); err != nil || n != 1 {
+		t.Errorf("Expected update in scope, got %d %v", n, err)
+	}
+	// Save does not insert a row out of scope again
+	if err := dbmap.Save(inv2, org1); err != nil {
+		t.Errorf("Expected save out of scope to change nothing, got %v", err)
+	}
+	var count int64
+	if err := dbmap.Dbx.Get(&count, "select count(*) from invoice_test"); err != nil || count != 2 {
+		t.Errorf("Expected 2 invoices after a save out of scope, got %d %v", count, err)
+	}
+	if n, err := dbmap.Delete(inv1, inv2, org1, Batch()); err != nil || n != 1 {
+		t.Errorf("Expected batch delete to only delete in scope, got %d %v", n, err)
+	}
+	if n, err := dbmap.Delete(inv2, org2); err != nil || n != 1 {
+		t.Errorf("Expected delete in scope, got %d %v", n, err)
+	}
+}
+
+type userKey struct{}
+
+// WithCtxHooks implements the context variants of its hooks.
+type WithCtxHooks struct {
+	ID      int64
+	Name    string
+	Creator string `db:"-"`
+	Ops     string `db:"-"`
+}
+
+func (w *WithCtxHooks) PreInsertCtx(ctx HookContext, e SqlExecutor) error {
+	w.Creator, _ = ctx.Value(userKey{}).(string)
+	w.Ops += string(ctx.Op) + ":" + ctx.Table.TableName + " "
+	return nil
+}
+
+func (w *WithCtxHooks) PostGetCtx(ctx HookContext, e SqlExecutor) error {
+	w.Ops += string(ctx.Op) + " "
+	return nil
+}
+
+// PostGet is not run, as PostGetCtx is implemented too.
+func (w *WithCtxHooks) PostGet(e SqlExecutor) error {
+	w.Ops += "legacy "
+	return nil
+}
+
+func TestHookContext(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.AddTableWithName(WithCtxHooks{}, "ctx_hooks_test").SetKeys(true, "ID")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), userKey{}, "alice")
+	w := &WithCtxHooks{Name: "a"}
+	if err := dbmap.Insert(w, WithContext(ctx)); err != nil {
+		t.Fatal(err)
+	}
+	if w.Creator != "alice" || w.Ops != "insert:ctx_hooks_test " {
+		t.Errorf("Expected PreInsertCtx to see the context, got %v", w)
+	}
+
+	got := &WithCtxHooks{}
+	MustGet(dbmap, got, w.ID)
+	var all []WithCtxHooks
+	MustSelect(dbmap, &all, "select * from ctx_hooks_test")
+	if got.Ops != "get " || len(all) != 1 || all[0].Ops != "get " {
+		t.Errorf("Expected only PostGetCtx to run, got %q %v", got.Ops, all)
+	}
+}
+
+type Validated struct {
+	ID   int64
+	Name string
+	Age  int
+}
+
+func (v *Validated) Validate(e SqlExecutor) error {
+	var verr ValidationError
+	if v.Name == "" {
+		verr.Add("Name", "is required")
+	}
+	if v.Age < 0 {
+		verr.Add("Age", "must not be negative")
+	}
+	return verr.Err()
+}
+
+func (v *Validated) PreInsert(e SqlExecutor) error {
+	v.Name = strings.TrimSpace(v.Name)
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.AddTableWithName(Validated{}, "validated_test").SetKeys(true, "ID")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Validated{Age: -1}
+	err := dbmap.Insert(v)
+	verr, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	if verr.TableName != "validated_test" || len(verr.Errors) != 2 || verr.Messages("Age")[0] != "must not be negative" {
+		t.Errorf("Unexpected ValidationError %#v", verr)
+	}
+	if v.ID != 0 {
+		t.Errorf("Expected an invalid row not to be inserted")
+	}
+
+	// validation runs before PreInsert
+	v = &Validated{Name: " a "}
+	_insert(dbmap, v)
+	v.Age = -2
+	if _, err = dbmap.Update(v); err == nil {
+		t.Errorf("Expected Update of an invalid row to fail")
+	}
+	if err = dbmap.Insert(&Validated{}, &Validated{Name: "b"}); err == nil {
+		t.Errorf("Expected Insert of an invalid row to fail")
+	}
+	var count int64
+	if err = dbmap.SelectOne(&count, "select count(*) from validated_test"); err != nil || count != 1 {
+		t.Errorf("Expected 1 row, got %d (%v)", count, err)
+	}
+}
+
+func TestChangeEvents(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.TableFor(&Person{}).SetOldSnapshots(true)
+
+	// Person's hooks change FName and LName
+	var events []ChangeEvent
+	unsubscribe := dbmap.Subscribe(func(ev ChangeEvent) {
+		events = append(events, ev)
+	})
+	defer unsubscribe()
+
+	p := &Person{FName: "bob", LName: "smith"}
+	_insert(dbmap, p)
+	_update(dbmap, p)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %v", events)
+	}
+	if ev := events[0]; ev.Table != "person_test" || ev.Op != OpInsert || ev.Keys[0] != p.ID || ev.New.(*Person).FName != "bob" {
+		t.Errorf("Unexpected insert event %#v", ev)
+	}
+	if ev := events[1]; ev.Op != OpUpdate || ev.Old.(*Person).FName != "bob" || ev.New.(*Person).FName != "preupdate" {
+		t.Errorf("Unexpected update event %#v", ev)
+	}
+
+	// events in a transaction are only delivered on commit
+	events = nil
+	tx, err := dbmap.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Delete(p); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	if len(events) != 0 {
+		t.Errorf("Expected no events from a rolled back transaction, got %v", events)
+	}
+
+	tx, err = dbmap.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Delete(p); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("Expected events to be held until commit, got %v", events)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Op != OpDelete || events[0].Old.(*Person).ID != p.ID {
+		t.Errorf("Expected a delete event after commit, got %v", events)
+	}
+
+	unsubscribe()
+	_insert(dbmap, &Person{FName: "alice"})
+	if len(events) != 1 {
+		t.Errorf("Expected no events after unsubscribing, got %v", events)
+	}
+}
+
+type Membership struct {
+	OrgID int64
+	Email string
+	Role  string
+}
+
+func TestGetBy(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.AddTableWithName(Membership{}, "membership_test").SetKeys(false, "OrgID", "Email")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	_insert(dbmap, &Membership{1, "a@example.com", "admin"}, &Membership{2, "a@example.com", "user"})
+
+	// fields are matched by name, in any order
+	var m Membership
+	key := struct {
+		Email string
+		OrgID int64
+	}{"a@example.com", 2}
+	if err := dbmap.GetBy(&m, key); err != nil || m.Role != "user" {
+		t.Errorf("Expected the user membership, got %v %v", m, err)
+	}
+
+	// or by column
+	tagged := struct {
+		Org  int64  `db:"orgid"`
+		Mail string `db:"email"`
+	}{1, "a@example.com"}
+	if err := dbmap.GetBy(&m, &tagged, Primary()); err != nil || m.Role != "admin" {
+		t.Errorf("Expected the admin membership, got %v %v", m, err)
+	}
+
+	if err := dbmap.GetBy(&m, struct{ OrgID int64 }{1}); err == nil {
+		t.Errorf("Expected an error for a key without Email")
+	}
+	if err := dbmap.GetBy(&m, struct {
+		OrgID int64
+		Email string
+		Role  string
+	}{1, "a@example.com", "admin"}); err == nil {
+		t.Errorf("Expected an error for a key with a non-key field")
+	}
+}
+
+type Gadget struct {
+	ID   int64
+	Name string
+}
+
+type Sku struct {
+	ID    string
+	Price int64
+}
+
+func TestRegister(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	skus := dbmap.Register(&Sku{}, "sku_test")
+	if len(skus.Keys) != 1 || skus.Keys[0].ColumnName != "id" || skus.Keys[0].isAutoIncr {
+		t.Errorf("Expected a non auto-increment id key, got %v", skus.Keys)
+	}
+	if dbmap.Register(Sku{}) != skus || skus.TableName != "sku_test" {
+		t.Errorf("Expected Register to return the existing table")
+	}
+
+	if err := dbmap.Insert(&Gadget{Name: "a"}); err == nil {
+		t.Errorf("Expected Insert of an unregistered type to fail")
+	}
+	dbmap.AutoRegister = true
+	// neither is a pointer to a struct, so neither may be dereferenced to
+	// find or register a table
+	if err := dbmap.Insert(&[]Gadget{{Name: "a"}}); err == nil {
+		t.Errorf("Expected Insert of a pointer to a slice to fail")
+	}
+	g0 := &Gadget{Name: "a"}
+	if err := dbmap.Insert(&g0); err == nil {
+		t.Errorf("Expected Insert of a pointer to a pointer to fail")
+	}
+	if dbmap.TableFor(Gadget{}) != nil {
+		t.Errorf("Expected the failed inserts not to register gadget")
+	}
+	// the table is registered, though it has not been created
+	dbmap.Insert(&Gadget{Name: "a"})
+	gadgets := dbmap.TableFor(Gadget{})
+	if gadgets == nil || gadgets.TableName != "gadget" || !gadgets.Keys[0].isAutoIncr {
+		t.Fatalf("Expected gadget to be registered with an auto-increment key, got %v", gadgets)
+	}
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	g := &Gadget{Name: "a"}
+	_insert(dbmap, g)
+	if g.ID == 0 {
+		t.Errorf("Expected a generated id")
+	}
+	_insert(dbmap, &Sku{ID: "x", Price: 5})
+	var s Sku
+	MustGet(dbmap, &s, "x")
+	if s.Price != 5 {
+		t.Errorf("Expected price 5, got %v", s)
+	}
+}
+
+func TestSharedSchema(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	other := NewDbMap(dbmap.Db, dbmap.Dialect).SetSchema(dbmap.Schema())
+	if other.TableFor(Person{}) != dbmap.TableFor(Person{}) {
+		t.Fatalf("Expected the DbMaps to share the person table")
+	}
+	other.AddTableWithName(Gadget{}, "gadget_test").SetKeys(true, "ID")
+	if dbmap.TableFor(Gadget{}) == nil {
+		t.Fatalf("Expected a table added to one DbMap to be shared")
+	}
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Person{FName: "bob"}
+	_insert(other, p)
+	var got Person
+	MustGet(dbmap, &got, p.ID)
+
+	var mismatch Dialect = SqliteDialect{}
+	if _, ok := dbmap.Dialect.(SqliteDialect); ok {
+		mismatch = PostgresDialect{}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected SetSchema with a different dialect to panic")
+		}
+	}()
+	NewDbMap(dbmap.Db, mismatch).SetSchema(dbmap.Schema())
+}
+
+type Address struct {
+	Street string
+	City   string `db:"town"`
+}
+
+type Customer struct {
+	Name     string
+	Home     Address `db:"home_,embed"`
+	ID       int64
+	Shipping Address `db:"ship_,embed"`
+}
+
+func TestEmbeddedValue(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	table := dbmap.AddTableWithName(Customer{}, "customer_test").SetKeys(true, "ID")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	if col := table.ColMap("Shipping.City"); col.ColumnName != "ship_town" {
+		t.Errorf("Expected Shipping.City in column ship_town, got %s", col.ColumnName)
+	}
+
+	c := &Customer{Name: "bob", Home: Address{"1 Main St", "Springfield"}, Shipping: Address{"2 Dock Rd", "Shelbyville"}}
+	_insert(dbmap, c)
+	if c.ID == 0 {
+		t.Fatalf("Expected a generated id")
+	}
+	c.Shipping.City = "Capital City"
+	_update(dbmap, c)
+
+	var got Customer
+	MustGet(dbmap, &got, c.ID)
+	if !reflect.DeepEqual(got, *c) {
+		t.Errorf("Expected %v, got %v", *c, got)
+	}
+	var all []Customer
+	MustSelect(dbmap, &all, "select * from customer_test where ship_town = ?", "Capital City")
+	if len(all) != 1 || all[0].Home.Street != "1 Main St" {
+		t.Errorf("Expected the customer, got %v", all)
+	}
+}
+
+type Cat struct {
+	ID    int64
+	Name  string
+	Lives int
+}
+
+func (c *Cat) PostGet(e SqlExecutor) error {
+	c.Name = strings.ToUpper(c.Name)
+	return nil
+}
+
+type Dog struct {
+	ID    int64
+	Name  string
+	Breed string
+}
+
+func TestDiscriminator(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+	dbmap.AddTableWithName(Cat{}, "animal_test").SetKeys(true, "ID").SetDiscriminator("kind", "cat")
+	dbmap.AddTableWithName(Dog{}, "animal_test").SetKeys(true, "ID").SetDiscriminator("kind", "dog")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	cat := &Cat{Name: "tom", Lives: 9}
+	dog := &Dog{Name: "rex", Breed: "collie"}
+	_insert(dbmap, cat, dog)
+
+	var kind string
+	if err := dbmap.SelectOne(&kind, "select kind from animal_test where id = ?", dog.ID); err != nil || kind != "dog" {
+		t.Errorf("Expected the dog to be inserted with kind dog, got %q %v", kind, err)
+	}
+	// the dog is not a cat
+	if ok, err := dbmap.Exists(&Cat{}, dog.ID); ok || err != nil {
+		t.Errorf("Expected no cat with the dog's id, got %v %v", ok, err)
+	}
+	if n, _ := dbmap.Delete(&Cat{ID: dog.ID}); n != 0 {
+		t.Errorf("Expected Delete of a cat not to delete the dog")
+	}
+
+	var animals []interface{}
+	if err := dbmap.SelectVariants(&animals, "animal_test", "select * from animal_test order by id"); err != nil {
+		t.Fatal(err)
+	}
+	if len(animals) != 2 {
+		t.Fatalf("Expected 2 animals, got %v", animals)
+	}
+	if c, ok := animals[0].(*Cat); !ok || c.Name != "TOM" || c.Lives != 9 {
+		t.Errorf("Expected a cat with its PostGet hook run, got %#v", animals[0])
+	}
+	if d, ok := animals[1].(*Dog); !ok || d.Breed != "collie" {
+		t.Errorf("Expected a dog, got %#v", animals[1])
+	}
+}
+
+func TestInsertResult(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	p1 := &Person{FName: "bob"}
+	bad := &Person{FName: "badname"}
+	p2 := &Person{FName: "alice"}
+	results, err := dbmap.InsertResult(p1, bad, p2)
+	if err == nil || len(results) != 3 {
+		t.Fatalf("Expected 3 results and the PreInsert error, got %v %v", results, err)
+	}
+	if r := results[0]; r.Row != p1 || r.Err != nil || r.RowsAffected != 1 || r.LastInsertID != p1.ID || p1.ID == 0 {
+		t.Errorf("Unexpected result for the first row %#v", r)
+	}
+	if r := results[1]; r.Err != err || r.RowsAffected != 0 {
+		t.Errorf("Expected the second row to fail, got %#v", r)
+	}
+	if r := results[2]; r.Err != nil || r.LastInsertID != p2.ID || p2.ID == 0 {
+		t.Errorf("Expected the third row to be inserted, got %#v", r)
+	}
+}
+
+func TestContinueOnError(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	p1 := &Person{FName: "bob"}
+	bad := &Person{FName: "badname"}
+	p2 := &Person{FName: "alice"}
+	err := dbmap.Insert(p1, bad, p2, ContinueOnError())
+	merr, ok := err.(MultiError)
+	if !ok || len(merr.Errors) != 3 || merr.Errors[0] != nil || merr.Errors[1] == nil || merr.Errors[2] != nil {
+		t.Fatalf("Expected a MultiError for the second row, got %v", err)
+	}
+	if p1.ID == 0 || p2.ID == 0 {
+		t.Errorf("Expected the other rows to be inserted")
+	}
+
+	// p1 is updated first, so stale is out of date, but only fails itself
+	stale := &Person{ID: p1.ID, Version: p1.Version}
+	count, err := dbmap.Update(p1, stale, p2, ContinueOnError(), Batch())
+	merr, ok = err.(MultiError)
+	if !ok || count != 2 || merr.Errors[0] != nil || merr.Errors[2] != nil {
+		t.Fatalf("Expected 2 rows updated and a MultiError, got %d %v", count, err)
+	}
+	var ole OptimisticLockError
+	if !errors.As(merr.Errors[1], &ole) {
+		t.Errorf("Expected an OptimisticLockError for the stale row, got %v", merr.Errors[1])
+	}
+}
+
+func TestColumnOrder(t *testing.T) {
+	dbmap := newDbMap()
+	defer dbmap.Dbx.Close()
+	table := dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "ID")
+	p := &Person{FName: "bob", LName: "smith"}
+
+	declared, _, err := table.BindUpdateSQL(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.SetColumnOrder(AlphabeticalOrder)
+	sorted, args, err := table.BindUpdateSQL(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// created, fname, lname, updated, version, then the key
+	if !strings.Contains(sorted, dbmap.Dialect.QuoteField("created")) || args[1] != "bob" || args[3] != p.Updated {
+		t.Errorf("Expected columns in alphabetical order, got %s %v", sorted, args)
+	}
+	table.ResetSql()
+	if again, _, _ := table.BindUpdateSQL(p); again != sorted {
+		t.Errorf("Expected the same statement after a reset, got %s and %s", sorted, again)
+	}
+	table.SetColumnOrder(DeclarationOrder)
+	if again, _, _ := table.BindUpdateSQL(p); again != declared {
+		t.Errorf("Expected the declaration order statement %s, got %s", declared, again)
+	}
+
+	// named columns come first, and the create statements are the same
+	// for the same mapping
+	create := func() []string {
+		dm := newDbMap()
+		defer dm.Dbx.Close()
+		dm.AddTableWithName(Person{}, "person_test").SetKeys(true, "ID").SetColumnOrder(AlphabeticalOrder, "ID", "version")
+		dm.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "ID")
+		stmts, err := dm.CreateTablesSql()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stmts
+	}
+	stmts := create()
+	if again := create(); !reflect.DeepEqual(stmts, again) {
+		t.Errorf("Expected the same create statements, got %q and %q", stmts, again)
+	}
+	var names []string
+	for _, col := range table.SetColumnOrder(AlphabeticalOrder, "ID", "version").Columns {
+		names = append(names, col.ColumnName)
+	}
+	if want := []string{"id", "version", "created", "fname", "lname", "updated"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected columns %v, got %v", want, names)
+	}
+	q := dbmap.Dialect.QuoteField
+	if i, j, k := strings.Index(stmts[0], q("id")), strings.Index(stmts[0], q("version")), strings.Index(stmts[0], q("created")); i < 0 || j < i || k < j {
+		t.Errorf("Expected id, version and created in order, got %s", stmts[0])
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	var order []string
+	var execs, inTx int
+	errBlocked := errors.New("blocked")
+	dbmap.Use(func(next ExecFunc) ExecFunc {
+		return func(ctx context.Context, stmt *Statement) error {
+			order = append(order, "outer")
+			if stmt.Exec {
+				execs++
+			}
+			if stmt.InTx {
+				inTx++
+			}
+			if strings.Contains(stmt.Query, "blocked") {
+				return errBlocked
+			}
+			return next(ctx, stmt)
+		}
+	}, func(next ExecFunc) ExecFunc {
+		return func(ctx context.Context, stmt *Statement) error {
+			order = append(order, "inner")
+			// rewrite the query to select a different name
+			stmt.Query = strings.Replace(stmt.Query, "'old'", "'new'", 1)
+			return next(ctx, stmt)
+		}
+	})
+
+	var name string
+	if err := dbmap.SelectOne(&name, "select 'old'"); err != nil || name != "new" {
+		t.Errorf("Expected the rewritten query to select new, got %q %v", name, err)
+	}
+	if len(order) != 2 || order[0] != "outer" || order[1] != "inner" {
+		t.Errorf("Expected middleware to run in order, got %v", order)
+	}
+	if _, err := dbmap.Exec("delete from person_test where fname = 'blocked'"); err != errBlocked {
+		t.Errorf("Expected the middleware to block the statement, got %v", err)
+	}
+
+	tx, err := dbmap.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Insert(&Person{FName: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	if execs < 2 || inTx < 1 {
+		t.Errorf("Expected exec statements and statements in a transaction, got %d %d", execs, inTx)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	// fail writes while down is set, counting the writes which get through
+	var down bool
+	var writes int
+	errDown := errors.New("database down")
+	dbmap.Use(func(next ExecFunc) ExecFunc {
+		return func(ctx context.Context, stmt *Statement) error {
+			if stmt.Exec {
+				writes++
+				if down {
+					return errDown
+				}
+			}
+			return next(ctx, stmt)
+		}
+	})
+
+	b := NewCircuitBreaker(2, 50*time.Millisecond)
+	dbmap.TableFor(Person{}).SetCircuitBreaker(b)
+
+	down = true
+	for i := 0; i < 2; i++ {
+		if err := dbmap.Insert(&Person{FName: "bob"}); err != errDown {
+			t.Fatalf("Expected the insert to fail, got %v", err)
+		}
+	}
+	if !b.Open() {
+		t.Errorf("Expected the breaker to be open after 2 failures")
+	}
+	if err := dbmap.Insert(&Person{FName: "bob"}); err != ErrCircuitOpen {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if writes != 2 {
+		t.Errorf("Expected the open breaker to stop the write, got %d writes", writes)
+	}
+	// other tables and reads are not affected
+	if err := dbmap.Insert(&Invoice{Memo: "memo"}); err != errDown {
+		t.Errorf("Expected the invoice insert to run, got %v", err)
+	}
+	var people []Person
+	if err := dbmap.Select(&people, "select * from person_test"); err != nil {
+		t.Error(err)
+	}
+
+	// after the reset duration, a successful write closes the breaker
+	down = false
+	time.Sleep(60 * time.Millisecond)
+	if err := dbmap.Insert(&Person{FName: "bob"}); err != nil {
+		t.Errorf("Expected the trial insert to succeed, got %v", err)
+	}
+	if b.Open() {
+		t.Errorf("Expected the breaker to close after a successful write")
+	}
+
+	// as middleware, the breaker guards all Exec statements
+	mb := NewCircuitBreaker(1, time.Minute)
+	dbmap.Use(mb.Middleware)
+	if _, err := dbmap.Exec("update no_such_table set x=1"); err == nil {
+		t.Fatal("Expected an error updating a missing table")
+	}
+	if _, err := dbmap.Exec("delete from invoice_test"); err != ErrCircuitOpen {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if err := dbmap.Select(&people, "select * from person_test"); err != nil {
+		t.Errorf("Expected reads to run while the breaker is open, got %v", err)
+	}
+	// let Cleanup drop the tables
+	dbmap.middleware = nil
+}
+
+func TestCached(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	var selects int
+	dbmap.Use(func(next ExecFunc) ExecFunc {
+		return func(ctx context.Context, stmt *Statement) error {
+			if !stmt.Exec {
+				selects++
+			}
+			return next(ctx, stmt)
+		}
+	})
+
+	p := &Person{FName: "bob", LName: "smith"}
+	_insert(dbmap, p)
+
+	var people []*Person
+	if err := dbmap.Select(&people, "select * from person_test where fname = ?", "bob", Cached(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	people[0].FName = "changed"
+	people = nil
+	// formatting does not matter
+	if err := dbmap.Select(&people, "select *\n  from person_test  where fname = ?", "bob", Cached(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if selects != 1 || len(people) != 1 || people[0].FName != "bob" {
+		t.Errorf("Expected a copy of the cached row, got %d selects and %v", selects, people)
+	}
+	// different arguments are cached apart
+	people = nil
+	if err := dbmap.Select(&people, "select * from person_test where fname = ?", "alice", Cached(time.Minute)); err != nil || len(people) != 0 {
+		t.Errorf("Expected no rows for alice, got %v %v", people, err)
+	}
+	if selects != 2 {
+		t.Errorf("Expected a query for different arguments, got %d selects", selects)
+	}
+
+	// writing to the table invalidates its cached queries
+	var count int64
+	if err := dbmap.SelectOne(&count, "select count(*) from person_test", Cached(time.Minute)); err != nil || count != 1 {
+		t.Fatalf("Expected 1 person, got %d %v", count, err)
+	}
+	_insert(dbmap, &Person{FName: "alice"})
+	selects = 0
+	if err := dbmap.SelectOne(&count, "select count(*) from person_test", Cached(time.Minute)); err != nil || count != 2 {
+		t.Errorf("Expected 2 people after an insert, got %d %v", count, err)
+	}
+	if _, err := dbmap.Exec("delete from person_test where fname = 'alice'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbmap.SelectOne(&count, "select count(*) from person_test", Cached(time.Minute)); err != nil || count != 1 {
+		t.Errorf("Expected 1 person after an Exec, got %d %v", count, err)
+	}
+	if selects != 2 {
+		t.Errorf("Expected writes to invalidate the cache, got %d selects", selects)
+	}
+
+	// writes to other tables do not
+	_insert(dbmap, &Invoice{Memo: "memo"})
+	dbmap.SelectOne(&count, "select count(*) from person_test", Cached(time.Minute))
+	if selects != 2 {
+		t.Errorf("Expected the cached count to be used, got %d selects", selects)
+	}
+
+	// entries expire after their ttl
+	dbmap.SelectOne(&count, "select count(*) from invoice_test", Cached(time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	dbmap.SelectOne(&count, "select count(*) from invoice_test", Cached(time.Millisecond))
+	if selects != 4 {
+		t.Errorf("Expected an expired entry to be read again, got %d selects", selects)
+	}
+
+	dbmap.InvalidateCache()
+	dbmap.SelectOne(&count, "select count(*) from person_test", Cached(time.Minute))
+	if selects != 5 {
+		t.Errorf("Expected InvalidateCache to empty the cache, got %d selects", selects)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	dbmap := initDbMap()
+	defer dbmap.Cleanup()
+
+	plan, err := dbmap.Explain("select * from person_test where FName = ?", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) == 0 || len(plan[0]) == 0 {
+		t.Errorf("Expected a plan, got %v", plan)
+	}
+	if _, ok := dbmap.Dialect.(SqliteDialect); ok {
+		if _, ok := plan[0]["detail"].(string); !ok {
+			t.Errorf("Expected a text detail column, got %v", plan[0])
+		}
+	}
+
+	var slow []SlowQuery
+	dbmap.SlowQueryThreshold = time.Nanosecond
+	dbmap.SlowQueryExplain = true
+	dbmap.SlowQueryLogger = func(q SlowQuery) {
+		slow = append(slow, q)
+	}
+	var people []Person
+	if err = dbmap.Select(&people, "select * from person_test where FName = ?", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if len(slow) != 1 || len(slow[0].Plan) == 0 {
+		t.Errorf("Expected the slow query to be explained, got %v", slow)
+	}
+
+	// statements in transactions are not explained
+	slow = nil
+	tx, err := dbmap.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err = tx.Select(&people, "select * from person_test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(slow) != 1 || slow[0].Plan != nil {
+		t.Errorf("Expected a slow query without a plan, got %v", slow)
 	}
+}
 
-	// VERIFY deleted
-	err := dbmap.Get(inv2, inv.ID)
-	if err != sql.ErrNoRows {
-		t.Errorf("Found invoice with id: %d after Delete()", inv.ID)
+func TestFingerprint(t *testing.T) {
+	tests := []struct{ query, fp string }{
+		{"select * from t where id = ?", "select * from t where id = ?"},
+		{"select *\n\tfrom t  where id = $1 and name = 'o''brien'", "select * from t where id = ? and name = ?"},
+		{"/* app='x' */ select a1, 2.5 from t -- trailing\nwhere x in ( ?, ?,?)", "select a1, ? from t where x in (?)"},
+		{"insert into t (a, b) values (1, 'b')", "insert into t (a, b) values (?)"},
+	}
+	for _, test := range tests {
+		if fp := Fingerprint(test.query); fp != test.fp {
+			t.Errorf("Expected %q for %q, got %q", test.fp, test.query, fp)
+		}
 	}
 }
 
-func TestWithIgnoredColumn(t *testing.T) {
+func TestStats(t *testing.T) {
 	dbmap := initDbMap()
 	defer dbmap.Cleanup()
+	dbmap.CollectStats = true
 
-	ic := &WithIgnoredColumn{-1, 0, 1}
-	_insert(dbmap, ic)
-	expected := &WithIgnoredColumn{0, 1, 1}
+	for _, name := range []string{"bob", "alice", "carol"} {
+		_insert(dbmap, &Person{FName: name})
+	}
+	var people []Person
+	for _, name := range []string{"bob", "nobody"} {
+		if err := dbmap.Select(&people, "select * from person_test where FName = ?", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dbmap.Exec("select * from no_such_table"); err == nil {
+		t.Fatal("Expected an error selecting from a missing table")
+	}
 
-	ic2 := &WithIgnoredColumn{}
-	MustGet(dbmap, ic2, ic.ID)
+	stats := map[string]QueryStats{}
+	for _, s := range dbmap.Stats() {
+		stats[s.Fingerprint] = s
+	}
+	s, ok := stats["select * from person_test where FName = ?"]
+	if !ok {
+		t.Fatalf("Expected stats for the select, got %v", stats)
+	}
+	if s.Count != 2 || s.Rows != 1 || s.Errors != 0 || s.TotalTime <= 0 || s.P99 < s.P50 {
+		t.Errorf("Unexpected select stats %+v", s)
+	}
+	inserts := 0
+	for fp, s := range stats {
+		if strings.HasPrefix(fp, "insert into") {
+			inserts += int(s.Count)
+			if s.Rows != s.Count {
+				t.Errorf("Expected a row per insert, got %+v", s)
+			}
+		}
+	}
+	if inserts != 3 {
+		t.Errorf("Expected 3 inserts, got %d", inserts)
+	}
+	if s := stats["select * from no_such_table"]; s.Errors != 1 || s.LastError == nil {
+		t.Errorf("Expected the failed statement's error, got %+v", s)
+	}
 
-	if !reflect.DeepEqual(expected, ic2) {
-		t.Errorf("%v != %v", expected, ic2)
+	dbmap.ResetStats()
+	if len(dbmap.Stats()) != 0 {
+		t.Errorf("Expected ResetStats to discard the stats")
 	}
+}
 
-	if _del(dbmap, ic) != 1 {
-		t.Errorf("Did not delete row with ID: %d", ic.ID)
-		return
+func TestOpen(t *testing.T) {
+	if _, err := Open("nosuchdriver", ""); err == nil {
+		t.Error("Expected an error opening an unknown driver")
 	}
 
-	err := dbmap.Get(ic2, ic.ID)
-	if err != sql.ErrNoRows {
-		t.Errorf("Found id: %d after Delete() (%#v)", ic.ID, ic2)
+	dialect, driver := dialectAndDriver()
+	dbmap, err := Open(driver, os.Getenv("MODL_TEST_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Db.Close()
+	if reflect.TypeOf(dbmap.Dialect) != reflect.TypeOf(dialect) {
+		t.Errorf("Expected a %T, got %T", dialect, dbmap.Dialect)
+	}
+	if err = dbmap.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err = dbmap.SelectOne(&n, "select 1"); err != nil || n != 1 {
+		t.Errorf("Expected to select 1, got %d %v", n, err)
+	}
+
+	RegisterDialect("wrapped-sqlite3", SqliteDialect{BusyRetries: 3})
+	if d, err := DialectFor("wrapped-sqlite3"); err != nil || d.(SqliteDialect).BusyRetries != 3 {
+		t.Errorf("Expected the registered dialect, got %v %v", d, err)
 	}
 }
 
-func TestVersionMultipleRows(t *testing.T) {
+func TestContextQueryer(t *testing.T) {
 	dbmap := initDbMap()
 	defer dbmap.Cleanup()
 
-	persons := []*Person{
-		&Person{0, 0, 0, "Bob", "Smith", 0},
-		&Person{0, 0, 0, "Jane", "Smith", 0},
-		&Person{0, 0, 0, "Mike", "Smith", 0},
+	if FromContext(context.Background()) != nil {
+		t.Error("Expected no Queryer in an empty context")
 	}
 
-	_insert(dbmap, persons[0], persons[1], persons[2])
-
-	for x, p := range persons {
-		if p.Version != 1 {
-			t.Errorf("person[%d].Version != 1: %d", x, p.Version)
-		}
+	ctx := NewContext(context.Background(), dbmap)
+	save := func(ctx context.Context, name string) error {
+		return FromContext(ctx).Insert(&Person{FName: name})
+	}
+	if err := save(ctx, "bob"); err != nil {
+		t.Fatal(err)
 	}
-}
 
-func TestWithStringPk(t *testing.T) {
-	dbmap := newDbMap()
-	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
-	dbmap.AddTableWithName(WithStringPk{}, "string_pk_test").SetKeys(true, "ID")
-	_, err := dbmap.Exec("create table string_pk_test (ID varchar(255), Name varchar(255));")
+	// the transaction stored in the context is used instead of the DbMap
+	tx, err := dbmap.Begin()
 	if err != nil {
-		t.Errorf("couldn't create string_pk_test: %v", err)
+		t.Fatal(err)
+	}
+	if err = save(NewContext(ctx, tx), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	var count int64
+	if err = FromContext(ctx).SelectOne(&count, "select count(*) from person_test"); err != nil || count != 1 {
+		t.Errorf("Expected the rolled back insert to be gone, got %d %v", count, err)
 	}
-	defer dbmap.Cleanup()
 
-	row := &WithStringPk{"1", "foo"}
-	err = dbmap.Insert(row)
-	if err == nil {
-		t.Errorf("Expected error when inserting into table w/non Int PK and autoincr set true")
+	// statements are run with the context
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	var people []Person
+	if err = FromContext(cancelled).Select(&people, "select * from person_test"); err == nil {
+		t.Error("Expected an error selecting with a cancelled context")
 	}
 }
 
-func BenchmarkNativeCrud(b *testing.B) {
-	var err error
-
-	b.StopTimer()
-	dbmap := initDbMapBench()
+func TestDryRun(t *testing.T) {
+	dbmap := initDbMap()
 	defer dbmap.Cleanup()
-	b.StartTimer()
-
-	insert := "insert into invoice_test (date_created, updated, memo, personid) values (?, ?, ?, ?)"
-	sel := "select id, date_created, updated, memo, personid from invoice_test where id=?"
-	update := "update invoice_test set date_created=?, updated=?, memo=?, personid=? where id=?"
-	delete := "delete from invoice_test where id=?"
-
-	suffix := dbmap.Dialect.AutoIncrInsertSuffix(&ColumnMap{ColumnName: "id"})
 
-	insert = ReBind(insert, dbmap.Dialect) + suffix
-	sel = ReBind(sel, dbmap.Dialect)
-	update = ReBind(update, dbmap.Dialect)
-	delete = ReBind(delete, dbmap.Dialect)
+	p := &Person{FName: "bob", LName: "smith"}
+	_insert(dbmap, p)
 
-	inv := &Invoice{0, 100, 200, "my memo", 0, false}
+	dbmap.DryRun(true)
+	p.FName = "robert"
+	if _, err := dbmap.Update(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbmap.Exec("delete from person_test where id = ?", Sensitive(p.ID)); err != nil {
+		t.Fatal(err)
+	}
+	var people []Person
+	if err := dbmap.Select(&people, "select * from person_test"); err != nil || len(people) != 0 {
+		t.Errorf("Expected no rows in dry run mode, got %v %v", people, err)
+	}
+	dbmap.DryRun(false)
 
-	for i := 0; i < b.N; i++ {
-		if len(suffix) == 0 {
-			res, err := dbmap.Db.Exec(insert, inv.Created, inv.Updated, inv.Memo, inv.PersonID)
-			if err != nil {
-				panic(err)
-			}
+	stmts := dbmap.Captured()
+	if len(stmts) != 3 {
+		t.Fatalf("Expected 3 captured statements, got %v", stmts)
+	}
+	if !strings.HasPrefix(stmts[0].Query, "update") || !stmts[0].Exec {
+		t.Errorf("Expected the update first, got %v", stmts[0])
+	}
+	if fmt.Sprint(stmts[1].Args...) != redacted {
+		t.Errorf("Expected captured args to stay redacted, got %v", stmts[1].Args)
+	}
+	if stmts[2].Exec {
+		t.Errorf("Expected the select not to be an exec, got %v", stmts[2])
+	}
+	if len(dbmap.Captured()) != 0 {
+		t.Errorf("Expected Captured to clear the statements")
+	}
 
-			newid, err := res.LastInsertId()
-			if err != nil {
-				panic(err)
-			}
-			inv.ID = newid
-		} else {
-			rows, err := dbmap.Db.Query(insert, inv.Created, inv.Updated, inv.Memo, inv.PersonID)
-			if err != nil {
-				panic(err)
-			}
+	// nothing was written
+	p2 := &Person{}
+	MustGet(dbmap, p2, p.ID)
+	if p2.FName != "bob" {
+		t.Errorf("Expected the row to be unchanged, got %v", p2)
+	}
+}
 
-			if rows.Next() {
-				err = rows.Scan(&inv.ID)
-				if err != nil {
-					panic(err)
-				}
-			}
-			rows.Close()
+type Meeting struct {
+	ID    int64
+	Day   time.Time
+	At    time.Time
+	Ended *time.Time
+}
 
-		}
+func TestTimeColumns(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.TimeLocation = time.UTC
+	table := dbmap.AddTableWithName(Meeting{}, "meeting_test").SetKeys(true, "ID")
+	table.ColMap("Day").SetTimeLayout("2006-01-02").SetSqlType("varchar(10)")
+	dbmap.Exec("drop table if exists meeting_test")
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
 
-		row := dbmap.Db.QueryRow(sel, inv.ID)
-		err = row.Scan(&inv.ID, &inv.Created, &inv.Updated, &inv.Memo, &inv.PersonID)
-		if err != nil {
-			panic(err)
-		}
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	at := time.Date(2024, 3, 5, 14, 30, 0, 0, zone)
+	m := &Meeting{Day: at, At: at}
+	_insert(dbmap, m)
 
-		inv.Created = 1000
-		inv.Updated = 2000
-		inv.Memo = "my memo 2"
-		inv.PersonID = 3000
+	var day string
+	if err := dbmap.SelectOne(&day, "select Day from meeting_test"); err != nil || day != "2024-03-05" {
+		t.Errorf("Expected the day to be stored as 2024-03-05, got %q %v", day, err)
+	}
 
-		_, err = dbmap.Db.Exec(update, inv.Created, inv.Updated, inv.Memo,
-			inv.PersonID, inv.ID)
-		if err != nil {
-			panic(err)
-		}
+	m2 := &Meeting{}
+	MustGet(dbmap, m2, m.ID)
+	if !m2.Day.Equal(time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the day to be read back in UTC, got %v", m2.Day)
+	}
+	if !m2.At.Equal(at) || m2.At.Location() != time.UTC {
+		t.Errorf("Expected %v in UTC, got %v", at, m2.At)
+	}
+	if m2.Ended != nil {
+		t.Errorf("Expected a nil end, got %v", m2.Ended)
+	}
 
-		_, err = dbmap.Db.Exec(delete, inv.ID)
-		if err != nil {
-			panic(err)
-		}
+	ended := at.Add(time.Hour)
+	m2.Ended = &ended
+	_update(dbmap, m2)
+	var meetings []*Meeting
+	if err := dbmap.Select(&meetings, "select * from meeting_test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(meetings) != 1 || meetings[0].Ended == nil || !meetings[0].Ended.Equal(ended) || meetings[0].Ended.Location() != time.UTC {
+		t.Errorf("Expected the end to round-trip in UTC, got %v", meetings)
 	}
 
+	// a DbMap sharing the schema reads times in its own location
+	other := NewDbMap(dbmap.Db, dbmap.Dialect).SetSchema(dbmap.Schema())
+	other.TimeLocation = zone
+	m3 := &Meeting{}
+	MustGet(other, m3, m.ID)
+	if !m3.At.Equal(at) || m3.At.Location() != zone {
+		t.Errorf("Expected %v in UTC+2, got %v", at, m3.At)
+	}
+	if !m3.Day.Equal(time.Date(2024, 3, 5, 0, 0, 0, 0, zone)) {
+		t.Errorf("Expected the day to be read in UTC+2, got %v", m3.Day)
+	}
+	MustGet(dbmap, m2, m.ID)
+	if m2.At.Location() != time.UTC || !m2.Day.Equal(time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the first DbMap to read times in UTC, got %v %v", m2.At, m2.Day)
+	}
 }
 
-func BenchmarkModlCrud(b *testing.B) {
-	b.StopTimer()
-	dbmap := initDbMapBench()
+func TestZeroTimeNull(t *testing.T) {
+	dbmap := newDbMap()
+	table := dbmap.AddTableWithName(Meeting{}, "meeting_test").SetKeys(true, "ID")
+	table.ColMap("At").SetZeroTimeNull(true)
+	table.ColMap("Ended").SetZeroTimeNull(true)
+	dbmap.Exec("drop table if exists meeting_test")
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
 	defer dbmap.Cleanup()
-	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
-	b.StartTimer()
-
-	inv := &Invoice{0, 100, 200, "my memo", 0, true}
-	for i := 0; i < b.N; i++ {
-		err := dbmap.Insert(inv)
-		if err != nil {
-			panic(err)
-		}
 
-		inv2 := Invoice{}
-		err = dbmap.Get(&inv2, inv.ID)
-		if err != nil {
-			panic(err)
-		}
+	m := &Meeting{Day: time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC), Ended: &time.Time{}}
+	_insert(dbmap, m)
 
-		inv2.Created = 1000
-		inv2.Updated = 2000
-		inv2.Memo = "my memo 2"
-		inv2.PersonID = 3000
-		_, err = dbmap.Update(&inv2)
-		if err != nil {
-			panic(err)
-		}
+	var nulls int
+	err := dbmap.SelectOne(&nulls, "select count(*) from meeting_test where At is null and Ended is null")
+	if err != nil || nulls != 1 {
+		t.Errorf("Expected zero times to be written as NULL, got %d %v", nulls, err)
+	}
 
-		_, err = dbmap.Delete(&inv2)
-		if err != nil {
-			panic(err)
-		}
+	m2 := &Meeting{}
+	MustGet(dbmap, m2, m.ID)
+	if !m2.At.IsZero() || m2.Ended != nil {
+		t.Errorf("Expected NULL to be read as a zero time and a nil pointer, got %v %v", m2.At, m2.Ended)
+	}
 
+	m2.At = time.Date(2024, 3, 5, 9, 0, 0, 0, time.UTC)
+	_update(dbmap, m2)
+	MustGet(dbmap, m, m.ID)
+	if !m.At.Equal(m2.At) {
+		t.Errorf("Expected %v, got %v", m2.At, m.At)
 	}
 }
 
-func initDbMapBench() *DbMap {
+type Digest [4]byte
+
+type Payload []byte
+
+type Attachment struct {
+	ID   int64
+	Data []byte
+	Hash Digest
+	Body Payload
+}
+
+func TestBinaryColumns(t *testing.T) {
 	dbmap := newDbMap()
-	dbmap.Db.Exec("drop table if exists invoice_test")
-	dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
-	err := dbmap.CreateTables()
-	if err != nil {
-		panic(err)
+	dbmap.AddTableWithName(Attachment{}, "attachment_test").SetKeys(true, "ID")
+	dbmap.Exec("drop table if exists attachment_test")
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
 	}
-	return dbmap
-}
+	defer dbmap.Cleanup()
 
-func (d *DbMap) Cleanup() {
-	err := d.DropTables()
-	if err != nil {
-		panic(err)
+	a := &Attachment{Data: []byte{0, 1, 2}, Hash: Digest{1, 2, 3, 4}, Body: Payload("body")}
+	_insert(dbmap, a)
+
+	a2 := &Attachment{}
+	MustGet(dbmap, a2, a.ID)
+	if !bytes.Equal(a2.Data, a.Data) || a2.Hash != a.Hash || string(a2.Body) != "body" {
+		t.Errorf("Expected %v, got %v", a, a2)
 	}
-	err = d.Dbx.Close()
+
+	// text values, which some drivers return as strings
+	var rows []Attachment
+	err := dbmap.Select(&rows, "select ID, 'data' as Data, 'hash' as Hash, 'text' as Body from attachment_test")
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || string(rows[0].Data) != "data" || string(rows[0].Hash[:]) != "hash" || string(rows[0].Body) != "text" {
+		t.Errorf("Expected text values to be read as bytes, got %v", rows)
 	}
-}
 
-func initDbMap() *DbMap {
-	dbmap := newDbMap()
-	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
-	dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
-	dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "id")
-	dbmap.AddTableWithName(WithIgnoredColumn{}, "ignored_column_test").SetKeys(true, "id")
-	dbmap.AddTableWithName(WithTime{}, "time_test").SetKeys(true, "ID")
-	err := dbmap.CreateTables()
-	if err != nil {
-		panic(err)
+	var nulls []Attachment
+	err = dbmap.Select(&nulls, "select ID, Data, null as Hash, null as Body from attachment_test")
+	if err != nil || len(nulls) != 1 || nulls[0].Hash != (Digest{}) || nulls[0].Body != nil {
+		t.Errorf("Expected NULL to be read as zero values, got %v %v", nulls, err)
 	}
 
-	return dbmap
+	col := func(v interface{}, size int) *ColumnMap {
+		return &ColumnMap{gotype: reflect.TypeOf(v), MaxSize: size}
+	}
+	for _, tt := range []struct {
+		col  *ColumnMap
+		want string
+	}{
+		{col([]byte{}, 0), "mediumblob"},
+		{col([]byte{}, 16), "varbinary(16)"},
+		{col(Payload{}, 1000), "blob"},
+		{col([]byte{}, 1<<20), "mediumblob"},
+		{col([]byte{}, 1<<30), "longblob"},
+		{col(Digest{}, 0), "binary(4)"},
+	} {
+		if got := (MySQLDialect{}).ToSqlType(tt.col); got != tt.want {
+			t.Errorf("Expected %s for %v of size %d, got %s", tt.want, tt.col.gotype, tt.col.MaxSize, got)
+		}
+	}
 }
 
-func TestTruncateTables(t *testing.T) {
-	dbmap := initDbMap()
-	defer dbmap.Cleanup()
-	err := dbmap.CreateTablesIfNotExists()
-	if err != nil {
-		t.Error(err)
+// Money is a Decimal wrapping big.Rat.
+type Money struct {
+	big.Rat
+}
+
+func (m Money) String() string {
+	return m.FloatString(2)
+}
+
+type Bill struct {
+	ID       int64
+	Total    Money
+	Discount *Money
+	Rate     float64
+}
+
+func TestDecimalColumns(t *testing.T) {
+	dbmap := newDbMap()
+	table := dbmap.AddTableWithName(Bill{}, "bill_test").SetKeys(true, "ID")
+	table.ColMap("Total").SetPrecision(14, 2)
+	table.ColMap("Rate").SetPrecision(5, 4)
+	dbmap.Exec("drop table if exists bill_test")
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
 	}
+	defer dbmap.Cleanup()
 
-	// Insert some data
-	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
-	dbmap.Insert(p1)
-	inv := &Invoice{0, 0, 1, "my invoice", 0, true}
-	dbmap.Insert(inv)
+	b := &Bill{Rate: 0.0825}
+	b.Total.UnmarshalText([]byte("123456789012.34"))
+	_insert(dbmap, b)
 
-	err = dbmap.TruncateTables()
-	if err != nil {
-		t.Error(err)
+	b2 := &Bill{}
+	MustGet(dbmap, b2, b.ID)
+	if b2.Total.String() != "123456789012.34" || b2.Discount != nil || b2.Rate != 0.0825 {
+		t.Errorf("Expected %v, got %v", b, b2)
 	}
 
-	// Make sure all rows are deleted
-	people := []Person{}
-	invoices := []Invoice{}
-	dbmap.Select(&people, "SELECT * FROM person_test")
-	if len(people) != 0 {
-		t.Errorf("Expected 0 person rows, got %d", len(people))
+	b2.Discount = &Money{}
+	b2.Discount.UnmarshalText([]byte("0.10"))
+	_update(dbmap, b2)
+	MustGet(dbmap, b, b.ID)
+	if b.Discount == nil || b.Discount.String() != "0.10" {
+		t.Errorf("Expected a discount of 0.10, got %v", b.Discount)
 	}
-	dbmap.Select(&invoices, "SELECT * FROM invoice_test")
-	if len(invoices) != 0 {
-		t.Errorf("Expected 0 invoice rows, got %d", len(invoices))
+
+	for _, tt := range []struct {
+		d    Dialect
+		col  string
+		want string
+	}{
+		{PostgresDialect{}, "Total", "numeric(14,2)"},
+		{PostgresDialect{}, "Discount", "numeric"},
+		{MySQLDialect{}, "Discount", "decimal(65,30)"},
+		{SqliteDialect{}, "Rate", "numeric(5,4)"},
+	} {
+		if got := tt.d.ToSqlType(table.ColMap(tt.col)); got != tt.want {
+			t.Errorf("Expected %s for %s in %T, got %s", tt.want, tt.col, tt.d, got)
+		}
 	}
 }
 
-func TestTruncateTablesIdentityRestart(t *testing.T) {
-	dbmap := initDbMap()
-	defer dbmap.Cleanup()
-	err := dbmap.CreateTablesIfNotExists()
-	if err != nil {
-		t.Error(err)
-	}
+type Place struct {
+	ID       int64
+	Name     string
+	Location Geometry
+	Area     *Geometry
+}
 
-	// Insert some data
-	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
-	dbmap.Insert(p1)
-	inv := &Invoice{0, 0, 1, "my invoice", 0, true}
-	dbmap.Insert(inv)
+func TestGeometry(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.AddTableWithName(Place{}, "place_test").SetKeys(true, "ID")
+	dbmap.Exec("drop table if exists place_test")
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup()
 
-	err = dbmap.TruncateTablesIdentityRestart()
-	if err != nil {
-		t.Error(err)
+	p := &Place{Name: "Boston", Location: Geometry{WKT: "POINT(-71.06 42.36)"}}
+	_insert(dbmap, p)
+	p2 := &Place{}
+	MustGet(dbmap, p2, p.ID)
+	if p2.Location.WKT != p.Location.WKT || p2.Area != nil {
+		t.Errorf("Expected %v, got %v", p, p2)
 	}
 
-	// Make sure all rows are deleted
-	people := []Person{}
-	invoices := []Invoice{}
-	dbmap.Select(&people, "SELECT * FROM person_test")
-	if len(people) != 0 {
-		t.Errorf("Expected 0 person rows, got %d", len(people))
+	var g Geometry
+	if err := g.Scan("0101000000"); err != nil || g.WKT != "" || !bytes.Equal(g.WKB, []byte{1, 1, 0, 0, 0}) {
+		t.Errorf("Expected hex geometry to be read as WKB, got %v %v", g, err)
 	}
-	dbmap.Select(&invoices, "SELECT * FROM invoice_test")
-	if len(invoices) != 0 {
-		t.Errorf("Expected 0 invoice rows, got %d", len(invoices))
+	if err := g.Scan("SRID=4326;POINT(1 2)"); err != nil || g.WKT != "SRID=4326;POINT(1 2)" || g.WKB != nil {
+		t.Errorf("Expected text geometry to be read as WKT, got %v %v", g, err)
 	}
 
-	p2 := &Person{0, 0, 0, "Other", "Person", 0}
-	dbmap.Insert(p2)
-	if p2.ID != int64(1) {
-		t.Errorf("Expected new person ID to be equal to 1, was %d", p2.ID)
+	for _, d := range []Dialect{PostgresDialect{}, MySQLDialect{}} {
+		dm := &DbMap{Dialect: d}
+		table := dm.AddTableWithName(Place{}, "place").SetKeys(true, "ID")
+		table.ColMap("Location").SetSRID(4326)
+		insert := table.bindInsert(dm, reflect.ValueOf(p).Elem(), false).query
+		if !strings.Contains(insert, "ST_GeomFromText(") || !strings.Contains(insert, ", 4326)") {
+			t.Errorf("Expected geometries to be inserted from text, got %s", insert)
+		}
+		if get := table.bindGet().query; !strings.Contains(get, "ST_AsText(") {
+			t.Errorf("Expected geometries to be selected as text, got %s", get)
+		}
+		create, err := dm.CreateTablesSql()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(create[0], d.(SpatialDialect).GeometryType(4326)) {
+			t.Errorf("Expected a geometry column with SRID 4326, got %s", create[0])
+		}
 	}
 }
 
-func TestSelectBehavior(t *testing.T) {
-	db := initDbMap()
-	defer db.Cleanup()
-
-	p := Person{}
+type Article struct {
+	ID    int64
+	Title string
+	Body  string
+}
 
-	// check that SelectOne with no rows returns ErrNoRows
-	err := db.SelectOne(&p, "select * from person_test")
-	if err == nil || err != sql.ErrNoRows {
+func TestSelectSearch(t *testing.T) {
+	dbmap := newDbMap()
+	dbmap.AddTableWithName(Article{}, "article_test").SetKeys(true, "ID").SetSearch("Title", "Body")
+	dbmap.Exec("drop table if exists article_test")
+	if err := dbmap.CreateTables(); err != nil {
 		t.Fatal(err)
 	}
+	defer dbmap.Cleanup()
 
-	// insert and ensure SelectOne works properly
-	bob := Person{0, 0, 0, "Bob", "Smith", 0}
-	db.Insert(&bob)
+	_insert(dbmap,
+		&Article{Title: "Cooking", Body: "How to bake bread"},
+		&Article{Title: "Bread", Body: "A history of baking"},
+		&Article{Title: "Gardening", Body: "Growing 100% organic tomatoes"},
+	)
 
-	err = db.SelectOne(&p, "select * from person_test")
-	if err != nil {
+	var articles []Article
+	if err := dbmap.SelectSearch(&articles, "bread"); err != nil {
 		t.Fatal(err)
 	}
-	if p.FName != "Bob" {
-		t.Errorf("Wrong FName: %s", p.FName)
+	if len(articles) != 2 {
+		t.Errorf("Expected 2 articles about bread, got %v", articles)
 	}
-	// there's a post hook on this that sets it to postget, ensure it ran
-	if p.LName != "postget" {
-		t.Errorf("Wrong LName: %s", p.LName)
+	// like wildcards in the text are matched literally
+	if _, ok := dbmap.Dialect.(Searcher); !ok {
+		articles = nil
+		if err := dbmap.SelectSearch(&articles, "0%"); err != nil || len(articles) != 1 {
+			t.Errorf("Expected 1 article containing 0%%, got %v %v", articles, err)
+		}
 	}
 
-	// insert again and ensure SelectOne *does not* error in rows > 1
-	ben := Person{0, 0, 0, "Ben", "Smith", 0}
-	db.Insert(&ben)
+	var people []Person
+	if err := dbmap.SelectSearch(&people, "bread"); err == nil {
+		t.Errorf("Expected an error searching a table without search columns")
+	}
 
-	err = db.SelectOne(&p, "select * from person_test ORDER BY fname ASC")
+	for _, tt := range []struct {
+		d     Dialect
+		index string
+		cond  string
+	}{
+		{PostgresDialect{}, `using gin (to_tsvector('english'::regconfig, coalesce("title", '') || ' ' || coalesce("body", '')))`, "websearch_to_tsquery("},
+		{MySQLDialect{}, "create fulltext index `article_search_idx` on `article` (`title`, `body`)", "match (`title`, `body`) against (? in natural language mode)"},
+	} {
+		dm := &DbMap{Dialect: tt.d}
+		table := dm.AddTableWithName(Article{}, "article").SetKeys(true, "ID").SetSearch("Title", "Body")
+		create, err := dm.CreateTablesSql()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(create) != 2 || !strings.Contains(create[1], tt.index) {
+			t.Errorf("Expected a search index %s, got %v", tt.index, create)
+		}
+		if cond := tt.d.(Searcher).SearchCondition(table); !strings.Contains(cond, tt.cond) {
+			t.Errorf("Expected a search condition with %s, got %s", tt.cond, cond)
+		}
+	}
+
+	// the index is ended with the dialect's terminator
+	dm := &DbMap{Dialect: unterminatedDialect{}}
+	dm.AddTableWithName(Article{}, "article").SetKeys(true, "ID").SetSearch("Title", "Body")
+	create, err := dm.CreateTablesSql()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if p.FName != "Ben" {
-		t.Errorf("Wrong FName: %s", p.FName)
+	if len(create) != 2 || strings.HasSuffix(create[1], ";") {
+		t.Errorf("Expected a search index without a terminator, got %v", create)
 	}
 }
 
-func TestQuoteTableNames(t *testing.T) {
-	dbmap := initDbMap()
-	defer dbmap.Cleanup()
-
-	quotedTableName := dbmap.Dialect.QuoteField("person_test")
-
-	// Use a buffer to hold the log to check generated queries
-	var logBuffer bytes.Buffer
-	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", log.Lmicroseconds))
-
-	// Create some rows
-	p1 := &Person{0, 0, 0, "bob", "smith", 0}
-	errorTemplate := "Expected quoted table name %v in query but didn't find it"
-
-	// Check if Insert quotes the table name
-	id := dbmap.Insert(p1)
-	if !bytes.Contains(logBuffer.Bytes(), []byte(quotedTableName)) {
-		t.Log("log:", logBuffer.String())
-		t.Errorf(errorTemplate, quotedTableName)
+func TestCollationAndComments(t *testing.T) {
+	for _, tt := range []struct {
+		d        Dialect
+		expected []string
+	}{
+		{SqliteDialect{}, []string{`"title" text collate nocase`}},
+		{PostgresDialect{}, []string{`"title" varchar(255) collate nocase`,
+			`comment on table "article" is 'Published articles';`, `comment on column "article"."body" is 'It''s markdown';`}},
+		{MySQLDialect{}, []string{"`title` varchar(255) collate nocase", "`body` varchar(255) comment 'It''s markdown'",
+			"comment='Published articles'"}},
+	} {
+		dm := &DbMap{Dialect: tt.d}
+		table := dm.AddTableWithName(Article{}, "article").SetKeys(true, "ID").SetComment("Published articles")
+		table.ColMap("Title").SetCollation("nocase")
+		table.ColMap("Body").SetComment("It's markdown")
+		create, err := dm.CreateTablesSql()
+		if err != nil {
+			t.Fatal(err)
+		}
+		all := strings.Join(create, "\n")
+		for _, e := range tt.expected {
+			if !strings.Contains(all, e) {
+				t.Errorf("%T: expected %s in %s", tt.d, e, all)
+			}
+		}
+		if _, ok := tt.d.(SqliteDialect); ok && (len(create) != 1 || strings.Contains(all, "comment")) {
+			t.Errorf("Expected sqlite to leave out comments, got %s", all)
+		}
 	}
-	logBuffer.Reset()
 
-	// Check if Get quotes the table name
-	dbmap.Get(Person{}, id)
-	if !bytes.Contains(logBuffer.Bytes(), []byte(quotedTableName)) {
-		t.Errorf(errorTemplate, quotedTableName)
+	// comments are ended with the dialect's terminator
+	dm := &DbMap{Dialect: unterminatedDialect{}}
+	dm.AddTableWithName(Article{}, "article").SetKeys(true, "ID").SetComment("Published articles")
+	create, err := dm.CreateTablesSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(create) != 2 || strings.HasSuffix(create[1], ";") {
+		t.Errorf("Expected an unterminated comment statement, got %v", create)
 	}
-	logBuffer.Reset()
 }
 
-type WithTime struct {
-	ID   int64
-	Time time.Time
+// unterminatedDialect is postgres for a driver which rejects ";".
+type unterminatedDialect struct {
+	PostgresDialect
 }
 
-func TestWithTime(t *testing.T) {
-	dbmap := initDbMap()
+func (unterminatedDialect) StatementTerminator() string {
+	return ""
+}
+
+func TestCaptureChanges(t *testing.T) {
+	dbmap := newDbMap()
+	table := dbmap.AddTableWithName(Article{}, "article_test").SetKeys(true, "ID")
+	dbmap.Exec("drop table if exists article_test")
+	dbmap.Exec("drop table if exists changes_test")
+	dbmap.Exec("drop table if exists changes_test_checkpoints")
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
 	defer dbmap.Cleanup()
+	defer dbmap.Exec("drop table changes_test_checkpoints")
+	defer dbmap.Exec("drop table changes_test")
 
-	// FIXME: there seems to be a bug with go-sql-driver and timezones?
-	// MySQL doesn't have any timestamp support, but since it is not
-	// sending any, the scan assumes UTC, so the scanner should
-	// probably convert to UTC before storing.  Also, note that time.Time
-	// support requires a special bit to be added to the DSN
-	t1, err := time.Parse("2006-01-02 15:04:05 -0700 MST",
-		"2013-08-09 21:30:43 +0000 UTC")
-	if err != nil {
+	if err := dbmap.CaptureChanges("changes_test", table); err != nil {
+		t.Fatal(err)
+	}
+	a := &Article{Title: "Draft", Body: "..."}
+	_insert(dbmap, a)
+	a.Title = "Final"
+	_update(dbmap, a)
+	if _, err := dbmap.Exec("delete from article_test"); err != nil {
 		t.Fatal(err)
 	}
 
-	w1 := WithTime{1, t1}
-	dbmap.Insert(&w1)
+	r := dbmap.ChangeReader("changes_test", "reader")
+	changes, err := r.Next(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Op != OpInsert || changes[1].Op != OpUpdate || changes[0].Table != "article_test" {
+		t.Fatalf("Expected an insert and an update, got %v", changes)
+	}
+	var row map[string]interface{}
+	if err := changes[1].Decode(&row); err != nil || row["title"] != "Final" {
+		t.Errorf("Expected the updated row, got %v %v", row, err)
+	}
+	if err := r.Ack(changes[1]); err != nil {
+		t.Fatal(err)
+	}
 
-	w2 := WithTime{}
-	dbmap.Get(&w2, w1.ID)
+	changes, err = dbmap.ChangeReader("changes_test", "reader").Next(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys map[string]int64
+	if len(changes) == 1 {
+		json.Unmarshal([]byte(changes[0].Keys), &keys)
+	}
+	if len(changes) != 1 || changes[0].Op != OpDelete || keys["id"] != a.ID {
+		t.Errorf("Expected the delete after the checkpoint, got %v", changes)
+	}
 
-	if w1.Time.UnixNano() != w2.Time.UnixNano() {
-		t.Errorf("%v != %v", w1, w2)
+	if err := dbmap.StopCapturingChanges("changes_test", table); err != nil {
+		t.Fatal(err)
+	}
+	_insert(dbmap, &Article{Title: "Unrecorded"})
+	if changes, err = r.Next(10); err != nil || len(changes) != 1 {
+		t.Errorf("Expected no changes to be recorded after stopping, got %v %v", changes, err)
 	}
 }
 
-func initDbMapNulls() *DbMap {
-	dbmap := newDbMap()
-	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
-	dbmap.AddTable(TableWithNull{}).SetKeys(false, "id")
-	err := dbmap.CreateTables()
-	if err != nil {
-		panic(err)
-	}
-	return dbmap
+// twoPhaseSqlite stands in for a TwoPhaseCommitter with sqlite, whose
+// transactions are committed and rolled back in place of prepared ones.
+type twoPhaseSqlite struct {
+	SqliteDialect
+	failPrepare bool
 }
 
-func newDbMap() *DbMap {
-	dialect, driver := dialectAndDriver()
-	return NewDbMap(connect(driver), dialect)
+func (d twoPhaseSqlite) BeginTwoPhase(branch string) []string { return nil }
+func (d twoPhaseSqlite) AbortTwoPhase(branch string) []string { return nil }
+func (d twoPhaseSqlite) CommitPrepared(branch string) string  { return "commit" }
+func (d twoPhaseSqlite) RollbackPrepared(branch string) string {
+	return "rollback"
+}
+func (d twoPhaseSqlite) PrepareTwoPhase(branch string) []string {
+	if d.failPrepare {
+		return []string{"select * from no_such_table"}
+	}
+	return nil
+}
+func (d twoPhaseSqlite) PreparedTransactions(m *DbMap) ([]string, error) {
+	return []string{"modl_0123.0", "other"}, nil
 }
 
-func connect(driver string) *sql.DB {
-	dsn := os.Getenv("MODL_TEST_DSN")
-	if dsn == "" {
-		panic("MODL_TEST_DSN env variable is not set. Please see README.md")
+func TestTwoPhase(t *testing.T) {
+	var dbmaps []*DbMap
+	for i := 0; i < 2; i++ {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		dbmap := NewDbMap(db, twoPhaseSqlite{})
+		dbmap.AddTableWithName(Article{}, "article_test").SetKeys(true, "ID")
+		if err := dbmap.CreateTables(); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		dbmaps = append(dbmaps, dbmap)
+	}
+	count := func(m *DbMap) int {
+		var n int
+		if err := m.SelectOne(&n, "select count(*) from article_test"); err != nil {
+			t.Fatal(err)
+		}
+		return n
 	}
 
-	db, err := sql.Open(driver, dsn)
-	if err != nil {
-		panic("Error connecting to db: " + err.Error())
+	c := NewTwoPhase(dbmaps...)
+	insert := func(txs []*Transaction) error {
+		for _, tx := range txs {
+			if err := tx.Insert(&Article{Title: "Shared"}); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	err = db.Ping()
-	if err != nil {
-		panic("Error connecting to db: " + err.Error())
+	if err := c.Run(insert); err != nil {
+		t.Fatal(err)
+	}
+	if count(dbmaps[0]) != 1 || count(dbmaps[1]) != 1 {
+		t.Errorf("Expected the row to be committed to both databases")
 	}
-	return db
-}
 
-func dialectAndDriver() (Dialect, string) {
-	switch os.Getenv("MODL_TEST_DIALECT") {
-	case "mysql":
-		return MySQLDialect{"InnoDB", "UTF8"}, "mysql"
-	case "postgres":
-		return PostgresDialect{}, "postgres"
-	case "sqlite":
-		return SqliteDialect{}, "sqlite3"
+	failed := errors.New("failed")
+	err := c.Run(func(txs []*Transaction) error {
+		insert(txs)
+		return failed
+	})
+	if err != failed || count(dbmaps[0]) != 1 || count(dbmaps[1]) != 1 {
+		t.Errorf("Expected both transactions to be rolled back, got %v", err)
 	}
-	panic("MODL_TEST_DIALECT env variable is not set or is invalid. Please see README.md")
-}
 
-func _insert(dbmap *DbMap, list ...interface{}) {
-	err := dbmap.Insert(list...)
-	if err != nil {
-		panic(err)
+	dbmaps[1].Dialect = twoPhaseSqlite{failPrepare: true}
+	if err := c.Run(insert); err == nil || count(dbmaps[0]) != 1 || count(dbmaps[1]) != 1 {
+		t.Errorf("Expected a failed prepare to roll back both transactions, got %v", err)
 	}
-}
 
-func _update(dbmap *DbMap, list ...interface{}) int64 {
-	count, err := dbmap.Update(list...)
-	if err != nil {
-		panic(err)
+	doubts, err := c.InDoubt()
+	if err != nil || len(doubts) != 2 || doubts[0].GID != "modl_0123" || doubts[0].Branch != "modl_0123.0" {
+		t.Errorf("Expected the coordinator's prepared branches, got %v %v", doubts, err)
+	}
+
+	dbmap := newDbMap()
+	defer dbmap.Dbx.Close()
+	if err := NewTwoPhase(dbmap).Run(insert); err == nil {
+		t.Errorf("Expected an error for a dialect without two-phase commit")
 	}
-	return count
 }
 
-func _del(dbmap *DbMap, list ...interface{}) int64 {
-	count, err := dbmap.Delete(list...)
-	if err != nil {
-		panic(err)
+func TestRewriteQuery(t *testing.T) {
+	d := PostgresDialect{}
+	for _, tt := range []struct{ query, want string }{
+		{"select * from t where a = ? and b = ?", "select * from t where a = $1 and b = $2"},
+		{"select '?', \"?\", E'\\'?' from t where a = ?", "select '?', \"?\", E'\\'?' from t where a = $1"},
+		{"select a -- why?\nfrom t where b = ? /* c = ? */", "select a -- why?\nfrom t where b = $1 /* c = ? */"},
+		{"select $$?$$, $x$?$x$ from t where a = ?", "select $$?$$, $x$?$x$ from t where a = $1"},
+		{"select * from t where doc ?? 'key' and a = ?", "select * from t where doc ? 'key' and a = $1"},
+		{"select * from t where doc ??| array['a'] and doc ??& array['b']", "select * from t where doc ?| array['a'] and doc ?& array['b']"},
+		{"select * from t where a = $1 and b ? 'key'", "select * from t where a = $1 and b ? 'key'"},
+		{"select 'unterminated ?", "select 'unterminated ?"},
+	} {
+		if got := d.RewriteQuery(tt.query); got != tt.want {
+			t.Errorf("Expected %q, got %q", tt.want, got)
+		}
 	}
 
-	return count
-}
+	dbmap := &DbMap{Dialect: d}
+	query, args, err := dbmap.rewrite("select * from t where a in (?) and b = ?", []interface{}{[]int{1, 2}, 3}, &queryOptions{})
+	if err != nil || query != "select * from t where a in ($1, $2) and b = $3" || len(args) != 3 {
+		t.Errorf("Expected slices to be expanded before rewriting, got %q %v %v", query, args, err)
+	}
+	if query, _, _ := dbmap.rewrite("select * from t where a = ?", nil, &queryOptions{raw: true}); query != "select * from t where a = ?" {
+		t.Errorf("Expected a raw call not to be rewritten, got %q", query)
+	}
+	dbmap.RawQueries = true
+	if query, _, _ := dbmap.rewrite("select * from t where a = ?", nil, &queryOptions{}); query != "select * from t where a = ?" {
+		t.Errorf("Expected raw queries not to be rewritten, got %q", query)
+	}
 
-func MustGet(dbmap *DbMap, i interface{}, keys ...interface{}) {
-	err := dbmap.Get(i, keys...)
-	if err != nil {
-		panic(err)
+	// other dialects are rebound for their driver's bind type
+	dbmap = &DbMap{Dialect: sqlserverDialect{}}
+	if query, _, _ := dbmap.rewrite("select * from t where a = ? and b = ?", nil, &queryOptions{}); query != "select * from t where a = @p1 and b = @p2" {
+		t.Errorf("Expected bindvars to be rebound for sqlserver, got %q", query)
+	}
+	dbmap = &DbMap{Dialect: MySQLDialect{}}
+	if query, _, _ := dbmap.rewrite("select * from t where a = ?", nil, &queryOptions{}); query != "select * from t where a = ?" {
+		t.Errorf("Expected mysql queries to be left alone, got %q", query)
 	}
 }
 
-func MustSelect(dbmap *DbMap, dest interface{}, query string, args ...interface{}) {
-	err := dbmap.Select(dest, query, args...)
-	if err != nil {
-		panic(err)
+// TestRewriteJsonb checks the ways to write postgres' jsonb operators, which
+// are also question marks.
+func TestRewriteJsonb(t *testing.T) {
+	dbmap := newDbMap()
+	defer dbmap.Dbx.Close()
+	if _, ok := dbmap.Dialect.(PostgresDialect); !ok {
+		t.Skip("jsonb operators are postgres only")
+	}
+	doc := `{"a": 1, "b": 2}`
+	for _, tt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		// doubled when the query is rewritten
+		{"select ?::jsonb ?? 'a'", []interface{}{doc}},
+		{"select ?::jsonb ??| array['a', 'c'] and ?::jsonb ??& array['a', 'b']", []interface{}{doc, doc}},
+		// as they are in queries which are not rewritten
+		{"select $1::jsonb ? 'a'", []interface{}{doc}},
+		{"select $1::jsonb ?| array['a', 'c']", []interface{}{doc, Raw()}},
+		{"select $1::jsonb ?& array['a', 'b']", []interface{}{doc, Raw()}},
+		{`select '{"a": 1}'::jsonb ? 'a'`, []interface{}{Raw()}},
+	} {
+		var found bool
+		if err := dbmap.SelectOne(&found, tt.query, tt.args...); err != nil || !found {
+			t.Errorf("Expected %q to find the keys, got %v %v", tt.query, found, err)
+		}
 	}
 }
+
+type sqlserverDialect struct {
+	SqliteDialect
+}
+
+func (d sqlserverDialect) DriverName() string {
+	return "sqlserver"
+}
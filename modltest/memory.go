@@ -0,0 +1,358 @@
+package modltest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jmoiron/modl"
+)
+
+// MemoryDriverName is the name of the database/sql driver of in-memory
+// databases, whose data source names name the databases.  The databases
+// live as long as the process, and are shared by all of the connections
+// opened with their name.
+const MemoryDriverName = "modlmem"
+
+func init() {
+	sql.Register(MemoryDriverName, memDriver{})
+	modl.RegisterDialect(MemoryDriverName, MemoryDialect{})
+}
+
+// MemoryDialect is the Dialect of in-memory databases, which are kept in
+// maps in the process, so that tests of code using modl can run without
+// cgo or a database server.  It writes the statements of SqliteDialect.
+//
+// In-memory databases run the statements modl generates for Insert, Get,
+// Update, Delete, Exists, CreateTables, DropTables and TruncateTables, and
+// queries like
+//
+//	select * from t where a = ? and (b is null or c in (?, ?)) order by d desc limit 10
+//
+// on a single table, with conditions comparing columns, literals and bind
+// parameters with =, <>, <, >, like, in, between and is null, combined with
+// and, or and not, and count(*), lower, upper and coalesce.  Joins, sub
+// queries, group by, returning and triggers are not supported, and
+// indexes are ignored, although primary keys, unique and not null columns
+// are enforced.  Transactions work on copies of the tables they write,
+// which replace the tables when they commit, so writes made to the same
+// tables outside of a transaction while it is open are lost.
+type MemoryDialect struct {
+	modl.SqliteDialect
+}
+
+// DriverName returns MemoryDriverName.
+func (d MemoryDialect) DriverName() string {
+	return MemoryDriverName
+}
+
+var memSeq int64
+
+// NewMemoryDbMap returns a DbMap of a new, empty in-memory database.  See
+// MemoryDialect.
+//
+//	dbmap := modltest.NewMemoryDbMap()
+//	dbmap.AddTable(Account{}).SetKeys(true, "ID")
+//	err := dbmap.CreateTables()
+func NewMemoryDbMap() *modl.DbMap {
+	name := fmt.Sprintf("modltest-%d", atomic.AddInt64(&memSeq, 1))
+	dbmap, err := modl.Open(MemoryDriverName, name)
+	if err != nil {
+		// the driver and dialect are registered by init
+		panic(err)
+	}
+	return dbmap
+}
+
+// memDatabases are the in-memory databases, by name.
+var memDatabases = struct {
+	sync.Mutex
+	m map[string]*memDB
+}{m: map[string]*memDB{}}
+
+type memDriver struct{}
+
+func (memDriver) Open(name string) (driver.Conn, error) {
+	memDatabases.Lock()
+	defer memDatabases.Unlock()
+	db, ok := memDatabases.m[name]
+	if !ok {
+		db = &memDB{tables: map[string]*memTable{}}
+		memDatabases.m[name] = db
+	}
+	return &memConn{db: db}, nil
+}
+
+// memDB is an in-memory database.  mu is held while each statement runs.
+type memDB struct {
+	mu     sync.Mutex
+	tables map[string]*memTable
+}
+
+// memConn is a connection to a memDB.
+type memConn struct {
+	db *memDB
+	tx *memTx
+}
+
+// memTx is a transaction, holding copies of the tables it has written, or
+// nil for those it has dropped, by name.
+type memTx struct {
+	conn       *memConn
+	tables     map[string]*memTable
+	savepoints []memSavepoint
+}
+
+type memSavepoint struct {
+	name   string
+	tables map[string]*memTable
+}
+
+func (c *memConn) Prepare(query string) (driver.Stmt, error) {
+	return &memStmt{conn: c, query: query}, nil
+}
+
+func (c *memConn) Close() error {
+	return nil
+}
+
+func (c *memConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *memConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, fmt.Errorf("modltest: a transaction is already open")
+	}
+	c.tx = &memTx{conn: c, tables: map[string]*memTable{}}
+	return c.tx, nil
+}
+
+func (c *memConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.run(query, namedValues(args))
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *memConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res, err := c.run(query, namedValues(args))
+	if err != nil {
+		return nil, err
+	}
+	return &memRows{columns: res.columns, rows: res.rows}, nil
+}
+
+// run runs the statements of query, with args bound to their parameters
+// in order, and returns the result of the last.
+func (c *memConn) run(query string, args []driver.Value) (*memResult, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	res := &memResult{}
+	p := &parser{conn: c, tokens: tokens, args: args}
+	for !p.done() {
+		if p.punct(";") {
+			continue
+		}
+		if res, err = p.statement(); err != nil {
+			return nil, err
+		}
+		if !p.done() && !p.punct(";") {
+			return nil, fmt.Errorf("modltest: unexpected %q in %s", p.peek().text, query)
+		}
+	}
+	return res, nil
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+// table returns the table named name, as the connection's transaction
+// sees it.
+func (c *memConn) table(name string) (*memTable, error) {
+	key := strings.ToLower(name)
+	t, ok := c.db.tables[key]
+	if c.tx != nil {
+		if tt, written := c.tx.tables[key]; written {
+			t, ok = tt, tt != nil
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("modltest: no such table: %s", name)
+	}
+	return t, nil
+}
+
+// writable returns the table named name to be written, which is a copy
+// of the table in a transaction.
+func (c *memConn) writable(name string) (*memTable, error) {
+	t, err := c.table(name)
+	if err != nil || c.tx == nil {
+		return t, err
+	}
+	key := strings.ToLower(name)
+	if _, written := c.tx.tables[key]; !written {
+		t = t.copy()
+		c.tx.tables[key] = t
+	}
+	return t, nil
+}
+
+// setTable adds t under name, or drops the table named name if t is nil.
+func (c *memConn) setTable(name string, t *memTable) {
+	key := strings.ToLower(name)
+	switch {
+	case c.tx != nil:
+		c.tx.tables[key] = t
+	case t == nil:
+		delete(c.db.tables, key)
+	default:
+		c.db.tables[key] = t
+	}
+}
+
+func (tx *memTx) Commit() error {
+	db := tx.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for key, t := range tx.tables {
+		if t == nil {
+			delete(db.tables, key)
+		} else {
+			db.tables[key] = t
+		}
+	}
+	tx.conn.tx = nil
+	return nil
+}
+
+func (tx *memTx) Rollback() error {
+	tx.conn.tx = nil
+	return nil
+}
+
+// savepoint, release and rollbackTo run the savepoint statements.
+func (tx *memTx) savepoint(name string) {
+	tx.savepoints = append(tx.savepoints, memSavepoint{name, copyTables(tx.tables)})
+}
+
+func (tx *memTx) find(name string) (int, error) {
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if strings.EqualFold(tx.savepoints[i].name, name) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("modltest: no such savepoint: %s", name)
+}
+
+func (tx *memTx) release(name string) error {
+	i, err := tx.find(name)
+	if err == nil {
+		tx.savepoints = tx.savepoints[:i]
+	}
+	return err
+}
+
+func (tx *memTx) rollbackTo(name string) error {
+	i, err := tx.find(name)
+	if err == nil {
+		tx.tables = copyTables(tx.savepoints[i].tables)
+		tx.savepoints = tx.savepoints[:i+1]
+	}
+	return err
+}
+
+func copyTables(tables map[string]*memTable) map[string]*memTable {
+	c := make(map[string]*memTable, len(tables))
+	for key, t := range tables {
+		if t != nil {
+			t = t.copy()
+		}
+		c[key] = t
+	}
+	return c
+}
+
+type memStmt struct {
+	conn  *memConn
+	query string
+}
+
+func (s *memStmt) Close() error {
+	return nil
+}
+
+func (s *memStmt) NumInput() int {
+	return -1
+}
+
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.run(s.query, args)
+}
+
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	res, err := s.conn.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &memRows{columns: res.columns, rows: res.rows}, nil
+}
+
+// memResult is the result of a statement.
+type memResult struct {
+	columns      []string
+	rows         [][]driver.Value
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (r *memResult) LastInsertId() (int64, error) {
+	return r.lastInsertID, nil
+}
+
+func (r *memResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+type memRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *memRows) Columns() []string {
+	return r.columns
+}
+
+func (r *memRows) Close() error {
+	r.rows = nil
+	return nil
+}
+
+func (r *memRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, v := range r.rows[0] {
+		if b, ok := v.([]byte); ok {
+			v = append([]byte{}, b...)
+		}
+		dest[i] = v
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
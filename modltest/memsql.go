@@ -0,0 +1,1552 @@
+package modltest
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memTable is a table of an in-memory database.
+type memTable struct {
+	name    string
+	columns []memColumn
+	// unique are the sets of columns whose values no two rows share
+	unique [][]int
+	// seq is the last value of the auto-increment column
+	seq  int64
+	rows [][]driver.Value
+}
+
+type memColumn struct {
+	name     string
+	notNull  bool
+	autoIncr bool
+	// dflt is the value of the column when an insert leaves it out
+	dflt expr
+}
+
+func (t *memTable) copy() *memTable {
+	c := *t
+	c.rows = make([][]driver.Value, len(t.rows))
+	for i, row := range t.rows {
+		c.rows[i] = append([]driver.Value{}, row...)
+	}
+	return &c
+}
+
+// column returns the index of the column named name, or -1.
+func (t *memTable) column(name string) int {
+	for i, col := range t.columns {
+		if strings.EqualFold(col.name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// check returns an error if row, which replaces the row at index skip, or
+// is added if it is -1, violates the table's constraints.
+func (t *memTable) check(row []driver.Value, skip int) error {
+	for i, col := range t.columns {
+		if col.notNull && row[i] == nil {
+			return fmt.Errorf("modltest: NOT NULL constraint failed: %s.%s", t.name, col.name)
+		}
+	}
+	for _, cols := range t.unique {
+		for r, other := range t.rows {
+			if r == skip {
+				continue
+			}
+			same := true
+			for _, c := range cols {
+				if n, ok := compare(row[c], other[c]); !ok || n != 0 {
+					same = false
+					break
+				}
+			}
+			if same {
+				names := make([]string, len(cols))
+				for i, c := range cols {
+					names[i] = t.name + "." + t.columns[c].name
+				}
+				return fmt.Errorf("modltest: UNIQUE constraint failed: %s", strings.Join(names, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokQuoted
+	tokString
+	tokNumber
+	tokParam
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// tokenize splits query into tokens, leaving out comments.
+func tokenize(query string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			i += end
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("modltest: unterminated comment")
+			}
+			i += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(query); j++ {
+				if query[j] == c {
+					if j+1 < len(query) && query[j+1] == c {
+						j++
+					} else {
+						break
+					}
+				}
+				b.WriteByte(query[j])
+			}
+			if j == len(query) {
+				return nil, fmt.Errorf("modltest: unterminated %c", c)
+			}
+			kind := tokQuoted
+			if c == '\'' {
+				kind = tokString
+			}
+			tokens = append(tokens, token{kind, b.String()})
+			i = j + 1
+		case isWordStart(c):
+			j := i + 1
+			for j < len(query) && (isWordStart(query[j]) || isDigit(query[j])) {
+				j++
+			}
+			tokens = append(tokens, token{tokWord, query[i:j]})
+			i = j
+		case isDigit(c) || c == '.' && i+1 < len(query) && isDigit(query[i+1]):
+			j := i
+			for j < len(query) && (isDigit(query[j]) || query[j] == '.') {
+				j++
+			}
+			if j < len(query) && (query[j] == 'e' || query[j] == 'E') {
+				j++
+				if j < len(query) && (query[j] == '+' || query[j] == '-') {
+					j++
+				}
+				for j < len(query) && isDigit(query[j]) {
+					j++
+				}
+			}
+			tokens = append(tokens, token{tokNumber, query[i:j]})
+			i = j
+		case c == '?':
+			tokens = append(tokens, token{tokParam, ""})
+			i++
+		case c == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			j := i + 1
+			for j < len(query) && isDigit(query[j]) {
+				j++
+			}
+			tokens = append(tokens, token{tokParam, query[i+1 : j]})
+			i = j
+		default:
+			n := 1
+			for _, op := range []string{"<=", ">=", "<>", "!=", "||"} {
+				if strings.HasPrefix(query[i:], op) {
+					n = 2
+				}
+			}
+			if n == 1 && !strings.ContainsRune("(),;=<>*.+-/", rune(c)) {
+				return nil, fmt.Errorf("modltest: unexpected %q", c)
+			}
+			tokens = append(tokens, token{tokPunct, query[i : i+n]})
+			i += n
+		}
+	}
+	return tokens, nil
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parser runs the statements of a query on conn as it parses them.
+type parser struct {
+	conn   *memConn
+	tokens []token
+	pos    int
+	args   []driver.Value
+	// param is the index of the next "?" parameter
+	param int
+	// table is the table column names are resolved in
+	table *memTable
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{tokPunct, "end of statement"}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// isKeyword returns true if the token at offset i from the current one is
+// the keyword word.
+func (p *parser) isKeyword(i int, word string) bool {
+	return p.pos+i < len(p.tokens) && p.tokens[p.pos+i].kind == tokWord && strings.EqualFold(p.tokens[p.pos+i].text, word)
+}
+
+// keyword consumes the keywords words and returns true if they follow.
+func (p *parser) keyword(words ...string) bool {
+	for i, w := range words {
+		if !p.isKeyword(i, w) {
+			return false
+		}
+	}
+	p.pos += len(words)
+	return true
+}
+
+func (p *parser) expectKeyword(words ...string) error {
+	if !p.keyword(words...) {
+		return p.unexpected(strings.Join(words, " "))
+	}
+	return nil
+}
+
+func (p *parser) punct(s string) bool {
+	if t := p.peek(); t.kind == tokPunct && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectPunct(s string) error {
+	if !p.punct(s) {
+		return p.unexpected(s)
+	}
+	return nil
+}
+
+func (p *parser) unexpected(expected string) error {
+	return fmt.Errorf("modltest: expected %s, got %q", expected, p.peek().text)
+}
+
+// name parses a name, which may be qualified, and returns its parts.
+func (p *parser) name() ([]string, error) {
+	var parts []string
+	for {
+		t := p.next()
+		if t.kind != tokWord && t.kind != tokQuoted {
+			p.pos--
+			return nil, p.unexpected("a name")
+		}
+		parts = append(parts, t.text)
+		if !(p.peek().text == "." && p.peek().kind == tokPunct) {
+			return parts, nil
+		}
+		p.pos++
+	}
+}
+
+// tableName parses the name of a table.
+func (p *parser) tableName() (string, error) {
+	parts, err := p.name()
+	return strings.Join(parts, "."), err
+}
+
+// skipTo moves to the next of the tokens stop outside of parentheses, or
+// to the end of the statement.
+func (p *parser) skipTo(stop ...string) {
+	depth := 0
+	for ; !p.done(); p.pos++ {
+		t := p.peek()
+		switch {
+		case t.kind == tokPunct && t.text == "(":
+			depth++
+		case t.kind == tokPunct && t.text == ")":
+			if depth == 0 {
+				return
+			}
+			depth--
+		case t.kind == tokPunct && t.text == ";" && depth == 0:
+			return
+		case depth == 0:
+			for _, s := range stop {
+				if t.kind != tokQuoted && t.kind != tokString && strings.EqualFold(t.text, s) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// statement runs the next statement.
+func (p *parser) statement() (*memResult, error) {
+	p.table = nil
+	switch {
+	case p.keyword("create"):
+		return p.create()
+	case p.keyword("drop", "table"):
+		return p.drop()
+	case p.keyword("insert", "into"):
+		return p.insert()
+	case p.keyword("select"):
+		return p.selects()
+	case p.keyword("update"):
+		return p.update()
+	case p.keyword("delete", "from"):
+		return p.delete()
+	case p.keyword("savepoint"):
+		return p.savepoint("savepoint")
+	case p.keyword("release"):
+		p.keyword("savepoint")
+		return p.savepoint("release")
+	case p.keyword("rollback", "to"):
+		p.keyword("savepoint")
+		return p.savepoint("rollback")
+	}
+	return nil, fmt.Errorf("modltest: unsupported statement starting with %q", p.peek().text)
+}
+
+func (p *parser) savepoint(op string) (*memResult, error) {
+	name, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	tx := p.conn.tx
+	if tx == nil {
+		return nil, fmt.Errorf("modltest: %s outside of a transaction", op)
+	}
+	switch op {
+	case "savepoint":
+		tx.savepoint(name)
+	case "release":
+		err = tx.release(name)
+	default:
+		err = tx.rollbackTo(name)
+	}
+	return &memResult{}, err
+}
+
+func (p *parser) create() (*memResult, error) {
+	if p.keyword("unique") || p.isKeyword(0, "index") {
+		// indexes are not kept
+		p.skipTo(";")
+		return &memResult{}, nil
+	}
+	if err := p.expectKeyword("table"); err != nil {
+		return nil, err
+	}
+	ifNotExists := p.keyword("if", "not", "exists")
+	name, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.conn.table(name); err == nil {
+		if ifNotExists {
+			p.skipTo(";")
+			return &memResult{}, nil
+		}
+		return nil, fmt.Errorf("modltest: table %s already exists", name)
+	}
+
+	t := &memTable{name: name}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var keys []int
+	for {
+		if p.keyword("primary", "key") || p.keyword("constraint") && p.skipName() && p.keyword("primary", "key") {
+			cols, err := p.columnList(t)
+			if err != nil {
+				return nil, err
+			}
+			keys = cols
+		} else if p.keyword("unique") {
+			cols, err := p.columnList(t)
+			if err != nil {
+				return nil, err
+			}
+			t.unique = append(t.unique, cols)
+		} else if p.isKeyword(0, "foreign") || p.isKeyword(0, "check") || p.isKeyword(0, "constraint") {
+			p.skipTo(",")
+		} else if err := p.columnDef(t, &keys); err != nil {
+			return nil, err
+		}
+		if !p.punct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	// table options, eg. "without rowid", are ignored
+	p.skipTo(";")
+	if len(keys) > 0 {
+		t.unique = append([][]int{keys}, t.unique...)
+	}
+	p.conn.setTable(name, t)
+	return &memResult{}, nil
+}
+
+// skipName skips a name and returns true.
+func (p *parser) skipName() bool {
+	p.name()
+	return true
+}
+
+// columnList parses a parenthesized list of the columns of t.
+func (p *parser) columnList(t *memTable) ([]int, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var cols []int
+	for {
+		parts, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		name := parts[len(parts)-1]
+		c := t.column(name)
+		if c < 0 {
+			return nil, fmt.Errorf("modltest: no such column: %s", name)
+		}
+		cols = append(cols, c)
+		p.keyword("asc")
+		p.keyword("desc")
+		if !p.punct(",") {
+			break
+		}
+	}
+	return cols, p.expectPunct(")")
+}
+
+// columnDef parses the definition of a column of t, adding its index to
+// keys if it is a primary key.
+func (p *parser) columnDef(t *memTable, keys *[]int) error {
+	parts, err := p.name()
+	if err != nil {
+		return err
+	}
+	col := memColumn{name: parts[0]}
+	index := len(t.columns)
+	integer := p.isKeyword(0, "integer")
+	for !p.done() {
+		switch {
+		case p.peek().text == "," && p.peek().kind == tokPunct, p.peek().text == ")" && p.peek().kind == tokPunct:
+			t.columns = append(t.columns, col)
+			return nil
+		case p.keyword("primary", "key"):
+			*keys = []int{index}
+			// sqlite's "integer primary key" is an alias for the rowid
+			col.autoIncr = col.autoIncr || integer
+		case p.keyword("autoincrement"), p.keyword("auto_increment"):
+			col.autoIncr = true
+		case p.keyword("not", "null"):
+			col.notNull = true
+		case p.keyword("unique"):
+			t.unique = append(t.unique, []int{index})
+		case p.keyword("default"):
+			e, err := p.operand()
+			if err != nil {
+				return err
+			}
+			col.dflt = e
+		case p.punct("("):
+			// the size of a type, or an expression
+			p.skipTo()
+			if err := p.expectPunct(")"); err != nil {
+				return err
+			}
+		default:
+			p.next()
+		}
+	}
+	return p.unexpected(")")
+}
+
+func (p *parser) drop() (*memResult, error) {
+	ifExists := p.keyword("if", "exists")
+	name, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	p.skipTo(";")
+	if _, err := p.conn.table(name); err != nil {
+		if ifExists {
+			return &memResult{}, nil
+		}
+		return nil, err
+	}
+	p.conn.setTable(name, nil)
+	return &memResult{}, nil
+}
+
+func (p *parser) insert() (*memResult, error) {
+	name, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	t, err := p.conn.writable(name)
+	if err != nil {
+		return nil, err
+	}
+	// a single row of defaults is inserted for "default values"
+	var cols []int
+	defaults := p.keyword("default", "values")
+	if !defaults {
+		if p.peek().text == "(" && p.peek().kind == tokPunct {
+			if cols, err = p.columnList(t); err != nil {
+				return nil, err
+			}
+		} else {
+			for i := range t.columns {
+				cols = append(cols, i)
+			}
+		}
+		if err := p.expectKeyword("values"); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &memResult{}
+	for {
+		var values []expr
+		if !defaults {
+			if values, err = p.exprList(); err != nil {
+				return nil, err
+			}
+		}
+		if len(values) != len(cols) {
+			return nil, fmt.Errorf("modltest: %d values for %d columns", len(values), len(cols))
+		}
+		row := make([]driver.Value, len(t.columns))
+		given := make([]bool, len(t.columns))
+		for i, e := range values {
+			v, err := e(nil)
+			if err != nil {
+				return nil, err
+			}
+			row[cols[i]], given[cols[i]] = storable(v), true
+		}
+		for i, col := range t.columns {
+			switch {
+			case col.autoIncr && row[i] == nil:
+				t.seq++
+				row[i] = t.seq
+				res.lastInsertID = t.seq
+			case col.autoIncr:
+				if n, ok := row[i].(int64); ok && n > t.seq {
+					t.seq = n
+				}
+				if n, ok := row[i].(int64); ok {
+					res.lastInsertID = n
+				}
+			case !given[i] && col.dflt != nil:
+				if row[i], err = col.dflt(nil); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := t.check(row, -1); err != nil {
+			return nil, err
+		}
+		t.rows = append(t.rows, row)
+		res.rowsAffected++
+		if defaults || !p.punct(",") {
+			break
+		}
+	}
+	if p.isKeyword(0, "returning") {
+		return nil, fmt.Errorf("modltest: returning is not supported")
+	}
+	return res, nil
+}
+
+// storable returns a copy of v, if it is a []byte.
+func storable(v driver.Value) driver.Value {
+	if b, ok := v.([]byte); ok {
+		return append([]byte{}, b...)
+	}
+	return v
+}
+
+// exprList parses a parenthesized list of expressions.
+func (p *parser) exprList() ([]expr, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var list []expr
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+		if !p.punct(",") {
+			break
+		}
+	}
+	return list, p.expectPunct(")")
+}
+
+// from parses the table name and alias of a select or delete, and sets it
+// as the table columns are resolved in.
+func (p *parser) from(writable bool) (*memTable, error) {
+	name, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	var t *memTable
+	if writable {
+		t, err = p.conn.writable(name)
+	} else {
+		t, err = p.conn.table(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.keyword("as")
+	if t := p.peek(); t.kind == tokQuoted || t.kind == tokWord && !isClause(t.text) {
+		p.next()
+	}
+	p.table = t
+	return t, nil
+}
+
+// isClause returns true if word begins a clause of a statement.
+func isClause(word string) bool {
+	switch strings.ToLower(word) {
+	case "where", "order", "limit", "offset", "group", "having", "join", "inner", "left", "set", "returning", "for":
+		return true
+	}
+	return false
+}
+
+// where parses an optional where clause, and returns the indexes of the
+// rows of t it matches.
+func (p *parser) where(t *memTable) ([]int, error) {
+	cond := expr(func([]driver.Value) (driver.Value, error) { return true, nil })
+	if p.keyword("where") {
+		var err error
+		if cond, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	var matched []int
+	for i, row := range t.rows {
+		v, err := cond(row)
+		if err != nil {
+			return nil, err
+		}
+		if truth(v) {
+			matched = append(matched, i)
+		}
+	}
+	return matched, nil
+}
+
+// selectItem is a column of the results of a select.
+type selectItem struct {
+	name  string
+	e     expr
+	star  bool
+	count bool
+}
+
+func (p *parser) selects() (*memResult, error) {
+	p.keyword("all")
+	// the columns are parsed once the table they name is known
+	start := p.pos
+	p.skipTo("from")
+	from := p.pos
+	var t *memTable
+	var rows []int
+	if p.keyword("from") {
+		var err error
+		if t, err = p.from(false); err != nil {
+			return nil, err
+		}
+	} else {
+		t = &memTable{rows: [][]driver.Value{nil}}
+		p.table = t
+	}
+	end := p.pos
+	p.pos = start
+	items, err := p.selectItems(t)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != from {
+		return nil, p.unexpected("from")
+	}
+	p.pos = end
+	if rows, err = p.where(t); err != nil {
+		return nil, err
+	}
+	if p.isKeyword(0, "group") || p.isKeyword(0, "join") || p.isKeyword(0, "inner") || p.isKeyword(0, "left") {
+		return nil, fmt.Errorf("modltest: %s is not supported", p.peek().text)
+	}
+	if err := p.orderBy(t, rows); err != nil {
+		return nil, err
+	}
+	if rows, err = p.limit(rows); err != nil {
+		return nil, err
+	}
+	// rows are not locked
+	p.keyword("for", "update")
+
+	res := &memResult{}
+	for _, item := range items {
+		if !item.star {
+			res.columns = append(res.columns, item.name)
+			continue
+		}
+		for _, col := range t.columns {
+			res.columns = append(res.columns, col.name)
+		}
+	}
+	if len(items) > 0 && items[0].count {
+		res.rows = [][]driver.Value{{int64(len(rows))}}
+		return res, nil
+	}
+	for _, r := range rows {
+		row := t.rows[r]
+		var out []driver.Value
+		for _, item := range items {
+			if item.star {
+				out = append(out, row...)
+				continue
+			}
+			v, err := item.e(row)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		res.rows = append(res.rows, out)
+	}
+	return res, nil
+}
+
+func (p *parser) selectItems(t *memTable) ([]selectItem, error) {
+	var items []selectItem
+	for {
+		start := p.pos
+		var item selectItem
+		switch {
+		case p.punct("*"):
+			item.star = true
+		case (p.peek().kind == tokWord || p.peek().kind == tokQuoted) && p.isPunctAt(1, ".") && p.isPunctAt(2, "*"):
+			p.pos += 3
+			item.star = true
+		case p.isKeyword(0, "count") && p.isPunctAt(1, "(") && p.isPunctAt(2, "*") && p.isPunctAt(3, ")"):
+			p.pos += 4
+			item.count, item.name = true, "count(*)"
+		default:
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			item.e = e
+			// columns are named by their column, or the text of their
+			// expression
+			if p.pos-start == 1 && p.tokens[start].kind != tokString {
+				item.name = p.tokens[start].text
+			} else if p.pos-start == 3 && p.isPunctAt(start-p.pos+1, ".") {
+				item.name = p.tokens[start+2].text
+			} else {
+				for _, tok := range p.tokens[start:p.pos] {
+					item.name += tok.text
+				}
+			}
+		}
+		if p.keyword("as") || p.peek().kind == tokQuoted || p.peek().kind == tokWord && !strings.EqualFold(p.peek().text, "from") {
+			parts, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			item.name = parts[0]
+		}
+		items = append(items, item)
+		if !p.punct(",") {
+			return items, nil
+		}
+	}
+}
+
+// isPunctAt returns true if the token at offset i is the punctuation s.
+func (p *parser) isPunctAt(i int, s string) bool {
+	j := p.pos + i
+	return j >= 0 && j < len(p.tokens) && p.tokens[j].kind == tokPunct && p.tokens[j].text == s
+}
+
+// orderBy parses an optional order by clause, and sorts rows, indexes of
+// the rows of t, by it.
+func (p *parser) orderBy(t *memTable, rows []int) error {
+	if !p.keyword("order", "by") {
+		return nil
+	}
+	type term struct {
+		e    expr
+		desc bool
+	}
+	var terms []term
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return err
+		}
+		desc := p.keyword("desc")
+		if !desc {
+			p.keyword("asc")
+		}
+		terms = append(terms, term{e, desc})
+		if !p.punct(",") {
+			break
+		}
+	}
+	var err error
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, term := range terms {
+			a, aerr := term.e(t.rows[rows[i]])
+			b, berr := term.e(t.rows[rows[j]])
+			if aerr != nil || berr != nil {
+				if err == nil {
+					err = aerr
+					if err == nil {
+						err = berr
+					}
+				}
+				return false
+			}
+			n := order(a, b)
+			if n == 0 {
+				continue
+			}
+			return n < 0 != term.desc
+		}
+		return false
+	})
+	return err
+}
+
+// limit parses optional limit and offset clauses, and returns the rows
+// they select.
+func (p *parser) limit(rows []int) ([]int, error) {
+	count := int64(-1)
+	var offset int64
+	intValue := func() (int64, error) {
+		e, err := p.operand()
+		if err != nil {
+			return 0, err
+		}
+		v, err := e(nil)
+		if err != nil {
+			return 0, err
+		}
+		n, ok := number(v)
+		if !ok {
+			return 0, fmt.Errorf("modltest: limit and offset must be numbers, got %v", v)
+		}
+		return int64(n), nil
+	}
+	var err error
+	if p.keyword("limit") {
+		if count, err = intValue(); err != nil {
+			return nil, err
+		}
+		if p.punct(",") {
+			// mysql's "limit offset, count"
+			offset = count
+			if count, err = intValue(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.keyword("offset") {
+		if offset, err = intValue(); err != nil {
+			return nil, err
+		}
+	}
+	if offset > int64(len(rows)) {
+		offset = int64(len(rows))
+	}
+	rows = rows[offset:]
+	if count >= 0 && count < int64(len(rows)) {
+		rows = rows[:count]
+	}
+	return rows, nil
+}
+
+func (p *parser) update() (*memResult, error) {
+	name, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	t, err := p.conn.writable(name)
+	if err != nil {
+		return nil, err
+	}
+	p.table = t
+	if err := p.expectKeyword("set"); err != nil {
+		return nil, err
+	}
+	type assignment struct {
+		col int
+		e   expr
+	}
+	var set []assignment
+	for {
+		parts, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		c := t.column(parts[len(parts)-1])
+		if c < 0 {
+			return nil, fmt.Errorf("modltest: no such column: %s", parts[len(parts)-1])
+		}
+		if err := p.expectPunct("="); err != nil {
+			return nil, err
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, assignment{c, e})
+		if !p.punct(",") {
+			break
+		}
+	}
+	rows, err := p.where(t)
+	if err != nil {
+		return nil, err
+	}
+	if p.isKeyword(0, "returning") {
+		return nil, fmt.Errorf("modltest: returning is not supported")
+	}
+	for _, r := range rows {
+		row := append([]driver.Value{}, t.rows[r]...)
+		for _, a := range set {
+			v, err := a.e(t.rows[r])
+			if err != nil {
+				return nil, err
+			}
+			row[a.col] = storable(v)
+		}
+		if err := t.check(row, r); err != nil {
+			return nil, err
+		}
+		t.rows[r] = row
+	}
+	return &memResult{rowsAffected: int64(len(rows))}, nil
+}
+
+func (p *parser) delete() (*memResult, error) {
+	if p.isKeyword(0, "sqlite_sequence") {
+		return p.deleteSequence()
+	}
+	t, err := p.from(true)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := p.where(t)
+	if err != nil {
+		return nil, err
+	}
+	if p.isKeyword(0, "returning") {
+		return nil, fmt.Errorf("modltest: returning is not supported")
+	}
+	deleted := map[int]bool{}
+	for _, r := range rows {
+		deleted[r] = true
+	}
+	kept := t.rows[:0]
+	for i, row := range t.rows {
+		if !deleted[i] {
+			kept = append(kept, row)
+		}
+	}
+	t.rows = kept
+	return &memResult{rowsAffected: int64(len(rows))}, nil
+}
+
+// deleteSequence restarts the auto-increment columns of the tables whose
+// rows of sqlite_sequence it deletes, as TruncateTables does.
+func (p *parser) deleteSequence() (*memResult, error) {
+	p.next()
+	seq := &memTable{columns: []memColumn{{name: "name"}, {name: "seq"}}}
+	var names []string
+	for key, t := range p.conn.db.tables {
+		if _, err := p.conn.table(key); err == nil {
+			names = append(names, t.name)
+		}
+	}
+	if tx := p.conn.tx; tx != nil {
+		for key, t := range tx.tables {
+			if _, ok := p.conn.db.tables[key]; !ok && t != nil {
+				names = append(names, t.name)
+			}
+		}
+	}
+	for _, name := range names {
+		seq.rows = append(seq.rows, []driver.Value{name, nil})
+	}
+	p.table = seq
+	rows, err := p.where(seq)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		t, err := p.conn.writable(names[r])
+		if err != nil {
+			return nil, err
+		}
+		t.seq = 0
+	}
+	return &memResult{rowsAffected: int64(len(rows))}, nil
+}
+
+// expr is a compiled expression, evaluated on a row of the table of its
+// statement.  Conditions are true, false or nil, for unknown.
+type expr func(row []driver.Value) (driver.Value, error)
+
+func (p *parser) expr() (expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, true)
+	}
+	return left, nil
+}
+
+func (p *parser) and() (expr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, false)
+	}
+	return left, nil
+}
+
+// logical returns the or of left and right if or is true, and their and
+// otherwise, with SQL's handling of unknown values.
+func logical(left, right expr, or bool) expr {
+	return func(row []driver.Value) (driver.Value, error) {
+		a, err := left(row)
+		if err != nil {
+			return nil, err
+		}
+		if a != nil && truth(a) == or {
+			return or, nil
+		}
+		b, err := right(row)
+		if err != nil {
+			return nil, err
+		}
+		if b != nil && truth(b) == or {
+			return or, nil
+		}
+		if a == nil || b == nil {
+			return nil, nil
+		}
+		return !or, nil
+	}
+}
+
+func (p *parser) not() (expr, error) {
+	if !p.keyword("not") {
+		return p.comparison()
+	}
+	e, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	return negate(e), nil
+}
+
+func negate(e expr) expr {
+	return func(row []driver.Value) (driver.Value, error) {
+		v, err := e(row)
+		if v == nil || err != nil {
+			return nil, err
+		}
+		return !truth(v), nil
+	}
+}
+
+func (p *parser) comparison() (expr, error) {
+	left, err := p.concat()
+	if err != nil {
+		return nil, err
+	}
+	if p.keyword("is") {
+		not := p.keyword("not")
+		if err := p.expectKeyword("null"); err != nil {
+			return nil, err
+		}
+		return func(row []driver.Value) (driver.Value, error) {
+			v, err := left(row)
+			return (v == nil) != not, err
+		}, nil
+	}
+	not := p.keyword("not")
+	var e expr
+	switch t := p.peek(); {
+	case p.keyword("in"):
+		list, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		e = in(left, list)
+	case p.keyword("like"):
+		right, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		e = like(left, right)
+	case p.keyword("between"):
+		low, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("and"); err != nil {
+			return nil, err
+		}
+		high, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		e = logical(compareWith(left, low, ">="), compareWith(left, high, "<="), false)
+	case not:
+		return nil, p.unexpected("in, like or between")
+	case t.kind == tokPunct && (t.text == "=" || t.text == "<>" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+		p.next()
+		right, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		return compareWith(left, right, t.text), nil
+	default:
+		return left, nil
+	}
+	if not {
+		e = negate(e)
+	}
+	return e, nil
+}
+
+// compareWith returns an expression comparing left and right with op.
+func compareWith(left, right expr, op string) expr {
+	return func(row []driver.Value) (driver.Value, error) {
+		a, err := left(row)
+		if err != nil {
+			return nil, err
+		}
+		b, err := right(row)
+		if err != nil {
+			return nil, err
+		}
+		n, ok := compare(a, b)
+		if !ok {
+			return nil, nil
+		}
+		switch op {
+		case "=":
+			return n == 0, nil
+		case "<>", "!=":
+			return n != 0, nil
+		case "<":
+			return n < 0, nil
+		case "<=":
+			return n <= 0, nil
+		case ">":
+			return n > 0, nil
+		}
+		return n >= 0, nil
+	}
+}
+
+func in(left expr, list []expr) expr {
+	return func(row []driver.Value) (driver.Value, error) {
+		a, err := left(row)
+		if a == nil || err != nil {
+			return nil, err
+		}
+		var result driver.Value = false
+		for _, e := range list {
+			b, err := e(row)
+			if err != nil {
+				return nil, err
+			}
+			n, ok := compare(a, b)
+			if !ok {
+				result = nil
+			} else if n == 0 {
+				return true, nil
+			}
+		}
+		return result, nil
+	}
+}
+
+// like matches the text of left with the pattern right, in which % matches
+// any text and _ any character, ignoring case like sqlite.
+func like(left, right expr) expr {
+	return func(row []driver.Value) (driver.Value, error) {
+		a, err := left(row)
+		if a == nil || err != nil {
+			return nil, err
+		}
+		b, err := right(row)
+		if b == nil || err != nil {
+			return nil, err
+		}
+		var re bytes.Buffer
+		re.WriteString("(?is)^")
+		for _, r := range text(b) {
+			switch r {
+			case '%':
+				re.WriteString(".*")
+			case '_':
+				re.WriteString(".")
+			default:
+				re.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		re.WriteString("$")
+		return regexp.MustCompile(re.String()).MatchString(text(a)), nil
+	}
+}
+
+// concat parses operands joined by ||, + or -.
+func (p *parser) concat() (expr, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokPunct || t.text != "||" && t.text != "+" && t.text != "-" {
+			return left, nil
+		}
+		p.next()
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		left = arithmetic(left, right, t.text)
+	}
+}
+
+func arithmetic(left, right expr, op string) expr {
+	return func(row []driver.Value) (driver.Value, error) {
+		a, err := left(row)
+		if a == nil || err != nil {
+			return nil, err
+		}
+		b, err := right(row)
+		if b == nil || err != nil {
+			return nil, err
+		}
+		if op == "||" {
+			return text(a) + text(b), nil
+		}
+		x, xok := a.(int64)
+		y, yok := b.(int64)
+		if xok && yok {
+			if op == "-" {
+				y = -y
+			}
+			return x + y, nil
+		}
+		f, fok := number(a)
+		g, gok := number(b)
+		if !fok || !gok {
+			return nil, fmt.Errorf("modltest: cannot compute %v %s %v", a, op, b)
+		}
+		if op == "-" {
+			g = -g
+		}
+		return f + g, nil
+	}
+}
+
+// operand parses a literal, parameter, column, function call or
+// parenthesized expression.
+func (p *parser) operand() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return constant(t.text), nil
+	case tokNumber:
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return constant(n), nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("modltest: bad number %s", t.text)
+		}
+		return constant(f), nil
+	case tokParam:
+		i := p.param
+		if len(t.text) > 0 {
+			n, _ := strconv.Atoi(t.text)
+			i = n - 1
+		} else {
+			p.param++
+		}
+		if i < 0 || i >= len(p.args) {
+			return nil, fmt.Errorf("modltest: no value for parameter %d", i+1)
+		}
+		return constant(p.args[i]), nil
+	case tokPunct:
+		switch t.text {
+		case "(":
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expectPunct(")")
+		case "-":
+			e, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			return arithmetic(constant(int64(0)), e, "-"), nil
+		}
+	case tokWord:
+		switch strings.ToLower(t.text) {
+		case "null":
+			return constant(nil), nil
+		case "true":
+			return constant(true), nil
+		case "false":
+			return constant(false), nil
+		case "current_timestamp":
+			return func([]driver.Value) (driver.Value, error) { return time.Now().UTC(), nil }, nil
+		}
+		if p.isPunctAt(0, "(") {
+			return p.call(t.text)
+		}
+	}
+	if t.kind != tokWord && t.kind != tokQuoted {
+		p.pos--
+		return nil, p.unexpected("a value")
+	}
+	p.pos--
+	parts, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	name := parts[len(parts)-1]
+	if p.table == nil || p.table.column(name) < 0 {
+		return nil, fmt.Errorf("modltest: no such column: %s", name)
+	}
+	c := p.table.column(name)
+	return func(row []driver.Value) (driver.Value, error) {
+		if row == nil {
+			return nil, fmt.Errorf("modltest: column %s has no value here", name)
+		}
+		return row[c], nil
+	}, nil
+}
+
+// call parses the arguments of a call of the function fn.
+func (p *parser) call(fn string) (expr, error) {
+	args, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(fn) {
+	case "lower", "upper":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("modltest: %s takes 1 argument", fn)
+		}
+		conv := strings.ToLower
+		if strings.EqualFold(fn, "upper") {
+			conv = strings.ToUpper
+		}
+		return func(row []driver.Value) (driver.Value, error) {
+			v, err := args[0](row)
+			if v == nil || err != nil {
+				return nil, err
+			}
+			return conv(text(v)), nil
+		}, nil
+	case "coalesce":
+		return func(row []driver.Value) (driver.Value, error) {
+			for _, e := range args {
+				v, err := e(row)
+				if v != nil || err != nil {
+					return v, err
+				}
+			}
+			return nil, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("modltest: function %s is not supported", fn)
+}
+
+func constant(v driver.Value) expr {
+	return func([]driver.Value) (driver.Value, error) {
+		return v, nil
+	}
+}
+
+// truth returns whether v is true.
+func truth(v driver.Value) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	case nil:
+		return false
+	}
+	n, ok := number(v)
+	return ok && n != 0
+}
+
+// number returns v as a number, if it is one.
+func number(v driver.Value) (float64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(x, 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(x), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// text returns the text of v.
+func text(v driver.Value) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// compare returns the order of a and b, and false if either is NULL.
+// Numbers are compared as numbers, with text which is a number, times as
+// times, and other values as text.
+func compare(a, b driver.Value) (int, bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			return cmpInt(x, y), true
+		}
+	}
+	if x, ok := a.(time.Time); ok {
+		if y, ok := b.(time.Time); ok {
+			return cmpInt(x.UnixNano(), y.UnixNano()), true
+		}
+	}
+	_, aText := a.(string)
+	_, bText := b.(string)
+	if !aText || !bText {
+		if x, ok := number(a); ok {
+			if y, ok := number(b); ok {
+				switch {
+				case x < y:
+					return -1, true
+				case x > y:
+					return 1, true
+				}
+				return 0, true
+			}
+		}
+	}
+	return strings.Compare(text(a), text(b)), true
+}
+
+func cmpInt(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// order returns the order of a and b for order by, in which NULLs come
+// first.
+func order(a, b driver.Value) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	n, _ := compare(a, b)
+	return n
+}
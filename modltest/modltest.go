@@ -0,0 +1,38 @@
+// Package modltest helps test code which uses modl against a real
+// database, without having to clean up after each test, or against an
+// in-memory database, without a database at all.  See NewMemoryDbMap.
+package modltest
+
+import (
+	"github.com/jmoiron/modl"
+)
+
+// WrapInRollback runs fn in a transaction on dbmap which is always rolled
+// back, so that whatever fn writes is undone when it returns:
+//
+//	func TestCreateAccount(t *testing.T) {
+//		modltest.WrapInRollback(dbmap, func(exec modl.SqlExecutor) {
+//			if err := CreateAccount(exec, "bob"); err != nil {
+//				t.Fatal(err)
+//			}
+//		})
+//	}
+//
+// exec is a *modl.Transaction.  Code which begins its own transactions
+// with modl.Begin(exec) gets transactions nested in it with savepoints,
+// whose commits are rolled back along with the rest.  The transaction is
+// rolled back even if fn panics, or calls t.Fatal.  WrapInRollback returns
+// an error if the transaction could not be begun or rolled back.
+func WrapInRollback(dbmap *modl.DbMap, fn func(exec modl.SqlExecutor)) (err error) {
+	tx, err := dbmap.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := tx.Rollback(); err == nil {
+			err = rerr
+		}
+	}()
+	fn(tx)
+	return nil
+}
@@ -0,0 +1,179 @@
+package modltest
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/modl"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type Account struct {
+	ID   int64
+	Name string
+}
+
+func newDbMap(t *testing.T) *modl.DbMap {
+	var dialect modl.Dialect
+	var driver string
+	switch os.Getenv("MODL_TEST_DIALECT") {
+	case "mysql":
+		dialect, driver = modl.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}, "mysql"
+	case "postgres":
+		dialect, driver = modl.PostgresDialect{}, "postgres"
+	case "sqlite":
+		dialect, driver = modl.SqliteDialect{}, "sqlite3"
+	default:
+		t.Skip("MODL_TEST_DIALECT env variable is not set. Please see README.md")
+	}
+	db, err := sql.Open(driver, os.Getenv("MODL_TEST_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbmap := modl.NewDbMap(db, dialect)
+	dbmap.AddTableWithName(Account{}, "modltest_account_test").SetKeys(true, "id")
+	if err = dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dbmap.DropTables()
+		db.Close()
+	})
+	return dbmap
+}
+
+// createAccounts inserts accounts in its own transaction, keeping the
+// first if a later one fails.
+func createAccounts(e modl.SqlExecutor, names ...string) error {
+	tx, err := modl.Begin(e)
+	if err != nil {
+		return err
+	}
+	if err = tx.Insert(&Account{Name: names[0]}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	inner, err := modl.Begin(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, name := range names[1:] {
+		if name == "" {
+			inner.Rollback()
+			return tx.Commit()
+		}
+		if err = inner.Insert(&Account{Name: name}); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = inner.Commit(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func count(t *testing.T, e modl.SqlExecutor) int {
+	var n int
+	if err := e.SelectOne(&n, "select count(*) from modltest_account_test"); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestWrapInRollback(t *testing.T) {
+	dbmap := newDbMap(t)
+
+	err := WrapInRollback(dbmap, func(exec modl.SqlExecutor) {
+		if err := createAccounts(exec, "bob", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if n := count(t, exec); n != 2 {
+			t.Errorf("Expected 2 accounts inside the transaction, got %d", n)
+		}
+		// the nested transaction's rollback keeps the outer insert
+		if err := createAccounts(exec, "carol", "dave", ""); err != nil {
+			t.Fatal(err)
+		}
+		if n := count(t, exec); n != 3 {
+			t.Errorf("Expected 3 accounts after a nested rollback, got %d", n)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, dbmap); n != 0 {
+		t.Errorf("Expected the accounts to be rolled back, got %d", n)
+	}
+}
+
+func TestMemoryDbMap(t *testing.T) {
+	dbmap := NewMemoryDbMap()
+	dbmap.AddTableWithName(Account{}, "modltest_account_test").SetKeys(true, "id")
+	if err := dbmap.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+
+	bob, alice := &Account{Name: "bob"}, &Account{Name: "alice"}
+	if err := dbmap.Insert(bob, alice); err != nil {
+		t.Fatal(err)
+	}
+	if bob.ID != 1 || alice.ID != 2 {
+		t.Errorf("Expected ids 1 and 2, got %d and %d", bob.ID, alice.ID)
+	}
+	bob.Name = "robert"
+	if n, err := dbmap.Update(bob); err != nil || n != 1 {
+		t.Fatalf("Expected 1 row updated, got %d, %v", n, err)
+	}
+	var read Account
+	if err := dbmap.Get(&read, bob.ID); err != nil || read != *bob {
+		t.Errorf("Expected %v, got %v, %v", bob, read, err)
+	}
+
+	var accounts []Account
+	err := dbmap.Select(&accounts, "select * from modltest_account_test where name like ? or id in (?, ?) order by name desc limit ?", "ali%", -1, 1, 10)
+	if err != nil || len(accounts) != 2 || accounts[0] != *bob || accounts[1] != *alice {
+		t.Errorf("Expected robert and alice, got %v, %v", accounts, err)
+	}
+	if _, err := dbmap.Exec("insert into modltest_account_test (id, name) values (?, ?)", alice.ID, "eve"); err == nil {
+		t.Errorf("Expected a duplicate key to fail")
+	}
+
+	err = WrapInRollback(dbmap, func(exec modl.SqlExecutor) {
+		if err := createAccounts(exec, "carol", "dave", ""); err != nil {
+			t.Fatal(err)
+		}
+		if n := count(t, exec); n != 3 {
+			t.Errorf("Expected 3 accounts after a nested rollback, got %d", n)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, dbmap); n != 2 {
+		t.Errorf("Expected the accounts to be rolled back, got %d", n)
+	}
+
+	if n, err := dbmap.Delete(alice); err != nil || n != 1 {
+		t.Errorf("Expected 1 row deleted, got %d, %v", n, err)
+	}
+	if err := dbmap.Get(&read, alice.ID); err != modl.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := dbmap.TruncateTables(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, dbmap); n != 0 {
+		t.Errorf("Expected no accounts after truncating, got %d", n)
+	}
+	if _, err := dbmap.Exec("insert into modltest_account_test default values"); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, dbmap); n != 1 {
+		t.Errorf("Expected 1 account of defaults, got %d", n)
+	}
+}
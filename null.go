@@ -0,0 +1,53 @@
+package modl
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// nullWrapped returns the type of the values held by t if it is a
+// nullable type:  the element type of a pointer, or the type of the value
+// field of a Null wrapper, a driver.Valuer struct like sql.NullString or
+// typed.Null with a Valid bool field and one other field.  It returns nil
+// for other types.
+func nullWrapped(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t.NumField() != 2 {
+		return nil
+	}
+	if !t.Implements(valuerType) && !reflect.PtrTo(t).Implements(valuerType) {
+		return nil
+	}
+	valid, ok := t.FieldByName("Valid")
+	if !ok || valid.Type.Kind() != reflect.Bool {
+		return nil
+	}
+	return t.Field(1 - valid.Index[0]).Type
+}
+
+// valueColumn returns the column as it is passed to Dialect.ToSqlType:
+// with the type of the values its field holds if it is nullable, so that
+// eg. an sql.NullInt64 or *int64 column has the type of an int64 one.
+func (c *ColumnMap) valueColumn() *ColumnMap {
+	t := nullWrapped(c.gotype)
+	if t == nil {
+		return c
+	}
+	vc := *c
+	vc.gotype = t
+	return &vc
+}
+
+// SetNotNull adds "not null" to the column's definition in create table
+// statements, as it is for primary keys.  It panics if the column's field
+// is nullable, a pointer or a Null wrapper like sql.NullString, as its
+// NULLs could not be written.
+func (c *ColumnMap) SetNotNull(b bool) *ColumnMap {
+	if b && nullWrapped(c.gotype) != nil {
+		panic(fmt.Sprintf("Column %s of type %s is nullable", c.ColumnName, c.gotype))
+	}
+	c.notNull = b
+	return c
+}
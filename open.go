@@ -0,0 +1,69 @@
+package modl
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	dialectsMu sync.RWMutex
+	dialects   = map[string]func() Dialect{
+		"sqlite3":          func() Dialect { return SqliteDialect{} },
+		"sqlite":           func() Dialect { return SqliteDialect{} },
+		"postgres":         func() Dialect { return PostgresDialect{} },
+		"pgx":              func() Dialect { return PostgresDialect{} },
+		"cloudsqlpostgres": func() Dialect { return PostgresDialect{} },
+		"mysql":            func() Dialect { return MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"} },
+	}
+)
+
+// RegisterDialect makes Open use dialect for databases opened with
+// driverName, eg. for a driver wrapping one of the standard drivers.
+func RegisterDialect(driverName string, dialect Dialect) {
+	dialectsMu.Lock()
+	defer dialectsMu.Unlock()
+	dialects[driverName] = func() Dialect { return dialect }
+}
+
+// DialectFor returns the Dialect for databases opened with driverName, or
+// an error if there is none.  See RegisterDialect.
+func DialectFor(driverName string) (Dialect, error) {
+	dialectsMu.RLock()
+	defer dialectsMu.RUnlock()
+	d, ok := dialects[driverName]
+	if !ok {
+		return nil, fmt.Errorf("modl: no dialect for driver %q", driverName)
+	}
+	return d(), nil
+}
+
+// Open opens a database with sql.Open and returns a DbMap for it, with the
+// Dialect for driverName.  Like sql.Open, it does not connect to the
+// database;  use Ping to check that it can be reached.
+//
+//	dbmap, err := modl.Open("postgres", "postgres://localhost/app?sslmode=disable")
+func Open(driverName, dsn string) (*DbMap, error) {
+	dialect, err := DialectFor(driverName)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	m := NewDbMap(db, dialect)
+	// sqlx picks the bindvars of its queries by driver name, so it is
+	// told about drivers it does not know
+	if sqlx.BindType(driverName) == sqlx.UNKNOWN {
+		bindType := sqlx.QUESTION
+		if _, ok := dialect.(PostgresDialect); ok {
+			bindType = sqlx.DOLLAR
+		}
+		sqlx.BindDriver(driverName, bindType)
+	}
+	m.Dbx = sqlx.NewDb(db, driverName)
+	return m, nil
+}
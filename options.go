@@ -0,0 +1,255 @@
+package modl
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// QueryOption tunes the behavior of a single call to Get, Select, SelectOne
+// or Exec.  Options are passed along with the keys or query arguments and
+// are removed before the statement is sent to the database:
+//
+//	err := dbmap.Get(&user, id, modl.WithTimeout(time.Second), modl.Primary())
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	ctx     context.Context
+	timeout time.Duration
+	noHooks bool
+	primary bool
+	comment string
+	reuse   bool
+	raw     bool
+
+	omitEmpty bool
+	ndjson    bool
+	// The rows passed with WithOld, by the row they are the old version of.
+	old map[interface{}]interface{}
+
+	cacheTTL time.Duration
+	analyze  bool
+
+	explicitKeys    bool
+	returningAll    bool
+	batch           bool
+	continueOnError bool
+}
+
+// WithContext runs the call's statements with ctx, which is also passed
+// to the DbMap's Annotator.
+func WithContext(ctx context.Context) QueryOption {
+	return func(o *queryOptions) {
+		o.ctx = ctx
+	}
+}
+
+// WithTimeout cancels the call's statements if they have not completed
+// within d.
+func WithTimeout(d time.Duration) QueryOption {
+	return func(o *queryOptions) {
+		o.timeout = d
+	}
+}
+
+// NoHooks skips the PostGet hook for the call.
+func NoHooks() QueryOption {
+	return func(o *queryOptions) {
+		o.noHooks = true
+	}
+}
+
+// Primary sends a read to the DbMap's primary database even if a Replica
+// is configured.
+func Primary() QueryOption {
+	return func(o *queryOptions) {
+		o.primary = true
+	}
+}
+
+// ExplicitKeys makes Insert include the values of auto-increment keys
+// which are already set on the struct, rather than having the database
+// generate them.
+func ExplicitKeys() QueryOption {
+	return func(o *queryOptions) {
+		o.explicitKeys = true
+	}
+}
+
+// ReturningAll makes Insert read each row back into its struct after it
+// is inserted.  See TableMap.SetReturningAll.
+func ReturningAll() QueryOption {
+	return func(o *queryOptions) {
+		o.returningAll = true
+	}
+}
+
+// ReuseSlice makes Select replace the elements of its destination slice
+// rather than append to it, scanning rows into its backing array up to its
+// capacity, and into the structs already pointed to by the elements of a
+// slice of pointers, instead of allocating a new struct per row.  It is
+// useful when the same slice is selected into repeatedly;  the previous
+// results are overwritten, including in copies of the slice.
+func ReuseSlice() QueryOption {
+	return func(o *queryOptions) {
+		o.reuse = true
+	}
+}
+
+// Batch makes Insert, Update and Delete write all of the elements in their
+// list with as few statements as the dialect's bind parameter limit allows,
+// rather than one statement per element.  The elements must all map to the
+// same table, and Insert can only batch tables without auto-increment
+// keys;  otherwise they are written one at a time.  If Update or Delete do
+// not write some elements because their version is out of date, a
+// BatchLockError describes which.
+func Batch() QueryOption {
+	return func(o *queryOptions) {
+		o.batch = true
+	}
+}
+
+// ContinueOnError makes Insert, Update and Delete carry on writing the
+// rest of their list when an element fails, rather than stopping, and
+// return a MultiError with the error of each element which failed.  Rows
+// are written one at a time, so it takes precedence over Batch.  On
+// postgres, a failed statement aborts the transaction it is in, so it is
+// best used outside of one.
+func ContinueOnError() QueryOption {
+	return func(o *queryOptions) {
+		o.continueOnError = true
+	}
+}
+
+// OmitEmpty makes Update leave columns set up with SetUseDefault, or
+// tagged omitempty, out of the statement when their fields hold the zero
+// value, so that they keep the values in the database.  Updates with it
+// are not batched.
+func OmitEmpty() QueryOption {
+	return func(o *queryOptions) {
+		o.omitEmpty = true
+	}
+}
+
+// WithOld gives Update old, a pointer to row as it was loaded, so that its
+// hooks can compare the two without reading the row again:  old is passed
+// to them in HookContext.Old, and to subscribers in ChangeEvent.Old.  row
+// is one of the pointers passed to Update;  the option may be passed once
+// for each of them.
+//
+//	_, err := dbmap.Update(&user, modl.WithOld(&user, &loaded))
+func WithOld(row, old interface{}) QueryOption {
+	return func(o *queryOptions) {
+		if o.old == nil {
+			o.old = map[interface{}]interface{}{}
+		}
+		o.old[row] = old
+	}
+}
+
+// Raw sends the call's query as it is written, without rebinding its
+// bindvars for the dialect, eg. for a postgres query using the jsonb "?"
+// operators without doubling them.  See DbMap.RawQueries.
+func Raw() QueryOption {
+	return func(o *queryOptions) {
+		o.raw = true
+	}
+}
+
+// Comment prepends the SQL comment /* c */ to the call's statements, which
+// helps attribute queries seen on the database server.  A space is put
+// between any "/" and "*" next to each other in c, so that it can neither
+// end the comment nor open a nested one.
+func Comment(c string) QueryOption {
+	return func(o *queryOptions) {
+		if len(o.comment) > 0 {
+			o.comment += " "
+		}
+		o.comment += escapeComment(c)
+	}
+}
+
+// escapeComment separates the "/" and "*" of any comment delimiters in c.
+func escapeComment(c string) string {
+	var b strings.Builder
+	for i := 0; i < len(c); i++ {
+		if i > 0 && (c[i-1] == '/' && c[i] == '*' || c[i-1] == '*' && c[i] == '/') {
+			b.WriteByte(' ')
+		}
+		b.WriteByte(c[i])
+	}
+	return b.String()
+}
+
+// context returns the context the call runs with.
+func (o *queryOptions) context() context.Context {
+	if o.ctx != nil {
+		return o.ctx
+	}
+	return context.Background()
+}
+
+// passOn returns the options which the statements run by a call, like the
+// Exec of an Update, should be run with:  its context, timeout and comment.
+func (o *queryOptions) passOn() []interface{} {
+	var opts []interface{}
+	if o.ctx != nil {
+		opts = append(opts, WithContext(o.ctx))
+	}
+	if o.timeout > 0 {
+		opts = append(opts, WithTimeout(o.timeout))
+	}
+	if len(o.comment) > 0 {
+		opts = append(opts, Comment(o.comment))
+	}
+	return opts
+}
+
+// splitOptions removes any QueryOptions from args, returning the remaining
+// args and the options they described.  args is returned unmodified if it
+// holds no options.
+func splitOptions(args []interface{}) ([]interface{}, *queryOptions) {
+	opts := &queryOptions{}
+	n := 0
+	for _, a := range args {
+		if o, ok := a.(QueryOption); ok {
+			o(opts)
+			n++
+		}
+	}
+	if n == 0 {
+		return args, opts
+	}
+	rest := make([]interface{}, 0, len(args)-n)
+	for _, a := range args {
+		if _, ok := a.(QueryOption); !ok {
+			rest = append(rest, a)
+		}
+	}
+	return rest, opts
+}
+
+// handleFor returns a handle for e configured with the options in o and a
+// function which releases its resources once the call has completed.  Reads
+// made outside of a transaction go to the DbMap's Replica unless Primary
+// was requested.
+func (o *queryOptions) handleFor(e SqlExecutor, read bool) (handle, context.CancelFunc) {
+	h := *e.handle().(*tracingHandle)
+	if _, isDb := h.h.(*sqlx.DB); isDb && read && !o.primary && h.d.Replica != nil {
+		h.h = h.d.Replica
+	}
+	if len(o.comment) > 0 {
+		h.comment = o.comment
+	}
+	h.reuse = o.reuse
+	if o.ctx != nil {
+		h.ctx = o.ctx
+	}
+	cancel := context.CancelFunc(func() {})
+	if o.timeout > 0 {
+		h.ctx, cancel = context.WithTimeout(h.ctx, o.timeout)
+	}
+	return &h, cancel
+}
@@ -0,0 +1,91 @@
+package modl
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// A RedisClient runs Redis commands, which are passed as the command's
+// name followed by its arguments, and returns their replies.  It must be
+// safe for concurrent use.  A go-redis client can be used with
+//
+//	modl.RedisFunc(func(ctx context.Context, args ...interface{}) (interface{}, error) {
+//		return rdb.Do(ctx, args...).Result()
+//	})
+type RedisClient interface {
+	Do(ctx context.Context, args ...interface{}) (interface{}, error)
+}
+
+// RedisFunc adapts a func to a RedisClient.
+type RedisFunc func(ctx context.Context, args ...interface{}) (interface{}, error)
+
+// Do calls f.
+func (f RedisFunc) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	return f(ctx, args...)
+}
+
+// RedisCache is a Cache keeping rows in Redis, under their keys prefixed
+// with Prefix, eg. "myapp:users:42":
+//
+//	cache := modl.NewRedisCache(client, "myapp:")
+//	dbmap.AddTable(User{}).SetKeys(true, "ID").SetCache(cache, time.Hour)
+type RedisCache struct {
+	Client RedisClient
+	Prefix string
+}
+
+// NewRedisCache returns a RedisCache running its commands with client.
+func NewRedisCache(client RedisClient, prefix string) *RedisCache {
+	return &RedisCache{Client: client, Prefix: prefix}
+}
+
+// Get returns the value stored under key.  It reads it with MGET, whose
+// reply for a missing key is nil, rather than an error which differs
+// between clients.
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := c.Client.Do(ctx, "MGET", c.Prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 1 {
+		return nil, fmt.Errorf("modl: unexpected reply to MGET: %T", reply)
+	}
+	switch v := values[0].(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("modl: unexpected value from MGET: %T", values[0])
+}
+
+// Set stores value under key, which expires after ttl if it is not 0.
+func (c *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []interface{}{"SET", c.Prefix + key, value}
+	if ttl > 0 {
+		ms := ttl.Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		args = append(args, "PX", ms)
+	}
+	_, err := c.Client.Do(ctx, args...)
+	return err
+}
+
+// Delete removes the values stored under keys.
+func (c *RedisCache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := []interface{}{"DEL"}
+	for _, key := range keys {
+		args = append(args, c.Prefix+key)
+	}
+	_, err := c.Client.Do(ctx, args...)
+	return err
+}
@@ -0,0 +1,179 @@
+package modl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// A relation is a func field of a table's type which loads related rows
+// when it is first called.
+type relation struct {
+	index  []int
+	target reflect.Type
+	many   bool
+	// for HasMany, the column of the target table holding this table's
+	// key;  for BelongsTo, the column of this table holding the target's
+	fkName string
+	column *ColumnMap
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// HasMany declares field, a func field of the table's type returning a
+// slice of target's type, or of pointers to it, and an error, as a lazy
+// loader of the rows of target's table whose foreignKey column holds this
+// row's key:
+//
+//	type User struct {
+//		ID     int64
+//		Orders func() ([]Order, error)
+//	}
+//	dbmap.AddTable(User{}).SetKeys(true, "ID").HasMany("Orders", Order{}, "user_id")
+//
+// Rows read by Get, Select and SelectOne have the field set to a function
+// which selects the related rows with the executor which read the row the
+// first time it is called, and returns the same rows after that.  A row
+// read in a Transaction must be loaded before it is committed.  The table
+// must have a single key;  the field is made transient.
+func (t *TableMap) HasMany(field string, target interface{}, foreignKey string) *TableMap {
+	return t.addRelation(field, target, &relation{many: true, fkName: foreignKey})
+}
+
+// BelongsTo declares field, a func field of the table's type returning a
+// pointer to target's type and an error, as a lazy loader of the row of
+// target's table whose key is held by this table's foreignKey field or
+// column.  The function returns nil if the foreign key is the zero value,
+// and ErrNotFound if there is no such row.  See HasMany.
+func (t *TableMap) BelongsTo(field string, target interface{}, foreignKey string) *TableMap {
+	return t.addRelation(field, target, &relation{column: t.ColMap(foreignKey)})
+}
+
+func (t *TableMap) addRelation(field string, target interface{}, rel *relation) *TableMap {
+	col := t.ColMap(field)
+	rel.index = col.fieldIndex
+	rel.target = reflect.TypeOf(target)
+	if rel.target.Kind() == reflect.Ptr {
+		rel.target = rel.target.Elem()
+	}
+
+	ft := col.gotype
+	ok := isLoader(ft)
+	if ok && rel.many {
+		out := ft.Out(0)
+		ok = out.Kind() == reflect.Slice && (out.Elem() == rel.target || out.Elem() == reflect.PtrTo(rel.target))
+	} else if ok {
+		ok = ft.Out(0) == reflect.PtrTo(rel.target)
+	}
+	if !ok {
+		panic(fmt.Sprintf("Field %s of %s has type %s, which cannot load %s", field, t.gotype.Name(), ft, rel.target))
+	}
+
+	col.SetTransient(true)
+	t.relations = append(t.relations, rel)
+	t.ResetSql()
+	return t
+}
+
+// isLoader returns true if t is a func type which may be declared as a
+// relation.
+func isLoader(t reflect.Type) bool {
+	return t.Kind() == reflect.Func && t.NumIn() == 0 && t.NumOut() == 2 && t.Out(1) == errorType
+}
+
+// loaded sets up the relations of row, a pointer to a row of the table
+// read by e, and runs its PostGet hook.
+func (t *TableMap) loaded(e SqlExecutor, row interface{}, opts *queryOptions) error {
+	if len(t.relations) > 0 {
+		elem := reflect.Indirect(reflect.ValueOf(row))
+		for _, rel := range t.relations {
+			t.bindRelation(e, elem, rel, opts.ctx)
+		}
+	}
+	if t.CanPostGet && !opts.noHooks {
+		return t.runHook(postGet, opts.context(), e, row)
+	}
+	return nil
+}
+
+// bindRelation sets the field of rel in elem to a function loading the
+// related rows with e and ctx, if it is not nil, once.
+func (t *TableMap) bindRelation(e SqlExecutor, elem reflect.Value, rel *relation, ctx context.Context) {
+	field := elem.FieldByIndex(rel.index)
+	out := field.Type().Out(0)
+
+	var key interface{}
+	if rel.many {
+		if len(t.Keys) == 1 {
+			key = bindValue(elem.FieldByIndex(t.Keys[0].fieldIndex))
+		}
+	} else if v := elem.FieldByIndex(rel.column.fieldIndex); !v.IsZero() {
+		key = bindValue(v)
+	}
+
+	var once sync.Once
+	var result reflect.Value
+	var err error
+	field.Set(reflect.MakeFunc(field.Type(), func([]reflect.Value) []reflect.Value {
+		once.Do(func() {
+			result, err = t.loadRelation(e, rel, out, key, ctx)
+		})
+		errv := reflect.Zero(errorType)
+		if err != nil {
+			errv = reflect.ValueOf(&err).Elem()
+		}
+		return []reflect.Value{result, errv}
+	}))
+}
+
+// loadRelation loads the rows of rel related to key as a value of type out.
+func (t *TableMap) loadRelation(e SqlExecutor, rel *relation, out reflect.Type, key interface{}, ctx context.Context) (reflect.Value, error) {
+	m := t.dbmap
+	var args []interface{}
+	if ctx != nil {
+		args = append(args, WithContext(ctx))
+	}
+	if !rel.many {
+		if key == nil {
+			return reflect.Zero(out), nil
+		}
+		dest := reflect.New(rel.target)
+		if err := get(m, e, dest.Interface(), append([]interface{}{key}, args...)...); err != nil {
+			return reflect.Zero(out), err
+		}
+		return dest, nil
+	}
+
+	if len(t.Keys) != 1 {
+		return reflect.Zero(out), fmt.Errorf("modl: table %s needs a single key to load related rows", t.TableName)
+	}
+	target := m.TableForType(rel.target)
+	if target == nil {
+		return reflect.Zero(out), fmt.Errorf("modl: no table found for %v", rel.target)
+	}
+	_, opts := splitOptions(args)
+	scope, err := target.scopeArgs(opts.context())
+	if err != nil {
+		return reflect.Zero(out), err
+	}
+	d := m.Dialect
+	s := bytes.Buffer{}
+	s.WriteString("select ")
+	s.WriteString(target.SelectColumnList(""))
+	s.WriteString(" from ")
+	s.WriteString(quoteTable(d, target.qualifiedName()))
+	s.WriteString(" where ")
+	s.WriteString(d.QuoteField(rel.fkName))
+	s.WriteString("=")
+	s.WriteString(d.BindVar(0))
+	target.writeScope(&s, 1)
+
+	dest := reflect.New(out)
+	args = append(append([]interface{}{key}, scope...), args...)
+	if err := hookedselect(m, e, dest.Interface(), s.String(), args...); err != nil {
+		return reflect.Zero(out), err
+	}
+	return dest.Elem(), nil
+}
@@ -0,0 +1,164 @@
+package modl
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A QueryRewriter is a Dialect which rewrites queries written by hand for
+// Select, Get, Exec and the like before they are run, eg. to convert "?"
+// bindvars to its own, so that they can be written the same way for every
+// database.  Queries generated by modl are not rewritten.  The "?"
+// bindvars of dialects which are not QueryRewriters are rebound with
+// sqlx.Rebind.  See DbMap.RawQueries and Raw.
+type QueryRewriter interface {
+	RewriteQuery(query string) string
+}
+
+// rewrite expands each slice argument in args into a list of bindvars in
+// query, eg. "id in (?)" with []int{1, 2, 3} becomes "id in (?, ?, ?)",
+// and rebinds its "?" bindvars for the dialect:  with its RewriteQuery if
+// it is a QueryRewriter, or else with sqlx.Rebind for the bind type of its
+// driver, eg. "@p1" for sqlserver.  Queries are not rebound if the DbMap
+// has RawQueries set or the call is Raw, but slices are still expanded
+// from "?" bindvars, which are then rebound.
+func (m *DbMap) rewrite(query string, args []interface{}, opts *queryOptions) (string, []interface{}, error) {
+	expand := hasSliceArg(args)
+	if expand {
+		var err error
+		if query, args, err = sqlx.In(query, args...); err != nil {
+			return query, args, err
+		}
+	}
+	switch {
+	case !m.RawQueries && !opts.raw:
+		if rw, ok := m.Dialect.(QueryRewriter); ok {
+			return rw.RewriteQuery(query), args, nil
+		}
+		if bt := sqlx.BindType(m.Dialect.DriverName()); bt != sqlx.QUESTION && bt != sqlx.UNKNOWN {
+			return sqlx.Rebind(bt, query), args, nil
+		}
+	case expand:
+		query = ReBind(query, m.Dialect)
+	}
+	return query, args, nil
+}
+
+// rewrites returns true if hand-written queries are rebound, so that they
+// can use "?" bindvars.
+func (m *DbMap) rewrites() bool {
+	if m.RawQueries {
+		return false
+	}
+	if _, ok := m.Dialect.(QueryRewriter); ok {
+		return true
+	}
+	bt := sqlx.BindType(m.Dialect.DriverName())
+	return bt != sqlx.QUESTION && bt != sqlx.UNKNOWN
+}
+
+// RewriteQuery converts the "?" bindvars of query to postgres' numbered
+// ones, leaving those in strings, quoted identifiers and comments alone.
+// "??" is written as "?", so the jsonb operators "?", "?|" and "?&" are
+// written "??", "??|" and "??&".  Queries which already use numbered
+// bindvars are not changed.
+func (d PostgresDialect) RewriteQuery(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n, last := 0, 0
+	numbered := !scanBindvars(query, func(i int, escaped bool) {
+		b.WriteString(query[last:i])
+		if escaped {
+			b.WriteByte('?')
+			last = i + 2
+			return
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+		last = i + 1
+	})
+	if numbered {
+		return query
+	}
+	b.WriteString(query[last:])
+	return b.String()
+}
+
+// scanBindvars calls fn with the offset of each "?" bindvar in query,
+// skipping those in strings, quoted identifiers and comments, and of each
+// "??" with escaped set.  It stops and returns false if query uses
+// numbered bindvars, as its question marks are then not bindvars.
+func scanBindvars(query string, fn func(i int, escaped bool)) bool {
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			// E'' strings escape quotes with backslashes
+			escapes := c == '\'' && i > 0 && (query[i-1] == 'E' || query[i-1] == 'e')
+			end := i + 1
+			for end < len(query) && query[end] != c {
+				if escapes && query[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(query) {
+				return true
+			}
+			i = end
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return true
+			}
+			i += end - 1
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return true
+			}
+			i += end + 3
+		case c == '$':
+			if i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9' {
+				return false
+			}
+			// dollar quoted strings, eg. $$...$$ or $body$...$body$
+			tag := dollarTag(query[i:])
+			if len(tag) == 0 {
+				continue
+			}
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				return true
+			}
+			i += 2*len(tag) + end - 1
+		case c == '?':
+			escaped := strings.HasPrefix(query[i:], "??")
+			fn(i, escaped)
+			if escaped {
+				i++
+			}
+		}
+	}
+	return true
+}
+
+// dollarTag returns the tag opening the dollar quoted string s starts with,
+// eg. "$$" or "$body$", or "" if it does not start with one.
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '$':
+			return s[:i+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 1 && c >= '0' && c <= '9':
+			continue
+		}
+		return ""
+	}
+	return ""
+}
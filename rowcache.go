@@ -0,0 +1,271 @@
+package modl
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// A Cache holds the rows of tables set up with SetCache, encoded, by key.
+// Its methods are called concurrently.  See RedisCache.
+type Cache interface {
+	// Get returns the value stored under key, or nil if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value under key for ttl, or without expiry if ttl is 0.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes the values stored under keys.
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// rowCache is the Cache of a table, and its settings.
+type rowCache struct {
+	// gen is incremented by each write of the table, so that rows read
+	// before a write are not stored after it
+	gen   uint64
+	cache Cache
+	ttl   time.Duration
+}
+
+// SetCache makes Get and GetBy read the table's rows through c, under
+// keys of the table's name and key values, eg. "users:42".  Rows read from
+// the database are stored in c for ttl, or without expiry if it is 0, and
+// rows written with Insert and Update are stored in c as they are written,
+// and removed from it by Delete.  Rows written in a Transaction are removed
+// from c, and removed again when it commits.  Rows written other than by
+// Insert, Update and Delete, eg. with Exec, or by other processes, should
+// be removed with Evict.  Rows are stored in c with the text of their
+// columns, encrypted columns encrypted, and PostGet hooks are run on rows
+// read from it.  Gets in a Transaction, with Primary, or of tables with a
+// scope are not read through c.  The cache is a best effort:  rows which
+// cannot be read from c are read from the database, and rows which cannot
+// be stored in it are removed.  To stop caching, call with a nil Cache.
+func (t *TableMap) SetCache(c Cache, ttl time.Duration) *TableMap {
+	if c == nil {
+		t.rowCache = nil
+		return t
+	}
+	t.rowCache = &rowCache{cache: c, ttl: ttl}
+	return t
+}
+
+// Evict removes the row with keys from the table's Cache.  See SetCache.
+func (t *TableMap) Evict(keys ...interface{}) error {
+	rc := t.rowCache
+	if rc == nil {
+		return nil
+	}
+	if len(keys) != len(t.Keys) {
+		return fmt.Errorf("modl: table %s has %d keys, got %d", t.TableName, len(t.Keys), len(keys))
+	}
+	atomic.AddUint64(&rc.gen, 1)
+	return rc.cache.Delete(context.Background(), t.cacheKey(keys))
+}
+
+// cacheKey returns the key of the row with keys in the table's Cache:  the
+// table's name and the text of the keys, separated by ":".
+func (t *TableMap) cacheKey(keys []interface{}) string {
+	var b strings.Builder
+	b.WriteString(t.qualifiedName())
+	for _, key := range keys {
+		b.WriteByte(':')
+		text := fmt.Sprint(key)
+		if dv, err := driver.DefaultParameterConverter.ConvertValue(key); err == nil && dv != nil {
+			text = formatText(dv)
+		}
+		b.WriteString(keySeparators.Replace(text))
+	}
+	return b.String()
+}
+
+// keySeparators escapes the separators in the text of keys, so that
+// composite keys cannot collide.
+var keySeparators = strings.NewReplacer(`\`, `\\`, ":", `\:`)
+
+// readsCache returns the table's Cache if a Get of keys with e and opts
+// may be read through it.
+func (t *TableMap) readsCache(e SqlExecutor, keys []interface{}, opts *queryOptions) *rowCache {
+	if _, ok := e.(*Transaction); ok || t.rowCache == nil || opts.primary {
+		return nil
+	}
+	if len(t.scope) > 0 || len(keys) != len(t.Keys) {
+		return nil
+	}
+	return t.rowCache
+}
+
+// getCached reads the row with keys into dest, a pointer to a row of the
+// table, from rc, and returns false if it is not cached.
+func (t *TableMap) getCached(m *DbMap, rc *rowCache, dest interface{}, keys []interface{}, opts *queryOptions) bool {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Type() != t.gotype {
+		return false
+	}
+	data, err := rc.cache.Get(opts.context(), t.cacheKey(keys))
+	if err != nil || data == nil {
+		return false
+	}
+	row := reflect.New(t.gotype).Elem()
+	if err := t.decodeRow(m, row, data); err != nil {
+		return false
+	}
+	v.Elem().Set(row)
+	return true
+}
+
+// fillCache stores elem, the row with keys read from the database when
+// rc's generation was gen, in rc, unless the table has been written since.
+// A write made while the row is being stored may be overwritten by it, so
+// the row is removed again if the table has been written by then.
+func (t *TableMap) fillCache(m *DbMap, rc *rowCache, gen uint64, elem reflect.Value, keys []interface{}, opts *queryOptions) {
+	if elem.Type() != t.gotype {
+		return
+	}
+	data, err := t.encodeRow(m, elem)
+	if err != nil || atomic.LoadUint64(&rc.gen) != gen {
+		return
+	}
+	key := t.cacheKey(keys)
+	rc.cache.Set(opts.context(), key, data, rc.ttl)
+	if atomic.LoadUint64(&rc.gen) != gen {
+		rc.cache.Delete(opts.context(), key)
+	}
+}
+
+// writeCache stores elem, a row of the table written by op with e, in the
+// table's Cache, or removes it.
+func (t *TableMap) writeCache(e SqlExecutor, op Operation, elem reflect.Value) {
+	rc := t.rowCache
+	if rc == nil {
+		return
+	}
+	atomic.AddUint64(&rc.gen, 1)
+	ctx := context.Background()
+	key := t.cacheKey(t.keyValues(elem))
+	if tx, ok := e.(*Transaction); ok {
+		tx.evicted = append(tx.evicted, evictedRow{t, key})
+	} else if op != OpDelete && t.writesCache() {
+		data, err := t.encodeRow(dbmapOf(e), elem)
+		if err == nil && rc.cache.Set(ctx, key, data, rc.ttl) == nil {
+			return
+		}
+	}
+	rc.cache.Delete(ctx, key)
+}
+
+// writesCache returns true if the rows written by Insert and Update hold
+// the values of all of the table's columns, so that they can be stored in
+// its Cache, rather than removed from it.
+func (t *TableMap) writesCache() bool {
+	for _, col := range t.Columns {
+		if col.isSelected() && (col.readOnly || len(col.defaultExpr) > 0 || len(col.generatedExpr) > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// evictedRow is the key of a row written in a Transaction, which is
+// removed from its table's Cache again when the transaction commits.
+type evictedRow struct {
+	table *TableMap
+	key   string
+}
+
+// evict removes rows written in a committed transaction from their
+// tables' Caches.
+func evict(rows []evictedRow) {
+	for _, row := range rows {
+		if rc := row.table.rowCache; rc != nil {
+			atomic.AddUint64(&rc.gen, 1)
+			rc.cache.Delete(context.Background(), row.key)
+		}
+	}
+}
+
+// cachedBinary holds a column value which is not text in a cached row.
+type cachedBinary struct {
+	Base64 []byte `json:"base64"`
+}
+
+// encodeRow returns elem, a row of the table, as a JSON object of the
+// text of its selected columns by column name, as their values are stored
+// in the database.  Values which are not valid UTF-8, eg. those of
+// encrypted columns, are held in objects as base64.
+func (t *TableMap) encodeRow(m *DbMap, elem reflect.Value) ([]byte, error) {
+	row := map[string]interface{}{}
+	for _, col := range t.Columns {
+		if !col.isSelected() {
+			continue
+		}
+		v := bindValue(elem.FieldByIndex(col.fieldIndex))
+		if codec := col.getCodec(m); codec != nil {
+			v = codec.bind(v)
+		}
+		dv, err := driver.DefaultParameterConverter.ConvertValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", col.ColumnName, err)
+		}
+		switch x := dv.(type) {
+		case nil:
+			row[col.ColumnName] = nil
+		case []byte:
+			if utf8.Valid(x) {
+				row[col.ColumnName] = string(x)
+			} else {
+				row[col.ColumnName] = cachedBinary{x}
+			}
+		default:
+			row[col.ColumnName] = formatText(dv)
+		}
+	}
+	return json.Marshal(row)
+}
+
+// decodeRow sets the fields of elem, a row of the table, from data, as
+// written by encodeRow.
+func (t *TableMap) decodeRow(m *DbMap, elem reflect.Value, data []byte) error {
+	var row map[string]json.RawMessage
+	if err := json.Unmarshal(data, &row); err != nil {
+		return err
+	}
+	for _, col := range t.Columns {
+		if !col.isSelected() {
+			continue
+		}
+		raw, ok := row[col.ColumnName]
+		if !ok {
+			return fmt.Errorf("column %s is not cached", col.ColumnName)
+		}
+		field := elem.FieldByIndex(col.fieldIndex)
+		if string(raw) == "null" {
+			field.Set(reflect.Zero(field.Type()))
+			continue
+		}
+		var text string
+		if strings.HasPrefix(string(raw), "{") {
+			var b cachedBinary
+			if err := json.Unmarshal(raw, &b); err != nil {
+				return err
+			}
+			text = string(b.Base64)
+		} else if err := json.Unmarshal(raw, &text); err != nil {
+			return err
+		}
+		var err error
+		if codec, ok := col.getCodec(m).(cipherCodec); ok {
+			err = codec.decode(field, []byte(text))
+		} else {
+			err = parseColumn(m, col, field, text)
+		}
+		if err != nil {
+			return fmt.Errorf("column %s: %v", col.ColumnName, err)
+		}
+	}
+	return nil
+}
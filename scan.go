@@ -0,0 +1,284 @@
+package modl
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+)
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+// scanKey identifies the field traversals used to scan a set of result
+// columns into a struct type.
+type scanKey struct {
+	mapper  *reflectx.Mapper
+	gotype  reflect.Type
+	columns string
+}
+
+// traversals returns the field index paths of base which the columns of a
+// result are scanned into.  They are cached per type and column list, so
+// that repeated queries do not have to match columns to fields again.
+func (m *DbMap) traversals(mapper *reflectx.Mapper, base reflect.Type, columns []string) ([][]int, error) {
+	key := scanKey{mapper, base, strings.Join(columns, ",")}
+	if fields, ok := m.scanCache.Load(key); ok {
+		return fields.([][]int), nil
+	}
+	fields := mapper.TraversalsByName(base, columns)
+	for i, f := range fields {
+		if len(f) == 0 {
+			// columns of embedded value structs are named by the table
+			if col := m.columnByName(base, columns[i]); col != nil {
+				fields[i] = col.fieldIndex
+				continue
+			}
+			return nil, fmt.Errorf("missing destination name %s in %v", columns[i], base)
+		}
+	}
+	m.scanCache.Store(key, fields)
+	return fields, nil
+}
+
+// columnByName returns the column called name of the table for base, if
+// it has one.
+func (m *DbMap) columnByName(base reflect.Type, name string) *ColumnMap {
+	table := m.TableForType(base)
+	if table == nil {
+		return nil
+	}
+	for _, col := range table.Columns {
+		if !col.Transient && strings.EqualFold(col.ColumnName, name) {
+			return col
+		}
+	}
+	return nil
+}
+
+// isScannable returns true if t is scanned directly from a single column
+// rather than having columns mapped to its fields.
+func isScannable(mapper *reflectx.Mapper, t reflect.Type) bool {
+	if reflect.PtrTo(t).Implements(scannerType) {
+		return true
+	}
+	if t.Kind() != reflect.Struct {
+		return true
+	}
+	return len(mapper.TypeMap(t).Index) == 0
+}
+
+// valuesPool holds the []interface{} buffers which row values are scanned
+// through, so that each query doesn't allocate its own.
+var valuesPool = sync.Pool{
+	New: func() interface{} { return new([]interface{}) },
+}
+
+// scanner scans rows of a result into values of a single type.
+type scanner struct {
+	rows      *sqlx.Rows
+	base      reflect.Type
+	scannable bool
+	fields    [][]int
+	values    []interface{}
+	pooled    *[]interface{}
+	// codecs holds the codec of each column which has one;  the column is
+	// scanned into raw and decoded into its field afterwards
+	codecs  []columnCodec
+	raw     []interface{}
+	columns []string
+}
+
+func (m *DbMap) newScanner(rows *sqlx.Rows, base reflect.Type) (*scanner, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	s := &scanner{rows: rows, base: base, scannable: isScannable(rows.Mapper, base), columns: columns}
+	if s.scannable {
+		if len(columns) > 1 {
+			return nil, fmt.Errorf("non-struct dest type %s with >1 columns (%d)", base.Kind(), len(columns))
+		}
+		return s, nil
+	}
+	s.fields, err = m.traversals(rows.Mapper, base, columns)
+	if err != nil {
+		return nil, err
+	}
+	s.pooled = valuesPool.Get().(*[]interface{})
+	if cap(*s.pooled) < len(columns) {
+		*s.pooled = make([]interface{}, len(columns))
+	}
+	s.values = (*s.pooled)[:len(columns)]
+	s.codecs = m.columnCodecs(base, columns)
+	if s.codecs != nil {
+		s.raw = make([]interface{}, len(columns))
+	}
+	return s, nil
+}
+
+// columnCodecs returns the codec of each of columns of the table for base,
+// or nil if none of them have one.
+func (m *DbMap) columnCodecs(base reflect.Type, columns []string) []columnCodec {
+	table := m.TableForType(base)
+	if table == nil {
+		return nil
+	}
+	var codecs []columnCodec
+	for _, col := range table.Columns {
+		codec := col.getCodec(m)
+		if codec == nil {
+			continue
+		}
+		for i, name := range columns {
+			if strings.EqualFold(name, col.ColumnName) {
+				if codecs == nil {
+					codecs = make([]columnCodec, len(columns))
+				}
+				codecs[i] = codec
+			}
+		}
+	}
+	return codecs
+}
+
+// release returns the scanner's buffers to the pool.  The scanner must not
+// be used afterwards.
+func (s *scanner) release() {
+	if s.pooled == nil {
+		return
+	}
+	for i := range s.values {
+		s.values[i] = nil
+	}
+	valuesPool.Put(s.pooled)
+	s.pooled, s.values = nil, nil
+}
+
+// scan scans the current row into v, which must be an addressable value
+// of the scanner's type.
+func (s *scanner) scan(v reflect.Value) error {
+	if s.scannable {
+		return s.rows.Scan(v.Addr().Interface())
+	}
+	for i, traversal := range s.fields {
+		if s.codecs != nil && s.codecs[i] != nil {
+			s.values[i] = &s.raw[i]
+			continue
+		}
+		s.values[i] = reflectx.FieldByIndexes(v, traversal).Addr().Interface()
+	}
+	if err := s.rows.Scan(s.values...); err != nil {
+		return err
+	}
+	for i, c := range s.codecs {
+		if c == nil {
+			continue
+		}
+		field := reflectx.FieldByIndexes(v, s.fields[i])
+		if err := c.decode(field, s.raw[i]); err != nil {
+			return fmt.Errorf("column %s: %v", s.columns[i], err)
+		}
+	}
+	return nil
+}
+
+// scanAll appends every row of rows to dest, which must be a pointer to a
+// slice of values or pointers.  If reuse is true, the rows replace the
+// slice's elements instead:  values are scanned directly into its backing
+// array while it has capacity, and the structs pointed to by a slice of
+// pointers are reused, rather than allocating a new struct for each row.
+func (m *DbMap) scanAll(rows *sqlx.Rows, dest interface{}, reuse bool) error {
+	value := reflect.ValueOf(dest)
+	if value.Kind() != reflect.Ptr {
+		return errors.New("must pass a pointer, not a value, to StructScan destination")
+	}
+	if value.IsNil() {
+		return errors.New("nil pointer passed to StructScan destination")
+	}
+	direct := reflect.Indirect(value)
+	if direct.Kind() != reflect.Slice {
+		return fmt.Errorf("expected slice but got %v", direct.Type())
+	}
+	if reuse {
+		direct.SetLen(0)
+	}
+
+	elemType := direct.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	base := reflectx.Deref(elemType)
+	s, err := m.newScanner(rows, base)
+	if err != nil {
+		return err
+	}
+	defer s.release()
+
+	if !reuse {
+		for rows.Next() {
+			vp := reflect.New(base)
+			if err = s.scan(vp.Elem()); err != nil {
+				return err
+			}
+			if isPtr {
+				direct.Set(reflect.Append(direct, vp))
+			} else {
+				direct.Set(reflect.Append(direct, vp.Elem()))
+			}
+		}
+		return rows.Err()
+	}
+
+	zero := reflect.Zero(elemType)
+	for rows.Next() {
+		n := direct.Len()
+		if n < direct.Cap() {
+			direct.SetLen(n + 1)
+		} else {
+			direct.Set(reflect.Append(direct, zero))
+		}
+		elem := direct.Index(n)
+		if isPtr {
+			if elem.IsNil() {
+				elem.Set(reflect.New(base))
+			}
+			elem = elem.Elem()
+		}
+		elem.Set(reflect.Zero(base))
+		if err = s.scan(elem); err != nil {
+			direct.SetLen(n)
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// scanOne scans the first row of rows into dest, which must be a pointer.
+// It returns sql.ErrNoRows if there are no rows.
+func (m *DbMap) scanOne(rows *sqlx.Rows, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr {
+		return errors.New("must pass a pointer, not a value, to StructScan destination")
+	}
+	if v.IsNil() {
+		return errors.New("nil pointer passed to StructScan destination")
+	}
+	s, err := m.newScanner(rows, v.Type().Elem())
+	if err != nil {
+		return err
+	}
+	defer s.release()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err = s.scan(v.Elem()); err != nil {
+		return err
+	}
+	return rows.Close()
+}
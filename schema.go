@@ -0,0 +1,86 @@
+package modl
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// A Schema holds the TableMaps of a DbMap.  One Schema can be shared by
+// several DbMaps, eg. for a primary database and its replicas, or for the
+// connections of each tenant, so that tables are mapped, and their
+// statements built, once for all of them:
+//
+//	schema := modl.NewSchema()
+//	primary := modl.NewDbMap(db, dialect).SetSchema(schema)
+//	tenant := modl.NewDbMap(tenantDb, dialect).SetSchema(schema)
+//	primary.AddTable(User{}).SetKeys(true, "id")
+//
+// Tables added to any of the DbMaps are shared by all of them.  Statements
+// are built for a Dialect, so the DbMaps sharing a Schema must use the
+// same kind of Dialect.  Settings of each DbMap, like its TimeLocation,
+// apply to the calls made through it.
+type Schema struct {
+	mu      sync.RWMutex
+	tables  []*TableMap
+	dialect reflect.Type
+}
+
+// NewSchema returns an empty Schema.
+func NewSchema() *Schema {
+	return &Schema{}
+}
+
+// Tables returns the tables of the schema, in the order they were added.
+func (s *Schema) Tables() []*TableMap {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tables[:len(s.tables):len(s.tables)]
+}
+
+// attach checks that the schema can be used with dialect.
+func (s *Schema) attach(dialect Dialect) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := reflect.TypeOf(dialect)
+	if s.dialect == nil {
+		s.dialect = t
+	} else if s.dialect != t {
+		panic(fmt.Sprintf("modl: schema is used with %v, cannot use it with %v", s.dialect, t))
+	}
+}
+
+// SetSchema makes the DbMap use s for its tables.  It should be called
+// before any tables are added to the DbMap;  tables already added are not
+// carried over.  It panics if s is used by a DbMap with a different kind
+// of Dialect.
+func (m *DbMap) SetSchema(s *Schema) *DbMap {
+	s.attach(m.Dialect)
+	m.schema = s
+	return m
+}
+
+// Schema returns the Schema holding the DbMap's tables.
+func (m *DbMap) Schema() *Schema {
+	m.schemaOnce.Do(func() {
+		if m.schema == nil {
+			m.schema = NewSchema()
+			m.schema.attach(m.Dialect)
+		}
+	})
+	return m.schema
+}
+
+// dbmapOf returns the DbMap which e runs statements for.
+func dbmapOf(e SqlExecutor) *DbMap {
+	switch x := e.(type) {
+	case *DbMap:
+		return x
+	case *Transaction:
+		return x.dbmap
+	}
+	if h, ok := e.handle().(*tracingHandle); ok {
+		return h.d
+	}
+	return nil
+}
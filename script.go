@@ -0,0 +1,161 @@
+package modl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Terminator is implemented by dialects whose statements are not ended
+// with ";".  The statements modl generates end with its
+// StatementTerminator, which may be empty for drivers which reject it.
+type Terminator interface {
+	StatementTerminator() string
+}
+
+// ScriptSplitter is implemented by dialects which quote text differently
+// than standard SQL, to split scripts into statements for ExecScript.
+type ScriptSplitter interface {
+	// SplitScript returns the statements of script, without their
+	// terminators.
+	SplitScript(script string) []string
+}
+
+// terminator returns the string ending generated statements.
+func (m *DbMap) terminator() string {
+	if t, ok := m.Dialect.(Terminator); ok {
+		return t.StatementTerminator()
+	}
+	return ";"
+}
+
+// ExecScript runs each of the statements in script, which are ended by
+// ";", in order, and stops at the first which fails.  Semicolons in
+// quoted strings, identifiers and comments do not end statements, nor do
+// those in postgres' dollar quoted strings.  Scripts for MySQL may change
+// the terminator with DELIMITER lines, like the mysql client, eg. to
+// create triggers.  Statements are run as they are written, without
+// rebinding.  ExecScript does not start a transaction;  use
+// Transaction.ExecScript to run a script in one.
+func (m *DbMap) ExecScript(script string) error {
+	return execScript(m, script)
+}
+
+func execScript(e SqlExecutor, script string) error {
+	m := dbmapOf(e)
+	var stmts []string
+	if s, ok := m.Dialect.(ScriptSplitter); ok {
+		stmts = s.SplitScript(script)
+	} else {
+		stmts = splitScript(script, scriptQuoting{})
+	}
+	for i, stmt := range stmts {
+		if _, err := e.Exec(stmt, Raw()); err != nil {
+			return fmt.Errorf("modl: statement %d of script: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// scriptQuoting holds the quoting rules of a dialect beyond standard SQL.
+type scriptQuoting struct {
+	backticks    bool
+	backslashes  bool
+	hashComments bool
+	dollars      bool
+	delimiters   bool
+}
+
+// SplitScript splits script with postgres' dollar quoted strings and
+// escape strings.
+func (d PostgresDialect) SplitScript(script string) []string {
+	return splitScript(script, scriptQuoting{dollars: true})
+}
+
+// SplitScript splits script with MySQL's backtick quoted identifiers,
+// backslash escapes, # comments and DELIMITER lines.
+func (d MySQLDialect) SplitScript(script string) []string {
+	return splitScript(script, scriptQuoting{backticks: true, backslashes: true, hashComments: true, delimiters: true})
+}
+
+// splitScript returns the statements of script, ended by ";" or the
+// current DELIMITER, without their terminators.  Empty statements are
+// left out.
+func splitScript(script string, q scriptQuoting) []string {
+	var stmts []string
+	delim := ";"
+	start := 0
+	add := func(end int) {
+		if stmt := strings.TrimSpace(script[start:end]); len(stmt) > 0 {
+			stmts = append(stmts, stmt)
+		}
+	}
+	lineStart := true
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		if q.delimiters && lineStart && hasPrefixFold(strings.TrimLeft(script[i:], " \t"), "delimiter ") {
+			add(i)
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			fields := strings.Fields(script[i : i+end])
+			if len(fields) > 1 {
+				delim = fields[1]
+			}
+			i += end
+			start = i
+			continue
+		}
+		lineStart = c == '\n'
+		switch {
+		case c == '\'' || c == '"' || c == '`' && q.backticks:
+			escapes := q.backslashes || c == '\'' && q.dollars && i > 0 && (script[i-1] == 'E' || script[i-1] == 'e')
+			end := i + 1
+			for end < len(script) && script[end] != c {
+				if escapes && script[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			i = end
+		case c == '-' && strings.HasPrefix(script[i:], "--"), c == '#' && q.hashComments:
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				i = len(script)
+				continue
+			}
+			i += end - 1
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				i = len(script)
+				continue
+			}
+			i += end + 3
+		case c == '$' && q.dollars:
+			tag := dollarTag(script[i:])
+			if len(tag) == 0 {
+				continue
+			}
+			end := strings.Index(script[i+len(tag):], tag)
+			if end < 0 {
+				i = len(script)
+				continue
+			}
+			i += 2*len(tag) + end - 1
+		case strings.HasPrefix(script[i:], delim):
+			add(i)
+			i += len(delim) - 1
+			start = i + 1
+		}
+	}
+	if start < len(script) {
+		add(len(script))
+	}
+	return stmts
+}
+
+// hasPrefixFold is strings.HasPrefix ignoring case.
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
@@ -0,0 +1,189 @@
+package modl
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A Searcher is a Dialect with full-text search, which SelectSearch uses to
+// match the columns set up with TableMap.SetSearch.  Dialects which are not
+// Searchers match rows containing the text with like.
+type Searcher interface {
+	// SearchCondition returns a condition matching the rows of table whose
+	// search columns match the text bound to "?".
+	SearchCondition(table *TableMap) string
+	// SearchRank returns an expression ranking the rows matching the text
+	// bound to "?", which they are ordered by, best first, or "" if they
+	// are ordered by the condition.
+	SearchRank(table *TableMap) string
+	// SearchIndex returns a statement creating an index for the search
+	// condition, without its terminator, which CreateTables runs after
+	// creating table, or "" if there is none.
+	SearchIndex(table *TableMap, ifNotExists bool) string
+}
+
+// SetSearch makes the table searchable by SelectSearch on the given fields
+// or columns, which should hold text.  With a Searcher dialect,
+// CreateTables also creates an index for searching them.  It panics if a
+// column does not exist.
+func (t *TableMap) SetSearch(columns ...string) *TableMap {
+	t.search = nil
+	for _, c := range columns {
+		t.search = append(t.search, t.ColMap(c))
+	}
+	return t
+}
+
+// SetSearchConfig sets the text search configuration postgres parses the
+// table's search columns and queries with, eg. "simple".  It is "english"
+// by default.
+func (t *TableMap) SetSearchConfig(config string) *TableMap {
+	t.searchConfig = config
+	return t
+}
+
+// SelectSearch selects the rows of the table for dest, a pointer to a
+// slice of a type registered with AddTable, whose search columns match
+// text, and binds them to dest like Select.  Rows are matched with
+// postgres' text search, ordered by rank, or with MySQL's MATCH ... AGAINST
+// in natural language mode, ordered by relevance;  other dialects match
+// rows containing text.  QueryOptions may be passed in args.  See
+// TableMap.SetSearch.
+func (m *DbMap) SelectSearch(dest interface{}, text string, args ...interface{}) error {
+	return selectSearch(m, m, dest, text, args...)
+}
+
+func selectSearch(m *DbMap, e SqlExecutor, dest interface{}, text string, args ...interface{}) error {
+	table := m.TableFor(dest)
+	if table == nil {
+		return fmt.Errorf("modl: no table found for %T", dest)
+	}
+	if len(table.search) == 0 {
+		return fmt.Errorf("modl: table %s has no search columns", table.TableName)
+	}
+	_, opts := splitOptions(args)
+	scope, err := table.scopeArgs(opts.context())
+	if err != nil {
+		return err
+	}
+
+	d := m.Dialect
+	s := bytes.Buffer{}
+	s.WriteString("select ")
+	x := 0
+	for _, col := range table.Columns {
+		if col.isSelected() {
+			if x > 0 {
+				s.WriteString(",")
+			}
+			s.WriteString(col.selectColumn(d))
+			x++
+		}
+	}
+	s.WriteString(" from ")
+	s.WriteString(quoteTable(d, table.qualifiedName()))
+	s.WriteString(" where ")
+
+	all := []interface{}{text}
+	rank := ""
+	if searcher, ok := d.(Searcher); ok {
+		s.WriteString(strings.Replace(searcher.SearchCondition(table), "?", d.BindVar(0), 1))
+		rank = searcher.SearchRank(table)
+	} else {
+		s.WriteString(searchText(table, d) + " like " + d.BindVar(0) + " escape '!'")
+		all[0] = "%" + likeEscaper.Replace(text) + "%"
+	}
+	table.writeScope(&s, 1)
+	all = append(all, scope...)
+	if len(rank) > 0 {
+		s.WriteString(" order by " + strings.Replace(rank, "?", d.BindVar(len(all)), 1) + " desc")
+		all = append(all, text)
+	}
+
+	return hookedselect(m, e, dest, s.String(), append(all, args...)...)
+}
+
+// likeEscaper escapes the wildcards of a like pattern with "!".
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// searchText returns an expression concatenating the table's search
+// columns, separated by spaces.
+func searchText(table *TableMap, d Dialect) string {
+	parts := make([]string, len(table.search))
+	for i, col := range table.search {
+		parts[i] = "coalesce(" + d.QuoteField(col.ColumnName) + ", '')"
+	}
+	return strings.Join(parts, " || ' ' || ")
+}
+
+// searchIndexName returns the name of the index for table's search.
+func searchIndexName(table *TableMap) string {
+	return unqualified(table.TableName) + "_search_idx"
+}
+
+// searchVector returns the tsvector of table's search columns, which its
+// search index is built on.
+func (d PostgresDialect) searchVector(table *TableMap) string {
+	return fmt.Sprintf("to_tsvector(%s, %s)", d.searchConfig(table), searchText(table, d))
+}
+
+func (d PostgresDialect) searchConfig(table *TableMap) string {
+	config := table.searchConfig
+	if len(config) == 0 {
+		config = "english"
+	}
+	return quoteValues([]string{config}) + "::regconfig"
+}
+
+// SearchRank returns the ts_rank of the tsvector of the search columns.
+func (d PostgresDialect) SearchRank(table *TableMap) string {
+	return fmt.Sprintf("ts_rank(%s, websearch_to_tsquery(%s, ?))", d.searchVector(table), d.searchConfig(table))
+}
+
+// SearchCondition matches the tsvector of the search columns against the
+// text parsed with websearch_to_tsquery, which understands quoted phrases,
+// "or" and "-".
+func (d PostgresDialect) SearchCondition(table *TableMap) string {
+	return fmt.Sprintf("%s @@ websearch_to_tsquery(%s, ?)", d.searchVector(table), d.searchConfig(table))
+}
+
+// SearchIndex returns a statement creating a GIN index on the tsvector of
+// the search columns.
+func (d PostgresDialect) SearchIndex(table *TableMap, ifNotExists bool) string {
+	ine := ""
+	if ifNotExists {
+		ine = "if not exists "
+	}
+	return fmt.Sprintf("create index %s%s on %s using gin (%s)", ine, d.QuoteField(searchIndexName(table)), quoteTable(d, table.qualifiedName()), d.searchVector(table))
+}
+
+// searchColumns returns the quoted search columns of table.
+func (d MySQLDialect) searchColumns(table *TableMap) string {
+	cols := make([]string, len(table.search))
+	for i, col := range table.search {
+		cols[i] = d.QuoteField(col.ColumnName)
+	}
+	return strings.Join(cols, ", ")
+}
+
+// SearchCondition returns a MATCH ... AGAINST in natural language mode.
+func (d MySQLDialect) SearchCondition(table *TableMap) string {
+	return fmt.Sprintf("match (%s) against (? in natural language mode)", d.searchColumns(table))
+}
+
+// SearchRank returns "", as rows matched in natural language mode are
+// ordered by relevance.
+func (d MySQLDialect) SearchRank(table *TableMap) string {
+	return ""
+}
+
+// SearchIndex returns a statement creating a FULLTEXT index on the search
+// columns.  MySQL cannot create indexes only if they do not exist, so
+// there is none if ifNotExists is true.
+func (d MySQLDialect) SearchIndex(table *TableMap, ifNotExists bool) string {
+	if ifNotExists {
+		return ""
+	}
+	return fmt.Sprintf("create fulltext index %s on %s (%s)", d.QuoteField(searchIndexName(table)), quoteTable(d, table.qualifiedName()), d.searchColumns(table))
+}
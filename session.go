@@ -0,0 +1,267 @@
+package modl
+
+import (
+	"reflect"
+)
+
+type sessionState int
+
+const (
+	sessionNew sessionState = iota
+	sessionLoaded
+	sessionRemoved
+)
+
+// tracked is a row held by a Session, and a copy of it as it was when it
+// was loaded or last flushed.
+type tracked struct {
+	ptr      interface{}
+	table    *TableMap
+	state    sessionState
+	snapshot reflect.Value
+}
+
+// A Session is a unit of work:  it tracks rows which are loaded through
+// it, added to it or removed from it, and writes the changes to them in a
+// single transaction when it is flushed.  Rows are inserted, updated if
+// their columns have changed since they were loaded, and deleted, with the
+// tables ordered by the relations declared with HasMany and BelongsTo, so
+// that rows are inserted after the rows they belong to and deleted before
+// them.  The hooks of updated rows are passed the rows as they were
+// loaded, see WithOld.  A Session is not safe for concurrent use.
+type Session struct {
+	dbmap *DbMap
+	rows  map[interface{}]*tracked
+	order []*tracked
+}
+
+// NewSession returns an empty Session which reads from and writes to m.
+func (m *DbMap) NewSession() *Session {
+	return &Session{dbmap: m, rows: map[interface{}]*tracked{}}
+}
+
+// Get runs DbMap.Get and tracks the row.
+func (s *Session) Get(dest interface{}, keys ...interface{}) error {
+	if err := s.dbmap.Get(dest, keys...); err != nil {
+		return err
+	}
+	return s.Attach(dest)
+}
+
+// Select runs DbMap.Select and tracks each of the rows, which must be of a
+// type registered with AddTable.  dest should be a pointer to a slice of
+// pointers, so that the rows stay where the Session tracks them.
+func (s *Session) Select(dest interface{}, query string, args ...interface{}) error {
+	if err := s.dbmap.Select(dest, query, args...); err != nil {
+		return err
+	}
+	v := reflect.Indirect(reflect.ValueOf(dest))
+	for i := 0; i < v.Len(); i++ {
+		row := v.Index(i)
+		if row.Kind() != reflect.Ptr {
+			row = row.Addr()
+		}
+		if err := s.Attach(row.Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attach tracks each element in list, pointers to rows which are already
+// in the database, as loaded, so that Flush updates them if they change.
+func (s *Session) Attach(list ...interface{}) error {
+	return s.track(sessionLoaded, list)
+}
+
+// Add tracks each element in list as a new row, which Flush inserts.
+func (s *Session) Add(list ...interface{}) error {
+	return s.track(sessionNew, list)
+}
+
+// Remove marks each element in list for deletion by Flush.  Removing a
+// row which has been added but not flushed forgets it.
+func (s *Session) Remove(list ...interface{}) error {
+	for _, ptr := range list {
+		if t, ok := s.rows[ptr]; ok && t.state == sessionNew {
+			s.forget(t)
+			continue
+		}
+		if err := s.track(sessionRemoved, []interface{}{ptr}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Detach stops tracking each element in list.
+func (s *Session) Detach(list ...interface{}) {
+	for _, ptr := range list {
+		if t, ok := s.rows[ptr]; ok {
+			s.forget(t)
+		}
+	}
+}
+
+// Clear stops tracking all rows.
+func (s *Session) Clear() {
+	s.rows = map[interface{}]*tracked{}
+	s.order = nil
+}
+
+func (s *Session) track(state sessionState, list []interface{}) error {
+	for _, ptr := range list {
+		table, elem, err := tableForPointer(s.dbmap, ptr, true)
+		if err != nil {
+			return err
+		}
+		t, ok := s.rows[ptr]
+		if !ok {
+			t = &tracked{ptr: ptr, table: table}
+			s.rows[ptr] = t
+			s.order = append(s.order, t)
+		}
+		t.state = state
+		t.snapshot = reflect.ValueOf(snapshot(elem)).Elem()
+	}
+	return nil
+}
+
+func (s *Session) forget(t *tracked) {
+	delete(s.rows, t.ptr)
+	for i, o := range s.order {
+		if o == t {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// changed returns true if t's row differs from its snapshot in any column
+// which Update writes.
+func (t *tracked) changed() bool {
+	elem := reflect.Indirect(reflect.ValueOf(t.ptr))
+	for _, col := range t.table.Columns {
+		if !col.isWritten() || col.isPK {
+			continue
+		}
+		a := elem.FieldByIndex(col.fieldIndex).Interface()
+		b := t.snapshot.FieldByIndex(col.fieldIndex).Interface()
+		if !reflect.DeepEqual(a, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending returns the number of rows Flush would insert, update and
+// delete.
+func (s *Session) Pending() (inserts, updates, deletes int) {
+	for _, t := range s.order {
+		switch {
+		case t.state == sessionNew:
+			inserts++
+		case t.state == sessionRemoved:
+			deletes++
+		case t.changed():
+			updates++
+		}
+	}
+	return inserts, updates, deletes
+}
+
+// Flush writes the Session's changes in a transaction.  If it fails, the
+// transaction is rolled back and the Session is left as it was, so that
+// it can be flushed again.  Otherwise inserted and updated rows are
+// tracked as loaded, and deleted rows are no longer tracked.
+func (s *Session) Flush() error {
+	tables := s.tableOrder()
+	b := s.dbmap.NewWriteBatch()
+	var written []*tracked
+	for _, table := range tables {
+		for _, t := range s.order {
+			if t.table == table && t.state == sessionNew {
+				b.Insert(t.ptr)
+				written = append(written, t)
+			}
+		}
+	}
+	for _, t := range s.order {
+		if t.state == sessionLoaded && t.changed() {
+			b.Update(t.ptr, WithOld(t.ptr, snapshot(t.snapshot)))
+			written = append(written, t)
+		}
+	}
+	var removed []*tracked
+	for i := len(tables) - 1; i >= 0; i-- {
+		for _, t := range s.order {
+			if t.table == tables[i] && t.state == sessionRemoved {
+				b.Delete(t.ptr)
+				removed = append(removed, t)
+			}
+		}
+	}
+
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	for _, t := range written {
+		t.state = sessionLoaded
+		t.snapshot = reflect.ValueOf(snapshot(reflect.Indirect(reflect.ValueOf(t.ptr)))).Elem()
+	}
+	for _, t := range removed {
+		s.forget(t)
+	}
+	return nil
+}
+
+// tableOrder returns the tables of the tracked rows, each after the tables
+// it belongs to by its relations.  Tables in a cycle keep the order their
+// rows were tracked in.
+func (s *Session) tableOrder() []*TableMap {
+	var tables []*TableMap
+	seen := map[*TableMap]bool{}
+	for _, t := range s.order {
+		if !seen[t.table] {
+			seen[t.table] = true
+			tables = append(tables, t.table)
+		}
+	}
+
+	// parents[t] holds the tables t's rows belong to
+	parents := map[*TableMap][]*TableMap{}
+	for _, table := range tables {
+		for _, rel := range table.relations {
+			other := s.dbmap.TableForType(rel.target)
+			if other == nil || !seen[other] || other == table {
+				continue
+			}
+			if rel.many {
+				parents[other] = append(parents[other], table)
+			} else {
+				parents[table] = append(parents[table], other)
+			}
+		}
+	}
+
+	var ordered []*TableMap
+	done := map[*TableMap]bool{}
+	visiting := map[*TableMap]bool{}
+	var visit func(*TableMap)
+	visit = func(table *TableMap) {
+		if done[table] || visiting[table] {
+			return
+		}
+		visiting[table] = true
+		for _, p := range parents[table] {
+			visit(p)
+		}
+		visiting[table] = false
+		done[table] = true
+		ordered = append(ordered, table)
+	}
+	for _, table := range tables {
+		visit(table)
+	}
+	return ordered
+}
@@ -0,0 +1,46 @@
+package modl
+
+import (
+	"math/rand"
+	"runtime/debug"
+	"time"
+)
+
+// redacted replaces bound values which should not be logged.
+const redacted = "[redacted]"
+
+// SlowQuery describes a statement which took longer than a DbMap's
+// SlowQueryThreshold to run.
+type SlowQuery struct {
+	Query    string
+	Args     []interface{}
+	Duration time.Duration
+	// Stack is the goroutine stack at the time the statement completed.
+	Stack []byte
+	// Plan is the statement's plan, if the DbMap's SlowQueryExplain is
+	// set and it could be explained.
+	Plan []ExplainRow
+}
+
+// observe reports the statement to the slow query log if it ran for longer
+// than the configured threshold.  explain, if not nil, returns its plan.
+func (m *DbMap) observe(query string, args []interface{}, d time.Duration, explain func() []ExplainRow) {
+	if m.SlowQueryThreshold <= 0 || d < m.SlowQueryThreshold || m.SlowQueryLogger == nil {
+		return
+	}
+	if m.SlowQuerySampleRate > 0 && rand.Float64() >= m.SlowQuerySampleRate {
+		return
+	}
+	if m.SlowQueryRedactArgs {
+		r := make([]interface{}, len(args))
+		for i := range r {
+			r[i] = redacted
+		}
+		args = r
+	}
+	var plan []ExplainRow
+	if m.SlowQueryExplain && explain != nil {
+		plan = explain()
+	}
+	m.SlowQueryLogger(SlowQuery{Query: query, Args: args, Duration: d, Stack: debug.Stack(), Plan: plan})
+}
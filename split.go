@@ -0,0 +1,160 @@
+package modl
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// splitIn returns the lists of args to run query with one after the other
+// instead of args, if the slices in args would be expanded into more bind
+// parameters than the Dialect's MaxBindParams:  the longest slice, which
+// must be the list of an "in" condition, is split into chunks which fit,
+// and the other args, including QueryOptions, are kept in each list.
+// Queries are only split if they have no "or" or negated condition, so
+// that the "in" condition is one the others are and-ed with, and each
+// chunk matches only the rows of its own part of the list.  Queries
+// returning rows are only split if they do not order, limit, group or
+// aggregate them, as rows read in chunks could not be.  It returns nil if
+// args need not or cannot be split, so that query is run as it is.
+func (m *DbMap) splitIn(query string, args []interface{}, rows bool) [][]interface{} {
+	// bindvar is the number of the longest slice among the args which are
+	// not options
+	total, longest, n, bindvar, bound := 0, -1, 0, 0, 0
+	for i, a := range args {
+		if _, ok := a.(QueryOption); ok {
+			continue
+		}
+		l := sliceLen(a)
+		if l < 0 {
+			total++
+		} else if total += l; l > n {
+			longest, n, bindvar = i, l, bound
+		}
+		bound++
+	}
+	max := m.Dialect.MaxBindParams()
+	room := max - (total - n)
+	if longest < 0 || total <= max || room < 1 || !inList(query, bindvar) {
+		return nil
+	}
+	if disjunctive.MatchString(query) {
+		return nil
+	}
+	if rows && unsplittable.MatchString(strings.ToLower(query)) {
+		return nil
+	}
+	v := reflect.ValueOf(args[longest])
+	var chunks [][]interface{}
+	for start := 0; start < n; start += room {
+		end := start + room
+		if end > n {
+			end = n
+		}
+		chunk := append([]interface{}{}, args...)
+		chunk[longest] = v.Slice(start, end).Interface()
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// sliceLen returns the length of a, if it is a slice expanded into a list
+// of bindvars, or -1.  See hasSliceArg.
+func sliceLen(a interface{}) int {
+	if _, ok := a.(driver.Valuer); ok {
+		return -1
+	}
+	v := reflect.ValueOf(a)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 {
+		return -1
+	}
+	return v.Len()
+}
+
+var (
+	// inListBefore and inListAfter match the text around the bindvar of
+	// the whole list of an "in" condition
+	inListBefore = regexp.MustCompile(`(?i)(^|[^\w])in\s*\(\s*$`)
+	notInBefore  = regexp.MustCompile(`(?i)(^|[^\w])not\s+in\s*\(\s*$`)
+	inListAfter  = regexp.MustCompile(`^\s*\)`)
+
+	// disjunctive matches queries whose "in" condition may not be and-ed
+	// with the rest of their conditions
+	disjunctive = regexp.MustCompile(`(?i)\bor\b|\bnot\s*\(`)
+
+	// unsplittable matches queries whose rows cannot be read in chunks
+	unsplittable = regexp.MustCompile(`\b(order|group)\s+by\b|\b(limit|offset|fetch|top|distinct|having|union|intersect|except)\b|\b(count|sum|avg|min|max|array_agg|string_agg|group_concat)\s*\(`)
+)
+
+// inList returns true if the "?" bindvar number n of query, counting from
+// 0 as sqlx.In does, is the whole list of an "in" condition, which can be
+// split.  Lists of "not in" conditions cannot.  Question marks in strings
+// and comments, and escaped as "??", are not counted.
+func inList(query string, n int) bool {
+	i := -1
+	scanBindvars(query, func(j int, escaped bool) {
+		if !escaped && n >= 0 {
+			i = j
+			n--
+		}
+	})
+	if i < 0 || n >= 0 {
+		return false
+	}
+	before, after := query[:i], query[i+1:]
+	return inListBefore.MatchString(before) && !notInBefore.MatchString(before) && inListAfter.MatchString(after)
+}
+
+// selectChunks runs query with each list of args in chunks into dest, a
+// pointer to a slice, and appends the rows of all of them to it, as Select
+// does, or sets it to them if the call reuses the slice.
+func selectChunks(m *DbMap, e SqlExecutor, dest interface{}, query string, chunks [][]interface{}) error {
+	v := reflect.ValueOf(dest).Elem()
+	rows := reflect.MakeSlice(v.Type(), 0, 0)
+	for _, args := range chunks {
+		part := reflect.New(v.Type())
+		if err := hookedselect(m, e, part.Interface(), query, args...); err != nil {
+			return err
+		}
+		rows = reflect.AppendSlice(rows, part.Elem())
+	}
+	if _, opts := splitOptions(chunks[0]); !opts.reuse {
+		rows = reflect.AppendSlice(v, rows)
+	}
+	v.Set(rows)
+	return nil
+}
+
+// execChunks runs query with each list of args in chunks with e, and
+// returns a result of the number of rows all of them affected, and the
+// last id inserted.  The chunks are run one after the other, so unless e
+// is a Transaction, those run before one which fails are not undone.
+func execChunks(e SqlExecutor, query string, chunks [][]interface{}) (sql.Result, error) {
+	var res chunkedResult
+	for _, args := range chunks {
+		r, err := e.Exec(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		res.Result = r
+		n, err := r.RowsAffected()
+		if err != nil {
+			res.err = err
+		}
+		res.rows += n
+	}
+	return res, nil
+}
+
+// chunkedResult is the result of a statement run in chunks.
+type chunkedResult struct {
+	sql.Result
+	rows int64
+	err  error
+}
+
+func (r chunkedResult) RowsAffected() (int64, error) {
+	return r.rows, r.err
+}
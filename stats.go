@@ -0,0 +1,225 @@
+package modl
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsSamples is the number of recent durations kept per fingerprint to
+// compute percentiles from.
+const statsSamples = 512
+
+// QueryStats are the statistics collected for statements sharing a
+// fingerprint.  See DbMap.CollectStats.
+type QueryStats struct {
+	// Fingerprint is the statement with its literals and bind variables
+	// replaced by ?, and comments and extra whitespace removed.
+	Fingerprint string
+	Count       int64
+	Errors      int64
+	// HardTimeouts is the number of statements cancelled by the DbMap's
+	// hard timeout, which are also counted in Errors.
+	HardTimeouts int64
+	// Rows is the total number of rows read by Selects and Gets, and
+	// affected by Execs.  Rows read with Queryx are not counted.
+	Rows      int64
+	TotalTime time.Duration
+	// P50, P95 and P99 are percentiles of the durations of recent
+	// statements.
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+	// LastError is the most recent error, and when it happened.
+	LastError   error
+	LastErrorAt time.Time
+}
+
+// statsRegistry holds the statistics of a DbMap by fingerprint.
+type statsRegistry struct {
+	mu    sync.Mutex
+	stats map[string]*queryStats
+}
+
+type queryStats struct {
+	QueryStats
+	samples []time.Duration
+	next    int
+}
+
+// Stats returns the statistics collected for each fingerprint while
+// CollectStats was set, with the most time consuming first.
+func (m *DbMap) Stats() []QueryStats {
+	r := &m.stats
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make([]QueryStats, 0, len(r.stats))
+	for _, s := range r.stats {
+		qs := s.QueryStats
+		samples := append([]time.Duration(nil), s.samples...)
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		qs.P50 = percentile(samples, 50)
+		qs.P95 = percentile(samples, 95)
+		qs.P99 = percentile(samples, 99)
+		stats = append(stats, qs)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].TotalTime != stats[j].TotalTime {
+			return stats[i].TotalTime > stats[j].TotalTime
+		}
+		return stats[i].Fingerprint < stats[j].Fingerprint
+	})
+	return stats
+}
+
+// ResetStats discards the collected statistics.
+func (m *DbMap) ResetStats() {
+	m.stats.mu.Lock()
+	defer m.stats.mu.Unlock()
+	m.stats.stats = nil
+}
+
+// record adds a statement which took d and read or wrote rows rows, or -1
+// if unknown, to the statistics of its fingerprint.
+func (r *statsRegistry) record(query string, d time.Duration, rows int64, err error) {
+	fp := Fingerprint(query)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stats == nil {
+		r.stats = map[string]*queryStats{}
+	}
+	s, ok := r.stats[fp]
+	if !ok {
+		s = &queryStats{QueryStats: QueryStats{Fingerprint: fp}}
+		r.stats[fp] = s
+	}
+	s.Count++
+	s.TotalTime += d
+	if rows > 0 {
+		s.Rows += rows
+	}
+	if err != nil && err != sql.ErrNoRows {
+		s.Errors++
+		var hte *HardTimeoutError
+		if errors.As(err, &hte) {
+			s.HardTimeouts++
+		}
+		s.LastError, s.LastErrorAt = err, time.Now()
+	}
+	if len(s.samples) < statsSamples {
+		s.samples = append(s.samples, d)
+	} else {
+		s.samples[s.next] = d
+		s.next = (s.next + 1) % statsSamples
+	}
+}
+
+// percentile returns the p'th percentile of sorted.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// bindLists matches lists of bind variables, like those expanded from a
+// slice argument.
+var bindLists = regexp.MustCompile(`\(\?(, \?)+\)`)
+
+// Fingerprint returns query with its string and numeric literals and bind
+// variables replaced by ?, lists of them collapsed to a single (?), and
+// comments and extra whitespace removed, so that statements which differ
+// only in their values have the same fingerprint.
+func Fingerprint(query string) string {
+	var b strings.Builder
+	space := false
+	emit := func(s string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(s)
+	}
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			space = true
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+			space = true
+		case c == '\'':
+			for i++; i < len(query); i++ {
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			emit("?")
+		case c == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			for i+1 < len(query) && isDigit(query[i+1]) {
+				i++
+			}
+			emit("?")
+		case isDigit(c) && (i == 0 || !isWordByte(lower(query[i-1]))):
+			for i+1 < len(query) && (isDigit(query[i+1]) || query[i+1] == '.') {
+				i++
+			}
+			emit("?")
+		case c == ',' || c == ')':
+			space = false
+			b.WriteByte(c)
+			if c == ',' {
+				space = true
+			}
+		case c == '(':
+			emit("(")
+			space = false
+			for i+1 < len(query) && isSpace(query[i+1]) {
+				i++
+			}
+		default:
+			emit(query[i : i+1])
+		}
+	}
+	return bindLists.ReplaceAllString(b.String(), "(?)")
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
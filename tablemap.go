@@ -2,8 +2,12 @@ package modl
 
 import (
 	"bytes"
+	"context"
+	"database/sql/driver"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/reflectx"
@@ -13,7 +17,9 @@ import (
 // Use dbmap.AddTable() or dbmap.AddTableWithName() to create these
 type TableMap struct {
 	// Name of database table.
-	TableName  string
+	TableName string
+	// Name of the schema holding the table, if it is not the default.
+	SchemaName string
 	Keys       []*ColumnMap
 	Columns    []*ColumnMap
 	gotype     reflect.Type
@@ -22,9 +28,11 @@ type TableMap struct {
 	updatePlan bindPlan
 	deletePlan bindPlan
 	getPlan    bindPlan
+	existsPlan bindPlan
 	dbmap      *DbMap
 	mapper     *reflectx.Mapper
 	// Cached capabilities for the struct mapped to this table
+	CanValidate   bool
 	CanPreInsert  bool
 	CanPostInsert bool
 	CanPostGet    bool
@@ -32,16 +40,142 @@ type TableMap struct {
 	CanPostUpdate bool
 	CanPreDelete  bool
 	CanPostDelete bool
+	// If true, the table is created "without rowid" on sqlite.
+	WithoutRowID bool
+	// If true, Insert uses auto-increment key values which are already set.
+	explicitKeys bool
+	// If true, Insert re-reads each row after it is inserted.
+	returningAll bool
+	// If true, the ChangeEvents of Updates include the row before.
+	oldSnapshots bool
+	// If true, Updates read the row before and pass it to their hooks.
+	oldRows bool
+	// The column and value telling this table's rows apart from those of
+	// the other types sharing it.
+	discriminator      string
+	discriminatorValue string
+	// The circuit breaker guarding writes to the table, if any.
+	breaker *CircuitBreaker
+	// MySQL table options, which override those set on the MySQLDialect.
+	Engine    string
+	Charset   string
+	Collation string
+	// A condition added to generated Get, Update and Delete statements.
+	scope         string
+	scopeResolver ScopeResolver
+	// The columns SelectSearch matches, and the postgres text search
+	// configuration it uses.
+	search       []*ColumnMap
+	searchConfig string
+	// How the version column is advanced, and the version of new rows.
+	versionStrategy VersionStrategy
+	versionInitial  int64
+	// Named queries run by Find.
+	finders map[string]string
+	// The func fields loading related rows.
+	relations []*relation
+	// The hooks added with AddHook, run after the row's own.
+	hooks map[HookEvent][]HookFunc
+	// The mapping the cached plans were built from.
+	shape *planShape
+	// The comment stored on the table by CreateTables.
+	comment string
+	// The name of the table keeping the versions of the rows, if any.
+	history string
+	// The column holding a checksum of the others, if any.
+	checksum *ColumnMap
+	// The Cache Get reads the rows through, if any.
+	rowCache *rowCache
 }
 
+// A ScopeResolver returns the values bound to the "?" bindvars of a
+// TableMap's default scope, eg. the tenant of the current request.  ctx
+// is the context passed with WithContext, or context.Background().
+type ScopeResolver func(ctx context.Context) ([]interface{}, error)
+
 // ResetSql removes cached insert/update/select/delete SQL strings
 // associated with this TableMap.  Call this if you've modified
-// any column names or the table name itself.
+// any column names or the table name itself.  Changes to the TableName,
+// SchemaName, Keys and Columns and to the columns' names and transience
+// are also noticed the next time a statement is planned, and reset the
+// cached SQL then.
 func (t *TableMap) ResetSql() {
 	t.insertPlan = bindPlan{}
 	t.updatePlan = bindPlan{}
 	t.deletePlan = bindPlan{}
 	t.getPlan = bindPlan{}
+	t.existsPlan = bindPlan{}
+	t.shape = nil
+}
+
+// planShape records the parts of a TableMap which may be changed directly,
+// as they were when its cached plans were built.
+type planShape struct {
+	table   string
+	schema  string
+	keys    []*ColumnMap
+	columns []columnShape
+}
+
+type columnShape struct {
+	col       *ColumnMap
+	name      string
+	transient bool
+}
+
+func (t *TableMap) currentShape() *planShape {
+	shape := &planShape{table: t.TableName, schema: t.SchemaName, keys: append([]*ColumnMap{}, t.Keys...)}
+	shape.columns = make([]columnShape, len(t.Columns))
+	for i, col := range t.Columns {
+		shape.columns[i] = columnShape{col, col.ColumnName, col.Transient}
+	}
+	return shape
+}
+
+// matches returns true if t has not been changed since shape was recorded.
+func (shape *planShape) matches(t *TableMap) bool {
+	if shape.table != t.TableName || shape.schema != t.SchemaName ||
+		len(shape.keys) != len(t.Keys) || len(shape.columns) != len(t.Columns) {
+		return false
+	}
+	for i, key := range t.Keys {
+		if shape.keys[i] != key {
+			return false
+		}
+	}
+	for i, col := range t.Columns {
+		c := shape.columns[i]
+		if c.col != col || c.name != col.ColumnName || c.transient != col.Transient {
+			return false
+		}
+	}
+	return true
+}
+
+// checkShape resets the cached plans if the table has been changed since
+// they were built, so that they are not used with a stale mapping.
+func (t *TableMap) checkShape() {
+	if t.shape != nil && !t.shape.matches(t) {
+		t.ResetSql()
+	}
+}
+
+// SetSchema sets the schema holding the table, so that the SQL generated
+// for it, including by CreateTables, names it as schema.table.
+//
+// Automatically calls ResetSql() to ensure SQL statements are regenerated.
+func (t *TableMap) SetSchema(schema string) *TableMap {
+	t.SchemaName = schema
+	t.ResetSql()
+	return t
+}
+
+// qualifiedName returns the table's name, qualified by its schema.
+func (t *TableMap) qualifiedName() string {
+	if len(t.SchemaName) > 0 {
+		return t.SchemaName + "." + t.TableName
+	}
+	return t.TableName
 }
 
 // SetKeys lets you specify the fields on a struct that map to primary
@@ -64,6 +198,289 @@ func (t *TableMap) SetKeys(isAutoIncr bool, fieldNames ...string) *TableMap {
 	return t
 }
 
+// SetWithoutRowID marks the table to be created as a "without rowid" table
+// on sqlite, which stores rows clustered by primary key.  Such tables must
+// have a primary key and cannot use autoincrement.  Other dialects ignore
+// this setting.
+func (t *TableMap) SetWithoutRowID(b bool) *TableMap {
+	t.WithoutRowID = b
+	return t
+}
+
+// SetExplicitKeys controls whether Insert includes the values of
+// auto-increment keys which are already set on the struct, rather than
+// having the database generate them.  Zero valued keys are still
+// generated.  This is useful when importing or replicating rows with
+// known ids.  See also the ExplicitKeys option, which applies to a single
+// call.
+func (t *TableMap) SetExplicitKeys(b bool) *TableMap {
+	t.explicitKeys = b
+	return t
+}
+
+// SetReturningAll controls whether Insert reads each row back into its
+// struct after it is inserted, so that values set by the database, such
+// as column defaults, triggers and computed columns, are reflected on it.
+// Dialects which support it use a "returning" clause, and others run a
+// follow-up Get.  See also the ReturningAll option, which applies to a
+// single call.
+func (t *TableMap) SetReturningAll(b bool) *TableMap {
+	t.returningAll = b
+	return t
+}
+
+// SetEngine sets the MySQL storage engine used to create this table,
+// overriding the engine set on the MySQLDialect.
+func (t *TableMap) SetEngine(engine string) *TableMap {
+	t.Engine = engine
+	return t
+}
+
+// SetCharset sets the MySQL character set used to create this table,
+// overriding the encoding set on the MySQLDialect.
+func (t *TableMap) SetCharset(charset string) *TableMap {
+	t.Charset = charset
+	return t
+}
+
+// SetCollation sets the MySQL collation used to create this table.
+func (t *TableMap) SetCollation(collation string) *TableMap {
+	t.Collation = collation
+	return t
+}
+
+// SetComment sets the comment CreateTables stores on this table, on
+// dialects which implement CommentDialect.  To unset, call with the empty
+// string.
+func (t *TableMap) SetComment(comment string) *TableMap {
+	t.comment = comment
+	return t
+}
+
+// ColumnOrder is the order in which a table's columns appear in the
+// statements modl generates for it.  For a given order, the statements'
+// text depends only on the table's mapping, so it is the same across
+// processes, which keeps statement caches and query fingerprints stable,
+// and the output of CreateTablesSql can be kept under version control.
+type ColumnOrder int
+
+const (
+	// DeclarationOrder orders columns as their fields are declared in the
+	// struct.  It is the default.
+	DeclarationOrder ColumnOrder = iota
+	// AlphabeticalOrder orders columns by name, so that reordering the
+	// fields of the struct does not change the statements.
+	AlphabeticalOrder
+)
+
+// SetColumnOrder sets the order of the table's columns in the statements
+// and create table statement generated for it.  The columns named by
+// first, by field or column name, come before the others, in the order
+// given, eg. to keep the key and timestamps at the front of the create
+// table statement whatever the order of the struct's fields.  It panics
+// if there is no such column.  The order of the primary key columns in
+// where clauses is always the order given to SetKeys.
+//
+// Automatically calls ResetSql() to ensure SQL statements are regenerated.
+func (t *TableMap) SetColumnOrder(order ColumnOrder, first ...string) *TableMap {
+	position := map[*ColumnMap]int{}
+	for i, name := range first {
+		col := t.ColMap(name)
+		if _, ok := position[col]; !ok {
+			position[col] = i
+		}
+	}
+	less := func(a, b *ColumnMap) bool {
+		return lessIndex(a.fieldIndex, b.fieldIndex)
+	}
+	if order == AlphabeticalOrder {
+		less = func(a, b *ColumnMap) bool {
+			return a.ColumnName < b.ColumnName
+		}
+	}
+	sort.SliceStable(t.Columns, func(i, j int) bool {
+		a, b := t.Columns[i], t.Columns[j]
+		pa, aFirst := position[a]
+		pb, bFirst := position[b]
+		switch {
+		case aFirst && bFirst:
+			return pa < pb
+		case aFirst || bFirst:
+			return aFirst
+		}
+		return less(a, b)
+	})
+	t.ResetSql()
+	return t
+}
+
+// lessIndex returns true if the field at index a is declared before the
+// one at index b.
+func lessIndex(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// SetDefaultScope adds condition to the where clauses of the statements
+// generated for Get, Reload, Update and Delete, eg. "org_id = ?", so that
+// they cannot reach rows outside of the scope.  Values for the "?" bindvars
+// in condition are returned by resolve, which may be nil if condition has
+// none.  Select and Exec, which run the caller's SQL, are not scoped.
+//
+// Automatically calls ResetSql() to ensure SQL statements are regenerated.
+func (t *TableMap) SetDefaultScope(condition string, resolve ScopeResolver) *TableMap {
+	t.scope = condition
+	t.scopeResolver = resolve
+	t.ResetSql()
+	return t
+}
+
+// scopeArgs returns the values for the bindvars of the table's default
+// scope.
+func (t *TableMap) scopeArgs(ctx context.Context) ([]interface{}, error) {
+	if len(t.scope) == 0 || t.scopeResolver == nil {
+		return nil, nil
+	}
+	return t.scopeResolver(ctx)
+}
+
+// writeScope writes the table's default scope to s as an additional
+// condition, numbering its bindvars from offset.  The condition on the
+// table's discriminator, if it has one, is written first.
+func (t *TableMap) writeScope(s *bytes.Buffer, offset int) {
+	t.writeDiscriminator(s)
+	if len(t.scope) == 0 {
+		return
+	}
+	s.WriteString(" and (")
+	for _, r := range t.scope {
+		if r == '?' {
+			s.WriteString(t.dbmap.Dialect.BindVar(offset))
+			offset++
+			continue
+		}
+		s.WriteRune(r)
+	}
+	s.WriteString(")")
+}
+
+// addColumns adds a column for each field of the struct type t, which is
+// at index in the table's type.  Fields tagged with `db:"prefix,embed"` are
+// value structs whose own fields are mapped to columns named with prefix,
+// eg. an Address field tagged `db:"addr_,embed"` maps to addr_street and
+// addr_city.  Their fields are named like "Address.Street".  Fields tagged
+// with `db:"name,omitempty"` are set up with SetUseDefault(true).
+func (t *TableMap) addColumns(st reflect.Type, index []int, namePrefix, columnPrefix string) {
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		fieldIndex := append(index[:len(index):len(index)], f.Index...)
+		columnName := f.Tag.Get("db")
+		if prefix := strings.TrimSuffix(columnName, ",embed"); prefix != columnName && f.Type.Kind() == reflect.Struct {
+			t.addColumns(f.Type, fieldIndex, namePrefix+f.Name+".", columnPrefix+prefix)
+			continue
+		}
+		omitEmpty := false
+		if n := strings.Index(columnName, ","); n >= 0 {
+			for _, opt := range strings.Split(columnName[n+1:], ",") {
+				if opt == "omitempty" {
+					omitEmpty = true
+				}
+			}
+			columnName = columnName[:n]
+		}
+		if columnName == "" {
+			columnName = sqlx.NameMapper(f.Name)
+		}
+		if columnName != "-" {
+			columnName = columnPrefix + columnName
+		}
+
+		t.Columns = append(t.Columns, &ColumnMap{
+			ColumnName: columnName,
+			Transient:  columnName == "-",
+			fieldName:  namePrefix + f.Name,
+			fieldIndex: fieldIndex,
+			gotype:     f.Type,
+			useDefault: omitEmpty,
+			table:      t,
+		})
+	}
+}
+
+// UnsupportedFieldError describes a field of a table's type which modl
+// cannot map to a column.  AddTable makes such fields transient, and
+// reports them to the DbMap's UnsupportedFieldLogger, or logs them as
+// warnings if it is not set.
+type UnsupportedFieldError struct {
+	TableName string
+	Field     string
+	Type      reflect.Type
+	// Hint says how the field could be mapped.
+	Hint string
+}
+
+func (e UnsupportedFieldError) Error() string {
+	return fmt.Sprintf("modl: field %s of table %s has type %s, which cannot be stored in a column, so it is transient; %s",
+		e.Field, e.TableName, e.Type, e.Hint)
+}
+
+// unsupportedHint returns how a field of type t could be mapped to a
+// column, or the empty string if it can be already.
+func unsupportedHint(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	pt := reflect.PtrTo(t)
+	if pt.Implements(valuerType) || pt.Implements(scannerType) || isTime(t) || isBytes(t) || isDecimal(t) {
+		return ""
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return "implement driver.Valuer and sql.Scanner on a map type to store it, eg. as JSON, or tag it db:\"-\""
+	case reflect.Func:
+		return "tag it db:\"-\", or declare it with HasMany or BelongsTo"
+	case reflect.Chan, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return "tag it db:\"-\""
+	case reflect.Struct:
+		return "tag it db:\",embed\" to map its fields to columns, implement driver.Valuer and sql.Scanner, or tag it db:\"-\""
+	case reflect.Slice, reflect.Array:
+		return "implement driver.Valuer and sql.Scanner on a slice type, eg. pq.StringArray for postgres arrays, or tag it db:\"-\""
+	}
+	return ""
+}
+
+// markUnsupported makes the columns of fields modl cannot map transient,
+// and reports them to the DbMap's UnsupportedFieldLogger, or else logs a
+// warning naming them.  Fields tagged db:"-" are left out on purpose, and
+// are not reported, nor are unexported fields.
+func (t *TableMap) markUnsupported() {
+	for _, col := range t.Columns {
+		if col.Transient {
+			continue
+		}
+		hint := unsupportedHint(col.gotype)
+		if len(hint) == 0 {
+			continue
+		}
+		col.Transient = true
+		if isLoader(col.gotype) {
+			// it is left to be declared as a relation
+			continue
+		}
+		if t.gotype.FieldByIndex(col.fieldIndex).PkgPath != "" {
+			// unexported fields are taken to be private state
+			continue
+		}
+		if t.dbmap != nil {
+			t.dbmap.unsupportedField(UnsupportedFieldError{t.TableName, col.fieldName, col.gotype, hint})
+		}
+	}
+}
+
 // ColMap returns the ColumnMap pointer matching the given struct field
 // name.  It panics if the struct does not contain a field matching this
 // name.
@@ -77,6 +494,44 @@ func (t *TableMap) ColMap(field string) *ColumnMap {
 		t.TableName, t.gotype.Name(), field))
 }
 
+// SelectColumnList returns the comma separated list of columns Get
+// selects, quoted and qualified by alias if it is not empty, so that
+// hand-written queries and joins can select the table's mapped columns:
+//
+//	query := "select " + table.SelectColumnList("p") + " from person p join ..."
+//
+// Write-only and transient columns are left out, and columns with select
+// expressions are selected as their expressions.
+func (t *TableMap) SelectColumnList(alias string) string {
+	return t.JoinColumnList(alias, "")
+}
+
+// JoinColumnList is SelectColumnList with each column selected as its
+// name with prefix, eg. p."id" as "person_id", so that the columns of
+// several tables can be selected together by SelectJoin.
+func (t *TableMap) JoinColumnList(alias, prefix string) string {
+	var cols []string
+	for _, col := range t.Columns {
+		if col.isSelected() {
+			cols = append(cols, col.aliasedSelectColumn(t.dbmap.Dialect, alias, prefix))
+		}
+	}
+	return strings.Join(cols, ",")
+}
+
+// InsertColumnList returns the comma separated, quoted list of columns
+// Insert writes, leaving out auto-increment keys, read-only and transient
+// columns.
+func (t *TableMap) InsertColumnList() string {
+	var cols []string
+	for _, col := range t.Columns {
+		if col.isWritten() && !col.isAutoIncr {
+			cols = append(cols, t.dbmap.Dialect.QuoteField(col.ColumnName))
+		}
+	}
+	return strings.Join(cols, ",")
+}
+
 // SetVersionCol sets the column to use as the Version field.  By default
 // the "Version" field is used.  Returns the column found, or panics
 // if the struct does not contain a field matching this name.
@@ -89,7 +544,63 @@ func (t *TableMap) SetVersionCol(field string) *ColumnMap {
 	return c
 }
 
+// BindInsertSQL returns the insert statement and bound arguments which
+// Insert would run for obj, a struct or pointer to a struct of the type
+// mapped to this table, without running it.  obj is not modified.
+func (t *TableMap) BindInsertSQL(obj interface{}) (string, []interface{}, error) {
+	elem, err := t.copyOf(obj)
+	if err != nil {
+		return "", nil, err
+	}
+	bi := t.bindInsert(t.dbmap, elem, false)
+	args, _ := unwrapSensitive(bi.args)
+	return bi.query, args, nil
+}
+
+// BindUpdateSQL returns the update statement and bound arguments which
+// Update would run for obj without running it.  See BindInsertSQL.
+func (t *TableMap) BindUpdateSQL(obj interface{}) (string, []interface{}, error) {
+	elem, err := t.copyOf(obj)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(t.Keys) < 1 {
+		return "", nil, &NoKeysErr{t}
+	}
+	bi := t.bindUpdate(t.dbmap, elem, false)
+	args, _ := unwrapSensitive(bi.args)
+	return bi.query, args, nil
+}
+
+// BindDeleteSQL returns the delete statement and bound arguments which
+// Delete would run for obj without running it.  See BindInsertSQL.
+func (t *TableMap) BindDeleteSQL(obj interface{}) (string, []interface{}, error) {
+	elem, err := t.copyOf(obj)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(t.Keys) < 1 {
+		return "", nil, &NoKeysErr{t}
+	}
+	bi := t.bindDelete(t.dbmap, elem)
+	args, _ := unwrapSensitive(bi.args)
+	return bi.query, args, nil
+}
+
+// copyOf returns an addressable copy of obj, so that binding it can't
+// modify the caller's value.
+func (t *TableMap) copyOf(obj interface{}) (reflect.Value, error) {
+	v := reflect.Indirect(reflect.ValueOf(obj))
+	if v.Type() != t.gotype {
+		return v, fmt.Errorf("modl: %v is not of type %v mapped to table %s", v.Type(), t.gotype, t.TableName)
+	}
+	elem := reflect.New(t.gotype).Elem()
+	elem.Set(v)
+	return elem, nil
+}
+
 func (t *TableMap) bindGet() bindPlan {
+	t.checkShape()
 	plan := t.getPlan
 	if plan.query == "" {
 
@@ -98,17 +609,17 @@ func (t *TableMap) bindGet() bindPlan {
 
 		x := 0
 		for _, col := range t.Columns {
-			if !col.Transient {
+			if col.isSelected() {
 				if x > 0 {
 					s.WriteString(",")
 				}
-				s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
+				s.WriteString(col.selectColumn(t.dbmap.Dialect))
 				plan.argFields = append(plan.argFields, col.fieldName)
 				x++
 			}
 		}
 		s.WriteString(" from ")
-		s.WriteString(t.dbmap.Dialect.QuoteField(t.TableName))
+		s.WriteString(quoteTable(t.dbmap.Dialect, t.qualifiedName()))
 		s.WriteString(" where ")
 		for x := range t.Keys {
 			col := t.Keys[x]
@@ -121,21 +632,77 @@ func (t *TableMap) bindGet() bindPlan {
 
 			plan.keyFields = append(plan.keyFields, col.fieldName)
 		}
-		s.WriteString(";")
+		t.writeScope(&s, len(plan.keyFields))
+		s.WriteString(t.dbmap.terminator())
 
 		plan.query = s.String()
+		t.finishPlan(&plan)
 		t.getPlan = plan
 	}
 
 	return plan
 }
 
-func (t *TableMap) bindDelete(elem reflect.Value) bindInstance {
+// bindExists returns the plan of a query which selects 1 from the row with
+// the table's keys.
+func (t *TableMap) bindExists() bindPlan {
+	t.checkShape()
+	plan := t.existsPlan
+	if plan.query == "" {
+		s := bytes.Buffer{}
+		s.WriteString("select 1 from ")
+		s.WriteString(quoteTable(t.dbmap.Dialect, t.qualifiedName()))
+		s.WriteString(" where ")
+		for x, col := range t.Keys {
+			if x > 0 {
+				s.WriteString(" and ")
+			}
+			s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
+			s.WriteString("=")
+			s.WriteString(t.dbmap.Dialect.BindVar(x))
+
+			plan.keyFields = append(plan.keyFields, col.fieldName)
+		}
+		t.writeScope(&s, len(plan.keyFields))
+		s.WriteString(t.dbmap.terminator())
+
+		plan.query = s.String()
+		t.finishPlan(&plan)
+		t.existsPlan = plan
+	}
+
+	return plan
+}
+
+// keyArgs returns the arguments of plan, a get or exists plan, for keys:
+// keys with sensitive values are wrapped, and the scope's arguments are
+// added.
+func (t *TableMap) keyArgs(plan bindPlan, keys []interface{}, opts *queryOptions) ([]interface{}, error) {
+	if sensitive := t.sensitiveArgs(plan.keyFields); sensitive != nil {
+		keys = append([]interface{}{}, keys...)
+		for i := range keys {
+			if i < len(sensitive) && sensitive[i] {
+				keys[i] = Sensitive(keys[i])
+			}
+		}
+	}
+	scope, err := t.scopeArgs(opts.context())
+	if err != nil {
+		return nil, err
+	}
+	if scope != nil {
+		keys = append(keys[:len(keys):len(keys)], scope...)
+	}
+	return keys, nil
+}
+
+func (t *TableMap) bindDelete(m *DbMap, elem reflect.Value) bindInstance {
+	t.checkShape()
 	plan := t.deletePlan
 	if plan.query == "" {
 
 		s := bytes.Buffer{}
-		s.WriteString(fmt.Sprintf("delete from %s", t.dbmap.Dialect.QuoteField(t.TableName)))
+		s.WriteString(fmt.Sprintf("delete from %s", quoteTable(t.dbmap.Dialect, t.qualifiedName())))
 
 		for y := range t.Columns {
 			col := t.Columns[y]
@@ -167,131 +734,372 @@ func (t *TableMap) bindDelete(elem reflect.Value) bindInstance {
 
 			plan.argFields = append(plan.argFields, plan.versField)
 		}
-		s.WriteString(";")
+		t.writeScope(&s, len(plan.argFields))
+		s.WriteString(t.dbmap.terminator())
 
 		plan.query = s.String()
+		t.finishPlan(&plan)
 		t.deletePlan = plan
 	}
 
-	return plan.createBindInstance(elem)
+	return plan.createBindInstance(m, elem)
 }
 
-func (t *TableMap) bindUpdate(elem reflect.Value) bindInstance {
+// bindUpdate binds elem to an update statement.  If omitEmpty is true,
+// columns set up with SetUseDefault whose fields hold the zero value are
+// left out of it.
+func (t *TableMap) bindUpdate(m *DbMap, elem reflect.Value, omitEmpty bool) bindInstance {
+	t.checkShape()
+	if omitEmpty {
+		if omit := t.omittedInsertColumns(elem); omit != nil {
+			return t.buildUpdatePlan(omit).createBindInstance(m, elem)
+		}
+	}
 	plan := t.updatePlan
 	if plan.query == "" {
+		plan = t.buildUpdatePlan(nil)
+		t.updatePlan = plan
+	}
 
-		s := bytes.Buffer{}
-		s.WriteString(fmt.Sprintf("update %s set ", t.dbmap.Dialect.QuoteField(t.TableName)))
-		x := 0
-
-		for y := range t.Columns {
-			col := t.Columns[y]
-			if !col.isPK && !col.Transient {
-				if x > 0 {
-					s.WriteString(", ")
-				}
-				s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
-				s.WriteString("=")
-				s.WriteString(t.dbmap.Dialect.BindVar(x))
+	return plan.createBindInstance(m, elem)
+}
 
-				if col == t.version {
-					plan.versField = col.fieldName
-					plan.argFields = append(plan.argFields, versFieldConst)
-				} else {
-					plan.argFields = append(plan.argFields, col.fieldName)
-				}
-				x++
-			}
-		}
+// buildUpdatePlan builds the update statement for the table, leaving out
+// the columns marked in omit, which may be nil.
+func (t *TableMap) buildUpdatePlan(omit []bool) bindPlan {
+	plan := bindPlan{}
+	s := bytes.Buffer{}
+	s.WriteString(fmt.Sprintf("update %s set ", quoteTable(t.dbmap.Dialect, t.qualifiedName())))
+	x := 0
 
-		s.WriteString(" where ")
-		for y := range t.Keys {
-			col := t.Keys[y]
-			if y > 0 {
-				s.WriteString(" and ")
+	for y := range t.Columns {
+		col := t.Columns[y]
+		if !col.isPK && col.isWritten() && (omit == nil || !omit[y] || col == t.version || col == t.checksum) {
+			if x > 0 {
+				s.WriteString(", ")
 			}
 			s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
 			s.WriteString("=")
-			s.WriteString(t.dbmap.Dialect.BindVar(x))
+			s.WriteString(col.bindExpr(t.dbmap.Dialect.BindVar(x)))
 
-			plan.argFields = append(plan.argFields, col.fieldName)
-			plan.keyFields = append(plan.keyFields, col.fieldName)
+			if col == t.version {
+				plan.versField = col.fieldName
+				plan.argFields = append(plan.argFields, versFieldConst)
+			} else if col == t.checksum {
+				plan.argFields = append(plan.argFields, checksumFieldConst)
+			} else {
+				plan.argFields = append(plan.argFields, col.fieldName)
+			}
 			x++
 		}
-		if plan.versField != "" {
+	}
+	if x == 0 {
+		// every column was omitted;  the key is set to itself so that the
+		// statement still matches the row
+		key := t.Keys[0]
+		s.WriteString(t.dbmap.Dialect.QuoteField(key.ColumnName))
+		s.WriteString("=")
+		s.WriteString(t.dbmap.Dialect.BindVar(x))
+		plan.argFields = append(plan.argFields, key.fieldName)
+		x++
+	}
+
+	s.WriteString(" where ")
+	for y := range t.Keys {
+		col := t.Keys[y]
+		if y > 0 {
 			s.WriteString(" and ")
-			s.WriteString(t.dbmap.Dialect.QuoteField(t.version.ColumnName))
-			s.WriteString("=")
-			s.WriteString(t.dbmap.Dialect.BindVar(x))
-			plan.argFields = append(plan.argFields, plan.versField)
 		}
-		s.WriteString(";")
+		s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
+		s.WriteString("=")
+		s.WriteString(t.dbmap.Dialect.BindVar(x))
 
-		plan.query = s.String()
-		t.updatePlan = plan
+		plan.argFields = append(plan.argFields, col.fieldName)
+		plan.keyFields = append(plan.keyFields, col.fieldName)
+		x++
+	}
+	if plan.versField != "" {
+		s.WriteString(" and ")
+		s.WriteString(t.dbmap.Dialect.QuoteField(t.version.ColumnName))
+		s.WriteString("=")
+		s.WriteString(t.dbmap.Dialect.BindVar(x))
+		plan.argFields = append(plan.argFields, plan.versField)
+		x++
 	}
+	if t.checksum != nil && t.checksum.isWritten() {
+		s.WriteString(" and coalesce(")
+		s.WriteString(t.dbmap.Dialect.QuoteField(t.checksum.ColumnName))
+		s.WriteString(", '')=")
+		s.WriteString(t.dbmap.Dialect.BindVar(x))
+		plan.argFields = append(plan.argFields, checksumMatchConst)
+	}
+	t.writeScope(&s, len(plan.argFields))
+	s.WriteString(t.dbmap.terminator())
 
-	return plan.createBindInstance(elem)
+	plan.query = s.String()
+	t.finishPlan(&plan)
+	return plan
 }
 
-func (t *TableMap) bindInsert(elem reflect.Value) bindInstance {
+// bindInsert binds elem to an insert statement.  If explicitKeys is true,
+// any auto-increment key which is already set on elem is inserted rather
+// than generated by the database.
+func (t *TableMap) bindInsert(m *DbMap, elem reflect.Value, explicitKeys bool) bindInstance {
+	t.checkShape()
+	explicitKeys = (explicitKeys || t.explicitKeys) && t.hasAutoIncrValue(elem)
+	if omit := t.omittedInsertColumns(elem); omit != nil || explicitKeys {
+		// these plans depend on the values being inserted, so they are
+		// not cached
+		return t.buildInsertPlan(omit, explicitKeys).createBindInstance(m, elem)
+	}
 	plan := t.insertPlan
 	if plan.query == "" {
-		plan.autoIncrIdx = -1
+		plan = t.buildInsertPlan(nil, false)
+		t.insertPlan = plan
+	}
 
-		s := bytes.Buffer{}
-		s2 := bytes.Buffer{}
-		s.WriteString(fmt.Sprintf("insert into %s (", t.dbmap.Dialect.QuoteField(t.TableName)))
+	return plan.createBindInstance(m, elem)
+}
 
-		x := 0
-		first := true
-		for y := range t.Columns {
-			col := t.Columns[y]
+// omittedInsertColumns returns which of the table's columns should be left
+// out of an insert of elem so that their database defaults apply, or nil
+// if all columns are to be inserted.
+func (t *TableMap) omittedInsertColumns(elem reflect.Value) []bool {
+	var omit []bool
+	for y, col := range t.Columns {
+		if col.useDefault && !col.Transient && elem.FieldByIndex(col.fieldIndex).IsZero() {
+			if omit == nil {
+				omit = make([]bool, len(t.Columns))
+			}
+			omit[y] = true
+		}
+	}
+	return omit
+}
 
-			if !col.Transient {
-				if !first {
-					s.WriteString(",")
-					s2.WriteString(",")
+// returningAllQuery returns the insert statement for bi with a "returning"
+// clause for each of the table's columns.
+func (t *TableMap) returningAllQuery(bi bindInstance) string {
+	query := strings.TrimSuffix(bi.query, t.dbmap.terminator())
+	if bi.autoIncrIdx > -1 {
+		query = strings.TrimSuffix(query, t.dbmap.Dialect.AutoIncrInsertSuffix(t.Columns[bi.autoIncrIdx]))
+	}
+	cols := make([]string, 0, len(t.Columns))
+	for _, col := range t.Columns {
+		if col.isSelected() {
+			cols = append(cols, col.selectColumn(t.dbmap.Dialect))
+		}
+	}
+	return query + " returning " + strings.Join(cols, ",") + t.dbmap.terminator()
+}
+
+// finishPlan fills in the parts of plan derived from its fields.
+func (t *TableMap) finishPlan(plan *bindPlan) {
+	if t.shape == nil {
+		t.shape = t.currentShape()
+	}
+	plan.sensitive = t.sensitiveArgs(plan.argFields)
+	plan.argIndexes = t.fieldIndexes(plan.argFields)
+	plan.keyIndexes = t.fieldIndexes(plan.keyFields)
+	plan.argColumns = t.fieldColumns(plan.argFields)
+	if plan.versField != "" {
+		plan.versIndex = t.version.fieldIndex
+		plan.nextVersion = t.nextVersion
+	}
+	for _, f := range plan.argFields {
+		if f == checksumFieldConst {
+			plan.checksumIndex = t.checksum.fieldIndex
+			plan.checksum = t.computeChecksum
+		}
+	}
+}
+
+// fieldColumns returns the columns the given fields are mapped to.  The
+// version column placeholder is mapped to the version column.
+func (t *TableMap) fieldColumns(fields []string) []*ColumnMap {
+	columns := make([]*ColumnMap, len(fields))
+	for i, f := range fields {
+		if f == versFieldConst {
+			columns[i] = t.version
+			continue
+		}
+		for _, col := range t.Columns {
+			if col.fieldName == f {
+				columns[i] = col
+				break
+			}
+		}
+	}
+	return columns
+}
+
+// fieldIndexes returns the index paths of the given fields.  The version
+// column placeholder is left with a nil index.
+func (t *TableMap) fieldIndexes(fields []string) [][]int {
+	indexes := make([][]int, len(fields))
+	for i, f := range fields {
+		for _, col := range t.Columns {
+			if col.fieldName == f {
+				indexes[i] = col.fieldIndex
+				break
+			}
+		}
+	}
+	return indexes
+}
+
+// sensitiveArgs returns which of the given fields are mapped to sensitive
+// columns, or nil if none are.
+func (t *TableMap) sensitiveArgs(fields []string) []bool {
+	var sensitive []bool
+	for i, f := range fields {
+		for _, col := range t.Columns {
+			if col.sensitive && col.fieldName == f {
+				if sensitive == nil {
+					sensitive = make([]bool, len(fields))
 				}
-				s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
+				sensitive[i] = true
+			}
+		}
+	}
+	return sensitive
+}
 
-				if col.isAutoIncr {
-					s2.WriteString(t.dbmap.Dialect.AutoIncrBindValue())
-					plan.autoIncrIdx = y
+// keyValues returns the values of the table's primary keys on elem.
+func (t *TableMap) keyValues(elem reflect.Value) []interface{} {
+	keys := make([]interface{}, 0, len(t.Keys))
+	for _, col := range t.Keys {
+		keys = append(keys, bindValue(elem.FieldByIndex(col.fieldIndex)))
+	}
+	return keys
+}
+
+// keysFrom returns the values of the fields of key, a struct or pointer
+// to a struct, which match the table's keys, in the order they were set
+// with SetKeys.  A field matches a key if it has the same name, or maps to
+// the same column name.  Every key must be matched, and every field must
+// match a key.
+func (t *TableMap) keysFrom(key interface{}) ([]interface{}, error) {
+	v := reflect.Indirect(reflect.ValueOf(key))
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("modl: key for %s must be a struct, got %T", t.TableName, key)
+	}
+	keys := make([]interface{}, len(t.Keys))
+	found := make([]bool, len(t.Keys))
+	vt := v.Type()
+	for i := 0; i < vt.NumField(); i++ {
+		f := vt.Field(i)
+		column := f.Tag.Get("db")
+		if column == "" {
+			column = sqlx.NameMapper(f.Name)
+		}
+		matched := false
+		for j, col := range t.Keys {
+			if col.fieldName == f.Name || col.ColumnName == column {
+				keys[j], found[j], matched = bindValue(v.Field(i)), true, true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("modl: key field %s is not a key of %s", f.Name, t.TableName)
+		}
+	}
+	for j, ok := range found {
+		if !ok {
+			return nil, fmt.Errorf("modl: key for %s has no field for %s", t.TableName, t.Keys[j].fieldName)
+		}
+	}
+	return keys, nil
+}
+
+// hasAutoIncrValue returns true if an auto-increment key field on elem
+// holds a non-zero value.
+func (t *TableMap) hasAutoIncrValue(elem reflect.Value) bool {
+	for _, col := range t.Keys {
+		if col.isAutoIncr && !elem.FieldByIndex(col.fieldIndex).IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// buildInsertPlan creates an insert plan for the table which leaves out
+// the columns marked in omit.  If explicitKeys is true, auto-increment
+// columns are bound like any other column.
+func (t *TableMap) buildInsertPlan(omit []bool, explicitKeys bool) bindPlan {
+	plan := bindPlan{autoIncrIdx: -1}
+
+	s := bytes.Buffer{}
+	s2 := bytes.Buffer{}
+	s.WriteString(fmt.Sprintf("insert into %s ", quoteTable(t.dbmap.Dialect, t.qualifiedName())))
+
+	x := 0
+	first := true
+	for y := range t.Columns {
+		col := t.Columns[y]
+
+		if col.isWritten() && (omit == nil || !omit[y]) {
+			if first {
+				s.WriteString("(")
+			} else {
+				s.WriteString(",")
+				s2.WriteString(",")
+			}
+			s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
+
+			if col.isAutoIncr && !explicitKeys {
+				s2.WriteString(t.dbmap.Dialect.AutoIncrBindValue())
+				plan.autoIncrIdx = y
+			} else {
+				s2.WriteString(col.bindExpr(t.dbmap.Dialect.BindVar(x)))
+				if col == t.version {
+					plan.versField = col.fieldName
+					plan.argFields = append(plan.argFields, versFieldConst)
+				} else if col == t.checksum {
+					plan.argFields = append(plan.argFields, checksumFieldConst)
 				} else {
-					s2.WriteString(t.dbmap.Dialect.BindVar(x))
-					if col == t.version {
-						plan.versField = col.fieldName
-						plan.argFields = append(plan.argFields, versFieldConst)
-					} else {
-						plan.argFields = append(plan.argFields, col.fieldName)
-					}
-
-					x++
+					plan.argFields = append(plan.argFields, col.fieldName)
 				}
 
-				first = false
+				x++
 			}
+
+			first = false
+		}
+	}
+	if len(t.discriminator) > 0 {
+		if first {
+			s.WriteString("(")
+		} else {
+			s.WriteString(",")
+			s2.WriteString(",")
 		}
+		s.WriteString(t.dbmap.Dialect.QuoteField(t.discriminator))
+		s2.WriteString(quoteValues([]string{t.discriminatorValue}))
+		first = false
+	}
+	if first {
+		// every column was left to its default
+		s.WriteString(defaultValues(t.dbmap.Dialect))
+	} else {
 		s.WriteString(") values (")
 		s.WriteString(s2.String())
 		s.WriteString(")")
-		if plan.autoIncrIdx > -1 {
-			s.WriteString(t.dbmap.Dialect.AutoIncrInsertSuffix(t.Columns[plan.autoIncrIdx]))
-		}
-		s.WriteString(";")
-
-		plan.query = s.String()
-		t.insertPlan = plan
 	}
+	if plan.autoIncrIdx > -1 {
+		s.WriteString(t.dbmap.Dialect.AutoIncrInsertSuffix(t.Columns[plan.autoIncrIdx]))
+	}
+	s.WriteString(t.dbmap.terminator())
 
-	return plan.createBindInstance(elem)
+	plan.query = s.String()
+	t.finishPlan(&plan)
+	return plan
 }
 
 // ColumnMap represents a mapping between a Go struct field and a single
 // column in a table.
-// Unique and MaxSize only inform the CreateTables() function and are not
-// used for validation by Insert/Update/Delete/Get.
+// Unique, MaxSize, Precision and Scale only inform the CreateTables()
+// function and are not used for validation by Insert/Update/Delete/Get.
 type ColumnMap struct {
 	// Column name in db table
 	ColumnName string
@@ -306,24 +1114,79 @@ type ColumnMap struct {
 	// correct column type to map to in CreateTables()
 	MaxSize int
 
+	// The total digits and digits after the decimal point of numeric
+	// columns, passed to Dialect.ToSqlType() like MaxSize.  See
+	// SetPrecision.
+	Precision int
+	Scale     int
+
 	// the table this column belongs to
 	table *TableMap
 
-	fieldName  string
-	gotype     reflect.Type
-	sqltype    string
-	createSql  string
-	isPK       bool
-	isAutoIncr bool
+	fieldName   string
+	fieldIndex  []int
+	gotype      reflect.Type
+	sqltype     string
+	createSql   string
+	defaultExpr string
+	checkExpr   string
+	enumValues  []string
+	useDefault  bool
+	sensitive   bool
+	isPK        bool
+	isAutoIncr  bool
+	notNull     bool
+	selectExpr  string
+	insertExpr  string
+	readOnly    bool
+	writeOnly   bool
+	srid        int
+	codec       columnCodec
+
+	generatedExpr   string
+	generatedStored bool
+
+	collation string
+	comment   string
 }
 
 // SetTransient allows you to mark the column as transient. If true
 // this column will be skipped when SQL statements are generated
 func (c *ColumnMap) SetTransient(b bool) *ColumnMap {
 	c.Transient = b
+	c.table.ResetSql()
+	return c
+}
+
+// SetReadOnly marks the column as one which the database writes, like a
+// computed or generated column:  it is selected, but Insert and Update
+// leave it out of their statements.
+func (c *ColumnMap) SetReadOnly(b bool) *ColumnMap {
+	c.readOnly = b
+	c.table.ResetSql()
+	return c
+}
+
+// SetWriteOnly marks the column as one which is written but never read
+// back, like the input of a password hash:  Insert and Update write it,
+// but Get, Reload and the other statements modl generates do not select
+// it.  A query selecting it explicitly still scans it into the field.
+func (c *ColumnMap) SetWriteOnly(b bool) *ColumnMap {
+	c.writeOnly = b
+	c.table.ResetSql()
 	return c
 }
 
+// isSelected returns true if statements which read rows select the column.
+func (c *ColumnMap) isSelected() bool {
+	return !c.Transient && !c.writeOnly
+}
+
+// isWritten returns true if Insert and Update write the column.
+func (c *ColumnMap) isWritten() bool {
+	return !c.Transient && !c.readOnly
+}
+
 // SetUnique sets the unqiue clause for this column.  If true, a unique clause
 // will be added to create table statements for this column.
 func (c *ColumnMap) SetUnique(b bool) *ColumnMap {
@@ -348,25 +1211,233 @@ func (c *ColumnMap) SetSqlType(t string) *ColumnMap {
 	return c
 }
 
+// SetDefault sets the expression used as the column's default value by
+// CreateTables, eg. "0" or "current_timestamp".  To unset, call with the
+// empty string.
+func (c *ColumnMap) SetDefault(expr string) *ColumnMap {
+	c.defaultExpr = expr
+	return c
+}
+
+// SetGenerated makes the column a generated column, whose value the
+// database computes from expr, eg. "price * qty".  CreateTables declares
+// it with "generated always as (expr)", stored if stored is true and
+// computed when read otherwise.  Generated columns are read-only;  see
+// SetReadOnly.  To unset, call with the empty string.
+func (c *ColumnMap) SetGenerated(expr string, stored bool) *ColumnMap {
+	c.generatedExpr = expr
+	c.generatedStored = stored
+	return c.SetReadOnly(len(expr) > 0)
+}
+
+// SetCheck sets a check constraint added to this column by CreateTables,
+// eg. "price >= 0".  To unset, call with the empty string.
+func (c *ColumnMap) SetCheck(expr string) *ColumnMap {
+	c.checkExpr = expr
+	return c
+}
+
+// SetCollation sets the collation CreateTables gives this column, which
+// decides how its values are compared and sorted, eg. "nocase" on sqlite
+// or "utf8mb4_bin" on MySQL.  The name is written as it is, so postgres
+// collations with upper case letters must be quoted, eg. `"C"`.  To unset,
+// call with the empty string.
+func (c *ColumnMap) SetCollation(collation string) *ColumnMap {
+	c.collation = collation
+	return c
+}
+
+// SetComment sets the comment CreateTables stores on this column, on
+// dialects which implement CommentDialect.  To unset, call with the empty
+// string.
+func (c *ColumnMap) SetComment(comment string) *ColumnMap {
+	c.comment = comment
+	return c
+}
+
+// SetEnum restricts the column to the given values.  CreateTables uses a
+// native enum type on dialects which have one and a check constraint on
+// others, and Insert and Update return an EnumValueError without running
+// any SQL if the struct field holds any other value.  Call with no values
+// to unset.
+func (c *ColumnMap) SetEnum(values ...string) *ColumnMap {
+	c.enumValues = values
+	return c
+}
+
+// checkEnum returns an EnumValueError if the enum column c's field on elem
+// holds a value which is not allowed.  NULL values are always allowed.
+func (c *ColumnMap) checkEnum(elem reflect.Value) error {
+	var val interface{} = elem.FieldByIndex(c.fieldIndex).Interface()
+	if v, ok := val.(driver.Valuer); ok {
+		var err error
+		if val, err = v.Value(); err != nil {
+			return err
+		}
+	}
+	var s string
+	switch v := val.(type) {
+	case nil:
+		return nil
+	case []byte:
+		s = string(v)
+	default:
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.String {
+			s = rv.String()
+		} else {
+			s = fmt.Sprint(v)
+		}
+	}
+	for _, allowed := range c.enumValues {
+		if s == allowed {
+			return nil
+		}
+	}
+	return EnumValueError{c.table.TableName, c.ColumnName, s, c.enumValues}
+}
+
+// checkEnums validates the enum columns of the table for elem.
+func (t *TableMap) checkEnums(elem reflect.Value) error {
+	for _, col := range t.Columns {
+		if len(col.enumValues) > 0 && !col.Transient {
+			if err := col.checkEnum(elem); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetUseDefault controls whether Insert leaves this column out of the
+// statement when its struct field holds the zero value, so that the
+// column's database default is used instead.  Update leaves it out too if
+// it is passed the OmitEmpty option.  Fields tagged with
+// `db:"name,omitempty"` are set up this way.
+func (c *ColumnMap) SetUseDefault(b bool) *ColumnMap {
+	c.useDefault = b
+	return c
+}
+
+// SetSensitive marks the column as holding sensitive data, like passwords,
+// tokens or personal information.  Its bound values are replaced by a
+// placeholder wherever modl logs or reports statements.  See Sensitive.
+func (c *ColumnMap) SetSensitive(b bool) *ColumnMap {
+	c.sensitive = b
+	c.table.ResetSql()
+	return c
+}
+
+// SetSelectExpr sets an SQL expression which Get and Reload select in
+// place of the column, eg. "ST_AsText(geom)" for a PostGIS geometry.  The
+// expression is selected as the column's name, so it is still scanned
+// into the column's field.
+func (c *ColumnMap) SetSelectExpr(expr string) *ColumnMap {
+	c.selectExpr = expr
+	c.table.ResetSql()
+	return c
+}
+
+// SetInsertExpr sets an SQL expression which Insert and Update write to
+// the column in place of the field's value, eg. "ST_GeomFromText(?, 4326)".
+// The "?" in the expression is replaced by the bindvar for the value.
+func (c *ColumnMap) SetInsertExpr(expr string) *ColumnMap {
+	c.insertExpr = expr
+	c.table.ResetSql()
+	return c
+}
+
+// SetCipher encrypts the column's values with c when they are written and
+// decrypts them when they are read by Get, Reload or a Select into the
+// table's type.  The column's field must be a string, *string or []byte;
+// strings are stored base64 encoded, so a text column must be large enough
+// for the longer value.  Keys and columns used in queries' where clauses
+// cannot usefully be encrypted, as the same value encrypts differently
+// every time.
+func (c *ColumnMap) SetCipher(fc FieldCipher) *ColumnMap {
+	if !canEncrypt(c.gotype) {
+		panic(fmt.Sprintf("Cannot encrypt column %s of type %s", c.ColumnName, c.gotype))
+	}
+	c.codec = cipherCodec{cipher: fc}
+	return c
+}
+
+// SetBoundCipher is like SetCipher, but binds each value to the column by
+// passing its qualified table and column name to fc as additional data,
+// so that a value copied into another column or table fails to decrypt.
+// Values must then be re-encrypted if the table or column is renamed.
+func (c *ColumnMap) SetBoundCipher(fc FieldCipher) *ColumnMap {
+	c.SetCipher(fc)
+	c.codec = cipherCodec{cipher: fc, column: c}
+	return c
+}
+
+// selectColumn returns the column, or its select expression, for a select
+// list.  Geometries are selected as text.
+func (c *ColumnMap) selectColumn(d Dialect) string {
+	return c.aliasedSelectColumn(d, "", "")
+}
+
+// aliasedSelectColumn is selectColumn with the column qualified by the
+// table alias and selected as its name with prefix, if they are not empty.
+// Select expressions are used as they are.
+func (c *ColumnMap) aliasedSelectColumn(d Dialect, alias, prefix string) string {
+	column := d.QuoteField(c.ColumnName)
+	if len(alias) > 0 {
+		column = alias + "." + column
+	}
+	rename := len(prefix) > 0
+	if len(c.selectExpr) > 0 {
+		column, rename = c.selectExpr, true
+	} else if sd := c.spatial(); sd != nil {
+		column, rename = sd.GeomAsText(column), true
+	}
+	if rename {
+		column += " as " + d.QuoteField(prefix+c.ColumnName)
+	}
+	return column
+}
+
+// bindExpr returns bindvar, wrapped in the column's insert expression if
+// it has one, or converted to a geometry for Geometry columns.
+func (c *ColumnMap) bindExpr(bindvar string) string {
+	if len(c.insertExpr) > 0 {
+		return strings.Replace(c.insertExpr, "?", bindvar, 1)
+	}
+	if sd := c.spatial(); sd != nil {
+		return strings.Replace(sd.GeomFromText(c.srid), "?", bindvar, 1)
+	}
+	return bindvar
+}
+
 // SetMaxSize specifies the max length of values of this column. This is
 // passed to the dialect.ToSqlType() function, which can use the value
-// to alter the generated type for "create table" statements
+// to alter the generated type for "create table" statements, eg. the
+// varchar length of strings, or the binary type of []byte in MySQL.
 func (c *ColumnMap) SetMaxSize(size int) *ColumnMap {
 	c.MaxSize = size
 	return c
 }
 
-// Return a table for a pointer;  error if i is not a pointer or if the
-// table is not found
+// Return a table for a pointer;  error if i is not a pointer to a struct or
+// if the table is not found.  The table is looked up by the struct's exact
+// type, registering it if AutoRegister is set, so that pointers to slices
+// or to other pointers are refused rather than dereferenced.
 func tableForPointer(m *DbMap, i interface{}, checkPk bool) (*TableMap, reflect.Value, error) {
 	v := reflect.ValueOf(i)
 	if v.Kind() != reflect.Ptr {
 		return nil, v, fmt.Errorf("value %v not a pointer", v)
 	}
 	v = v.Elem()
+	if v.Kind() != reflect.Struct {
+		return nil, v, fmt.Errorf("could not find table for %v: not a pointer to a struct", reflect.TypeOf(i))
+	}
 	t := m.TableForType(v.Type())
+	if t == nil && m.AutoRegister {
+		t = m.register(v.Type())
+	}
 	if t == nil {
-		return nil, v, fmt.Errorf("could not find table for %v", t)
+		return nil, v, fmt.Errorf("could not find table for %v", v.Type())
 	}
 	if checkPk && len(t.Keys) < 1 {
 		return t, v, &NoKeysErr{t}
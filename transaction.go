@@ -2,6 +2,9 @@ package modl
 
 import (
 	"database/sql"
+	"fmt"
+	"io"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -13,6 +16,21 @@ import (
 type Transaction struct {
 	dbmap *DbMap
 	Tx    *sqlx.Tx
+	// stmts, if set, prepares the transaction's statements for reuse
+	stmts *stmtCache
+	// events are the ChangeEvents held until Commit
+	events []ChangeEvent
+	// written are the tables written in the transaction, whose cached
+	// query results are invalidated again at Commit
+	written []string
+	// evicted are the rows written in the transaction, which are removed
+	// from their tables' Caches again at Commit
+	evicted []evictedRow
+	// parent is the transaction a nested transaction was begun in, and
+	// savepoint the name of the savepoint it started at
+	parent     *Transaction
+	savepoint  string
+	savepoints *int
 }
 
 // Insert has the same behavior as DbMap.Insert(), but runs in a transaction.
@@ -20,6 +38,12 @@ func (t *Transaction) Insert(list ...interface{}) error {
 	return insert(t.dbmap, t, list...)
 }
 
+// InsertResult has the same behavior as DbMap.InsertResult(), but runs in
+// a transaction.
+func (t *Transaction) InsertResult(list ...interface{}) ([]RowResult, error) {
+	return insertResult(t.dbmap, t, list...)
+}
+
 // Update has the same behavior as DbMap.Update(), but runs in a transaction.
 func (t *Transaction) Update(list ...interface{}) (int64, error) {
 	return update(t.dbmap, t, list...)
@@ -30,11 +54,31 @@ func (t *Transaction) Delete(list ...interface{}) (int64, error) {
 	return deletes(t.dbmap, t, list...)
 }
 
+// Save has the same behavior as DbMap.Save(), but runs in a transaction.
+func (t *Transaction) Save(list ...interface{}) error {
+	return save(t.dbmap, t, list...)
+}
+
+// Reload has the same behavior as DbMap.Reload(), but runs in a transaction.
+func (t *Transaction) Reload(list ...interface{}) error {
+	return reload(t.dbmap, t, list...)
+}
+
 // Get has the Same behavior as DbMap.Get(), but runs in a transaction.
 func (t *Transaction) Get(dest interface{}, keys ...interface{}) error {
 	return get(t.dbmap, t, dest, keys...)
 }
 
+// GetBy has the same behavior as DbMap.GetBy(), but runs in a transaction.
+func (t *Transaction) GetBy(dest interface{}, key interface{}, opts ...QueryOption) error {
+	return getBy(t.dbmap, t, dest, key, opts...)
+}
+
+// Exists has the same behavior as DbMap.Exists(), but runs in a transaction.
+func (t *Transaction) Exists(i interface{}, keys ...interface{}) (bool, error) {
+	return exists(t.dbmap, t, i, keys...)
+}
+
 // Select has the Same behavior as DbMap.Select(), but runs in a transaction.
 func (t *Transaction) Select(dest interface{}, query string, args ...interface{}) error {
 	return hookedselect(t.dbmap, t, dest, query, args...)
@@ -44,24 +88,176 @@ func (t *Transaction) SelectOne(dest interface{}, query string, args ...interfac
 	return hookedget(t.dbmap, t, dest, query, args...)
 }
 
+// SelectKeyset has the same behavior as DbMap.SelectKeyset(), but runs in
+// a transaction.
+func (t *Transaction) SelectKeyset(dest interface{}, query string, cursor KeysetCursor, args ...interface{}) (KeysetCursor, error) {
+	return selectKeyset(t.dbmap, t, dest, query, cursor, args...)
+}
+
+// SelectVariants has the same behavior as DbMap.SelectVariants(), but runs
+// in a transaction.
+func (t *Transaction) SelectVariants(dest *[]interface{}, tableName, query string, args ...interface{}) error {
+	return selectVariants(t.dbmap, t, dest, tableName, query, args...)
+}
+
+// SelectSearch has the same behavior as DbMap.SelectSearch(), but runs in
+// a transaction.
+func (t *Transaction) SelectSearch(dest interface{}, text string, args ...interface{}) error {
+	return selectSearch(t.dbmap, t, dest, text, args...)
+}
+
+// SelectJoin has the same behavior as DbMap.SelectJoin(), but runs in a
+// transaction.
+func (t *Transaction) SelectJoin(dest interface{}, query string, args ...interface{}) error {
+	return selectJoin(t.dbmap, t, dest, query, args...)
+}
+
+// SelectToChannel has the same behavior as DbMap.SelectToChannel(), but
+// runs in a transaction.  Hooks which run statements cannot run while the
+// rows are read on drivers which allow one statement per connection at a
+// time, like lib/pq.
+func (t *Transaction) SelectToChannel(dest interface{}, query string, args ...interface{}) error {
+	return selectToChannel(t.dbmap, t, dest, query, args...)
+}
+
+// SelectJSON has the same behavior as DbMap.SelectJSON(), but runs in a
+// transaction.
+func (t *Transaction) SelectJSON(w io.Writer, query string, args ...interface{}) (int64, error) {
+	return selectJSON(t.dbmap, t, w, query, args...)
+}
+
+// ExecScript has the same behavior as DbMap.ExecScript(), but runs in a
+// transaction.
+func (t *Transaction) ExecScript(script string) error {
+	return execScript(t, script)
+}
+
+// AsOf has the same behavior as DbMap.AsOf(), but runs in a transaction.
+func (t *Transaction) AsOf(dest interface{}, at time.Time, where string, args ...interface{}) error {
+	return asOf(t.dbmap, t, dest, at, where, args...)
+}
+
+// Find has the same behavior as DbMap.Find(), but runs in a transaction.
+func (t *Transaction) Find(dest interface{}, name string, args ...interface{}) error {
+	return find(t.dbmap, t, dest, name, args...)
+}
+
+// Explain has the same behavior as DbMap.Explain(), but runs in a
+// transaction.
+func (t *Transaction) Explain(query string, args ...interface{}) ([]ExplainRow, error) {
+	return explain(t.dbmap, t, query, args...)
+}
+
 // Exec has the same behavior as DbMap.Exec(), but runs in a transaction.
 func (t *Transaction) Exec(query string, args ...interface{}) (sql.Result, error) {
-	t.dbmap.trace(query, args)
-	return t.Tx.Exec(query, args...)
+	if chunks := t.dbmap.splitIn(query, args, false); chunks != nil {
+		return execChunks(t, query, chunks)
+	}
+	args, opts := splitOptions(args)
+	query, args, err := t.dbmap.rewrite(query, args, opts)
+	if err != nil {
+		return nil, err
+	}
+	h, done := opts.handleFor(t, false)
+	defer done()
+	res, err := h.Exec(query, args...)
+	t.dbmap.written(t, t.dbmap.tablesIn(query)...)
+	return res, err
+}
+
+// Begin starts a transaction nested in t, using a savepoint.  Committing
+// it releases the savepoint, keeping its writes as part of t, and rolling
+// it back undoes only its own writes.  Its ChangeEvents are delivered when
+// the outermost transaction commits.  See also the Begin function.
+func (t *Transaction) Begin() (*Transaction, error) {
+	if !t.dbmap.Dialect.SupportsSavepoints() {
+		return nil, fmt.Errorf("modl: %T does not support nested transactions", t.dbmap.Dialect)
+	}
+	if t.savepoints == nil {
+		t.savepoints = new(int)
+	}
+	*t.savepoints++
+	name := fmt.Sprintf("modl_savepoint_%d", *t.savepoints)
+	if _, err := t.Exec("savepoint " + name); err != nil {
+		return nil, err
+	}
+	return &Transaction{
+		dbmap:      t.dbmap,
+		Tx:         t.Tx,
+		stmts:      t.stmts,
+		parent:     t,
+		savepoint:  name,
+		savepoints: t.savepoints,
+	}, nil
 }
 
-// Commit commits the underlying database transaction.
+// Begin starts a transaction on e:  a new one if e is a DbMap, or one
+// nested in it if e is a Transaction.  Code which begins its transactions
+// with Begin can be run inside of a caller's transaction.
+func Begin(e SqlExecutor) (*Transaction, error) {
+	switch e := e.(type) {
+	case *DbMap:
+		return e.Begin()
+	case *Transaction:
+		return e.Begin()
+	}
+	return nil, fmt.Errorf("modl: cannot begin a transaction on %T", e)
+}
+
+// Commit commits the underlying database transaction, and then delivers
+// the ChangeEvents of the rows written in it and invalidates cached query
+// results of the tables it wrote to.  A nested transaction releases its
+// savepoint, and leaves these to the transaction it was begun in.
+//
+// A commit which fails, eg. because a sqlite database is busy, is not
+// retried, as the transaction is over once it has been attempted;  the
+// whole transaction has to be run again, which InTransaction does.
 func (t *Transaction) Commit() error {
+	if t.parent != nil {
+		_, err := t.Exec("release savepoint " + t.savepoint)
+		if err == nil {
+			t.parent.events = append(t.parent.events, t.events...)
+			t.parent.written = append(t.parent.written, t.written...)
+			t.parent.evicted = append(t.parent.evicted, t.evicted...)
+		}
+		t.events, t.written, t.evicted = nil, nil, nil
+		return err
+	}
 	t.dbmap.trace("commit;")
-	return t.Tx.Commit()
+	err := t.Tx.Commit()
+	t.finish(err == nil)
+	return err
+}
+
+// finish drops the ChangeEvents, written tables and evicted rows held by
+// the transaction, after delivering and invalidating them if it committed.
+func (t *Transaction) finish(committed bool) {
+	events, written, evicted := t.events, t.written, t.evicted
+	t.events, t.written, t.evicted = nil, nil, nil
+	if committed {
+		t.dbmap.deliver(events)
+		t.dbmap.written(t.dbmap, written...)
+		evict(evicted)
+	}
 }
 
-// Rollback rolls back the underlying database transaction.
+// Rollback rolls back the underlying database transaction, dropping the
+// ChangeEvents of the rows written in it.  A nested transaction rolls back
+// to its savepoint.
 func (t *Transaction) Rollback() error {
+	if t.parent != nil {
+		t.events, t.written, t.evicted = nil, nil, nil
+		_, err := t.Exec("rollback to savepoint " + t.savepoint)
+		return err
+	}
 	t.dbmap.trace("rollback;")
+	t.events, t.written, t.evicted = nil, nil, nil
 	return t.Tx.Rollback()
 }
 
 func (t *Transaction) handle() handle {
-	return &tracingHandle{h: t.Tx, d: t.dbmap}
+	if t.stmts != nil {
+		return newHandle(t.dbmap, t.stmts)
+	}
+	return newHandle(t.dbmap, t.Tx)
 }
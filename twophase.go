@@ -0,0 +1,300 @@
+package modl
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A TwoPhaseCommitter is a Dialect which can take part in a transaction
+// across databases, by preparing its own transaction to commit before it is
+// committed.  It is used by TwoPhase.  Each database's part of the global
+// transaction is a branch, with an id of its own.
+type TwoPhaseCommitter interface {
+	// BeginTwoPhase returns statements making the transaction just begun
+	// the branch with the given id.
+	BeginTwoPhase(branch string) []string
+	// PrepareTwoPhase returns statements preparing the branch to commit,
+	// after which it survives the loss of its connection.
+	PrepareTwoPhase(branch string) []string
+	// AbortTwoPhase returns statements ending a branch which has not been
+	// prepared, before its transaction is rolled back.
+	AbortTwoPhase(branch string) []string
+	// CommitPrepared and RollbackPrepared return statements committing
+	// and rolling back a prepared branch.
+	CommitPrepared(branch string) string
+	RollbackPrepared(branch string) string
+	// PreparedTransactions returns the ids of the branches prepared in the
+	// database of m which have not been committed or rolled back.
+	PreparedTransactions(m *DbMap) ([]string, error)
+}
+
+// TwoPhase coordinates transactions on several DbMaps, eg. on two
+// databases, so that they either all commit or all roll back, using
+// two-phase commit.  Their Dialects must be TwoPhaseCommitters:  postgres,
+// with max_prepared_transactions set, or MySQL, with XA transactions.
+type TwoPhase struct {
+	// Prefix begins the ids of the coordinator's transactions, so that
+	// InDoubt can tell them from others.  It is "modl_" by default.
+	Prefix string
+	dbmaps []*DbMap
+}
+
+// NewTwoPhase returns a TwoPhase coordinating transactions on dbmaps.
+func NewTwoPhase(dbmaps ...*DbMap) *TwoPhase {
+	return &TwoPhase{Prefix: "modl_", dbmaps: dbmaps}
+}
+
+// An InDoubtError is returned by TwoPhase.Run when the global transaction
+// GID was prepared on every DbMap, so it must commit, but committing some
+// of its branches failed.  Those branches stay prepared, holding their
+// locks, until they are resolved;  see TwoPhase.InDoubt.
+type InDoubtError struct {
+	GID string
+	// Failed are the indexes of the DbMaps whose branches did not commit.
+	Failed []int
+	Err    error
+}
+
+func (e *InDoubtError) Error() string {
+	return fmt.Sprintf("modl: transaction %s is in doubt on %d databases: %v", e.GID, len(e.Failed), e.Err)
+}
+
+// Run begins a transaction on each DbMap and calls fn with them, in the
+// order the DbMaps were given.  If fn returns an error, the transactions
+// are rolled back.  Otherwise each is prepared to commit, and once all of
+// them are, they are committed;  if preparing any fails, they are all
+// rolled back.  If committing a prepared transaction fails, Run returns an
+// *InDoubtError.  ChangeEvents are delivered when each transaction
+// commits.
+func (c *TwoPhase) Run(fn func(txs []*Transaction) error) error {
+	committers := make([]TwoPhaseCommitter, len(c.dbmaps))
+	for i, m := range c.dbmaps {
+		tpc, ok := m.Dialect.(TwoPhaseCommitter)
+		if !ok {
+			return fmt.Errorf("modl: %T does not support two-phase commit", m.Dialect)
+		}
+		committers[i] = tpc
+	}
+	gid, err := c.newGID()
+	if err != nil {
+		return err
+	}
+
+	txs := make([]*Transaction, 0, len(c.dbmaps))
+	// abort rolls back the branches from prepared on, which have not been
+	// prepared, and those before, which have
+	abort := func(prepared int, err error) error {
+		for i, tx := range txs {
+			branch := branchID(gid, i)
+			if i < prepared {
+				tx.Exec(committers[i].RollbackPrepared(branch))
+			} else {
+				execAll(tx, committers[i].AbortTwoPhase(branch))
+			}
+			tx.Tx.Rollback()
+			tx.finish(false)
+		}
+		return err
+	}
+
+	for i, m := range c.dbmaps {
+		tx, err := m.Begin()
+		if err != nil {
+			return abort(0, err)
+		}
+		if err := execAll(tx, committers[i].BeginTwoPhase(branchID(gid, i))); err != nil {
+			tx.Rollback()
+			return abort(0, err)
+		}
+		txs = append(txs, tx)
+	}
+	if err := fn(txs); err != nil {
+		return abort(0, err)
+	}
+	for i, tx := range txs {
+		if err := execAll(tx, committers[i].PrepareTwoPhase(branchID(gid, i))); err != nil {
+			return abort(i, err)
+		}
+	}
+
+	var doubt *InDoubtError
+	for i, tx := range txs {
+		_, err := tx.Exec(committers[i].CommitPrepared(branchID(gid, i)))
+		// the transaction was ended by preparing it, so closing it only
+		// returns its connection
+		tx.Tx.Rollback()
+		tx.finish(err == nil)
+		if err != nil {
+			if doubt == nil {
+				doubt = &InDoubtError{GID: gid, Err: err}
+			}
+			doubt.Failed = append(doubt.Failed, i)
+		}
+	}
+	if doubt != nil {
+		return doubt
+	}
+	return nil
+}
+
+// newGID returns a random id for a global transaction.
+func (c *TwoPhase) newGID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return c.Prefix + hex.EncodeToString(b), nil
+}
+
+// branchID returns the id of the branch of the global transaction gid on
+// the i'th DbMap.
+func branchID(gid string, i int) string {
+	return gid + "." + strconv.Itoa(i)
+}
+
+// execAll runs each of stmts in tx.
+func execAll(tx *Transaction, stmts []string) error {
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InDoubt is a branch of a global transaction which was prepared but not
+// committed or rolled back, eg. because its process stopped during Run.
+type InDoubt struct {
+	DbMap  *DbMap
+	GID    string
+	Branch string
+}
+
+// InDoubt returns the branches of the coordinator's transactions which are
+// prepared on its DbMaps.  A global transaction which Run returned an
+// InDoubtError for must be committed;  otherwise, if Run did not return,
+// it should be committed if it is prepared on every DbMap, or has been
+// committed on some, and rolled back if not.  See Resolve.
+func (c *TwoPhase) InDoubt() ([]InDoubt, error) {
+	var doubts []InDoubt
+	for _, m := range c.dbmaps {
+		tpc, ok := m.Dialect.(TwoPhaseCommitter)
+		if !ok {
+			return nil, fmt.Errorf("modl: %T does not support two-phase commit", m.Dialect)
+		}
+		branches, err := tpc.PreparedTransactions(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range branches {
+			if !strings.HasPrefix(b, c.Prefix) {
+				continue
+			}
+			gid := b
+			if i := strings.LastIndex(b, "."); i > 0 {
+				gid = b[:i]
+			}
+			doubts = append(doubts, InDoubt{DbMap: m, GID: gid, Branch: b})
+		}
+	}
+	return doubts, nil
+}
+
+// Resolve commits or rolls back a branch returned by InDoubt.
+func (c *TwoPhase) Resolve(d InDoubt, commit bool) error {
+	tpc, ok := d.DbMap.Dialect.(TwoPhaseCommitter)
+	if !ok {
+		return fmt.Errorf("modl: %T does not support two-phase commit", d.DbMap.Dialect)
+	}
+	stmt := tpc.RollbackPrepared(d.Branch)
+	if commit {
+		stmt = tpc.CommitPrepared(d.Branch)
+	}
+	_, err := d.DbMap.Exec(stmt)
+	return err
+}
+
+// BeginTwoPhase returns no statements;  a postgres transaction is made a
+// branch by preparing it.
+func (d PostgresDialect) BeginTwoPhase(branch string) []string {
+	return nil
+}
+
+// PrepareTwoPhase returns PREPARE TRANSACTION.
+func (d PostgresDialect) PrepareTwoPhase(branch string) []string {
+	return []string{"prepare transaction " + quoteValues([]string{branch})}
+}
+
+// AbortTwoPhase returns no statements.
+func (d PostgresDialect) AbortTwoPhase(branch string) []string {
+	return nil
+}
+
+// CommitPrepared returns COMMIT PREPARED.
+func (d PostgresDialect) CommitPrepared(branch string) string {
+	return "commit prepared " + quoteValues([]string{branch})
+}
+
+// RollbackPrepared returns ROLLBACK PREPARED.
+func (d PostgresDialect) RollbackPrepared(branch string) string {
+	return "rollback prepared " + quoteValues([]string{branch})
+}
+
+// PreparedTransactions selects the prepared transactions of the current
+// database from pg_prepared_xacts.
+func (d PostgresDialect) PreparedTransactions(m *DbMap) ([]string, error) {
+	var gids []string
+	err := m.Select(&gids, "select gid from pg_prepared_xacts where database = current_database()")
+	return gids, err
+}
+
+// BeginTwoPhase ends the local transaction begun by the driver, which
+// cannot hold an XA transaction, and starts one.
+func (d MySQLDialect) BeginTwoPhase(branch string) []string {
+	return []string{"commit", "xa start " + quoteValues([]string{branch})}
+}
+
+// PrepareTwoPhase returns XA END and XA PREPARE.
+func (d MySQLDialect) PrepareTwoPhase(branch string) []string {
+	xid := quoteValues([]string{branch})
+	return []string{"xa end " + xid, "xa prepare " + xid}
+}
+
+// AbortTwoPhase returns XA END and XA ROLLBACK.
+func (d MySQLDialect) AbortTwoPhase(branch string) []string {
+	xid := quoteValues([]string{branch})
+	return []string{"xa end " + xid, "xa rollback " + xid}
+}
+
+// CommitPrepared returns XA COMMIT.
+func (d MySQLDialect) CommitPrepared(branch string) string {
+	return "xa commit " + quoteValues([]string{branch})
+}
+
+// RollbackPrepared returns XA ROLLBACK.
+func (d MySQLDialect) RollbackPrepared(branch string) string {
+	return "xa rollback " + quoteValues([]string{branch})
+}
+
+// PreparedTransactions reads the ids of prepared XA transactions with XA
+// RECOVER.
+func (d MySQLDialect) PreparedTransactions(m *DbMap) ([]string, error) {
+	rows, err := m.handle().Queryx("xa recover")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var xids []string
+	for rows.Next() {
+		var formatID, gtridLength, bqualLength int
+		var data string
+		if err := rows.Scan(&formatID, &gtridLength, &bqualLength, &data); err != nil {
+			return nil, err
+		}
+		xids = append(xids, data)
+	}
+	return xids, rows.Err()
+}
@@ -0,0 +1,124 @@
+package typed
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Null is a nullable T, for columns of types without a Null wrapper of
+// their own, such as those implementing driver.Valuer.  Like the wrappers
+// of database/sql, it is NULL unless Valid is true, and modl creates its
+// column with the type of a T column:
+//
+//	type Account struct {
+//		ID      int64
+//		Balance typed.Null[Money]
+//	}
+type Null[T any] struct {
+	V     T
+	Valid bool
+}
+
+// NewNull returns a valid Null holding v.
+func NewNull[T any](v T) Null[T] {
+	return Null[T]{V: v, Valid: true}
+}
+
+// Value returns nil if n is not valid, or else the value of V, as its own
+// Value if it is a driver.Valuer.
+func (n Null[T]) Value() (driver.Value, error) {
+	if !n.Valid {
+		return nil, nil
+	}
+	if v, ok := interface{}(n.V).(driver.Valuer); ok {
+		return v.Value()
+	}
+	if v, ok := interface{}(&n.V).(driver.Valuer); ok {
+		return v.Value()
+	}
+	return driver.DefaultParameterConverter.ConvertValue(n.V)
+}
+
+// Scan sets n from src:  invalid if it is NULL, and otherwise with V
+// scanned from it, with V's own Scan if it is a sql.Scanner.
+func (n *Null[T]) Scan(src interface{}) error {
+	var zero T
+	n.V, n.Valid = zero, false
+	if src == nil {
+		return nil
+	}
+	if s, ok := interface{}(&n.V).(sql.Scanner); ok {
+		if err := s.Scan(src); err != nil {
+			return err
+		}
+		n.Valid = true
+		return nil
+	}
+	if err := convert(reflect.ValueOf(&n.V).Elem(), src); err != nil {
+		return fmt.Errorf("typed: cannot scan a %T into a %T: %v", src, zero, err)
+	}
+	n.Valid = true
+	return nil
+}
+
+// convert sets dst from src, a value returned by a driver, as database/sql
+// does for the basic types:  text is parsed into numbers and bools, and
+// numbers formatted into strings.
+func convert(dst reflect.Value, src interface{}) error {
+	var text string
+	switch s := src.(type) {
+	case []byte:
+		if dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes(append([]byte(nil), s...))
+			return nil
+		}
+		text = string(s)
+	case string:
+		text = s
+	default:
+		v := reflect.ValueOf(src)
+		switch {
+		case dst.Kind() == reflect.String:
+			dst.SetString(fmt.Sprint(src))
+		case v.Type().ConvertibleTo(dst.Type()):
+			dst.Set(v.Convert(dst.Type()))
+		default:
+			return fmt.Errorf("unsupported conversion")
+		}
+		return nil
+	}
+	switch dst.Kind() {
+	case reflect.String:
+		dst.SetString(text)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(text, 10, dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(text, 10, dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(text, dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		dst.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported conversion")
+	}
+	return nil
+}
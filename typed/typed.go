@@ -0,0 +1,128 @@
+// Package typed provides a type safe layer over modl using generics.  Its
+// functions take and return values of the row type rather than
+// interface{}, and work with the TableMaps registered on a modl.DbMap, so
+// either API can be used for the same tables:
+//
+//	dbmap.AddTable(Person{}).SetKeys(true, "id")
+//	p, err := typed.Get[Person](dbmap, 1)
+//	people, err := typed.Select[Person](dbmap, "select * from person where age > ?", 30)
+//
+// Each function takes a modl.Queryer, so it may be given a DbMap, a
+// Transaction, or a wrapper around either.
+package typed
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/modl"
+)
+
+// Get returns the row of T's table with the given primary keys, or
+// modl.ErrNotFound if there is none.  QueryOptions may be passed along with
+// keys.
+func Get[T any](e modl.Queryer, keys ...interface{}) (*T, error) {
+	row := new(T)
+	if err := e.Get(row, keys...); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// Select runs query and returns its rows as values of T, which does not
+// need to be registered with AddTable.  See DbMap.Select.
+func Select[T any](e modl.Queryer, query string, args ...interface{}) ([]T, error) {
+	var rows []T
+	if err := e.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// SelectOne runs query and returns its single row as a value of T.  See
+// DbMap.SelectOne.
+func SelectOne[T any](e modl.Queryer, query string, args ...interface{}) (T, error) {
+	var row T
+	err := e.SelectOne(&row, query, args...)
+	return row, err
+}
+
+// SelectChan runs query and returns a channel of its rows as values of T,
+// which are sent as they are read, with up to buffer of them waiting to be
+// received.  The channel is closed when the rows run out, the query fails
+// or the context passed WithContext is cancelled;  wait then returns the
+// error, if any.  e must be a modl.ChannelSelecter, like a DbMap or a
+// Transaction.  See DbMap.SelectToChannel.
+//
+//	people, wait := typed.SelectChan[Person](dbmap, 100, "select * from person")
+//	for p := range people {
+//		...
+//	}
+//	err := wait()
+func SelectChan[T any](e modl.Queryer, buffer int, query string, args ...interface{}) (rows <-chan T, wait func() error) {
+	ch := make(chan T, buffer)
+	errc := make(chan error, 1)
+	if cs, ok := e.(modl.ChannelSelecter); ok {
+		go func() {
+			errc <- cs.SelectToChannel(ch, query, args...)
+		}()
+	} else {
+		close(ch)
+		errc <- fmt.Errorf("modl: %T cannot select to a channel", e)
+	}
+	var err error
+	var once sync.Once
+	return ch, func() error {
+		once.Do(func() { err = <-errc })
+		return err
+	}
+}
+
+// Insert inserts each of rows.  See DbMap.Insert.
+func Insert[T any](e modl.Queryer, rows ...*T) error {
+	return e.Insert(list(rows, nil)...)
+}
+
+// Update updates each of rows and returns the number of rows updated.  See
+// DbMap.Update.
+func Update[T any](e modl.Queryer, rows ...*T) (int64, error) {
+	return e.Update(list(rows, nil)...)
+}
+
+// Delete deletes each of rows and returns the number of rows deleted.  See
+// DbMap.Delete.
+func Delete[T any](e modl.Queryer, rows ...*T) (int64, error) {
+	return e.Delete(list(rows, nil)...)
+}
+
+// Save inserts or updates each of rows.  See DbMap.Save.
+func Save[T any](e modl.Queryer, rows ...*T) error {
+	return e.Save(list(rows, nil)...)
+}
+
+// InsertBatch inserts rows with the given QueryOptions, eg. modl.Batch().
+func InsertBatch[T any](e modl.Queryer, rows []*T, opts ...modl.QueryOption) error {
+	return e.Insert(list(rows, opts)...)
+}
+
+// UpdateBatch updates rows with the given QueryOptions, eg. modl.Batch().
+func UpdateBatch[T any](e modl.Queryer, rows []*T, opts ...modl.QueryOption) (int64, error) {
+	return e.Update(list(rows, opts)...)
+}
+
+// DeleteBatch deletes rows with the given QueryOptions, eg. modl.Batch().
+func DeleteBatch[T any](e modl.Queryer, rows []*T, opts ...modl.QueryOption) (int64, error) {
+	return e.Delete(list(rows, opts)...)
+}
+
+// list returns rows followed by opts as the []interface{} modl takes.
+func list[T any](rows []*T, opts []modl.QueryOption) []interface{} {
+	l := make([]interface{}, 0, len(rows)+len(opts))
+	for _, r := range rows {
+		l = append(l, r)
+	}
+	for _, o := range opts {
+		l = append(l, o)
+	}
+	return l
+}
@@ -0,0 +1,185 @@
+package typed
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/modl"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type Person struct {
+	ID    int64
+	FName string
+	LName string
+}
+
+func newDbMap(t *testing.T) *modl.DbMap {
+	var dialect modl.Dialect
+	var driver string
+	switch os.Getenv("MODL_TEST_DIALECT") {
+	case "mysql":
+		dialect, driver = modl.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}, "mysql"
+	case "postgres":
+		dialect, driver = modl.PostgresDialect{}, "postgres"
+	case "sqlite":
+		dialect, driver = modl.SqliteDialect{}, "sqlite3"
+	default:
+		t.Skip("MODL_TEST_DIALECT env variable is not set. Please see README.md")
+	}
+	db, err := sql.Open(driver, os.Getenv("MODL_TEST_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbmap := modl.NewDbMap(db, dialect)
+	dbmap.AddTableWithName(Person{}, "typed_person_test").SetKeys(true, "id")
+	if err = dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dbmap.DropTables()
+		db.Close()
+	})
+	return dbmap
+}
+
+func TestTyped(t *testing.T) {
+	dbmap := newDbMap(t)
+
+	p1, p2 := &Person{FName: "bob"}, &Person{FName: "jane"}
+	if err := Insert(dbmap, p1, p2); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Get[Person](dbmap, p1.ID)
+	if err != nil || p.FName != "bob" {
+		t.Errorf("Expected bob, got %v %v", p, err)
+	}
+	if _, err = Get[Person](dbmap, p2.ID+1); err != modl.ErrNotFound {
+		t.Errorf("Expected modl.ErrNotFound, got %v", err)
+	}
+
+	p2.LName = "doe"
+	if n, err := Update(dbmap, p2); err != nil || n != 1 {
+		t.Errorf("Expected 1 row updated, got %d %v", n, err)
+	}
+	people, err := Select[Person](dbmap, "select * from typed_person_test order by id")
+	if err != nil || len(people) != 2 || people[1].LName != "doe" {
+		t.Errorf("Unexpected people %v %v", people, err)
+	}
+	count, err := SelectOne[int64](dbmap, "select count(*) from typed_person_test")
+	if err != nil || count != 2 {
+		t.Errorf("Expected count of 2, got %d %v", count, err)
+	}
+
+	if n, err := DeleteBatch(dbmap, []*Person{p1, p2}, modl.Batch()); err != nil || n != 2 {
+		t.Errorf("Expected 2 rows deleted, got %d %v", n, err)
+	}
+}
+
+// countingQueryer wraps a modl.Queryer, counting the rows it selects.
+type countingQueryer struct {
+	modl.Queryer
+	selects int
+}
+
+func (c *countingQueryer) Select(dest interface{}, query string, args ...interface{}) error {
+	c.selects++
+	return c.Queryer.Select(dest, query, args...)
+}
+
+func TestWrappedQueryer(t *testing.T) {
+	dbmap := newDbMap(t)
+	q := &countingQueryer{Queryer: dbmap}
+
+	if err := Insert(q, &Person{FName: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	people, err := Select[Person](q, "select * from typed_person_test")
+	if err != nil || len(people) != 1 || q.selects != 1 {
+		t.Errorf("Expected 1 person through the wrapper, got %v %v %d", people, err, q.selects)
+	}
+}
+
+func TestSelectChan(t *testing.T) {
+	dbmap := newDbMap(t)
+	if err := Insert(dbmap, &Person{FName: "bob"}, &Person{FName: "jane"}); err != nil {
+		t.Fatal(err)
+	}
+	people, wait := SelectChan[Person](dbmap, 0, "select * from typed_person_test order by id")
+	var names []string
+	for p := range people {
+		names = append(names, p.FName)
+	}
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(names) != "[bob jane]" {
+		t.Errorf("Expected bob and jane, got %v", names)
+	}
+
+	people, wait = SelectChan[Person](&countingQueryer{Queryer: dbmap}, 0, "select * from typed_person_test")
+	if _, open := <-people; open || wait() == nil {
+		t.Errorf("Expected an error from a Queryer which cannot select to a channel")
+	}
+}
+
+// Cents is a driver.Valuer without a Null wrapper of its own.
+type Cents struct {
+	n int64
+}
+
+func (c Cents) Value() (driver.Value, error) {
+	return c.n, nil
+}
+
+func (c *Cents) Scan(src interface{}) error {
+	var n sql.NullInt64
+	if err := n.Scan(src); err != nil || !n.Valid {
+		return fmt.Errorf("cannot scan %v into Cents", src)
+	}
+	c.n = n.Int64
+	return nil
+}
+
+type Account struct {
+	ID      int64
+	Name    Null[string]
+	Visits  Null[int32]
+	Balance Null[Cents]
+}
+
+func TestNull(t *testing.T) {
+	dbmap := newDbMap(t)
+	dbmap.AddTableWithName(Account{}, "typed_account_test").SetKeys(true, "ID")
+	if err := dbmap.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := &Account{}
+	full := &Account{Name: NewNull("bob"), Visits: NewNull(int32(3)), Balance: NewNull(Cents{150})}
+	if err := Insert(dbmap, empty, full); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Get[Account](dbmap, empty.ID)
+	if err != nil || *got != *empty {
+		t.Errorf("Expected %+v, got %+v %v", empty, got, err)
+	}
+	got, err = Get[Account](dbmap, full.ID)
+	if err != nil || *got != *full {
+		t.Errorf("Expected %+v, got %+v %v", full, got, err)
+	}
+
+	var n Null[int64]
+	if err := n.Scan([]byte("42")); err != nil || !n.Valid || n.V != 42 {
+		t.Errorf("Expected 42 from text, got %+v %v", n, err)
+	}
+	if err := n.Scan("x"); err == nil || n.Valid {
+		t.Errorf("Expected x not to scan into an int64, got %+v", n)
+	}
+}
@@ -0,0 +1,198 @@
+package modl
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// SetDiscriminator maps the table's type as one of several variants which
+// share a table, told apart by the value of column:
+//
+//	dbmap.AddTableWithName(Cat{}, "animals").SetKeys(true, "ID").SetDiscriminator("kind", "cat")
+//	dbmap.AddTableWithName(Dog{}, "animals").SetKeys(true, "ID").SetDiscriminator("kind", "dog")
+//
+// Insert writes value to column, and Get, Update and Delete only match
+// rows holding it.  SelectVariants selects rows of any of the variants.
+// column must not be a field of the type.  CreateTables creates the table
+// once, with the columns of all of its variants.
+//
+// Automatically calls ResetSql() to ensure SQL statements are regenerated.
+func (t *TableMap) SetDiscriminator(column, value string) *TableMap {
+	t.discriminator = column
+	t.discriminatorValue = value
+	t.ResetSql()
+	return t
+}
+
+// writeDiscriminator writes a condition matching the table's variant to s.
+func (t *TableMap) writeDiscriminator(s *bytes.Buffer) {
+	if len(t.discriminator) == 0 {
+		return
+	}
+	s.WriteString(" and ")
+	s.WriteString(t.dbmap.Dialect.QuoteField(t.discriminator))
+	s.WriteString("=")
+	s.WriteString(quoteValues([]string{t.discriminatorValue}))
+}
+
+// variantsOf returns the tables with a discriminator which are named
+// tableName.
+func (m *DbMap) variantsOf(tableName string) []*TableMap {
+	var variants []*TableMap
+	for _, table := range m.Schema().Tables() {
+		if table.TableName == tableName && len(table.discriminator) > 0 {
+			variants = append(variants, table)
+		}
+	}
+	return variants
+}
+
+// distinctTables returns tables without the variants of tables which are
+// already in the list, so that shared tables are created and dropped once.
+func distinctTables(tables []*TableMap) []*TableMap {
+	var distinct []*TableMap
+	seen := map[string]bool{}
+	for _, table := range tables {
+		if len(table.discriminator) > 0 {
+			if seen[table.TableName] {
+				continue
+			}
+			seen[table.TableName] = true
+		}
+		distinct = append(distinct, table)
+	}
+	return distinct
+}
+
+// createColumns returns the columns to create table with:  its own, or
+// for a variant, those of all of the variants and the discriminator.
+func (m *DbMap) createColumns(table *TableMap) []*ColumnMap {
+	if len(table.discriminator) == 0 {
+		return table.Columns
+	}
+	var columns []*ColumnMap
+	seen := map[string]bool{}
+	for _, variant := range m.variantsOf(table.TableName) {
+		for _, col := range variant.Columns {
+			name := strings.ToLower(col.ColumnName)
+			if !col.Transient && !seen[name] {
+				seen[name] = true
+				columns = append(columns, col)
+			}
+		}
+	}
+	disc := &ColumnMap{
+		ColumnName: table.discriminator,
+		gotype:     reflect.TypeOf(""),
+		table:      table,
+	}
+	return append(columns, disc)
+}
+
+// SelectVariants runs query, which selects rows of tableName, and appends
+// each row to dest as a pointer to the type of its variant, chosen by its
+// discriminator column, which the query must select.  PostGet hooks are
+// run on each row.  See TableMap.SetDiscriminator.
+func (m *DbMap) SelectVariants(dest *[]interface{}, tableName, query string, args ...interface{}) error {
+	return selectVariants(m, m, dest, tableName, query, args...)
+}
+
+// variantColumn is a column of a variant, and the field of the union row
+// it is scanned into.
+type variantColumn struct {
+	col   *ColumnMap
+	field int
+}
+
+func selectVariants(m *DbMap, e SqlExecutor, dest *[]interface{}, tableName, query string, args ...interface{}) error {
+	variants := m.variantsOf(tableName)
+	if len(variants) == 0 {
+		return fmt.Errorf("modl: table %s has no variants", tableName)
+	}
+	_, opts := splitOptions(args)
+
+	// rows are scanned into a struct with a field for each column of any
+	// variant, and copied into the variant they are for
+	var fields []reflect.StructField
+	byName := map[string]int{}
+	columns := make([][]variantColumn, len(variants))
+	for i, variant := range variants {
+		for _, col := range variant.Columns {
+			if col.Transient {
+				continue
+			}
+			// columns of other variants are null, so fields are pointers,
+			// or hold the value a codec decodes
+			typ := reflect.PtrTo(col.gotype)
+			if col.getCodec(m) != nil {
+				typ = reflect.TypeOf((*interface{})(nil)).Elem()
+			}
+			name := strings.ToLower(col.ColumnName)
+			f, ok := byName[name]
+			if !ok {
+				f = len(fields)
+				byName[name] = f
+				fields = append(fields, reflect.StructField{
+					Name: fmt.Sprintf("F%d", f),
+					Type: typ,
+					Tag:  reflect.StructTag(fmt.Sprintf(`db:"%s"`, col.ColumnName)),
+				})
+			} else if fields[f].Type != typ {
+				return fmt.Errorf("modl: column %s of %s has different types in its variants", col.ColumnName, tableName)
+			}
+			columns[i] = append(columns[i], variantColumn{col, f})
+		}
+	}
+	disc := len(fields)
+	fields = append(fields, reflect.StructField{
+		Name: fmt.Sprintf("F%d", disc),
+		Type: reflect.TypeOf(sql.NullString{}),
+		Tag:  reflect.StructTag(fmt.Sprintf(`db:"%s"`, variants[0].discriminator)),
+	})
+
+	rows := reflect.New(reflect.SliceOf(reflect.StructOf(fields)))
+	if err := e.Select(rows.Interface(), query, args...); err != nil {
+		return err
+	}
+
+	rows = rows.Elem()
+	for r := 0; r < rows.Len(); r++ {
+		row := rows.Index(r)
+		value := row.Field(disc).Interface().(sql.NullString)
+		i := -1
+		for j, variant := range variants {
+			if value.Valid && variant.discriminatorValue == value.String {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return fmt.Errorf("modl: no variant of %s for %s %q", tableName, variants[0].discriminator, value.String)
+		}
+
+		variant := variants[i]
+		v := reflect.New(variant.gotype)
+		for _, vc := range columns[i] {
+			field := v.Elem().FieldByIndex(vc.col.fieldIndex)
+			if codec := vc.col.getCodec(m); codec != nil {
+				if err := codec.decode(field, row.Field(vc.field).Interface()); err != nil {
+					return fmt.Errorf("column %s: %v", vc.col.ColumnName, err)
+				}
+				continue
+			}
+			if p := row.Field(vc.field); !p.IsNil() {
+				field.Set(p.Elem())
+			}
+		}
+		if variant.CanPostGet && !opts.noHooks {
+			if err := variant.runHook(postGet, opts.context(), e, v.Interface()); err != nil {
+				return err
+			}
+		}
+		*dest = append(*dest, v.Interface())
+	}
+	return nil
+}
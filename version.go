@@ -0,0 +1,65 @@
+package modl
+
+import (
+	"time"
+)
+
+// A VersionStrategy returns the version to write to a row whose version
+// column holds current, which is 0 for rows being inserted.  Versions
+// must change on every write for optimistic locking to catch conflicting
+// updates.  See TableMap.SetVersionStrategy.
+type VersionStrategy func(current int64) int64
+
+// IncrementVersion adds one to the version on each write, so that rows
+// are inserted with version 1.  It is the default strategy.
+func IncrementVersion(current int64) int64 {
+	return current + 1
+}
+
+// TimestampVersion sets the version to the time of each write, in
+// nanoseconds since the Unix epoch, so that it also records when the row
+// was last written.  If the clock has not moved past the current version,
+// the version is incremented instead.
+func TimestampVersion(current int64) int64 {
+	now := time.Now().UnixNano()
+	if now <= current {
+		return current + 1
+	}
+	return now
+}
+
+// SetVersionStrategy sets how the version column is advanced by Insert
+// and Update.  A nil strategy restores IncrementVersion.
+//
+// Automatically calls ResetSql() to ensure SQL statements are regenerated.
+func (t *TableMap) SetVersionStrategy(s VersionStrategy) *TableMap {
+	t.versionStrategy = s
+	t.ResetSql()
+	return t
+}
+
+// SetVersionInitial sets the version Insert writes to rows whose version
+// field is 0, in place of the one given by the table's VersionStrategy.
+// It panics if v is negative;  0 restores the strategy's.
+//
+// Automatically calls ResetSql() to ensure SQL statements are regenerated.
+func (t *TableMap) SetVersionInitial(v int64) *TableMap {
+	if v < 0 {
+		panic("modl: SetVersionInitial needs a positive version")
+	}
+	t.versionInitial = v
+	t.ResetSql()
+	return t
+}
+
+// nextVersion returns the version to write to a row whose version is
+// current.
+func (t *TableMap) nextVersion(current int64) int64 {
+	if current == 0 && t.versionInitial != 0 {
+		return t.versionInitial
+	}
+	if t.versionStrategy != nil {
+		return t.versionStrategy(current)
+	}
+	return IncrementVersion(current)
+}
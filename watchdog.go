@@ -0,0 +1,141 @@
+package modl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// watchdogGrace is how long a statement may keep running after its hard
+// timeout has cancelled its context before it is cancelled by the Dialect.
+const watchdogGrace = time.Second
+
+// StatementCanceller is implemented by dialects which can cancel a
+// statement running on another connection, as a backstop for drivers
+// which do not stop statements when their context is cancelled.  See
+// SetHardTimeout.
+type StatementCanceller interface {
+	// CancelStatement returns a statement cancelling those running
+	// with the comment "/* tag */".  The tag is unique to the statement,
+	// even across processes.
+	CancelStatement(tag string) string
+}
+
+// A HardTimeoutError is returned for statements cancelled because they ran
+// for longer than the DbMap's hard timeout.  It wraps
+// context.DeadlineExceeded.
+type HardTimeoutError struct {
+	Query   string
+	Timeout time.Duration
+}
+
+func (e *HardTimeoutError) Error() string {
+	return fmt.Sprintf("modl: statement cancelled after the hard timeout of %v: %s", e.Timeout, e.Query)
+}
+
+func (e *HardTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// watchdog holds a DbMap's hard timeout.
+type watchdog struct {
+	// cancelled is the number of statements which exceeded the timeout;
+	// it is first to be aligned for atomic use
+	cancelled int64
+	timeout   time.Duration
+	seq       uint64
+	// nonce is random, so that the tags of statements sent by other
+	// DbMaps and processes are distinct from this one's
+	nonce string
+}
+
+// SetHardTimeout sets a limit on how long each statement run through this
+// DbMap, and its transactions, may run, as a backstop for calls made
+// without a timeout.  Unlike SetDefaultTimeout, it applies even if the call
+// has a later deadline.  Statements which exceed it are cancelled through
+// their context, and fail with a *HardTimeoutError;  if the Dialect is a
+// StatementCanceller, statements which are still running a second later,
+// because the driver does not stop them, are cancelled from another
+// connection, eg. with pg_cancel_backend;  this backstop does not apply to
+// the statements of a WriteBatch or Copy, which are prepared once and
+// reused.  Cancelled statements are counted by HardTimeouts, and in the
+// HardTimeouts of their QueryStats.  Set it to 0, the default, for no
+// limit.  It should be set before the DbMap is used.
+func (m *DbMap) SetHardTimeout(d time.Duration) *DbMap {
+	if m.watchdog == nil {
+		b := make([]byte, 8)
+		rand.Read(b)
+		m.watchdog = &watchdog{nonce: hex.EncodeToString(b)}
+	}
+	m.watchdog.timeout = d
+	return m
+}
+
+// HardTimeouts returns the number of statements which have been cancelled
+// because they exceeded the hard timeout.  See SetHardTimeout.
+func (m *DbMap) HardTimeouts() int64 {
+	if m.watchdog == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.watchdog.cancelled)
+}
+
+// watch applies the DbMap's hard timeout to query, run with ctx.  It
+// returns the context and query to run instead, a function to call with
+// the statement's error once it has returned, which returns the error to
+// report, and a function cancelling the context, to call once the
+// statement's results have been read.
+func (t *tracingHandle) watch(ctx context.Context, query string) (context.Context, string, func(error) error, context.CancelFunc) {
+	w := t.d.watchdog
+	if w == nil || w.timeout <= 0 {
+		return ctx, query, func(err error) error { return err }, func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= w.timeout {
+		return ctx, query, func(err error) error { return err }, func() {}
+	}
+	wctx, cancel := context.WithTimeout(ctx, w.timeout)
+
+	sent := query
+	var backstop *time.Timer
+	// statements prepared through a stmtCache are keyed by their text, so
+	// they are not tagged, which would make each one distinct
+	_, cached := t.h.(*stmtCache)
+	if c, ok := t.d.Dialect.(StatementCanceller); ok && !cached {
+		tag := fmt.Sprintf("modl-watchdog-%s-%d", w.nonce, atomic.AddUint64(&w.seq, 1))
+		sent = "/* " + tag + " */ " + query
+		db, ok := t.h.(*sqlx.DB)
+		if !ok {
+			db = t.d.primary()
+		}
+		backstop = time.AfterFunc(w.timeout+watchdogGrace, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), watchdogGrace)
+			defer cancel()
+			db.ExecContext(ctx, c.CancelStatement(tag))
+		})
+	}
+	return wctx, sent, func(err error) error {
+		if backstop != nil {
+			backstop.Stop()
+		}
+		if err == nil || wctx.Err() != context.DeadlineExceeded || ctx.Err() != nil {
+			return err
+		}
+		atomic.AddInt64(&w.cancelled, 1)
+		return &HardTimeoutError{Query: query, Timeout: w.timeout}
+	}, cancel
+}
+
+// CancelStatement cancels the statements with tag with pg_cancel_backend.
+// The whole comment is matched, so that tag does not match the tags it is
+// a prefix of.
+func (d PostgresDialect) CancelStatement(tag string) string {
+	pattern := "%/* " + likeEscaper.Replace(tag) + " */%"
+	return "select pg_cancel_backend(pid) from pg_stat_activity where pid <> pg_backend_pid() and query like '" +
+		strings.Replace(pattern, "'", "''", -1) + "' escape '!'"
+}
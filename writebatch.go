@@ -0,0 +1,182 @@
+package modl
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// stmtCache is a cursor for a transaction which prepares each distinct
+// statement it runs once, and reuses it when the statement is run again.
+// The statements are closed when the transaction ends.
+type stmtCache struct {
+	tx    *sqlx.Tx
+	stmts map[string]*sqlx.Stmt
+}
+
+func newStmtCache(tx *sqlx.Tx) *stmtCache {
+	return &stmtCache{tx: tx, stmts: map[string]*sqlx.Stmt{}}
+}
+
+func (c *stmtCache) stmt(ctx context.Context, query string) (*sqlx.Stmt, error) {
+	if s, ok := c.stmts[query]; ok {
+		return s, nil
+	}
+	s, err := c.tx.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = s
+	return s, nil
+}
+
+func (c *stmtCache) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	s, err := c.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return s.QueryxContext(ctx, args...)
+}
+
+func (c *stmtCache) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	// a Row cannot carry an error from preparing the statement, so single
+	// row queries are not prepared
+	return c.tx.QueryRowxContext(ctx, query, args...)
+}
+
+func (c *stmtCache) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	s, err := c.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return s.ExecContext(ctx, args...)
+}
+
+type writeKind int
+
+const (
+	writeInsert writeKind = iota
+	writeUpdate
+	writeDelete
+)
+
+type writeOp struct {
+	kind writeKind
+	list []interface{}
+}
+
+// A WriteBatch queues Inserts, Updates and Deletes and writes them in a
+// single transaction when it is flushed.  Each distinct statement is
+// prepared once per flush.  It is meant for jobs which write many rows,
+// and is not safe for concurrent use.
+type WriteBatch struct {
+	dbmap    *DbMap
+	coalesce bool
+	ops      []writeOp
+}
+
+// NewWriteBatch returns an empty WriteBatch which writes to m.
+func (m *DbMap) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{dbmap: m}
+}
+
+// SetCoalesce sets whether consecutive writes of the same kind are sent
+// together with the Batch option when the WriteBatch is flushed.  Hooks
+// still run for every element, but for Update and Delete a version
+// conflict is then reported as a BatchLockError.
+func (b *WriteBatch) SetCoalesce(coalesce bool) *WriteBatch {
+	b.coalesce = coalesce
+	return b
+}
+
+// Insert queues an Insert of each element in list.
+func (b *WriteBatch) Insert(list ...interface{}) {
+	b.ops = append(b.ops, writeOp{writeInsert, list})
+}
+
+// Update queues an Update of each element in list.
+func (b *WriteBatch) Update(list ...interface{}) {
+	b.ops = append(b.ops, writeOp{writeUpdate, list})
+}
+
+// Delete queues a Delete of each element in list.
+func (b *WriteBatch) Delete(list ...interface{}) {
+	b.ops = append(b.ops, writeOp{writeDelete, list})
+}
+
+// Len returns the number of elements queued.
+func (b *WriteBatch) Len() int {
+	n := 0
+	for _, op := range b.ops {
+		n += len(op.list)
+	}
+	return n
+}
+
+// Reset discards the queued writes.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Flush writes the queued elements in a transaction, in the order they
+// were queued, and empties the queue.  If any write fails, including an
+// Update or Delete of a row whose version is out of date, the transaction
+// is rolled back and the queue is kept, so that it can be inspected or
+// flushed again.
+func (b *WriteBatch) Flush() error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	tx, err := b.dbmap.Begin()
+	if err != nil {
+		return err
+	}
+	tx.stmts = newStmtCache(tx.Tx)
+
+	for _, op := range b.pending() {
+		if err = op.write(tx, b.coalesce); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	b.Reset()
+	return nil
+}
+
+// pending returns the queued writes, with consecutive writes of the same
+// kind merged if the batch coalesces them.
+func (b *WriteBatch) pending() []writeOp {
+	if !b.coalesce {
+		return b.ops
+	}
+	var ops []writeOp
+	for _, op := range b.ops {
+		if n := len(ops); n > 0 && ops[n-1].kind == op.kind {
+			ops[n-1].list = append(ops[n-1].list, op.list...)
+			continue
+		}
+		ops = append(ops, writeOp{op.kind, append([]interface{}{}, op.list...)})
+	}
+	return ops
+}
+
+func (op writeOp) write(tx *Transaction, coalesce bool) error {
+	list := op.list
+	if coalesce {
+		list = append(list[:len(list):len(list)], Batch())
+	}
+	var err error
+	switch op.kind {
+	case writeInsert:
+		err = tx.Insert(list...)
+	case writeUpdate:
+		_, err = tx.Update(list...)
+	case writeDelete:
+		_, err = tx.Delete(list...)
+	}
+	return err
+}